@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Principal types abuse can be reported for.
+const (
+	principalUser   = "user"
+	principalDevice = "device"
+)
+
+var (
+	// abuseBaseRate is the submissions per minute allowed for a principal with one report. Every
+	// further report halves it. Principals without reports aren't limited.
+	abuseBaseRate = 60
+	// abuseReviewThreshold is the number of reports after which a principal's receipts are held
+	// for review.
+	abuseReviewThreshold = 2
+)
+
+type AbuseReport struct {
+	ID            string    `json:"id"`
+	PrincipalType string    `json:"principalType"`
+	PrincipalID   string    `json:"principalId"`
+	Reason        string    `json:"reason"`
+	Source        string    `json:"source,omitempty"`
+	ReportedAt    time.Time `json:"reportedAt"`
+}
+
+type abusePrincipal struct {
+	reports int
+	limiter *tokenBucket
+}
+
+var (
+	abuseMu         sync.RWMutex
+	abuseReports    []AbuseReport
+	abusePrincipals = map[string]*abusePrincipal{}
+)
+
+func principalKey(principalType, id string) string {
+	return principalType + ":" + id
+}
+
+// receiptPrincipals returns the principals a receipt was submitted by.
+func receiptPrincipals(receipt Receipt) []string {
+	var keys []string
+	if receipt.UserID != "" {
+		keys = append(keys, principalKey(principalUser, receipt.UserID))
+	}
+	if receipt.DeviceID != "" {
+		keys = append(keys, principalKey(principalDevice, receipt.DeviceID))
+	}
+	return keys
+}
+
+// allowSubmission applies the tightened rate limits of reported principals to a receipt.
+func allowSubmission(receipt Receipt) bool {
+	abuseMu.RLock()
+	defer abuseMu.RUnlock()
+	for _, key := range receiptPrincipals(receipt) {
+		if principal, ok := abusePrincipals[key]; ok && !principal.limiter.allow() {
+			return false
+		}
+	}
+	return true
+}
+
+// abuseReviewReason returns why a receipt should be held for review because of reports against
+// its submitters, or "" if it shouldn't be.
+func abuseReviewReason(receipt Receipt) string {
+	abuseMu.RLock()
+	defer abuseMu.RUnlock()
+	for _, key := range receiptPrincipals(receipt) {
+		if principal, ok := abusePrincipals[key]; ok && principal.reports >= abuseReviewThreshold {
+			return fmt.Sprintf("%s was reported for abuse %d times", key, principal.reports)
+		}
+	}
+	return ""
+}
+
+func reportAbuseHandler(w http.ResponseWriter, r *http.Request) {
+	var report AbuseReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil || report.PrincipalID == "" || report.Reason == "" {
+		http.Error(w, "An abuse report needs a principalId and a reason.", http.StatusBadRequest)
+		return
+	}
+	if report.PrincipalType != principalUser && report.PrincipalType != principalDevice {
+		http.Error(w, "The principalType must be user or device.", http.StatusBadRequest)
+		return
+	}
+	report.ID = uuid.New().String()
+	report.ReportedAt = time.Now().UTC()
+
+	key := principalKey(report.PrincipalType, report.PrincipalID)
+	abuseMu.Lock()
+	abuseReports = append(abuseReports, report)
+	principal, ok := abusePrincipals[key]
+	if !ok {
+		principal = &abusePrincipal{}
+		abusePrincipals[key] = principal
+	}
+	principal.reports++
+	perMinute := max(abuseBaseRate>>(principal.reports-1), 1)
+	principal.limiter = newTokenBucket(float64(perMinute)/60, perMinute)
+	reports := principal.reports
+	abuseMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"report":            report,
+		"reports":           reports,
+		"ratePerMinute":     perMinute,
+		"reviewSubmissions": reports >= abuseReviewThreshold,
+	})
+}
+
+// listAbuseReportsHandler returns every report, or those against one principal with
+// ?principalType=&principalId=.
+func listAbuseReportsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	principalType, principalID := query.Get("principalType"), query.Get("principalId")
+
+	abuseMu.RLock()
+	reports := slices.DeleteFunc(slices.Clone(abuseReports), func(report AbuseReport) bool {
+		return (principalType != "" && report.PrincipalType != principalType) ||
+			(principalID != "" && report.PrincipalID != principalID)
+	})
+	abuseMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"reports": reports})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Ledger accounts. Points a program owes are carried on its tenant's liability account and
+// points users hold on the user balances control account, whose per-user sub-ledger is the
+// users' entries. Transfers pass through the clearing account, which nets to zero once both legs
+// are posted, and transfer fees are income of the tenant.
+const (
+	accountUserBalances     = "user-balances"
+	accountTransferClearing = "transfer-clearing"
+)
+
+func programLiabilityAccount(tenantID string) string { return "program-liability:" + tenantID }
+func feeIncomeAccount(tenantID string) string        { return "fee-income:" + tenantID }
+
+// entryAccounts returns the accounts an entry debits and credits. An earn debits the program's
+// liability and credits the user; a redemption or reversal moves the points back.
+func entryAccounts(entry LedgerEntry) (debit, credit string) {
+	switch entry.Type {
+	case entryTransferOut:
+		return accountUserBalances, accountTransferClearing
+	case entryTransferIn:
+		return accountTransferClearing, accountUserBalances
+	case entryTransferFee:
+		return accountUserBalances, feeIncomeAccount(entry.TenantID)
+	}
+	if entry.Points > 0 {
+		return programLiabilityAccount(entry.TenantID), accountUserBalances
+	}
+	return accountUserBalances, programLiabilityAccount(entry.TenantID)
+}
+
+// ledgerIntegrityKey binds the user of each ledger entry into its hash. Unlike the identity key
+// it is never rotated, so the hashes of entries stay verifiable after their users are resealed.
+var ledgerIntegrityKey []byte
+
+// ledgerHashUserBound is the HashVersion of entries whose hash binds their user and idempotency
+// key. Entries appended before have HashVersion 0.
+const ledgerHashUserBound = 1
+
+// initLedgerIntegrityKey sets the ledger integrity key from secret. As with the identity key, a
+// random one is only allowed while the ledger is kept in memory.
+func initLedgerIntegrityKey(secret string, persistent bool) error {
+	ledgerIntegrityKey = []byte(secret)
+	if secret == "" {
+		if persistent {
+			return errors.New("a ledger integrity key is required with persistent storage: set -ledger-integrity-key, LEDGER_INTEGRITY_KEY or the ledger-integrity-key secret")
+		}
+		ledgerIntegrityKey = randomSecret()
+		log.Println("No ledger integrity key configured; ledger entries can't be verified after a restart.")
+	}
+	return nil
+}
+
+// entryHash chains entry, recorded against userID, to the hash of the entry before it. The user
+// is bound with an HMAC under the ledger integrity key rather than by its seal or pseudonym, since
+// rotating the identity key changes both.
+func entryHash(previous string, entry LedgerEntry, userID string) string {
+	contract := ""
+	if entry.Contract != nil {
+		contract = entry.Contract.ProgramID + "@" + strconv.Itoa(entry.Contract.Version)
+	}
+	fields := []string{
+		previous, entry.ID, entry.Type, strconv.Itoa(entry.Points), entry.TenantID, entry.ReceiptID,
+		entry.Reference, contract, entry.TransferID, entry.CreatedAt.Format("2006-01-02T15:04:05.999999999Z07:00"),
+		entry.Debit, entry.Credit,
+	}
+	if entry.HashVersion >= ledgerHashUserBound {
+		binding := hmacSHA256(hmacSHA256(ledgerIntegrityKey, "receipt-processor ledger user"), userID)
+		fields = append(fields, strconv.Itoa(entry.HashVersion), hex.EncodeToString(binding), entry.IdempotencyKey)
+	}
+	h := sha256.New()
+	for _, field := range fields {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AccountBalance is an account's line in the trial balance. Balance is Debits less Credits.
+type AccountBalance struct {
+	Account string `json:"account"`
+	Debits  int    `json:"debits"`
+	Credits int    `json:"credits"`
+	Balance int    `json:"balance"`
+}
+
+// trialBalanceLocked totals the debits and credits of every account. ledgerMu must be held.
+func trialBalanceLocked() []AccountBalance {
+	accounts := map[string]*AccountBalance{}
+	account := func(name string) *AccountBalance {
+		if accounts[name] == nil {
+			accounts[name] = &AccountBalance{Account: name}
+		}
+		return accounts[name]
+	}
+	for _, entry := range ledger {
+		amount := max(entry.Points, -entry.Points)
+		account(entry.Debit).Debits += amount
+		account(entry.Credit).Credits += amount
+	}
+	list := make([]AccountBalance, 0, len(accounts))
+	for _, balance := range accounts {
+		balance.Balance = balance.Debits - balance.Credits
+		list = append(list, *balance)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Account < list[j].Account })
+	return list
+}
+
+func trialBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	ledgerMu.Lock()
+	accounts := trialBalanceLocked()
+	entries := len(ledger)
+	ledgerMu.Unlock()
+
+	debits, credits := 0, 0
+	for _, account := range accounts {
+		debits += account.Debits
+		credits += account.Credits
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"accounts": accounts,
+		"debits":   debits,
+		"credits":  credits,
+		"balanced": debits == credits,
+		"entries":  entries,
+	})
+}
+
+// checkLedgerLocked audits the ledger and returns every problem found: broken hash chain links,
+// postings that don't match their entry, user entries that don't add up to the control account or
+// can't be decrypted, transfers left in clearing, and receipts whose earn entries don't match what
+// they were credited. ledgerMu must be held.
+func checkLedgerLocked() []string {
+	problems := []string{}
+	previous := ""
+	userTotal, controlTotal, clearing := 0, 0, 0
+	receiptTotals := map[string]int{}
+	for i, entry := range ledger {
+		userID, ok := openUserID(entry.sealedUserID, entry.ID)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("entry %s: user can't be decrypted", entry.ID))
+		}
+		if entryHash(previous, entry, userID) != entry.Hash {
+			problems = append(problems, fmt.Sprintf("entry %d (%s): hash doesn't match its contents and the previous entry", i, entry.ID))
+		}
+		previous = entry.Hash
+
+		if debit, credit := entryAccounts(entry); entry.Debit != debit || entry.Credit != credit || entry.Points == 0 {
+			problems = append(problems, fmt.Sprintf("entry %s: posted to %s/%s, expected %s/%s", entry.ID, entry.Debit, entry.Credit, debit, credit))
+		}
+		amount := max(entry.Points, -entry.Points)
+		if entry.Credit == accountUserBalances {
+			controlTotal += amount
+		}
+		if entry.Debit == accountUserBalances {
+			controlTotal -= amount
+		}
+		if entry.Debit == accountTransferClearing {
+			clearing += amount
+		}
+		if entry.Credit == accountTransferClearing {
+			clearing -= amount
+		}
+
+		userTotal += entry.Points
+
+		if entry.Type == entryEarn || entry.Type == entryReversal {
+			receiptTotals[entry.ReceiptID] += entry.Points
+		}
+	}
+	if userTotal != controlTotal {
+		problems = append(problems, fmt.Sprintf("user sub-ledgers total %d, but the %s account holds %d", userTotal, accountUserBalances, controlTotal))
+	}
+	if clearing != 0 {
+		problems = append(problems, fmt.Sprintf("the %s account holds %d instead of zero", accountTransferClearing, clearing))
+	}
+	for id, credited := range receiptCredits {
+		if receiptTotals[id] != credited {
+			problems = append(problems, fmt.Sprintf("receipt %s: credited %d, but its entries total %d", id, credited, receiptTotals[id]))
+		}
+	}
+	return problems
+}
+
+func ledgerIntegrityHandler(w http.ResponseWriter, r *http.Request) {
+	ledgerMu.Lock()
+	problems := checkLedgerLocked()
+	entries := len(ledger)
+	head := ""
+	if entries > 0 {
+		head = ledger[entries-1].Hash
+	}
+	ledgerMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok":       len(problems) == 0,
+		"entries":  entries,
+		"head":     head,
+		"problems": problems,
+	})
+}
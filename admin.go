@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// adminToken authorizes requests to the /admin routes. The admin API is disabled when it is empty.
+var adminToken secretValue
+
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := adminToken.Get()
+		if expected == "" {
+			http.Error(w, "The admin API is disabled.", http.StatusForbidden)
+			return
+		}
+		if !hasAdminToken(r) {
+			http.Error(w, "Invalid admin credentials.", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasAdminToken reports whether the request is made with the admin token, which routes outside
+// the admin API accept in place of a user's or tenant's credentials.
+func hasAdminToken(r *http.Request) bool {
+	expected := adminToken.Get()
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
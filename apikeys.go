@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// APIKeysConfig lists the API keys clients of the /receipts routes authenticate with.
+type APIKeysConfig struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// APIKey is a client's key. Name identifies the client in the logs, never the key itself, which
+// may be a "secret:" reference. A key with a TenantID may only be used for that tenant, and a
+// disabled key is refused until it is enabled again, e.g. while a leak is investigated.
+type APIKey struct {
+	Name     string `json:"name"`
+	Key      string `json:"key"`
+	TenantID string `json:"tenantId,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// apiKeys are the configured keys by the SHA-256 of the key, so a lookup takes as long whatever
+// the key presented. The /receipts routes are open when there are none.
+var apiKeys map[[sha256.Size]byte]APIKey
+
+// loadAPIKeys reads the keys of a JSON file, if path isn't empty, and those of list, given as
+// name=key pairs separated by commas.
+func loadAPIKeys(path, list string) (map[[sha256.Size]byte]APIKey, error) {
+	var cfg APIKeysConfig
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	for _, pair := range splitList(list) {
+		name, key, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("an API key of the list is not name=key")
+		}
+		cfg.Keys = append(cfg.Keys, APIKey{Name: name, Key: key})
+	}
+
+	keys := make(map[[sha256.Size]byte]APIKey, len(cfg.Keys))
+	names := map[string]bool{}
+	for _, key := range cfg.Keys {
+		if key.Name == "" || key.Key == "" {
+			return nil, fmt.Errorf("API key %q: name and key are required", key.Name)
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("API key %q is configured twice", key.Name)
+		}
+		names[key.Name] = true
+		if err := resolveSecrets(&key.Key); err != nil {
+			return nil, fmt.Errorf("API key %q: %w", key.Name, err)
+		}
+		hash := sha256.Sum256([]byte(key.Key))
+		if _, taken := keys[hash]; taken {
+			return nil, fmt.Errorf("API key %q has the same key as another", key.Name)
+		}
+		keys[hash] = key
+	}
+	return keys, nil
+}
+
+// requireAPIKey requires a valid X-API-Key on the /receipts routes when API keys are configured:
+// a missing or unknown key is 401, and a disabled key or one used for another tenant 403. The
+// key's name is logged with the request. It is router middleware, so routes added later under
+// /receipts are covered too.
+func requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(apiKeys) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		if !strings.HasPrefix(route, "/receipts") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		presented := r.Header.Get("X-API-Key")
+		if presented == "" {
+			http.Error(w, "An X-API-Key header is required.", http.StatusUnauthorized)
+			return
+		}
+		key, ok := apiKeys[sha256.Sum256([]byte(presented))]
+		if !ok {
+			http.Error(w, "Invalid API key.", http.StatusUnauthorized)
+			return
+		}
+		if entry, ok := r.Context().Value(requestEntryKey{}).(*requestEntry); ok {
+			entry.apiKey = key.Name
+		}
+		switch {
+		case key.Disabled:
+			http.Error(w, "The API key is disabled.", http.StatusForbidden)
+			return
+		case key.TenantID != "" && key.TenantID != tenantFromRequest(r):
+			http.Error(w, "The API key is not valid for this tenant.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// API versions. Version 2 wraps the receipt responses in an envelope with links and metadata, for
+// generic clients to navigate the API; version 1 answers as before.
+const (
+	apiVersion1 = 1
+	apiVersion2 = 2
+
+	latestAPIVersion = apiVersion2
+)
+
+// defaultAPIVersion is the version of the requests that don't ask for one.
+var defaultAPIVersion = apiVersion1
+
+// apiVersionFlags defines the API version flags on fs.
+func apiVersionFlags(fs *flag.FlagSet) {
+	fs.IntVar(&defaultAPIVersion, "default-api-version", envInt("DEFAULT_API_VERSION", defaultAPIVersion), "API version of the requests without an API-Version header: 1 (bare responses) or 2 (responses in an envelope with links)")
+}
+
+func checkDefaultAPIVersion() error {
+	if defaultAPIVersion < apiVersion1 || defaultAPIVersion > latestAPIVersion {
+		return fmt.Errorf("unknown -default-api-version %d: must be from 1 to %d", defaultAPIVersion, latestAPIVersion)
+	}
+	return nil
+}
+
+type apiVersionKey struct{}
+
+// requestAPIVersion is the API version the request is served in.
+func requestAPIVersion(r *http.Request) int {
+	if version, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return version
+	}
+	return defaultAPIVersion
+}
+
+// negotiateAPIVersion serves each request in the API version of its API-Version header, or the
+// default one, and names it in the API-Version response header. Unknown versions are 400.
+func negotiateAPIVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := defaultAPIVersion
+		if header := r.Header.Get("API-Version"); header != "" {
+			parsed, err := strconv.Atoi(header)
+			if err != nil || parsed < apiVersion1 || parsed > latestAPIVersion {
+				http.Error(w, fmt.Sprintf("Unsupported API-Version %q; versions 1 to %d are supported.", header, latestAPIVersion), http.StatusBadRequest)
+				return
+			}
+			version = parsed
+		}
+		w.Header().Set("API-Version", strconv.Itoa(version))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+	})
+}
+
+// receiptLinks are the links of a receipt response: the receipt, its points and breakdown, and the
+// balance of the user who submitted it.
+func receiptLinks(receipt ProcessedReceipt) map[string]string {
+	self := "/receipts/" + url.PathEscape(receipt.ID)
+	links := map[string]string{
+		"self":      self,
+		"points":    self + "/points",
+		"breakdown": self + "/breakdown",
+	}
+	if receipt.Receipt.UserID != "" {
+		links["user"] = "/users/" + url.PathEscape(receipt.Receipt.UserID) + "/balance"
+	}
+	return links
+}
+
+// writeReceiptResponse writes a response about receipt with status. In API version 2, it is the
+// data of an envelope with the receipt's links and meta: the rules version it was scored by, if
+// recorded, and when it was processed.
+func writeReceiptResponse(w http.ResponseWriter, r *http.Request, status int, response map[string]any, receipt ProcessedReceipt) {
+	var body any = response
+	if requestAPIVersion(r) >= apiVersion2 {
+		meta := map[string]any{"processedAt": receipt.ProcessedAt.Format(time.RFC3339Nano)}
+		if receipt.RulesVersion != 0 {
+			meta["rulesVersion"] = receipt.RulesVersion
+		}
+		body = map[string]any{"data": response, "links": receiptLinks(receipt), "meta": meta}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Receipts are archived archiveAfter after they were processed, unless their tenant sets its own
+// archiveAfter: the full record moves to the archive tier and only an index entry stays in the
+// receipt store. 0 never archives. A receipt read again is retrieved into the store, and archived
+// again once it hasn't been retrieved for keepRetrieved.
+var (
+	archiveAfter  time.Duration
+	keepRetrieved = 24 * time.Hour
+)
+
+// errReceiptArchived is returned for an archived receipt whose retrieval from the archive tier has
+// started but not finished.
+var errReceiptArchived = errors.New("receipt is being retrieved from the archive")
+
+// errArchiveRetrieving is returned by an ArchiveTier for a record that is being restored.
+var errArchiveRetrieving = errors.New("archived record is being restored")
+
+// ArchiveRef marks a receipt as archived under Key.
+type ArchiveRef struct {
+	Key        string
+	ArchivedAt time.Time
+	// RetrievedAt is set while the full receipt is back in the store.
+	RetrievedAt *time.Time
+}
+
+// An ArchiveTier keeps archived receipt records in cheaper storage, where they may take a while
+// to get back.
+type ArchiveTier interface {
+	Archive(ctx context.Context, key string, data []byte) error
+	// Retrieve returns the record, or errArchiveRetrieving once it has asked the tier to restore
+	// it. Asking again while it is restored is harmless.
+	Retrieve(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var archiveTier ArchiveTier
+
+func newArchiveTier(kind string, blobs BlobStore, restoreDays int) (ArchiveTier, error) {
+	switch kind {
+	case "", "blob":
+		return blobArchive{blobs: blobs}, nil
+	case "glacier":
+		s3, ok := blobs.(*s3BlobStore)
+		if !ok {
+			return nil, errors.New("the glacier archive tier needs the s3 blob store")
+		}
+		return glacierArchive{s3: s3, restoreDays: restoreDays}, nil
+	default:
+		return nil, fmt.Errorf("unknown archive tier %q", kind)
+	}
+}
+
+// blobArchive keeps archived records in the blob store, from which they come back right away.
+type blobArchive struct {
+	blobs BlobStore
+}
+
+func (a blobArchive) Archive(ctx context.Context, key string, data []byte) error {
+	return a.blobs.Put(ctx, key, data, "application/json")
+}
+
+func (a blobArchive) Retrieve(ctx context.Context, key string) ([]byte, error) {
+	body, err := a.blobs.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func (a blobArchive) Delete(ctx context.Context, key string) error {
+	return a.blobs.Delete(ctx, key)
+}
+
+// glacierArchive keeps archived records in the S3 bucket of the blob store in the GLACIER storage
+// class. Reading one first restores a copy for restoreDays, which takes hours.
+type glacierArchive struct {
+	s3          *s3BlobStore
+	restoreDays int
+}
+
+func (a glacierArchive) request(ctx context.Context, method, path string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, a.s3.endpoint+"/"+a.s3.bucket+"/"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signAWSRequest(req, sha256Hex(body), a.s3.creds, a.s3.region, "s3", time.Now())
+	return a.s3.client.Do(req)
+}
+
+func (a glacierArchive) Archive(ctx context.Context, key string, data []byte) error {
+	resp, err := a.request(ctx, http.MethodPut, key, data, http.Header{
+		"Content-Type":        {"application/json"},
+		"X-Amz-Storage-Class": {"GLACIER"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 put %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+func (a glacierArchive) Retrieve(ctx context.Context, key string) ([]byte, error) {
+	resp, err := a.request(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, errBlobNotFound
+	case http.StatusForbidden:
+		// A Glacier object that isn't restored is refused with InvalidObjectState.
+		if detail, _ := io.ReadAll(io.LimitReader(resp.Body, 4096)); !bytes.Contains(detail, []byte("InvalidObjectState")) {
+			return nil, fmt.Errorf("s3 get %s: %s", key, resp.Status)
+		}
+	default:
+		return nil, fmt.Errorf("s3 get %s: %s", key, resp.Status)
+	}
+
+	restore := "<RestoreRequest><Days>" + strconv.Itoa(a.restoreDays) +
+		"</Days><GlacierJobParameters><Tier>Standard</Tier></GlacierJobParameters></RestoreRequest>"
+	restoreResp, err := a.request(ctx, http.MethodPost, key+"?restore", []byte(restore), http.Header{"Content-Type": {"application/xml"}})
+	if err != nil {
+		return nil, err
+	}
+	defer restoreResp.Body.Close()
+	switch restoreResp.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusConflict:
+		// Started now, already restored but expiring, or already in progress.
+		return nil, errArchiveRetrieving
+	default:
+		return nil, fmt.Errorf("s3 restore %s: %s", key, restoreResp.Status)
+	}
+}
+
+func (a glacierArchive) Delete(ctx context.Context, key string) error {
+	return a.s3.Delete(ctx, key)
+}
+
+// tenantArchiveAfter is how long after processing the tenant's receipts are archived, 0 for never.
+func tenantArchiveAfter(tenantID string) time.Duration {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	if after := tenants[tenantID].ArchiveAfter; after > 0 {
+		return time.Duration(after)
+	}
+	return archiveAfter
+}
+
+func archiveKey(id string) string {
+	return "archive/receipts/" + id + ".json"
+}
+
+// isArchived reports whether only the index entry of a stored receipt is in the store.
+func isArchived(receipt ProcessedReceipt) bool {
+	return receipt.Archive != nil && receipt.Archive.RetrievedAt == nil
+}
+
+// archiveEntry is what stays in the store of an archived receipt: what identifies it, its user and
+// its outcome.
+func archiveEntry(stored ProcessedReceipt, ref ArchiveRef) ProcessedReceipt {
+	return ProcessedReceipt{
+		ID:           stored.ID,
+		TenantID:     stored.TenantID,
+		Status:       stored.Status,
+		Points:       stored.Points,
+		ProcessedAt:  stored.ProcessedAt,
+		UserIDHash:   stored.UserIDHash,
+		SealedUserID: stored.SealedUserID,
+		Archive:      &ref,
+	}
+}
+
+// archivable reports whether a stored receipt is due to be archived at now.
+func archivable(receipt ProcessedReceipt, now time.Time) bool {
+	after := tenantArchiveAfter(receipt.TenantID)
+	switch {
+	case after <= 0 || receipt.DeletedAt != nil || receipt.Status == statusPendingReview:
+		return false
+	case receipt.Archive == nil:
+		return now.Sub(receipt.ProcessedAt) > after
+	default:
+		return receipt.Archive.RetrievedAt != nil && now.Sub(*receipt.Archive.RetrievedAt) > keepRetrieved
+	}
+}
+
+// startArchiveSweeper periodically archives the production receipts that are due.
+func startArchiveSweeper(interval time.Duration) {
+	scheduleTask("archive-sweep", interval, sweepArchivableReceipts)
+}
+
+func sweepArchivableReceipts() {
+	archived := 0
+	for _, receipt := range listStore(receiptStore) {
+		if !archivable(receipt, time.Now()) {
+			continue
+		}
+		if err := archiveReceipt(receipt); err != nil {
+			log.Printf("Archiving receipt %s: %v", receipt.ID, err)
+			continue
+		}
+		archived++
+	}
+	if archived > 0 {
+		log.Printf("Archived %d receipts", archived)
+	}
+}
+
+// archiveReceipt writes the stored receipt to the archive tier, then replaces it with its index
+// entry unless it changed in the meantime.
+func archiveReceipt(stored ProcessedReceipt) error {
+	data, err := encodeStoredReceipt(stored)
+	if err != nil {
+		return err
+	}
+	ref := ArchiveRef{Key: archiveKey(stored.ID), ArchivedAt: time.Now().UTC()}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := archiveTier.Archive(ctx, ref.Key, data); err != nil {
+		return err
+	}
+
+	receiptStoreMu.Lock()
+	defer receiptStoreMu.Unlock()
+	current, err := receiptStore.Get(stored.ID)
+	if err != nil {
+		return err
+	}
+	if now, _ := encodeStoredReceipt(current); !bytes.Equal(now, data) {
+		// Updated since it was listed: it is archived as updated on the next sweep.
+		return nil
+	}
+	return receiptStore.Put(archiveEntry(current, ref))
+}
+
+// hydrateArchivedReceipt reads the full record of an archived receipt back from the archive tier.
+// The user ID is taken from the index entry, which is resealed on key rotations.
+func hydrateArchivedReceipt(entry ProcessedReceipt) (ProcessedReceipt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	data, err := archiveTier.Retrieve(ctx, entry.Archive.Key)
+	switch {
+	case errors.Is(err, errArchiveRetrieving):
+		return ProcessedReceipt{}, errReceiptArchived
+	case err != nil:
+		return ProcessedReceipt{}, fmt.Errorf("retrieving archived receipt %s: %w", entry.ID, err)
+	}
+	receipt, err := decodeStoredReceipt(data)
+	if err != nil {
+		return ProcessedReceipt{}, fmt.Errorf("archived receipt %s: %w", entry.ID, err)
+	}
+	receipt.UserIDHash, receipt.SealedUserID = entry.UserIDHash, entry.SealedUserID
+	retrievedAt := time.Now().UTC()
+	receipt.Archive = &ArchiveRef{Key: entry.Archive.Key, ArchivedAt: entry.Archive.ArchivedAt, RetrievedAt: &retrievedAt}
+	return receipt, nil
+}
+
+// retrieveArchivedReceipt brings an archived receipt back into the store and returns it as stored.
+func retrieveArchivedReceipt(id string) (ProcessedReceipt, error) {
+	receiptStoreMu.Lock()
+	defer receiptStoreMu.Unlock()
+	store, stored, err := findStoredReceipt(id)
+	if err != nil || !isArchived(stored) {
+		return stored, err
+	}
+	receipt, err := hydrateArchivedReceipt(stored)
+	if err != nil {
+		return ProcessedReceipt{}, err
+	}
+	if err := store.Put(receipt); err != nil {
+		return ProcessedReceipt{}, err
+	}
+	return receipt, nil
+}
+
+// writeReceiptRetrieving answers a request for an archived receipt that is still being retrieved
+// with 202 Accepted, to be asked again later.
+func writeReceiptRetrieving(w http.ResponseWriter, id string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", "3600")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "status": "retrieving"})
+}
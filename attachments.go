@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const attachmentURLTTL = 15 * time.Minute
+
+var allowedAttachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+var (
+	maxAttachmentSize int64 = 10 << 20
+
+	// attachmentURLKeys sign download URLs. A random secret is used when none is configured, so
+	// URLs handed out before a restart stop working.
+	attachmentURLKeys *keyRing
+)
+
+type Attachment struct {
+	ID          string                  `json:"id"`
+	Filename    string                  `json:"filename"`
+	ContentType string                  `json:"contentType"`
+	Size        int64                   `json:"size"`
+	SHA256      string                  `json:"sha256"`
+	UploadedAt  time.Time               `json:"uploadedAt"`
+	Scan        ScanResult              `json:"scan"`
+	Quarantined bool                    `json:"quarantined,omitempty"`
+	Processing  string                  `json:"processing,omitempty"`
+	Variants    map[string]ImageVariant `json:"variants,omitempty"`
+	BlobKey     string                  `json:"-"`
+}
+
+func initAttachmentSecret(secret string) {
+	key := []byte(secret)
+	if secret == "" {
+		key = randomSecret()
+		log.Println("No attachment URL secret configured; download URLs will not survive a restart.")
+	}
+	attachmentURLKeys = newKeyRing(keyRingAttachmentURLs, key, nil)
+}
+
+func uploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	receipt, exists := getTenantReceipt(r, id)
+	if !exists {
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	if virusScanner == nil && !allowUnscannedUploads {
+		http.Error(w, "Attachments can't be accepted: no virus scanner is configured.", http.StatusServiceUnavailable)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "The attachment is too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "The attachment is invalid.", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentSize+1))
+	if err != nil {
+		http.Error(w, "The attachment is invalid.", http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) > maxAttachmentSize {
+		http.Error(w, "The attachment is too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "The attachment is empty.", http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	if !allowedAttachmentTypes[contentType] {
+		http.Error(w, "The attachment type is not supported.", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	attachment := Attachment{
+		ID:          uuid.New().String(),
+		Filename:    filepath.Base(header.Filename),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		SHA256:      sha256Hex(data),
+		UploadedAt:  time.Now().UTC(),
+	}
+	attachment.Scan = ScanResult{Status: scanNotScanned}
+	if virusScanner != nil {
+		if attachment.Scan, err = virusScanner.Scan(r.Context(), data); err != nil {
+			log.Printf("Scanning attachment for receipt %s: %v", id, err)
+			http.Error(w, "The attachment could not be scanned.", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	// Infected files are kept for investigation under a separate prefix and never served.
+	attachment.Quarantined = attachment.Scan.Status == scanInfected
+	attachment.BlobKey = "attachments/" + id + "/" + attachment.ID
+	if attachment.Quarantined {
+		attachment.BlobKey = "quarantine/" + id + "/" + attachment.ID
+	} else if isProcessableImage(contentType) {
+		attachment.Processing = processingPending
+	}
+	if err := blobStore.Put(r.Context(), attachment.BlobKey, data, contentType); err != nil {
+		log.Printf("Storing attachment for receipt %s: %v", id, err)
+		http.Error(w, "The attachment could not be stored.", http.StatusInternalServerError)
+		return
+	}
+
+	receipt, err = updateReceipt(id, func(receipt *ProcessedReceipt) error {
+		receipt.Attachments = append(receipt.Attachments, attachment)
+		return nil
+	})
+	if err != nil {
+		blobStore.Delete(r.Context(), attachment.BlobKey)
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	if attachment.Processing == processingPending && !enqueueImageJob(imageJob{receiptID: id, attachmentID: attachment.ID}) {
+		log.Printf("Image pipeline queue full; attachment %s of receipt %s will not be processed", attachment.ID, id)
+	}
+
+	if attachment.Quarantined {
+		publishReceiptEvent(eventAttachmentQuarantined, receipt, map[string]any{
+			"attachmentId": attachment.ID,
+			"signature":    attachment.Scan.Signature,
+		})
+		http.Error(w, "The attachment failed the virus scan.", http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachmentResponse(id, attachment))
+}
+
+func listAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	receipt, exists := getTenantReceipt(r, id)
+	if !exists {
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	attachments := make([]map[string]any, 0, len(receipt.Attachments))
+	for _, attachment := range receipt.Attachments {
+		attachments = append(attachments, attachmentResponse(id, attachment))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"attachments": attachments})
+}
+
+// downloadAttachmentHandler serves an attachment to holders of a signed, unexpired download URL.
+func downloadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, attachmentID := vars["id"], vars["attachmentId"]
+
+	query := r.URL.Query()
+	variantName := query.Get("variant")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires || !validAttachmentSignature(query.Get("signature"), id, attachmentID, variantName, expires) {
+		http.Error(w, "The download link is invalid or has expired.", http.StatusForbidden)
+		return
+	}
+
+	receipt, exists := getReceipt(id)
+	if !exists {
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
+	var attachment *Attachment
+	for i := range receipt.Attachments {
+		if receipt.Attachments[i].ID == attachmentID {
+			attachment = &receipt.Attachments[i]
+		}
+	}
+	if attachment == nil {
+		http.Error(w, "No attachment found for that ID.", http.StatusNotFound)
+		return
+	}
+	if attachment.Quarantined {
+		http.Error(w, "The attachment is quarantined.", http.StatusForbidden)
+		return
+	}
+
+	key, contentType, filename := attachment.BlobKey, attachment.ContentType, attachment.Filename
+	if variantName != "" {
+		variant, ok := attachment.Variants[variantName]
+		if !ok {
+			http.Error(w, "No such variant for that attachment.", http.StatusNotFound)
+			return
+		}
+		key, contentType = variant.BlobKey, variant.ContentType
+		filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + "-" + variantName + variantExtension(contentType)
+	}
+
+	body, err := blobStore.Get(r.Context(), key)
+	if err != nil {
+		log.Printf("Reading attachment %s of receipt %s: %v", attachmentID, id, err)
+		http.Error(w, "The attachment could not be read.", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	io.Copy(w, body)
+}
+
+func attachmentResponse(receiptID string, attachment Attachment) map[string]any {
+	response := map[string]any{
+		"id":          attachment.ID,
+		"filename":    attachment.Filename,
+		"contentType": attachment.ContentType,
+		"size":        attachment.Size,
+		"sha256":      attachment.SHA256,
+		"uploadedAt":  attachment.UploadedAt,
+		"scan":        attachment.Scan,
+	}
+	if attachment.Quarantined {
+		response["quarantined"] = true
+		return response
+	}
+	if attachment.Processing != "" {
+		response["processing"] = attachment.Processing
+	}
+	response["downloadUrl"] = attachmentURL(receiptID, attachment.ID, "")
+
+	if len(attachment.Variants) > 0 {
+		variants := map[string]any{}
+		for name, variant := range attachment.Variants {
+			variants[name] = map[string]any{
+				"contentType": variant.ContentType,
+				"width":       variant.Width,
+				"height":      variant.Height,
+				"downloadUrl": attachmentURL(receiptID, attachment.ID, name),
+			}
+		}
+		response["variants"] = variants
+	}
+	return response
+}
+
+// attachmentURL returns a signed download URL for an attachment, or one of its variants when
+// variant is set.
+func attachmentURL(receiptID, attachmentID, variant string) string {
+	expires := time.Now().Add(attachmentURLTTL).Unix()
+	query := url.Values{}
+	if variant != "" {
+		query.Set("variant", variant)
+	}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", signAttachmentURL(attachmentURLKeys.current(), receiptID, attachmentID, variant, expires))
+	return "/receipts/" + receiptID + "/attachments/" + attachmentID + "?" + query.Encode()
+}
+
+func signAttachmentURL(key []byte, receiptID, attachmentID, variant string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s/%s/%s/%d", receiptID, attachmentID, variant, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validAttachmentSignature checks a download URL signature against every accepted key, so URLs
+// signed before a rotation keep working through its grace period.
+func validAttachmentSignature(signature, receiptID, attachmentID, variant string, expires int64) bool {
+	for _, key := range attachmentURLKeys.accepted() {
+		if hmac.Equal([]byte(signature), []byte(signAttachmentURL(key, receiptID, attachmentID, variant, expires))) {
+			return true
+		}
+	}
+	return false
+}
+
+func variantExtension(contentType string) string {
+	if contentType == "image/png" {
+		return ".png"
+	}
+	return ".jpg"
+}
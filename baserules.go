@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Types of base rules.
+const (
+	baseRetailerCharacters = "retailer-characters"
+	baseRoundTotal         = "round-total"
+	baseTotalMultiple      = "total-multiple"
+	baseItemCount          = "item-count"
+	baseItemDescription    = "item-description"
+	baseOddDay             = "odd-day"
+)
+
+// How the item-description rule measures descriptions.
+const (
+	lengthBytes     = "bytes"
+	lengthRunes     = "runes"
+	lengthGraphemes = "graphemes"
+	lengthWords     = "words"
+)
+
+// BaseRule is one of the rules every receipt is scored by, with its parameters. Type is what the
+// rule checks; Name, the type by default, is what its points are reported as in breakdowns, so a
+// type can be used by several rules. Disabled rules award nothing.
+//
+//   - retailer-characters: Points for every letter or digit in the retailer name.
+//   - round-total: Points if the total has no cents.
+//   - total-multiple: Points if the total is a multiple of Multiple, e.g. "0.25".
+//   - item-count: Points for every Per items.
+//   - item-description: Multiplier times the price of each item whose trimmed description is a
+//     multiple of Length long, rounded with the rule's rounding mode. Basis is what the length
+//     counts: bytes (the default), runes, graphemes or words.
+//   - odd-day: Points if the purchase day is odd.
+type BaseRule struct {
+	Type       string `json:"type"`
+	Name       string `json:"name,omitempty"`
+	Points     int    `json:"points,omitempty"`
+	Multiple   string `json:"multiple,omitempty"`
+	Per        int    `json:"per,omitempty"`
+	Length     int    `json:"length,omitempty"`
+	Multiplier string `json:"multiplier,omitempty"`
+	Basis      string `json:"basis,omitempty"`
+	Disabled   bool   `json:"disabled,omitempty"`
+
+	multiple   Money
+	multiplier *big.Rat
+}
+
+// defaultBaseRules are the base rules of receipts when the rules config doesn't list its own.
+func defaultBaseRules() []BaseRule {
+	return []BaseRule{
+		{Type: baseRetailerCharacters, Points: 1},
+		{Type: baseRoundTotal, Points: 50},
+		{Type: baseTotalMultiple, Name: "quarter-multiple", Points: 25, Multiple: "0.25"},
+		{Type: baseItemCount, Name: "item-pairs", Points: 5, Per: 2},
+		{Type: baseItemDescription, Length: 3, Multiplier: "0.2"},
+		{Type: baseOddDay, Points: 6},
+	}
+}
+
+func (r *BaseRule) prepare() error {
+	if r.Name == "" {
+		r.Name = r.Type
+	}
+	switch r.Type {
+	case baseRetailerCharacters, baseRoundTotal, baseOddDay:
+	case baseTotalMultiple:
+		multiple, err := parseMoney(r.Multiple)
+		if err != nil || multiple <= 0 {
+			return fmt.Errorf("multiple %q must be a positive amount with two decimals", r.Multiple)
+		}
+		r.multiple = multiple
+	case baseItemCount:
+		if r.Per < 1 {
+			return fmt.Errorf("per must be at least 1")
+		}
+	case baseItemDescription:
+		if r.Length < 1 {
+			return fmt.Errorf("length must be at least 1")
+		}
+		switch r.Basis {
+		case "":
+			r.Basis = lengthBytes
+		case lengthBytes, lengthRunes, lengthGraphemes, lengthWords:
+		default:
+			return fmt.Errorf("unknown basis %q: must be bytes, runes, graphemes or words", r.Basis)
+		}
+		multiplier, ok := new(big.Rat).SetString(r.Multiplier)
+		if !ok || multiplier.Sign() < 0 {
+			return fmt.Errorf("invalid multiplier %q", r.Multiplier)
+		}
+		r.multiplier = multiplier
+	default:
+		return fmt.Errorf("unknown type %q", r.Type)
+	}
+	return nil
+}
+
+// receiptTotal is the receipt's total, if it is an amount.
+func receiptTotal(receipt Receipt) (Money, bool) {
+	total, err := parseMoney(receipt.Total)
+	return total, err == nil
+}
+
+// contributions scores the receipt by the rule.
+func (r BaseRule) contributions(cfg RulesConfig, receipt Receipt) Breakdown {
+	breakdown := Breakdown{}
+	switch r.Type {
+	case baseRetailerCharacters:
+		characters := 0
+		for _, char := range receipt.Retailer {
+			if unicode.IsLetter(char) || unicode.IsDigit(char) {
+				characters++
+			}
+		}
+		breakdown.add(r.Name, characters*r.Points)
+	case baseRoundTotal:
+		if total, ok := receiptTotal(receipt); ok && total.IsWhole() {
+			breakdown.add(r.Name, r.Points)
+		}
+	case baseTotalMultiple:
+		if total, ok := receiptTotal(receipt); ok && total.IsMultipleOf(r.multiple) {
+			breakdown.add(r.Name, r.Points)
+		}
+	case baseItemCount:
+		breakdown.add(r.Name, len(receipt.Items)/r.Per*r.Points)
+	case baseItemDescription:
+		rounding := cfg.roundingFor(r.Name)
+		// Multiplier × price is cents × multiplier / 100, rounded exactly rather than in floating
+		// point.
+		num, den := r.multiplier.Num().Int64(), r.multiplier.Denom().Int64()
+		for i, item := range receipt.Items {
+			if r.descriptionLength(item.ShortDescription)%r.Length != 0 {
+				continue
+			}
+			price, err := parseMoney(item.Price)
+			if err != nil {
+				continue
+			}
+			if points := int(roundRatio(price.Cents()*num, 100*den, rounding)); points != 0 {
+				breakdown = append(breakdown, Contribution{Rule: r.Name, Points: points, Item: &i, Rounding: rounding})
+			}
+		}
+	case baseOddDay:
+		if date, err := time.Parse("2006-01-02", receipt.PurchaseDate); err == nil && date.Day()%2 == 1 {
+			breakdown.add(r.Name, r.Points)
+		}
+	}
+	return breakdown
+}
+
+// descriptionLength measures a trimmed item description by the rule's basis.
+func (r BaseRule) descriptionLength(description string) int {
+	description = strings.TrimSpace(description)
+	switch r.Basis {
+	case lengthRunes:
+		return utf8.RuneCountInString(description)
+	case lengthGraphemes:
+		return graphemeCount(description)
+	case lengthWords:
+		return len(strings.Fields(description))
+	}
+	return len(description)
+}
+
+// graphemeCount counts the user-perceived characters of s, so "Café" is 4 long whether its é is one
+// code point or an e and a combining accent. It approximates Unicode's extended grapheme clusters:
+// combining marks, variation selectors, emoji skin tones, joined emoji and Hangul jamo extend the
+// character before them, and regional indicators pair into flags.
+func graphemeCount(s string) int {
+	count := 0
+	var previous rune
+	regionalIndicators := 0
+	for _, r := range s {
+		extends := false
+		switch {
+		case count == 0:
+		case unicode.Is(unicode.M, r), r == '\u200d', previous == '\u200d', r >= 0x1f3fb && r <= 0x1f3ff:
+			extends = true
+		case r >= 0x1160 && r <= 0x11ff, r >= 0xd7b0 && r <= 0xd7ff:
+			extends = true
+		case r >= 0x1f1e6 && r <= 0x1f1ff:
+			extends = regionalIndicators%2 == 1
+		case r == '\n' && previous == '\r':
+			extends = true
+		}
+		if r >= 0x1f1e6 && r <= 0x1f1ff {
+			regionalIndicators++
+		} else {
+			regionalIndicators = 0
+		}
+		if !extends {
+			count++
+		}
+		previous = r
+	}
+	return count
+}
+
+// describe explains the rule to end users, as describeRule.
+func (r BaseRule) describe() string {
+	switch r.Type {
+	case baseRetailerCharacters:
+		if r.Points == 1 {
+			return "One point for every letter or digit in the retailer name."
+		}
+		return fmt.Sprintf("%d points for every letter or digit in the retailer name.", r.Points)
+	case baseRoundTotal:
+		return "The total is a round dollar amount with no cents."
+	case baseTotalMultiple:
+		return "The total is a multiple of " + r.Multiple + "."
+	case baseItemCount:
+		return fmt.Sprintf("%d points for every %d items on the receipt.", r.Points, r.Per)
+	case baseItemDescription:
+		unit := "characters"
+		if r.Basis == lengthWords {
+			unit = "words"
+		}
+		return fmt.Sprintf("The item's trimmed description is a multiple of %d %s long, which earns %s times its price.", r.Length, unit, r.Multiplier)
+	case baseOddDay:
+		return "The purchase date is on an odd day of the month."
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestDescriptionLength(t *testing.T) {
+	tests := []struct {
+		name                    string
+		description             string
+		bytes, runes, graphemes int
+	}{
+		{"ascii", "Cafe", 4, 4, 4},
+		{"empty", "", 0, 0, 0},
+		{"trimmed", "  Caf\u00e9  ", 5, 4, 4},
+		{"precomposed accent", "Caf\u00e9", 5, 4, 4},
+		{"combining accent", "Cafe\u0301", 6, 5, 4},
+		{"stacked combining marks", "e\u0301\u0302", 5, 3, 1},
+		{"variation selector", "\u2764\ufe0f", 6, 2, 1},
+		{"skin tone", "\U0001f44d\U0001f3fd", 8, 2, 1},
+		{"zwj family", "\U0001f468\u200d\U0001f469\u200d\U0001f467", 18, 5, 1},
+		{"zwj sequence between words", "a\U0001f469\u200d\U0001f4bb!", 13, 5, 3},
+		{"flag", "\U0001f1ef\U0001f1f5", 8, 2, 1},
+		{"two flags", "\U0001f1ef\U0001f1f5\U0001f1fa\U0001f1f8", 16, 4, 2},
+		{"unpaired regional indicator", "\U0001f1ef\U0001f1f5\U0001f1fa", 12, 3, 2},
+		{"cjk", "寿司", 6, 2, 2},
+		{"cjk and emoji", "Tea \U0001f375 茶", 12, 7, 7},
+		{"precomposed hangul", "한글", 6, 2, 2},
+		{"hangul jamo", "\u1112\u1161\u11ab", 9, 3, 1},
+		{"crlf", "a\r\nb", 4, 4, 3},
+	}
+	for _, test := range tests {
+		for _, basis := range []struct {
+			name string
+			want int
+		}{{lengthBytes, test.bytes}, {lengthRunes, test.runes}, {lengthGraphemes, test.graphemes}} {
+			rule := BaseRule{Type: baseItemDescription, Length: 1, Multiplier: "0.2", Basis: basis.name}
+			if err := rule.prepare(); err != nil {
+				t.Fatal(err)
+			}
+			if got := rule.descriptionLength(test.description); got != basis.want {
+				t.Errorf("%s: %s length of %q = %d, want %d", test.name, basis.name, test.description, got, basis.want)
+			}
+		}
+	}
+}
+
+func TestGraphemeCount(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		// A combining mark at the start has nothing to extend.
+		{"\u0301", 1},
+		{"\u0301a", 2},
+		{"Cafe\u0301 Cre\u0300me", 10},
+		{"\U0001f469\u200d\u2764\ufe0f\u200d\U0001f468", 1},
+		{"\U0001f44b\U0001f3fb\U0001f44b\U0001f3ff", 2},
+		{"\U0001f1e8\U0001f1e6\U0001f1fa\U0001f1f8\U0001f1f2\U0001f1fd", 3},
+		{"日本語のレシート", 8},
+	}
+	for _, test := range tests {
+		if got := graphemeCount(test.s); got != test.want {
+			t.Errorf("graphemeCount(%q) = %d, want %d", test.s, got, test.want)
+		}
+	}
+}
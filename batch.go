@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A batch is processed while the client waits, so it is capped in receipts and in size; larger
+// backlogs go through jobs or imports.
+const (
+	maxBatchReceipts = 5000
+	maxBatchSize     = 32 << 20
+)
+
+// BatchResult is the outcome of one receipt of a batch: its ID and points, or why it was refused.
+// Duplicate is set for a receipt that was already stored under ID.
+type BatchResult struct {
+	ID        string            `json:"id,omitempty"`
+	Points    *int              `json:"points,omitempty"`
+	Status    string            `json:"status,omitempty"`
+	Reason    string            `json:"reason,omitempty"`
+	Duplicate bool              `json:"duplicate,omitempty"`
+	Warnings  []RuleWarning     `json:"warnings,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Errors    []ValidationIssue `json:"errors,omitempty"`
+}
+
+// processBatchHandler processes a JSON array of receipts one after the other, as if each was
+// submitted on its own, and returns their results in the same order. A refused receipt doesn't
+// stop the rest of the batch.
+func processBatchHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, tenantID, ok := authenticateSubmitter(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchSize)
+	var batch []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "The batch is too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "The batch must be a JSON array of receipts.", http.StatusBadRequest)
+		return
+	}
+	if len(batch) > maxBatchReceipts {
+		http.Error(w, fmt.Sprintf("A batch holds at most %d receipts; submit larger ones as a job.", maxBatchReceipts), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	now, ok := requestTime(w, r, tenantID)
+	if !ok {
+		return
+	}
+	results := make([]BatchResult, len(batch))
+	for i, raw := range batch {
+		results[i] = processBatchReceipt(r.Context(), raw, deviceID, tenantID, now)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func processBatchReceipt(ctx context.Context, raw json.RawMessage, deviceID, tenantID string, now time.Time) BatchResult {
+	var receipt Receipt
+	if err := json.Unmarshal(raw, &receipt); err != nil {
+		recordDeviceSubmission(deviceID, ProcessedReceipt{}, errors.New("invalid receipt JSON"))
+		return BatchResult{Error: "The receipt is invalid."}
+	}
+	if refused := checkAdmission(ctx, &receipt, deviceID); refused != nil {
+		return BatchResult{Error: refused.message, Errors: refused.errs}
+	}
+	processed, err := submitReceipt(ctx, receipt, tenantID, now)
+	recordDeviceSubmission(receipt.DeviceID, processed, err)
+	duplicate := errors.Is(err, errDuplicateReceipt)
+	switch {
+	case duplicate && duplicateResponse == duplicateConflict:
+		return BatchResult{ID: processed.ID, Error: "The receipt was already submitted."}
+	case errors.Is(err, errReplayedSignature):
+		return BatchResult{Error: "The device already signed another receipt with that nonce."}
+	case err != nil && !duplicate:
+		log.Printf("Storing receipt: %v", err)
+		return BatchResult{Error: "The receipt could not be stored."}
+	}
+
+	result := BatchResult{ID: processed.ID, Duplicate: duplicate}
+	if processed.Status != statusPendingReview {
+		result.Points = &processed.Points
+	}
+	if processed.Status != statusScored {
+		result.Status, result.Reason = processed.Status, processed.StatusReason
+	}
+	result.Warnings = receiptSkippedRules(processed)
+	return result
+}
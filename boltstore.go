@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltMetaBucket = []byte("meta")
+	// boltSchemaVersionKey holds the version of the last migration applied to the file.
+	boltSchemaVersionKey = []byte("schema-version")
+	boltReceiptsBucket   = []byte("receipts")
+	boltSandboxBucket    = []byte("sandbox-receipts")
+	boltReceiptBuckets   = [][]byte{boltReceiptsBucket, boltSandboxBucket}
+	// boltLedgerBucket holds the ledger entries keyed by their position, as big-endian uint64s, so
+	// they iterate in the order they were appended.
+	boltLedgerBucket = []byte("ledger")
+	// boltRecordsBucket holds a bucket of records per kind; see RecordStore.
+	boltRecordsBucket = []byte("records")
+)
+
+// boltMigrations are the schema of BoltDB files, in order. Bumping receiptSchemaVersion also
+// needs a step rewriting the receipts, so the file never holds records older than the release
+// reading it.
+var boltMigrations = []struct {
+	description string
+	up          func(tx *bolt.Tx) error
+}{
+	{"create the receipt buckets", func(tx *bolt.Tx) error {
+		for _, name := range boltReceiptBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"rewrite receipts at receipt schema version 2", rewriteBoltReceipts},
+	{"create the ledger bucket", func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltLedgerBucket)
+		return err
+	}},
+	{"create the records bucket", func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRecordsBucket)
+		return err
+	}},
+}
+
+// boltDB is a BoltDB file holding the production and sandbox receipt stores and the ledger, so
+// they survive restarts. Only one process can have the file open at a time.
+type boltDB struct {
+	db *bolt.DB
+}
+
+// boltStore is a ReceiptStore in one bucket of a BoltDB file.
+type boltStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// openBoltDB opens the BoltDB file at path, creating it if needed. Its stores can be used once it
+// is migrated to the latest version.
+func openBoltDB(path string) (*boltDB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o640, &bolt.Options{Timeout: 5 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("open %s: another process has it open", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	return &boltDB{db: db}, nil
+}
+
+// Close closes the file, waiting for open transactions to finish.
+func (b *boltDB) Close() error {
+	return b.db.Close()
+}
+
+func (b *boltDB) stores() (production, sandbox *boltStore) {
+	return &boltStore{db: b.db, bucket: boltReceiptsBucket}, &boltStore{db: b.db, bucket: boltSandboxBucket}
+}
+
+func (b *boltDB) migrations() []migration {
+	steps := make([]migration, len(boltMigrations))
+	for i, step := range boltMigrations {
+		steps[i] = migration{Version: i + 1, Description: step.description}
+	}
+	return steps
+}
+
+func (b *boltDB) schemaVersion() (int, error) {
+	version := 0
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = boltSchemaVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+func boltSchemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket(boltMetaBucket)
+	if meta == nil {
+		return 0, nil
+	}
+	raw := meta.Get(boltSchemaVersionKey)
+	if raw == nil {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(string(raw))
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q", raw)
+	}
+	return version, nil
+}
+
+// migrate applies each step in its own write transaction, which also records its version. Bolt
+// allows one write transaction at a time, and one process to open the file, which is the lock.
+func (b *boltDB) migrate(target int, applied func(migration)) error {
+	steps := b.migrations()
+	for {
+		var step migration
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			current, err := boltSchemaVersion(tx)
+			if err != nil || current >= target {
+				return err
+			}
+			step = steps[current]
+			if err := boltMigrations[current].up(tx); err != nil {
+				return err
+			}
+			meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+			if err != nil {
+				return err
+			}
+			return meta.Put(boltSchemaVersionKey, []byte(strconv.Itoa(step.Version)))
+		})
+		switch {
+		case err != nil && step.Version != 0:
+			return fmt.Errorf("migration %d (%s): %w", step.Version, step.Description, err)
+		case err != nil || step.Version == 0:
+			return err
+		}
+		applied(step)
+	}
+}
+
+// rewriteBoltReceipts rewrites every receipt at the current receipt schema version.
+func rewriteBoltReceipts(tx *bolt.Tx) error {
+	for _, name := range boltReceiptBuckets {
+		bucket := tx.Bucket(name)
+		migrated := map[string][]byte{}
+		err := bucket.ForEach(func(id, data []byte) error {
+			receipt, err := decodeStoredReceipt(data)
+			if err != nil {
+				return fmt.Errorf("receipt %s: %w", id, err)
+			}
+			if migrated[string(id)], err = encodeStoredReceipt(receipt); err != nil {
+				return fmt.Errorf("receipt %s: %w", id, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Buckets can't be written while they are iterated.
+		for id, data := range migrated {
+			if err := bucket.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) Put(receipt ProcessedReceipt) error {
+	data, err := encodeStoredReceipt(receipt)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(receipt.ID), data)
+	})
+}
+
+func (s *boltStore) Get(id string) (ProcessedReceipt, error) {
+	var receipt ProcessedReceipt
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(s.bucket).Get([]byte(id))
+		if data == nil {
+			return errReceiptNotFound
+		}
+		var err error
+		receipt, err = decodeStoredReceipt(data)
+		return err
+	})
+	if err != nil && !errors.Is(err, errReceiptNotFound) {
+		err = fmt.Errorf("receipt %s: %w", id, err)
+	}
+	return receipt, err
+}
+
+func (s *boltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) Count() (int, error) {
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(s.bucket).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+func (s *boltStore) List() ([]ProcessedReceipt, error) {
+	receipts := []ProcessedReceipt{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).ForEach(func(id, data []byte) error {
+			receipt, err := decodeStoredReceipt(data)
+			if err != nil {
+				return fmt.Errorf("receipt %s: %w", id, err)
+			}
+			receipts = append(receipts, receipt)
+			return nil
+		})
+	})
+	return receipts, err
+}
+
+// boltLedgerStore is the LedgerStore of a BoltDB file.
+type boltLedgerStore struct {
+	db *bolt.DB
+}
+
+func (s *boltLedgerStore) Append(entries ...LedgerEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltLedgerBucket)
+		for _, entry := range entries {
+			data, err := encodeLedgerEntry(entry)
+			if err != nil {
+				return err
+			}
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(binary.BigEndian.AppendUint64(nil, seq), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltLedgerStore) List() ([]LedgerEntry, error) {
+	entries := []LedgerEntry{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltLedgerBucket).ForEach(func(key, data []byte) error {
+			entry, err := decodeLedgerEntry(data)
+			if err != nil {
+				return fmt.Errorf("ledger entry %d: %w", binary.BigEndian.Uint64(key), err)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Reseal rewrites the entry with its new seal, finding it by ID.
+func (s *boltLedgerStore) Reseal(entry LedgerEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltLedgerBucket)
+		var key []byte
+		err := bucket.ForEach(func(k, data []byte) error {
+			stored, err := decodeLedgerEntry(data)
+			if err == nil && stored.ID == entry.ID {
+				key = append([]byte{}, k...)
+			}
+			return err
+		})
+		switch {
+		case err != nil:
+			return err
+		case key == nil:
+			return fmt.Errorf("no ledger entry %s", entry.ID)
+		}
+		data, err := encodeLedgerEntry(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+}
+
+// boltRecordStore is the RecordStore of a BoltDB file.
+type boltRecordStore struct {
+	db *bolt.DB
+}
+
+func (s *boltRecordStore) PutRecord(kind, key string, record []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(boltRecordsBucket).CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), record)
+	})
+}
+
+func (s *boltRecordStore) GetRecord(kind, key string) ([]byte, error) {
+	var record []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRecordsBucket).Bucket([]byte(kind))
+		if bucket == nil {
+			return errRecordNotFound
+		}
+		data := bucket.Get([]byte(key))
+		if data == nil {
+			return errRecordNotFound
+		}
+		record = append([]byte{}, data...)
+		return nil
+	})
+	return record, err
+}
+
+func (s *boltRecordStore) SwapRecord(kind, key string, old, new []byte) (bool, error) {
+	swapped := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(boltRecordsBucket).CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		current := bucket.Get([]byte(key))
+		if (current != nil) != (old != nil) || !bytes.Equal(current, old) {
+			return nil
+		}
+		swapped = true
+		if new == nil {
+			return bucket.Delete([]byte(key))
+		}
+		return bucket.Put([]byte(key), new)
+	})
+	return swapped && err == nil, err
+}
+
+func (s *boltRecordStore) ListRecords(kind string) (map[string][]byte, error) {
+	records := map[string][]byte{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRecordsBucket).Bucket([]byte(kind))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, data []byte) error {
+			records[string(key)] = append([]byte{}, data...)
+			return nil
+		})
+	})
+	return records, err
+}
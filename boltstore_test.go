@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// openTestBoltDB opens a BoltDB file in the test's temporary directory, migrated to the latest
+// version.
+func openTestBoltDB(t *testing.T) *boltDB {
+	t.Helper()
+	db, err := openBoltDB(filepath.Join(t.TempDir(), "receipts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrateStorage(db, -1); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestBoltMigrations(t *testing.T) {
+	db, err := openBoltDB(filepath.Join(t.TempDir(), "receipts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if version, err := db.schemaVersion(); err != nil || version != 0 {
+		t.Fatalf("schema version of a new file = %d, %v, want 0", version, err)
+	}
+	if err := migrateStorage(db, 2); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := db.schemaVersion(); version != 2 {
+		t.Errorf("schema version after migrating to 2 = %d", version)
+	}
+	if err := migrateStorage(db, -1); err != nil {
+		t.Fatal(err)
+	}
+	latest := latestMigration(db)
+	if version, _ := db.schemaVersion(); version != latest {
+		t.Errorf("schema version after migrating = %d, want the latest %d", version, latest)
+	}
+	if err := migrateStorage(db, 1); err == nil {
+		t.Error("migrating back to 1 succeeded, want an error")
+	}
+	if err := migrateStorage(db, latest+1); err == nil {
+		t.Error("migrating past the latest version succeeded, want an error")
+	}
+
+	steps := len(boltMigrations)
+	boltMigrations = boltMigrations[:steps-1]
+	defer func() { boltMigrations = boltMigrations[:steps] }()
+	if err := migrateStorage(db, -1); !errors.Is(err, errNewerSchema) {
+		t.Errorf("opening storage migrated by a later release = %v, want errNewerSchema", err)
+	}
+}
+
+func TestBoltLedgerStore(t *testing.T) {
+	resetLedger(t)
+	db := openTestBoltDB(t)
+	store := &boltLedgerStore{db: db.db}
+	if err := loadLedger(store); err != nil {
+		t.Fatal(err)
+	}
+	earnPoints(t, "alice", 100)
+	if w := redeem("alice", `{"points": 30}`, "alice", "key-1"); w.Code != http.StatusCreated {
+		t.Fatalf("redeem = %d: %s", w.Code, w.Body)
+	}
+
+	// Read back, as after a restart.
+	ledgerMu.Lock()
+	ledger = nil
+	ledgerMu.Unlock()
+	if err := loadLedger(store); err != nil {
+		t.Fatal(err)
+	}
+	if got := userBalance("alice"); got != 70 {
+		t.Errorf("balance read back = %d, want 70", got)
+	}
+	ledgerMu.Lock()
+	entries := append([]LedgerEntry{}, ledger...)
+	problems := checkLedgerLocked()
+	ledgerMu.Unlock()
+	if len(problems) > 0 {
+		t.Errorf("problems in the ledger read back: %v", problems)
+	}
+	if len(entries) != 2 || entries[1].IdempotencyKey != "key-1" || entries[1].HashVersion != ledgerHashUserBound {
+		t.Fatalf("entries read back = %+v", entries)
+	}
+
+	resealed := entries[1]
+	resealed.sealedUserID = []byte("resealed")
+	if err := store.Reseal(resealed); err != nil {
+		t.Fatal(err)
+	}
+	listed, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(listed[1].sealedUserID) != "resealed" || listed[1].Hash != entries[1].Hash {
+		t.Errorf("resealed entry = %+v, want the new seal and the same hash", listed[1])
+	}
+	if err := store.Reseal(LedgerEntry{ID: "missing"}); err == nil {
+		t.Error("resealing a missing entry succeeded, want an error")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CostRules put a monetary cost on points credited to users, so spending can be attributed to
+// the tenants and promotions (the rules named in breakdowns) that awarded it. PointCost is the
+// cost of one point, overridden per tenant by TenantPointCosts. A promotion with a budget is
+// disabled once its spend reaches the budget: later receipts don't get its points.
+type CostRules struct {
+	PointCost        string            `json:"pointCost,omitempty"`
+	TenantPointCosts map[string]string `json:"tenantPointCosts,omitempty"`
+	Budgets          []PromotionBudget `json:"budgets,omitempty"`
+
+	pointCost        *big.Rat
+	tenantPointCosts map[string]*big.Rat
+}
+
+// PromotionBudget caps the spend on a promotion for a tenant, or across all tenants when TenantID
+// is empty.
+type PromotionBudget struct {
+	Promotion string `json:"promotion"`
+	TenantID  string `json:"tenantId,omitempty"`
+	Amount    string `json:"amount"`
+
+	amount *big.Rat
+}
+
+func (c *CostRules) prepare() error {
+	var err error
+	if c.pointCost, err = parseCost(orDefault(c.PointCost, "0")); err != nil {
+		return fmt.Errorf("pointCost: %w", err)
+	}
+	c.tenantPointCosts = map[string]*big.Rat{}
+	for tenant, cost := range c.TenantPointCosts {
+		if c.tenantPointCosts[tenant], err = parseCost(cost); err != nil {
+			return fmt.Errorf("point cost of tenant %q: %w", tenant, err)
+		}
+	}
+	for i := range c.Budgets {
+		budget := &c.Budgets[i]
+		if budget.Promotion == "" {
+			return fmt.Errorf("budget %d: promotion is required", i)
+		}
+		if budget.amount, err = parseCost(budget.Amount); err != nil {
+			return fmt.Errorf("budget for %q: %w", budget.Promotion, err)
+		}
+	}
+	return nil
+}
+
+func parseCost(value string) (*big.Rat, error) {
+	cost, ok := new(big.Rat).SetString(strings.TrimSpace(value))
+	if !ok || cost.Sign() < 0 {
+		return nil, fmt.Errorf("invalid amount %q", value)
+	}
+	return cost, nil
+}
+
+func (c CostRules) pointCostFor(tenantID string) *big.Rat {
+	if cost, ok := c.tenantPointCosts[tenantID]; ok {
+		return cost
+	}
+	return c.pointCost
+}
+
+type costKey struct {
+	tenantID  string
+	promotion string
+}
+
+// promotionCost is the points a promotion credited on a number of receipts and what they cost
+// when they were awarded.
+type promotionCost struct {
+	receipts int
+	points   int
+	cost     *big.Rat
+}
+
+// costsMu guards the cost totals. It is taken under the receipt store and ledger locks, so it must
+// be the last lock taken.
+var (
+	costsMu sync.Mutex
+	costs   = map[costKey]*promotionCost{}
+	// receiptCosts is what each receipt's promotions are currently counted for.
+	receiptCosts = map[string]map[string]promotionCost{}
+)
+
+// trackReceiptCosts brings the cost totals in line with receipt's contributions, counting them only
+// while counted is set. Points keep the cost they had when awarded, so a reversal takes back
+// exactly what was added. It publishes a quota.exceeded event for each budget the receipt spent.
+func trackReceiptCosts(receipt ProcessedReceipt, counted bool) {
+	current := map[string]int{}
+	if counted {
+		for _, contribution := range receipt.Breakdown {
+			current[contribution.Rule] += contribution.Points
+		}
+	}
+
+	budgets := currentRules().Costs.Budgets
+	costsMu.Lock()
+	wasSpent := spentBudgetsLocked(budgets)
+	countReceiptCostsLocked(receipt, current)
+	var spent []PromotionBudget
+	for i, nowSpent := range spentBudgetsLocked(budgets) {
+		if nowSpent && !wasSpent[i] {
+			spent = append(spent, budgets[i])
+		}
+	}
+	costsMu.Unlock()
+
+	for _, budget := range spent {
+		data := map[string]any{
+			"promotion": budget.Promotion,
+			"budget":    budget.Amount,
+			"reason":    "the budget of promotion " + budget.Promotion + " is spent",
+		}
+		if budget.TenantID != "" {
+			data["tenantId"] = budget.TenantID
+		}
+		publishEvent(Event{Type: eventQuotaExceeded, ReceiptID: receipt.ID, Data: data})
+	}
+}
+
+// spentBudgetsLocked reports, for each budget, whether its spend reached its amount. costsMu must be
+// held.
+func spentBudgetsLocked(budgets []PromotionBudget) []bool {
+	spent := make([]bool, len(budgets))
+	for i, budget := range budgets {
+		spent[i] = budgetSpentLocked(budget).Cmp(budget.amount) >= 0
+	}
+	return spent
+}
+
+// countReceiptCostsLocked counts the points receipt's promotions currently credit in the cost
+// totals. costsMu must be held.
+func countReceiptCostsLocked(receipt ProcessedReceipt, current map[string]int) {
+	previous := receiptCosts[receipt.ID]
+	next := map[string]promotionCost{}
+	for promotion, old := range previous {
+		if current[promotion] == old.points {
+			next[promotion] = old
+			continue
+		}
+		total := costs[costKey{receipt.TenantID, promotion}]
+		total.receipts--
+		total.points -= old.points
+		total.cost.Sub(total.cost, old.cost)
+	}
+	unitCost := currentRules().Costs.pointCostFor(receipt.TenantID)
+	for promotion, points := range current {
+		if _, kept := next[promotion]; kept || points == 0 {
+			continue
+		}
+		line := promotionCost{1, points, new(big.Rat).Mul(unitCost, new(big.Rat).SetInt64(int64(points)))}
+		key := costKey{receipt.TenantID, promotion}
+		if costs[key] == nil {
+			costs[key] = &promotionCost{cost: new(big.Rat)}
+		}
+		costs[key].receipts++
+		costs[key].points += points
+		costs[key].cost.Add(costs[key].cost, line.cost)
+		next[promotion] = line
+	}
+	if len(next) == 0 {
+		delete(receiptCosts, receipt.ID)
+	} else {
+		receiptCosts[receipt.ID] = next
+	}
+}
+
+// budgetSpentLocked returns the spend counted against budget. costsMu must be held.
+func budgetSpentLocked(budget PromotionBudget) *big.Rat {
+	spent := new(big.Rat)
+	for key, total := range costs {
+		if key.promotion == budget.Promotion && (budget.TenantID == "" || key.tenantID == budget.TenantID) {
+			spent.Add(spent, total.cost)
+		}
+	}
+	return spent
+}
+
+// applyBudgets drops the contributions of promotions whose budget is exhausted for the receipt's
+// tenant.
+func applyBudgets(processed *ProcessedReceipt) {
+	var exhausted []string
+	costsMu.Lock()
+	for _, budget := range currentRules().Costs.Budgets {
+		if budget.TenantID != "" && budget.TenantID != processed.TenantID {
+			continue
+		}
+		if budgetSpentLocked(budget).Cmp(budget.amount) >= 0 {
+			exhausted = append(exhausted, budget.Promotion)
+		}
+	}
+	costsMu.Unlock()
+	if len(exhausted) > 0 {
+		processed.Breakdown = slices.DeleteFunc(processed.Breakdown, func(c Contribution) bool {
+			return slices.Contains(exhausted, c.Rule)
+		})
+	}
+}
+
+func listCostsHandler(w http.ResponseWriter, r *http.Request) {
+	type costLine struct {
+		TenantID  string `json:"tenantId"`
+		Promotion string `json:"promotion"`
+		Receipts  int    `json:"receipts"`
+		Points    int    `json:"points"`
+		Cost      string `json:"cost"`
+	}
+	costsMu.Lock()
+	list := make([]costLine, 0, len(costs))
+	for key, total := range costs {
+		list = append(list, costLine{key.tenantID, key.promotion, total.receipts, total.points, total.cost.FloatString(2)})
+	}
+	costsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].TenantID != list[j].TenantID {
+			return list[i].TenantID < list[j].TenantID
+		}
+		return list[i].Promotion < list[j].Promotion
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"costs": list})
+}
+
+// listBudgetsHandler reports how much of each promotion budget has been consumed.
+func listBudgetsHandler(w http.ResponseWriter, r *http.Request) {
+	type budgetStatus struct {
+		PromotionBudget
+		Spent     string `json:"spent"`
+		Remaining string `json:"remaining"`
+		Exhausted bool   `json:"exhausted"`
+	}
+	list := []budgetStatus{}
+	costsMu.Lock()
+	for _, budget := range currentRules().Costs.Budgets {
+		spent := budgetSpentLocked(budget)
+		remaining := new(big.Rat).Sub(budget.amount, spent)
+		if remaining.Sign() < 0 {
+			remaining.SetInt64(0)
+		}
+		list = append(list, budgetStatus{
+			PromotionBudget: budget,
+			Spent:           spent.FloatString(2),
+			Remaining:       remaining.FloatString(2),
+			Exhausted:       spent.Cmp(budget.amount) >= 0,
+		})
+	}
+	costsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"budgets": list})
+}
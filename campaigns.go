@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Campaign statuses. Campaigns are drafted, then activated; an active campaign can be paused and
+// resumed until it is ended, which is final. Only draft and paused campaigns can be edited.
+const (
+	campaignDraft  = "draft"
+	campaignActive = "active"
+	campaignPaused = "paused"
+	campaignEnded  = "ended"
+)
+
+// Campaign bundles promotions awarded to receipts it targets while it is active. Its promotions
+// appear in breakdowns as "<campaign id>:<promotion name>", so their cost is tracked like any
+// other promotion's, and the campaign stops awarding once their combined cost reaches Budget.
+type Campaign struct {
+	ID         string              `json:"id"`
+	Name       string              `json:"name"`
+	Status     string              `json:"status"`
+	Promotions []CampaignPromotion `json:"promotions"`
+	// Budget is the most the campaign may spend, in the currency of the point costs. Empty is
+	// unlimited.
+	Budget    string            `json:"budget,omitempty"`
+	Targeting CampaignTargeting `json:"targeting"`
+	// StartDate and EndDate bound the purchase dates the campaign applies to, inclusively.
+	StartDate string               `json:"startDate,omitempty"`
+	EndDate   string               `json:"endDate,omitempty"`
+	History   []CampaignTransition `json:"history"`
+
+	budget *big.Rat
+}
+
+// CampaignPromotion awards Points to each targeted receipt with at least MinTotal. A Multiplier,
+// e.g. "2" for double points, also awards the points the receipt earned before campaigns applied
+// that many times over, rounded with the promotion's rounding mode.
+type CampaignPromotion struct {
+	Name       string `json:"name"`
+	Points     int    `json:"points"`
+	Multiplier string `json:"multiplier,omitempty"`
+	MinTotal   string `json:"minTotal,omitempty"`
+
+	multiplier *big.Rat
+	minTotal   *Money
+}
+
+// CampaignTargeting limits a campaign to some tenants, retailers and tenant regions. An empty list
+// targets everyone; retailers match case-insensitively, and can be patterns with * standing for
+// any text, such as "target*".
+type CampaignTargeting struct {
+	Tenants   []string `json:"tenants,omitempty"`
+	Retailers []string `json:"retailers,omitempty"`
+	Regions   []string `json:"regions,omitempty"`
+}
+
+type CampaignTransition struct {
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+	Actor  string    `json:"actor"`
+}
+
+var campaignIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+var (
+	campaignsMu sync.RWMutex
+	campaigns   = map[string]*Campaign{}
+)
+
+func (c *Campaign) prepare() error {
+	if c.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if c.Budget != "" {
+		budget, err := parseCost(c.Budget)
+		if err != nil {
+			return fmt.Errorf("budget: %w", err)
+		}
+		c.budget = budget
+	}
+	for _, date := range []string{c.StartDate, c.EndDate} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			return fmt.Errorf("invalid date %q", date)
+		}
+	}
+	if c.StartDate != "" && c.EndDate != "" && c.EndDate < c.StartDate {
+		return fmt.Errorf("endDate is before startDate")
+	}
+	names := map[string]bool{}
+	for i := range c.Promotions {
+		promotion := &c.Promotions[i]
+		if promotion.Name == "" || names[promotion.Name] {
+			return fmt.Errorf("promotion names must be given and unique")
+		}
+		names[promotion.Name] = true
+		minTotal, err := parseOptionalMoney(promotion.MinTotal)
+		if err != nil {
+			return fmt.Errorf("promotion %q: invalid minTotal %q", promotion.Name, promotion.MinTotal)
+		}
+		promotion.minTotal = minTotal
+		promotion.multiplier = nil
+		if promotion.Multiplier != "" {
+			multiplier, ok := new(big.Rat).SetString(promotion.Multiplier)
+			if !ok || multiplier.Cmp(big.NewRat(1, 1)) < 0 {
+				return fmt.Errorf("promotion %q: multiplier %q must be a number of at least 1", promotion.Name, promotion.Multiplier)
+			}
+			promotion.multiplier = multiplier
+		}
+	}
+	for _, retailer := range c.Targeting.Retailers {
+		if _, err := path.Match(retailer, ""); err != nil {
+			return fmt.Errorf("invalid retailer pattern %q", retailer)
+		}
+	}
+	return nil
+}
+
+// matchesRetailer reports whether a retailer name or pattern of the targeting matches the
+// receipt's retailer.
+func matchesRetailer(pattern, retailer string) bool {
+	matched, _ := path.Match(strings.ToLower(strings.TrimSpace(pattern)), strings.ToLower(strings.TrimSpace(retailer)))
+	return matched
+}
+
+// targets reports whether the campaign applies to receipt, submitted to a tenant in region.
+func (c *Campaign) targets(receipt Receipt, tenantID, region string) bool {
+	if c.StartDate != "" && receipt.PurchaseDate < c.StartDate {
+		return false
+	}
+	if c.EndDate != "" && receipt.PurchaseDate > c.EndDate {
+		return false
+	}
+	if len(c.Targeting.Tenants) > 0 && !slices.Contains(c.Targeting.Tenants, tenantID) {
+		return false
+	}
+	if len(c.Targeting.Regions) > 0 && !slices.Contains(c.Targeting.Regions, region) {
+		return false
+	}
+	if len(c.Targeting.Retailers) > 0 && !slices.ContainsFunc(c.Targeting.Retailers, func(pattern string) bool {
+		return matchesRetailer(pattern, receipt.Retailer)
+	}) {
+		return false
+	}
+	return true
+}
+
+func (c *Campaign) promotionRule(promotion CampaignPromotion) string {
+	return c.ID + ":" + promotion.Name
+}
+
+// campaignStatsLocked totals what the campaign's promotions have credited. costsMu must be held.
+func campaignStatsLocked(c *Campaign) (receipts, points int, cost *big.Rat) {
+	cost = new(big.Rat)
+	prefix := c.ID + ":"
+	for key, total := range costs {
+		if strings.HasPrefix(key.promotion, prefix) {
+			points += total.points
+			cost.Add(cost, total.cost)
+		}
+	}
+	for _, lines := range receiptCosts {
+		for promotion := range lines {
+			if strings.HasPrefix(promotion, prefix) {
+				receipts++
+				break
+			}
+		}
+	}
+	return receipts, points, cost
+}
+
+// applyCampaigns adds the promotions of every active campaign that targets the receipt and still
+// has budget. Multipliers all apply to the points earned before any campaign, so campaigns don't
+// compound.
+func applyCampaigns(processed *ProcessedReceipt) {
+	region := tenantRegion(processed.TenantID)
+	total, totalOK := receiptTotal(processed.Receipt)
+	earned := int64(processed.Breakdown.Total())
+
+	campaignsMu.RLock()
+	defer campaignsMu.RUnlock()
+	ids := make([]string, 0, len(campaigns))
+	for id := range campaigns {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		campaign := campaigns[id]
+		if campaign.Status != campaignActive || !campaign.targets(processed.Receipt, processed.TenantID, region) {
+			continue
+		}
+		if campaign.budget != nil {
+			costsMu.Lock()
+			_, _, spent := campaignStatsLocked(campaign)
+			costsMu.Unlock()
+			if spent.Cmp(campaign.budget) >= 0 {
+				continue
+			}
+		}
+		for _, promotion := range campaign.Promotions {
+			if promotion.minTotal != nil && (!totalOK || total < *promotion.minTotal) {
+				continue
+			}
+			rule := campaign.promotionRule(promotion)
+			points := promotion.Points
+			mode := ""
+			if promotion.multiplier != nil {
+				mode = currentRules().roundingFor(rule)
+				extra := new(big.Rat).Sub(promotion.multiplier, big.NewRat(1, 1))
+				extra.Mul(extra, new(big.Rat).SetInt64(earned))
+				points += int(roundRatio(extra.Num().Int64(), extra.Denom().Int64(), mode))
+			}
+			if points != 0 {
+				processed.Breakdown = append(processed.Breakdown, Contribution{Rule: rule, Points: points, Rounding: mode})
+			}
+		}
+	}
+}
+
+// campaignView is a campaign with its performance so far.
+type campaignView struct {
+	*Campaign
+	Stats map[string]any `json:"stats"`
+}
+
+func viewCampaign(c *Campaign) campaignView {
+	costsMu.Lock()
+	receipts, points, cost := campaignStatsLocked(c)
+	costsMu.Unlock()
+	stats := map[string]any{"receipts": receipts, "points": points, "cost": cost.FloatString(2)}
+	if c.budget != nil {
+		remaining := new(big.Rat).Sub(c.budget, cost)
+		if remaining.Sign() < 0 {
+			remaining.SetInt64(0)
+		}
+		stats["budgetRemaining"] = remaining.FloatString(2)
+		stats["budgetExhausted"] = remaining.Sign() == 0
+	}
+	copied := *c
+	return campaignView{Campaign: &copied, Stats: stats}
+}
+
+func listCampaignsHandler(w http.ResponseWriter, r *http.Request) {
+	campaignsMu.RLock()
+	list := make([]campaignView, 0, len(campaigns))
+	for _, campaign := range campaigns {
+		list = append(list, viewCampaign(campaign))
+	}
+	campaignsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"campaigns": list})
+}
+
+func getCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	campaignsMu.RLock()
+	campaign, exists := campaigns[mux.Vars(r)["id"]]
+	var view campaignView
+	if exists {
+		view = viewCampaign(campaign)
+	}
+	campaignsMu.RUnlock()
+	if !exists {
+		http.Error(w, "No campaign found for that ID.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
+
+// putCampaignHandler creates a draft campaign or replaces the definition of a draft or paused
+// one, keeping its status and history.
+func putCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !campaignIDPattern.MatchString(id) {
+		http.Error(w, "Campaign IDs are up to 64 lowercase letters, digits and dashes.", http.StatusBadRequest)
+		return
+	}
+	var campaign Campaign
+	if err := json.NewDecoder(r.Body).Decode(&campaign); err != nil {
+		http.Error(w, "The campaign is invalid.", http.StatusBadRequest)
+		return
+	}
+	campaign.ID = id
+	if err := campaign.prepare(); err != nil {
+		http.Error(w, "The campaign is invalid: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+
+	campaignsMu.Lock()
+	statusCode := http.StatusOK
+	if existing, exists := campaigns[id]; exists {
+		if existing.Status != campaignDraft && existing.Status != campaignPaused {
+			campaignsMu.Unlock()
+			http.Error(w, "Only draft and paused campaigns can be changed.", http.StatusConflict)
+			return
+		}
+		campaign.Status, campaign.History = existing.Status, existing.History
+	} else {
+		campaign.Status = campaignDraft
+		campaign.History = []CampaignTransition{{Status: campaignDraft, At: time.Now().UTC(), Actor: adminActor(r)}}
+		statusCode = http.StatusCreated
+	}
+	campaigns[id] = &campaign
+	view := viewCampaign(&campaign)
+	campaignsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(view)
+}
+
+// deleteCampaignHandler removes a draft campaign. Campaigns that were activated are ended instead,
+// keeping their history and stats.
+func deleteCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	campaignsMu.Lock()
+	campaign, exists := campaigns[mux.Vars(r)["id"]]
+	if !exists {
+		campaignsMu.Unlock()
+		http.Error(w, "No campaign found for that ID.", http.StatusNotFound)
+		return
+	}
+	if campaign.Status != campaignDraft {
+		campaignsMu.Unlock()
+		http.Error(w, "Only draft campaigns can be deleted; end the campaign instead.", http.StatusConflict)
+		return
+	}
+	delete(campaigns, campaign.ID)
+	campaignsMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// campaignTransitions lists the statuses each action can be taken from.
+var campaignTransitions = map[string]struct {
+	from []string
+	to   string
+}{
+	"activate": {[]string{campaignDraft, campaignPaused}, campaignActive},
+	"pause":    {[]string{campaignActive}, campaignPaused},
+	"end":      {[]string{campaignDraft, campaignActive, campaignPaused}, campaignEnded},
+}
+
+// transitionCampaignHandler applies the activate, pause or end action to a campaign.
+func transitionCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	transition, ok := campaignTransitions[vars["action"]]
+	if !ok {
+		http.Error(w, "Unknown campaign action.", http.StatusNotFound)
+		return
+	}
+
+	campaignsMu.Lock()
+	campaign, exists := campaigns[vars["id"]]
+	if !exists {
+		campaignsMu.Unlock()
+		http.Error(w, "No campaign found for that ID.", http.StatusNotFound)
+		return
+	}
+	if !slices.Contains(transition.from, campaign.Status) {
+		status := campaign.Status
+		campaignsMu.Unlock()
+		http.Error(w, "A campaign can't "+vars["action"]+" while "+status+".", http.StatusConflict)
+		return
+	}
+	if transition.to == campaignActive && len(campaign.Promotions) == 0 {
+		campaignsMu.Unlock()
+		http.Error(w, "A campaign needs a promotion to be activated.", http.StatusUnprocessableEntity)
+		return
+	}
+	campaign.Status = transition.to
+	campaign.History = append(campaign.History, CampaignTransition{Status: transition.to, At: time.Now().UTC(), Actor: adminActor(r)})
+	view := viewCampaign(campaign)
+	campaignsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// storageBackends are the backends configured for each kind of storage, by kind: receipts, blobs,
+// archive, exports and locks. They are set at startup.
+var storageBackends = map[string]string{}
+
+// webhookNotifiers counts the configured notifiers that deliver to webhooks.
+func webhookNotifiers() int {
+	n := 0
+	for _, route := range notifierRoutes {
+		if _, ok := route.notifier.(webhookNotifier); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// capabilitiesHandler describes what this deployment can do, for clients to detect features
+// rather than assume them: the API versions, asynchronous processing, webhooks, receipt
+// extraction, authentication, storage backends and the optional features enabled. Subsystems the
+// service doesn't have, such as gRPC, are listed as unavailable, so clients can tell them from
+// ones they don't know about.
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	versions := []int{}
+	for version := apiVersion1; version <= latestAPIVersion; version++ {
+		versions = append(versions, version)
+	}
+	_, signed := keyRings[keyRingWebhookSigning].currentKey()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"version": serviceVersion(),
+		"apiVersions": map[string]any{
+			"supported": versions,
+			"default":   defaultAPIVersion,
+		},
+		"async": map[string]any{
+			"jobs":       !readOnly,
+			"priorities": []string{priorityRealtime, priorityStandard, priorityBackfill},
+			"callbacks":  !readOnly,
+			"imports":    !readOnly,
+		},
+		"webhooks": map[string]any{
+			"notifiers": webhookNotifiers(),
+			"signed":    signed,
+		},
+		"extraction": map[string]any{
+			"ocrText":      true,
+			"ocrImages":    false,
+			"walletPasses": true,
+			"attachments":  virusScanner != nil || allowUnscannedUploads,
+			"virusScan":    virusScanner != nil,
+		},
+		"auth": map[string]any{
+			"apiKeys":          len(apiKeys) > 0,
+			"userTokens":       userTokens != nil,
+			"submissionTokens": true,
+			"deviceKeys":       true,
+		},
+		"grpc":     false,
+		"readOnly": readOnly,
+		"storage":  storageBackends,
+		"features": enabledFeatures(),
+	})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// environment is the deployment the server runs in. Outside production, any request can set the
+// time it is handled at with X-Test-Clock, so time-based behavior can be tested end to end.
+var environment = "production"
+
+// requestTime returns the time a request for tenantID is handled at: the RFC 3339 time in its
+// X-Test-Clock header outside production or for sandbox tenants, or else the current time. It
+// writes a 400 when the header can't be used.
+func requestTime(w http.ResponseWriter, r *http.Request, tenantID string) (time.Time, bool) {
+	header := r.Header.Get("X-Test-Clock")
+	if header == "" {
+		return time.Now(), true
+	}
+	if environment == "production" && !tenantIsSandbox(tenantID) {
+		http.Error(w, "X-Test-Clock is only honored outside production and for sandbox tenants.", http.StatusBadRequest)
+		return time.Time{}, false
+	}
+	now, err := time.Parse(time.RFC3339, header)
+	if err != nil {
+		http.Error(w, "X-Test-Clock must be an RFC 3339 time, e.g. 2025-03-01T14:30:00Z.", http.StatusBadRequest)
+		return time.Time{}, false
+	}
+	return now, true
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// receipt and item mirror the receipt payload accepted by /receipts/process.
+type receipt struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Total        string `json:"total"`
+	Items        []item `json:"items"`
+	UserID       string `json:"userId,omitempty"`
+}
+
+type item struct {
+	ShortDescription string `json:"shortDescription"`
+	Price            string `json:"price"`
+}
+
+// itemDescriptions are what generated items are named, a mix of lengths so the description rule
+// fires on some of them.
+var itemDescriptions = []string{
+	"Mountain Dew 12PK", "Emils Cheese Pizza", "Knorr Creamy Chicken", "Doritos Nacho Cheese",
+	"Klarbrunn 12-PK 12 FL OZ", "Gatorade", "Whole Milk 1 Gal", "Bananas", "Sourdough Bread",
+	"Greek Yogurt", "Paper Towels 6 Roll", "Ground Coffee", "Eggs Large Dozen", "Chicken Breast",
+	"Cheddar Cheese", "Orange Juice", "Spaghetti", "Marinara Sauce", "Dish Soap", "Apples Gala",
+}
+
+// receiptGenerator makes random receipts shaped like real ones.
+type receiptGenerator struct {
+	rand        *rand.Rand
+	retailers   []string
+	minItems    int
+	maxItems    int
+	prices      string
+	priceMedian float64
+	users       int
+	from        time.Time
+}
+
+// price draws an item price from the configured distribution: lognormal, which is how shelf
+// prices are spread (mostly cheap, a long tail of expensive ones), or uniform up to twice the
+// median.
+func (g *receiptGenerator) price() int64 {
+	var price float64
+	switch g.prices {
+	case "uniform":
+		price = g.rand.Float64() * 2 * g.priceMedian
+	default:
+		price = g.priceMedian * math.Exp(0.8*g.rand.NormFloat64())
+	}
+	// Prices end in .99 or a multiple of .25 often enough for the multiple-of bonuses to
+	// fire as they do on real receipts.
+	cents := max(int64(price*100), 1)
+	switch g.rand.Intn(4) {
+	case 0:
+		cents = cents/100*100 + 99
+	case 1:
+		cents = max(cents/25*25, 25)
+	}
+	return cents
+}
+
+func (g *receiptGenerator) next() receipt {
+	r := receipt{Retailer: g.retailers[g.rand.Intn(len(g.retailers))]}
+	day := g.from.AddDate(0, 0, g.rand.Intn(365))
+	r.PurchaseDate = day.Format("2006-01-02")
+	// Shopping clusters around midday and early evening.
+	hour := min(max(int(13+3*g.rand.NormFloat64()), 0), 23)
+	r.PurchaseTime = fmt.Sprintf("%02d:%02d", hour, g.rand.Intn(60))
+	var total int64
+	for range g.minItems + g.rand.Intn(g.maxItems-g.minItems+1) {
+		cents := g.price()
+		total += cents
+		r.Items = append(r.Items, item{
+			ShortDescription: itemDescriptions[g.rand.Intn(len(itemDescriptions))],
+			Price:            formatCents(cents),
+		})
+	}
+	r.Total = formatCents(total)
+	if g.users > 0 {
+		r.UserID = fmt.Sprintf("loadgen-user-%d", g.rand.Intn(g.users))
+	}
+	return r
+}
+
+func formatCents(cents int64) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// loadResult is the outcome of one request: its status code, or 0 if it failed without a
+// response.
+type loadResult struct {
+	status  int
+	latency time.Duration
+}
+
+func loadgen(args []string) error {
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	baseURL := fs.String("url", "http://localhost:8087", "base URL of the receipt processor")
+	rps := fs.Float64("rps", 50, "target requests per second")
+	duration := fs.Duration("duration", 30*time.Second, "how long to generate load")
+	workers := fs.Int("workers", 32, "maximum requests in flight")
+	timeout := fs.Duration("timeout", 10*time.Second, "per-request timeout")
+	retailers := fs.String("retailers", "Target,Walmart,M&M Corner Market,Costco,Walgreens", "comma-separated retailers to draw from")
+	minItems := fs.Int("min-items", 1, "fewest items on a receipt")
+	maxItems := fs.Int("max-items", 8, "most items on a receipt")
+	prices := fs.String("prices", "lognormal", "item price distribution: lognormal or uniform")
+	priceMedian := fs.Float64("price-median", 4.5, "median item price")
+	users := fs.Int("users", 100, "number of distinct user IDs to spread receipts over (0 for anonymous receipts)")
+	tenant := fs.String("tenant", "", "X-Tenant-ID to submit receipts for")
+	seed := fs.Int64("seed", 0, "random seed (0 picks one from the clock)")
+	fs.Parse(args)
+
+	switch {
+	case *rps <= 0:
+		return fmt.Errorf("-rps must be positive")
+	case *workers <= 0:
+		return fmt.Errorf("-workers must be positive")
+	case *minItems < 1 || *maxItems < *minItems:
+		return fmt.Errorf("-min-items must be at least 1 and at most -max-items")
+	case *prices != "lognormal" && *prices != "uniform":
+		return fmt.Errorf("-prices must be lognormal or uniform")
+	case *priceMedian <= 0:
+		return fmt.Errorf("-price-median must be positive")
+	}
+	var retailerList []string
+	for _, retailer := range strings.Split(*retailers, ",") {
+		if retailer = strings.TrimSpace(retailer); retailer != "" {
+			retailerList = append(retailerList, retailer)
+		}
+	}
+	if len(retailerList) == 0 {
+		return fmt.Errorf("-retailers needs at least one retailer")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	generator := &receiptGenerator{
+		rand:        rand.New(rand.NewSource(*seed)),
+		retailers:   retailerList,
+		minItems:    *minItems,
+		maxItems:    *maxItems,
+		prices:      *prices,
+		priceMedian: *priceMedian,
+		users:       *users,
+		from:        time.Now().UTC().AddDate(-1, 0, 0),
+	}
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *workers},
+	}
+	endpoint := strings.TrimRight(*baseURL, "/") + "/receipts/process"
+
+	fmt.Fprintf(os.Stderr, "Sending %.0f receipts/s to %s for %s (seed %d)...\n", *rps, endpoint, *duration, *seed)
+	payloads := make(chan []byte, *workers)
+	results := make(chan loadResult, *workers)
+	var wg sync.WaitGroup
+	for range *workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for payload := range payloads {
+				results <- send(client, endpoint, *tenant, payload)
+			}
+		}()
+	}
+	var collected []loadResult
+	done := make(chan struct{})
+	go func() {
+		for result := range results {
+			collected = append(collected, result)
+		}
+		close(done)
+	}()
+
+	// Requests are paced on a fixed schedule rather than a ticker, so a slow tick doesn't lower
+	// the rate. Requests that find every worker busy and the queue full are dropped and
+	// counted: the server is slower than the target rate allows for.
+	interval := time.Duration(float64(time.Second) / *rps)
+	start := time.Now()
+	dropped := 0
+	for sent := 0; ; sent++ {
+		at := start.Add(time.Duration(sent) * interval)
+		if at.Sub(start) >= *duration {
+			break
+		}
+		time.Sleep(time.Until(at))
+		payload, _ := json.Marshal(generator.next())
+		select {
+		case payloads <- payload:
+		default:
+			dropped++
+		}
+	}
+	close(payloads)
+	wg.Wait()
+	close(results)
+	<-done
+	report(os.Stdout, collected, dropped, time.Since(start))
+	return nil
+}
+
+func send(client *http.Client, endpoint, tenant string, payload []byte) loadResult {
+	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return loadResult{}
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if tenant != "" {
+		request.Header.Set("X-Tenant-ID", tenant)
+	}
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return loadResult{latency: time.Since(start)}
+	}
+	// The body is read so the connection can be reused, and so latency covers the whole response.
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	return loadResult{status: response.StatusCode, latency: time.Since(start)}
+}
+
+// report prints the achieved rate, outcomes by status and latency percentiles.
+func report(w io.Writer, results []loadResult, dropped int, elapsed time.Duration) {
+	statuses := map[int]int{}
+	latencies := make([]time.Duration, 0, len(results))
+	var sum time.Duration
+	for _, result := range results {
+		statuses[result.status]++
+		latencies = append(latencies, result.latency)
+		sum += result.latency
+	}
+	fmt.Fprintf(w, "requests:  %d in %s (%.1f/s)\n", len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds())
+	if dropped > 0 {
+		fmt.Fprintf(w, "dropped:   %d (all workers busy; raise -workers or lower -rps)\n", dropped)
+	}
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		label := fmt.Sprint(code)
+		if code == 0 {
+			label = "failed"
+		}
+		fmt.Fprintf(w, "  %-7s  %d\n", label, statuses[code])
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(math.Ceil(p*float64(len(latencies))))-1]
+	}
+	fmt.Fprintln(w, "latency:")
+	fmt.Fprintf(w, "  min   %s\n", latencies[0])
+	fmt.Fprintf(w, "  mean  %s\n", sum/time.Duration(len(latencies)))
+	fmt.Fprintf(w, "  p50   %s\n", percentile(0.50))
+	fmt.Fprintf(w, "  p90   %s\n", percentile(0.90))
+	fmt.Fprintf(w, "  p99   %s\n", percentile(0.99))
+	fmt.Fprintf(w, "  max   %s\n", latencies[len(latencies)-1])
+}
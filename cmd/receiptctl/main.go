@@ -0,0 +1,44 @@
+// Command receiptctl is a command line companion to the receipt processor.
+//
+// Usage:
+//
+//	receiptctl <command> [flags]
+//
+// Commands:
+//
+//	loadgen   drive the API with random receipts at a target rate and report latencies
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// commands maps each subcommand to its implementation, which parses its own flags.
+var commands = map[string]func(args []string) error{
+	"loadgen": loadgen,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: receiptctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  loadgen   drive the API with random receipts at a target rate and report latencies")
+	fmt.Fprintln(os.Stderr, "run 'receiptctl <command> -h' for a command's flags")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	command, exists := commands[os.Args[1]]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "receiptctl: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "receiptctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldDifference is a receipt field that differs between the compared receipts.
+type FieldDifference struct {
+	Field string `json:"field"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
+
+// ItemDifferences pairs the items of the compared receipts by description. Items with the same
+// description in both but different prices are listed in PriceChanged.
+type ItemDifferences struct {
+	Matched      int                   `json:"matched"`
+	OnlyA        []Item                `json:"onlyA"`
+	OnlyB        []Item                `json:"onlyB"`
+	PriceChanged []ItemPriceDifference `json:"priceChanged"`
+}
+
+type ItemPriceDifference struct {
+	ShortDescription string `json:"shortDescription"`
+	A                string `json:"a"`
+	B                string `json:"b"`
+}
+
+// RuleDifference is the points a rule awarded each of the compared receipts, totalled over their
+// items, and Difference is B less A.
+type RuleDifference struct {
+	Rule       string `json:"rule"`
+	A          int    `json:"a"`
+	B          int    `json:"b"`
+	Difference int    `json:"difference"`
+}
+
+type comparedReceipt struct {
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Points int    `json:"points"`
+}
+
+var (
+	errComparedNotFound = errors.New("no receipt found for that ID")
+	errComparedInvalid  = errors.New("not a receipt ID or a receipt")
+)
+
+// resolveComparedReceipt loads one side of a comparison: a stored receipt's ID, or a receipt
+// payload, which is scored as if submitted at now without being stored.
+func resolveComparedReceipt(r *http.Request, raw json.RawMessage, now time.Time) (ProcessedReceipt, error) {
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		receipt, exists := getTenantReceipt(r, id)
+		if !exists {
+			return ProcessedReceipt{}, errComparedNotFound
+		}
+		return receipt, nil
+	}
+
+	var receipt Receipt
+	if err := json.Unmarshal(raw, &receipt); err != nil {
+		return ProcessedReceipt{}, errComparedInvalid
+	}
+	processed := processReceipt(r.Context(), receipt, tenantFromRequest(r), now)
+	processed.ID = ""
+	return processed, nil
+}
+
+func compareFields(a, b ProcessedReceipt) []FieldDifference {
+	fields := []struct{ name, a, b string }{
+		{"tenantId", a.TenantID, b.TenantID},
+		{"status", a.Status, b.Status},
+		{"statusReason", a.StatusReason, b.StatusReason},
+		{"retailer", a.Receipt.Retailer, b.Receipt.Retailer},
+		{"purchaseDate", a.Receipt.PurchaseDate, b.Receipt.PurchaseDate},
+		{"purchaseTime", a.Receipt.PurchaseTime, b.Receipt.PurchaseTime},
+		{"total", a.Receipt.Total, b.Receipt.Total},
+		{"locale", a.Receipt.Locale, b.Receipt.Locale},
+		{"language", a.Language, b.Language},
+		{"trusted", strconv.FormatBool(a.Trusted), strconv.FormatBool(b.Trusted)},
+		{"contract", contractLabel(a.Contract), contractLabel(b.Contract)},
+	}
+	differences := []FieldDifference{}
+	for _, field := range fields {
+		if field.a != field.b {
+			differences = append(differences, FieldDifference{field.name, field.a, field.b})
+		}
+	}
+	return differences
+}
+
+func contractLabel(contract *ContractRef) string {
+	if contract == nil {
+		return ""
+	}
+	return contract.ProgramID + "@" + strconv.Itoa(contract.Version)
+}
+
+// compareItems pairs items with the same trimmed description in order, so a receipt with one more
+// of an item lists just the extra one.
+func compareItems(a, b []Item) ItemDifferences {
+	differences := ItemDifferences{OnlyA: []Item{}, OnlyB: []Item{}, PriceChanged: []ItemPriceDifference{}}
+	unmatched := map[string][]Item{}
+	for _, item := range b {
+		key := strings.TrimSpace(item.ShortDescription)
+		unmatched[key] = append(unmatched[key], item)
+	}
+	for _, item := range a {
+		key := strings.TrimSpace(item.ShortDescription)
+		candidates := unmatched[key]
+		if len(candidates) == 0 {
+			differences.OnlyA = append(differences.OnlyA, item)
+			continue
+		}
+		differences.Matched++
+		if candidates[0].Price != item.Price {
+			differences.PriceChanged = append(differences.PriceChanged, ItemPriceDifference{key, item.Price, candidates[0].Price})
+		}
+		unmatched[key] = candidates[1:]
+	}
+	for _, item := range b {
+		key := strings.TrimSpace(item.ShortDescription)
+		if len(unmatched[key]) > 0 {
+			differences.OnlyB = append(differences.OnlyB, unmatched[key][0])
+			unmatched[key] = unmatched[key][1:]
+		}
+	}
+	return differences
+}
+
+func compareRules(a, b Breakdown) []RuleDifference {
+	totals := map[string]*RuleDifference{}
+	rule := func(name string) *RuleDifference {
+		if totals[name] == nil {
+			totals[name] = &RuleDifference{Rule: name}
+		}
+		return totals[name]
+	}
+	for _, contribution := range a {
+		rule(contribution.Rule).A += contribution.Points
+	}
+	for _, contribution := range b {
+		rule(contribution.Rule).B += contribution.Points
+	}
+	differences := make([]RuleDifference, 0, len(totals))
+	for _, total := range totals {
+		total.Difference = total.B - total.A
+		differences = append(differences, *total)
+	}
+	sort.Slice(differences, func(i, j int) bool { return differences[i].Rule < differences[j].Rule })
+	return differences
+}
+
+// compareReceiptsHandler diffs two receipts, each given as a stored receipt's ID or as a receipt
+// payload, for support to explain why one earned more than the other.
+func compareReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		A json.RawMessage `json:"a"`
+		B json.RawMessage `json:"b"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.A == nil || request.B == nil {
+		http.Error(w, `The request must give the receipts to compare as "a" and "b".`, http.StatusBadRequest)
+		return
+	}
+	now, ok := requestTime(w, r, tenantFromRequest(r))
+	if !ok {
+		return
+	}
+	a, err := resolveComparedReceipt(r, request.A, now)
+	var b ProcessedReceipt
+	if err == nil {
+		b, err = resolveComparedReceipt(r, request.B, now)
+	}
+	switch {
+	case errors.Is(err, errComparedNotFound):
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "Each receipt must be given as a receipt ID or a receipt.", http.StatusBadRequest)
+	default:
+		writeComparison(w, a, b)
+	}
+}
+
+func writeComparison(w http.ResponseWriter, a, b ProcessedReceipt) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"a":                comparedReceipt{a.ID, a.Status, a.Points},
+		"b":                comparedReceipt{b.ID, b.Status, b.Points},
+		"pointsDifference": b.Points - a.Points,
+		"fields":           compareFields(a, b),
+		"items":            compareItems(a.Receipt.Items, b.Receipt.Items),
+		"rules":            compareRules(a.Breakdown, b.Breakdown),
+	})
+}
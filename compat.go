@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// readOnly is set when the instance must not write to its storage: when asked to with -read-only,
+// or when the storage was migrated by a later release that this one may not write compatibly,
+// as happens while a blue/green rollout is staggered.
+var readOnly bool
+
+var errStorageReadOnly = errors.New("storage is read-only")
+
+// readOnlyRequests are the requests that don't write to storage despite their method, so they are
+// still served in read-only mode.
+var readOnlyRequests = map[string]bool{
+	"POST /receipts/validate": true,
+	"POST /receipts/score":    true,
+	"POST /receipts/compare":  true,
+	"POST /admin/selftest":    true,
+}
+
+// readOnlyStore is a ReceiptStore that refuses writes.
+type readOnlyStore struct {
+	ReceiptStore
+}
+
+func (readOnlyStore) Put(ProcessedReceipt) error { return errStorageReadOnly }
+func (readOnlyStore) Delete(string) error        { return errStorageReadOnly }
+
+// Count counts the receipts of the underlying store.
+func (s readOnlyStore) Count() (int, error) { return storeSize(s.ReceiptStore) }
+
+// enterReadOnlyMode stops the receipt stores from being written.
+func enterReadOnlyMode() {
+	readOnly = true
+	receiptStore = readOnlyStore{receiptStore}
+	sandboxStore = readOnlyStore{sandboxStore}
+}
+
+// readOnlyGuard rejects requests that could write while the instance is read-only, rather than
+// letting them fail part way through.
+func readOnlyGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if readOnly && !readOnlyRequests[r.Method+" "+r.URL.Path] {
+				http.Error(w, "The server is read-only; changes can't be made right now.", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errReceiptRejected   = errors.New("receipt was rejected")
+	errInvalidCorrection = errors.New("corrected receipt is invalid")
+)
+
+// ExtractionCorrection holds the receipt fields a client wants to fix. Fields left out are kept.
+type ExtractionCorrection struct {
+	Retailer     *string `json:"retailer"`
+	PurchaseDate *string `json:"purchaseDate"`
+	PurchaseTime *string `json:"purchaseTime"`
+	Total        *string `json:"total"`
+	Items        *[]Item `json:"items"`
+	Source       string  `json:"source,omitempty"`
+}
+
+// CorrectionLogEntry records one corrected field, keyed by the retailer as originally extracted
+// so corrections can be grouped when improving extraction for that retailer.
+type CorrectionLogEntry struct {
+	ReceiptID string    `json:"receiptId"`
+	TenantID  string    `json:"tenantId"`
+	Retailer  string    `json:"retailer"`
+	Field     string    `json:"field"`
+	Before    any       `json:"before"`
+	After     any       `json:"after"`
+	Source    string    `json:"source,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+var (
+	correctionsMu  sync.RWMutex
+	correctionsLog []CorrectionLogEntry
+)
+
+// correctExtractionHandler applies corrections to a receipt's extracted fields and re-evaluates it.
+// Rejected receipts can't be corrected, and corrections are validated like submitted receipts.
+func correctExtractionHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var correction ExtractionCorrection
+	if err := json.NewDecoder(r.Body).Decode(&correction); err != nil {
+		http.Error(w, "The correction is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	var entries []CorrectionLogEntry
+	var invalid []ValidationIssue
+	receipt, err := updateReceipt(id, func(receipt *ProcessedReceipt) error {
+		if !tenantCanAccess(r, *receipt) || !userCanAccess(r, *receipt) || receipt.DeletedAt != nil {
+			return errReceiptNotFound
+		}
+		if receipt.Status == statusRejected {
+			return errReceiptRejected
+		}
+		entries = applyCorrection(receipt, correction)
+		if len(entries) > 0 {
+			if errs, _ := validateReceipt(receipt.Receipt, time.Now()); len(errs) > 0 {
+				invalid = errs
+				return errInvalidCorrection
+			}
+			// The device only vouched for the receipt as it was submitted.
+			receipt.Receipt.Signature = ""
+			evaluateReceipt(receipt)
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errReceiptNotFound):
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	case errors.Is(err, errReceiptRejected):
+		http.Error(w, "The receipt was rejected and can't be corrected.", http.StatusConflict)
+		return
+	case errors.Is(err, errInvalidCorrection):
+		writeValidationErrors(w, invalid)
+		return
+	case errors.Is(err, errReceiptArchived):
+		writeReceiptRetrieving(w, id)
+		return
+	case err != nil:
+		log.Printf("Correcting receipt %s: %v", id, err)
+		http.Error(w, "The correction could not be saved.", http.StatusInternalServerError)
+		return
+	}
+
+	if len(entries) > 0 {
+		correctionsMu.Lock()
+		correctionsLog = append(correctionsLog, entries...)
+		correctionsMu.Unlock()
+
+		fields := make([]string, len(entries))
+		for i, entry := range entries {
+			fields[i] = entry.Field
+		}
+		switch receipt.Status {
+		case statusPendingReview:
+			publishReceiptEvent(eventReceiptFlagged, receipt, map[string]any{"reason": receipt.StatusReason})
+		default:
+			publishReceiptEvent(eventReceiptReprocessed, receipt, map[string]any{"corrected": fields})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":        receipt.ID,
+		"status":    receipt.Status,
+		"points":    receipt.Points,
+		"corrected": len(entries),
+	})
+}
+
+// applyCorrection updates the receipt's fields and returns a log entry for each field that changed.
+func applyCorrection(receipt *ProcessedReceipt, correction ExtractionCorrection) []CorrectionLogEntry {
+	now := time.Now().UTC()
+	retailer := receipt.Receipt.Retailer
+
+	var entries []CorrectionLogEntry
+	record := func(field string, before, after any) {
+		entries = append(entries, CorrectionLogEntry{
+			ReceiptID: receipt.ID,
+			TenantID:  receipt.TenantID,
+			Retailer:  retailer,
+			Field:     field,
+			Before:    before,
+			After:     after,
+			Source:    correction.Source,
+			Time:      now,
+		})
+	}
+	correctString := func(field string, target *string, value *string) {
+		if value != nil && *value != *target {
+			record(field, *target, *value)
+			*target = *value
+		}
+	}
+
+	correctString("retailer", &receipt.Receipt.Retailer, correction.Retailer)
+	correctString("purchaseDate", &receipt.Receipt.PurchaseDate, correction.PurchaseDate)
+	correctString("purchaseTime", &receipt.Receipt.PurchaseTime, correction.PurchaseTime)
+	correctString("total", &receipt.Receipt.Total, correction.Total)
+	if correction.Items != nil {
+		before, _ := json.Marshal(receipt.Receipt.Items)
+		after, _ := json.Marshal(*correction.Items)
+		if string(before) != string(after) {
+			record("items", receipt.Receipt.Items, *correction.Items)
+			receipt.Receipt.Items = *correction.Items
+		}
+	}
+	return entries
+}
+
+func listCorrectionsHandler(w http.ResponseWriter, r *http.Request) {
+	retailer := r.URL.Query().Get("retailer")
+
+	correctionsMu.RLock()
+	entries := []CorrectionLogEntry{}
+	for _, entry := range correctionsLog {
+		if retailer == "" || strings.EqualFold(entry.Retailer, retailer) {
+			entries = append(entries, entry)
+		}
+	}
+	correctionsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"corrections": entries})
+}
@@ -0,0 +1,51 @@
+package main
+
+import "time"
+
+// Data-quality flags, set on receipts scored on incomplete or uncertain data so consumers can tell
+// a genuinely low score from one the rules couldn't fully apply to.
+const (
+	// flagTotalMissing is set when the receipt has no total the rules could read, so the rules of
+	// the total awarded nothing.
+	flagTotalMissing = "parsed-total-missing"
+	// flagTimeMissing is set when the receipt has no purchase time, so no time window applied.
+	flagTimeMissing = "time-missing"
+	// flagOCRLowConfidence is set when the receipt was extracted from OCR text with a confidence
+	// under ocrConfidenceThreshold.
+	flagOCRLowConfidence = "ocr-low-confidence"
+)
+
+// ocrConfidenceThreshold is the lowest extraction confidence at which a receipt isn't flagged.
+var ocrConfidenceThreshold = 0.8
+
+// dataQualityFlags returns the data-quality flags of a receipt, or nil when it has none.
+func dataQualityFlags(receipt Receipt) []string {
+	var flags []string
+	if _, ok := receiptTotal(receipt); !ok {
+		flags = append(flags, flagTotalMissing)
+	}
+	if _, err := time.Parse("15:04", receipt.PurchaseTime); err != nil {
+		flags = append(flags, flagTimeMissing)
+	}
+	if receipt.OCRConfidence != nil && *receipt.OCRConfidence < ocrConfidenceThreshold {
+		flags = append(flags, flagOCRLowConfidence)
+	}
+	return flags
+}
+
+// extractionConfidence is how confident the extraction of receipt is, from 0 to 1: the share of
+// the purchase date, time, total and items the template found, scaled by the confidence of a fuzzy
+// retailer match.
+func extractionConfidence(receipt Receipt, match *RetailerMatch) float64 {
+	found := 0
+	for _, present := range []bool{receipt.PurchaseDate != "", receipt.PurchaseTime != "", receipt.Total != "", len(receipt.Items) > 0} {
+		if present {
+			found++
+		}
+	}
+	confidence := float64(found) / 4
+	if match != nil && match.Method == "fuzzy" {
+		confidence *= match.Confidence
+	}
+	return float64(int(confidence*100+0.5)) / 100
+}
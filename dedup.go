@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Responses to a receipt submitted again, chosen with -duplicate-response.
+const (
+	duplicateExisting = "existing"
+	duplicateConflict = "conflict"
+)
+
+// duplicateResponse is how a receipt submitted again is answered: with the stored receipt's ID, as
+// if it was just processed, or with 409 Conflict.
+var duplicateResponse = duplicateExisting
+
+// errDuplicateReceipt is returned with the stored receipt when the same receipt is submitted again.
+var errDuplicateReceipt = errors.New("the receipt was already submitted")
+
+// contentHashKind is the kind of the records of the receipt each tenant's content hash is stored
+// under, keyed by contentKey. The record store keeps one record per key, so instances sharing it
+// store one receipt per content.
+const contentHashKind = "content-hash"
+
+// contentClaimTimeout is how long a claim on a content hash waits for its receipt to be stored.
+// A claim whose receipt isn't stored by then was abandoned, e.g. by an instance that stopped, and
+// is taken over.
+const contentClaimTimeout = 10 * time.Second
+
+// contentClaim is the record of a content hash: the receipt stored, or being stored, under it.
+type contentClaim struct {
+	ReceiptID string    `json:"receiptId"`
+	ClaimedAt time.Time `json:"claimedAt"`
+}
+
+// contentLocks serialize the submissions of the same content to the instance, each taking the
+// lock its hash falls on, so they don't contend for its record.
+var contentLocks [64]sync.Mutex
+
+// receiptContentHash is the SHA-256 of a receipt's canonical form: as scored, with spaces around its
+// retailer and item descriptions trimmed, and without its signature and OCR confidence, which don't
+// change what was bought.
+func receiptContentHash(receipt Receipt) string {
+	receipt.Retailer = strings.TrimSpace(receipt.Retailer)
+	receipt.Signature = ""
+	receipt.OCRConfidence = nil
+	items := make([]Item, len(receipt.Items))
+	for i, item := range receipt.Items {
+		items[i] = Item{ShortDescription: strings.TrimSpace(item.ShortDescription), Price: item.Price}
+	}
+	receipt.Items = items
+	data, _ := json.Marshal(receipt)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func contentKey(tenantID, hash string) string {
+	return tenantID + "/" + hash
+}
+
+// claimContent claims the tenant's content hash for the receipt with id, about to be stored. If
+// the tenant has a receipt with the content stored, and not deleted since, it is returned with
+// errDuplicateReceipt instead. Archived receipts count as stored. release gives up the claim if
+// the receipt isn't stored after all.
+func claimContent(tenantID, hash, id string) (release func(), stored ProcessedReceipt, err error) {
+	key := contentKey(tenantID, hash)
+	claim, err := json.Marshal(contentClaim{ReceiptID: id, ClaimedAt: time.Now().UTC()})
+	if err != nil {
+		return nil, ProcessedReceipt{}, err
+	}
+	for deadline := time.Now().Add(2 * contentClaimTimeout); time.Now().Before(deadline); {
+		current, err := recordStore.GetRecord(contentHashKind, key)
+		switch {
+		case errors.Is(err, errRecordNotFound):
+			current = nil
+		case err != nil:
+			return nil, ProcessedReceipt{}, err
+		default:
+			var held contentClaim
+			if err := json.Unmarshal(current, &held); err != nil {
+				return nil, ProcessedReceipt{}, fmt.Errorf("content hash %s: %w", key, err)
+			}
+			_, stored, err := findStoredReceipt(held.ReceiptID)
+			switch {
+			case err == nil && stored.DeletedAt == nil:
+				return nil, stored, errDuplicateReceipt
+			case err != nil && !errors.Is(err, errReceiptNotFound):
+				return nil, ProcessedReceipt{}, err
+			case err != nil && time.Since(held.ClaimedAt) < contentClaimTimeout:
+				// Another submission of the content is storing its receipt.
+				time.Sleep(20 * time.Millisecond)
+				continue
+			}
+		}
+		swapped, err := recordStore.SwapRecord(contentHashKind, key, current, claim)
+		if err != nil {
+			return nil, ProcessedReceipt{}, err
+		}
+		if swapped {
+			return func() {
+				if _, err := recordStore.SwapRecord(contentHashKind, key, claim, nil); err != nil {
+					log.Printf("Releasing content hash %s: %v", key, err)
+				}
+			}, ProcessedReceipt{}, nil
+		}
+	}
+	return nil, ProcessedReceipt{}, fmt.Errorf("content hash %s: too many submissions at once", key)
+}
+
+// lockContent takes the lock of the receipt's content, held while checking that the tenant doesn't
+// have it stored yet and storing it, and returns its hash and the function releasing the lock.
+func lockContent(receipt Receipt) (hash string, unlock func()) {
+	hash = receiptContentHash(receipt)
+	b, _ := strconv.ParseUint(hash[:2], 16, 8)
+	lock := &contentLocks[int(b)%len(contentLocks)]
+	lock.Lock()
+	return hash, lock.Unlock
+}
+
+// indexContentHashes records the content hash of the stored receipts that have none at startup,
+// such as those stored before hashes were kept in the store. The content of archived receipts is
+// read from the archive tier.
+func indexContentHashes() error {
+	records, err := recordStore.ListRecords(contentHashKind)
+	if err != nil {
+		return err
+	}
+	indexed := make(map[string]bool, len(records))
+	for _, record := range records {
+		var claim contentClaim
+		if json.Unmarshal(record, &claim) == nil {
+			indexed[claim.ReceiptID] = true
+		}
+	}
+	for _, store := range []ReceiptStore{receiptStore, sandboxStore} {
+		for _, receipt := range listStore(store) {
+			if receipt.DeletedAt != nil || indexed[receipt.ID] {
+				continue
+			}
+			if isArchived(receipt) {
+				hydrated, err := hydrateArchivedReceipt(receipt)
+				if err != nil {
+					log.Printf("Indexing archived receipt %s by content: %v", receipt.ID, err)
+					continue
+				}
+				receipt = hydrated
+			}
+			key := contentKey(receipt.TenantID, receiptContentHash(openIdentifiers(receipt).Receipt))
+			claim, err := json.Marshal(contentClaim{ReceiptID: receipt.ID, ClaimedAt: receipt.ProcessedAt})
+			if err != nil {
+				return err
+			}
+			if _, err := recordStore.SwapRecord(contentHashKind, key, nil, claim); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeDuplicateReceipt refuses a receipt submitted again with 409 Conflict and the ID it is stored
+// under.
+func writeDuplicateReceipt(w http.ResponseWriter, stored ProcessedReceipt) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]any{"error": "The receipt was already submitted.", "id": stored.ID})
+}
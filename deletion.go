@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// restoreWindow is how long a deleted receipt can be restored before the sweeper removes it for good.
+var restoreWindow = 30 * 24 * time.Hour
+
+var (
+	errReceiptDeleted    = errors.New("receipt is deleted")
+	errReceiptNotDeleted = errors.New("receipt is not deleted")
+	errRestoreExpired    = errors.New("restore window has passed")
+	errLegalHold         = errors.New("receipt is under legal hold")
+)
+
+// deleteReceiptHandler soft-deletes a receipt. It disappears from the API and balances but keeps its
+// points and attachments until the restore window passes.
+func deleteReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	now, ok := requestTime(w, r, tenantFromRequest(r))
+	if !ok {
+		return
+	}
+	receipt, err := updateReceipt(id, func(receipt *ProcessedReceipt) error {
+		if !tenantCanAccess(r, *receipt) || !userCanAccess(r, *receipt) || receipt.DeletedAt != nil {
+			return errReceiptNotFound
+		}
+		if underLegalHold(*receipt) {
+			return errLegalHold
+		}
+		deletedAt := now.UTC()
+		receipt.DeletedAt = &deletedAt
+		return nil
+	})
+	switch {
+	case errors.Is(err, errLegalHold):
+		http.Error(w, "The receipt is under legal hold and can't be deleted.", http.StatusConflict)
+		return
+	case errors.Is(err, errReceiptNotFound):
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	case errors.Is(err, errReceiptArchived):
+		writeReceiptRetrieving(w, id)
+		return
+	case err != nil:
+		log.Printf("Deleting receipt %s: %v", id, err)
+		http.Error(w, "The receipt could not be deleted.", http.StatusInternalServerError)
+		return
+	}
+
+	restorableUntil := receipt.DeletedAt.Add(restoreWindow)
+	publishReceiptEvent(eventReceiptDeleted, receipt, map[string]any{"restorableUntil": restorableUntil})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"id": receipt.ID, "restorableUntil": restorableUntil})
+}
+
+func restoreReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	now, ok := requestTime(w, r, tenantFromRequest(r))
+	if !ok {
+		return
+	}
+	receipt, err := updateReceipt(id, func(receipt *ProcessedReceipt) error {
+		switch {
+		case !tenantCanAccess(r, *receipt) || !userCanAccess(r, *receipt):
+			return errReceiptNotFound
+		case receipt.DeletedAt == nil:
+			return errReceiptNotDeleted
+		case now.Sub(*receipt.DeletedAt) > restoreWindow && !underLegalHold(*receipt):
+			return errRestoreExpired
+		}
+		receipt.DeletedAt = nil
+		return nil
+	})
+	switch {
+	case errors.Is(err, errReceiptNotFound):
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	case errors.Is(err, errReceiptNotDeleted):
+		http.Error(w, "The receipt is not deleted.", http.StatusConflict)
+		return
+	case errors.Is(err, errRestoreExpired):
+		http.Error(w, "The restore window for the receipt has passed.", http.StatusGone)
+		return
+	case errors.Is(err, errReceiptArchived):
+		writeReceiptRetrieving(w, id)
+		return
+	case err != nil:
+		log.Printf("Restoring receipt %s: %v", id, err)
+		http.Error(w, "The receipt could not be restored.", http.StatusInternalServerError)
+		return
+	}
+
+	publishReceiptEvent(eventReceiptRestored, receipt, nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"id": receipt.ID, "status": receipt.Status, "points": receipt.Points})
+}
+
+// startDeletionSweeper periodically hard-deletes receipts whose restore window has passed, along
+// with their attachment files. Receipts under legal hold are kept until the hold is released.
+func startDeletionSweeper(interval time.Duration) {
+	scheduleTask("deletion-sweep", interval, sweepDeletedReceipts)
+}
+
+func sweepDeletedReceipts() {
+	for _, receipt := range listReceipts() {
+		if receipt.DeletedAt == nil || time.Since(*receipt.DeletedAt) <= restoreWindow {
+			continue
+		}
+		purged, err := purgeReceipt(receipt.ID, func(receipt ProcessedReceipt) bool {
+			return receipt.DeletedAt != nil && time.Since(*receipt.DeletedAt) > restoreWindow && !underLegalHold(receipt)
+		})
+		if err != nil {
+			continue
+		}
+		deleteAttachmentBlobs(purged)
+		if purged.Archive != nil {
+			if err := archiveTier.Delete(context.Background(), purged.Archive.Key); err != nil {
+				log.Printf("Deleting archived record of receipt %s: %v", purged.ID, err)
+			}
+		}
+		log.Printf("Purged receipt %s deleted at %s", purged.ID, purged.DeletedAt.Format(time.RFC3339))
+	}
+}
+
+// deleteAttachmentBlobs removes the files of a purged receipt's attachments and their variants.
+func deleteAttachmentBlobs(purged ProcessedReceipt) {
+	for _, attachment := range purged.Attachments {
+		keys := []string{attachment.BlobKey}
+		for _, variant := range attachment.Variants {
+			keys = append(keys, variant.BlobKey)
+		}
+		for _, key := range keys {
+			if err := blobStore.Delete(context.Background(), key); err != nil {
+				log.Printf("Deleting blob %s of receipt %s: %v", key, purged.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DeprecationsConfig lists the deprecated routes.
+type DeprecationsConfig struct {
+	Deprecations []Deprecation `json:"deprecations"`
+}
+
+// Deprecation marks a route as deprecated: Route is its method and path template, e.g.
+// "GET /receipts/{id}/points", and APIVersion, when set, limits the deprecation to the requests
+// served in that API version. Successor and Link are URLs of what replaces it and of the
+// announcement. Once Sunset has passed, the route is 410 Gone if Enforce is set, and keeps being
+// served, still announced, otherwise.
+type Deprecation struct {
+	Route      string     `json:"route"`
+	APIVersion int        `json:"apiVersion,omitempty"`
+	Since      time.Time  `json:"since"`
+	Sunset     *time.Time `json:"sunset,omitempty"`
+	Successor  string     `json:"successor,omitempty"`
+	Link       string     `json:"link,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	Enforce    bool       `json:"enforce,omitempty"`
+}
+
+// deprecations are the deprecated routes, in the order configured.
+var deprecations []Deprecation
+
+func loadDeprecationsConfig(path string) ([]Deprecation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg DeprecationsConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, deprecation := range cfg.Deprecations {
+		if deprecation.Since.IsZero() {
+			return nil, fmt.Errorf("%s: deprecation of %q: since is required", path, deprecation.Route)
+		}
+		if deprecation.Sunset != nil && deprecation.Sunset.Before(deprecation.Since) {
+			return nil, fmt.Errorf("%s: deprecation of %q: sunset is before since", path, deprecation.Route)
+		}
+		if deprecation.APIVersion < 0 || deprecation.APIVersion > latestAPIVersion {
+			return nil, fmt.Errorf("%s: deprecation of %q: unknown apiVersion %d", path, deprecation.Route, deprecation.APIVersion)
+		}
+	}
+	return cfg.Deprecations, nil
+}
+
+// checkDeprecatedRoutes fails if a deprecation names a route the router doesn't have, as a typo
+// would otherwise leave the route silently undeprecated.
+func checkDeprecatedRoutes(router *mux.Router) error {
+	routes := map[string]bool{}
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			routes[method+" "+template] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, deprecation := range deprecations {
+		if !routes[deprecation.Route] {
+			return fmt.Errorf("deprecated route %q does not exist; routes are written as \"GET /receipts/{id}/points\"", deprecation.Route)
+		}
+	}
+	return nil
+}
+
+// deprecationOf returns the deprecation of a route in an API version, if it is deprecated.
+func deprecationOf(route string, version int) (Deprecation, bool) {
+	for _, deprecation := range deprecations {
+		if deprecation.Route == route && (deprecation.APIVersion == 0 || deprecation.APIVersion == version) {
+			return deprecation, true
+		}
+	}
+	return Deprecation{}, false
+}
+
+type deprecatedSeries struct {
+	route  string
+	apiKey string
+}
+
+var (
+	deprecatedMu       sync.Mutex
+	deprecatedRequests = map[deprecatedSeries]uint64{}
+)
+
+// announceDeprecations adds the Deprecation, Sunset and Link headers to the responses of
+// deprecated routes and counts their requests by API key, so their remaining users are known
+// before they are retired. Past an enforced sunset, the route is 410 Gone. It is router
+// middleware and must run after requireAPIKey.
+func announceDeprecations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(deprecations) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		route = r.Method + " " + route
+		deprecation, deprecated := deprecationOf(route, requestAPIVersion(r))
+		if !deprecated {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		apiKey := ""
+		if entry, ok := r.Context().Value(requestEntryKey{}).(*requestEntry); ok {
+			apiKey = entry.apiKey
+		}
+		deprecatedMu.Lock()
+		deprecatedRequests[deprecatedSeries{route, apiKey}]++
+		deprecatedMu.Unlock()
+
+		header := w.Header()
+		header.Set("Deprecation", "@"+strconv.FormatInt(deprecation.Since.Unix(), 10))
+		if deprecation.Sunset != nil {
+			header.Set("Sunset", deprecation.Sunset.UTC().Format(http.TimeFormat))
+		}
+		if deprecation.Successor != "" {
+			header.Add("Link", "<"+deprecation.Successor+`>; rel="successor-version"`)
+		}
+		if deprecation.Link != "" {
+			header.Add("Link", "<"+deprecation.Link+`>; rel="deprecation"`)
+		}
+		if deprecation.Enforce && deprecation.Sunset != nil && time.Now().After(*deprecation.Sunset) {
+			message := "This route was retired on " + deprecation.Sunset.UTC().Format(time.DateOnly) + "."
+			if deprecation.Message != "" {
+				message += " " + deprecation.Message
+			}
+			http.Error(w, message, http.StatusGone)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeDeprecationMetrics writes the requests to deprecated routes by route and API key, the key
+// being empty for requests made without one.
+func writeDeprecationMetrics(b *strings.Builder) {
+	deprecatedMu.Lock()
+	defer deprecatedMu.Unlock()
+	b.WriteString("# HELP receipt_processor_deprecated_requests_total Requests to deprecated routes, by route and API key.\n")
+	b.WriteString("# TYPE receipt_processor_deprecated_requests_total counter\n")
+	series := make([]deprecatedSeries, 0, len(deprecatedRequests))
+	for s := range deprecatedRequests {
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].route != series[j].route {
+			return series[i].route < series[j].route
+		}
+		return series[i].apiKey < series[j].apiKey
+	})
+	for _, s := range series {
+		fmt.Fprintf(b, "receipt_processor_deprecated_requests_total{route=%q,api_key=%q} %d\n", s.route, s.apiKey, deprecatedRequests[s])
+	}
+}
+
+// listDeprecationsHandler returns the deprecated routes, for clients to check what they use.
+func listDeprecationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"deprecations": append([]Deprecation{}, deprecations...)})
+}
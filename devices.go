@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Device types.
+const (
+	devicePOS   = "pos"
+	deviceKiosk = "kiosk"
+)
+
+// Device is a POS terminal or kiosk that submits receipts. Devices authenticate with their API key
+// in the X-Device-Key header, and receipts signed with a device's public key are trusted.
+type Device struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name,omitempty"`
+	Type         string            `json:"type"`
+	TenantID     string            `json:"tenantId"`
+	PublicKey    ed25519.PublicKey `json:"publicKey,omitempty"`
+	RegisteredAt time.Time         `json:"registeredAt"`
+	Stats        DeviceStats       `json:"stats"`
+	// keyHash is the SHA-256 of the device's API key, which is only shown when it is issued.
+	keyHash string
+}
+
+// DeviceStats counts a device's submissions so a misconfigured terminal stands out. Errors are
+// submissions that were refused or failed signature verification.
+type DeviceStats struct {
+	Submitted        int       `json:"submitted"`
+	Scored           int       `json:"scored"`
+	Flagged          int       `json:"flagged"`
+	Errors           int       `json:"errors"`
+	LastSubmissionAt time.Time `json:"lastSubmissionAt,omitzero"`
+	LastError        string    `json:"lastError,omitempty"`
+	LastErrorAt      time.Time `json:"lastErrorAt,omitzero"`
+}
+
+// signatureFailedReason prefixes the review reason of receipts whose signature can't be verified.
+const signatureFailedReason = "signature verification failed"
+
+var (
+	devicesMu sync.RWMutex
+	devices   = map[string]*Device{}
+	// deviceKeys maps API key hashes to device IDs.
+	deviceKeys = map[string]string{}
+)
+
+var (
+	errUnknownDevice     = errors.New("the device is not registered")
+	errInvalidSignature  = errors.New("the signature does not match the receipt")
+	errInvalidDeviceKey  = errors.New("invalid device credentials")
+	errDeviceKeyMismatch = errors.New("the receipt's deviceId does not match the device credentials")
+	errMissingNonce      = errors.New("the signed receipt has no nonce")
+	errReplayedSignature = errors.New("the device already signed another receipt with the nonce")
+)
+
+// deviceNonceKind is the kind of the records of the nonces devices signed receipts with, keyed by
+// device and nonce, holding the tenant and content hash of the receipt signed.
+const deviceNonceKind = "device-nonce"
+
+// signedReceiptPayload is the message a POS device signs: the receipt's fields, one per line, with
+// each item as its description and price separated by a tab.
+func signedReceiptPayload(receipt Receipt) []byte {
+	var b strings.Builder
+	for _, field := range []string{receipt.DeviceID, receipt.Nonce, receipt.UserID, receipt.Retailer, receipt.PurchaseDate, receipt.PurchaseTime, receipt.Total} {
+		b.WriteString(field)
+		b.WriteByte('\n')
+	}
+	for _, item := range receipt.Items {
+		b.WriteString(item.ShortDescription)
+		b.WriteByte('\t')
+		b.WriteString(item.Price)
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// verifyReceiptSignature reports whether the receipt carries a valid signature from a registered
+// device. Unsigned receipts are simply untrusted; a signature that can't be verified is an error.
+func verifyReceiptSignature(receipt Receipt) (bool, error) {
+	if receipt.Signature == "" {
+		return false, nil
+	}
+	devicesMu.RLock()
+	var key ed25519.PublicKey
+	if device, exists := devices[receipt.DeviceID]; exists {
+		key = device.PublicKey
+	}
+	devicesMu.RUnlock()
+	if key == nil {
+		return false, errUnknownDevice
+	}
+	if receipt.Nonce == "" {
+		return false, errMissingNonce
+	}
+	signature, err := base64.StdEncoding.DecodeString(receipt.Signature)
+	if err != nil || !ed25519.Verify(key, signedReceiptPayload(receipt), signature) {
+		return false, errInvalidSignature
+	}
+	return true, nil
+}
+
+// claimDeviceNonce records that the device signed the receipt with the content hash, submitted
+// to the tenant, with its nonce. It fails with errReplayedSignature if the device signed another
+// receipt with the nonce; submitting the same receipt again is fine. Receipts without a valid
+// signature are left alone, so a forged signature can't use up a nonce.
+func claimDeviceNonce(receipt Receipt, tenantID, hash string) error {
+	if trusted, _ := verifyReceiptSignature(receipt); !trusted {
+		return nil
+	}
+	key := receipt.DeviceID + "/" + receipt.Nonce
+	signed := []byte(strconv.Quote(contentKey(tenantID, hash)))
+	claimed, err := recordStore.SwapRecord(deviceNonceKind, key, nil, signed)
+	if err != nil || claimed {
+		return err
+	}
+	previous, err := recordStore.GetRecord(deviceNonceKind, key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(previous, signed) {
+		return errReplayedSignature
+	}
+	return nil
+}
+
+// deviceFromRequest returns the device authenticated by the request's X-Device-Key header, or an
+// empty ID when the header is absent.
+func deviceFromRequest(r *http.Request) (id, tenantID string, err error) {
+	key := r.Header.Get("X-Device-Key")
+	if key == "" {
+		return "", "", nil
+	}
+	devicesMu.RLock()
+	defer devicesMu.RUnlock()
+	device, exists := devices[deviceKeys[sha256Hex([]byte(key))]]
+	if !exists {
+		return "", "", errInvalidDeviceKey
+	}
+	return device.ID, device.TenantID, nil
+}
+
+// recordDeviceSubmission updates a device's stats after it submitted receipt, or failed to with
+// err. It does nothing for receipts from unregistered devices.
+func recordDeviceSubmission(id string, receipt ProcessedReceipt, err error) {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	device, exists := devices[id]
+	if !exists {
+		return
+	}
+
+	now := time.Now().UTC()
+	stats := &device.Stats
+	stats.Submitted++
+	stats.LastSubmissionAt = now
+	switch {
+	case err != nil:
+		stats.Errors++
+		stats.LastError, stats.LastErrorAt = err.Error(), now
+	case receipt.Review != nil && strings.HasPrefix(receipt.StatusReason, signatureFailedReason):
+		stats.Errors++
+		stats.Flagged++
+		stats.LastError, stats.LastErrorAt = receipt.StatusReason, now
+	case receipt.Status == statusPendingReview:
+		stats.Flagged++
+	case receipt.Status == statusScored:
+		stats.Scored++
+	}
+}
+
+func newDeviceKey() string {
+	key := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return "dev_" + hex.EncodeToString(key)
+}
+
+// issueDeviceKey replaces the device's API key with a new one and returns it. devicesMu must be
+// held.
+func issueDeviceKey(device *Device) string {
+	delete(deviceKeys, device.keyHash)
+	key := newDeviceKey()
+	device.keyHash = sha256Hex([]byte(key))
+	deviceKeys[device.keyHash] = device.ID
+	return key
+}
+
+func decodePublicKey(value string) (ed25519.PublicKey, bool) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	return key, err == nil && len(key) == ed25519.PublicKeySize
+}
+
+// registerDeviceHandler registers a device and issues its API key.
+func registerDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		Type      string `json:"type"`
+		TenantID  string `json:"tenantId"`
+		PublicKey string `json:"publicKey"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "The device is invalid.", http.StatusBadRequest)
+		return
+	}
+	device := &Device{
+		ID:           orDefault(request.ID, uuid.New().String()),
+		Name:         request.Name,
+		Type:         orDefault(request.Type, devicePOS),
+		TenantID:     orDefault(request.TenantID, defaultTenant),
+		RegisteredAt: time.Now().UTC(),
+	}
+	if device.Type != devicePOS && device.Type != deviceKiosk {
+		http.Error(w, "The device type must be pos or kiosk.", http.StatusBadRequest)
+		return
+	}
+	if request.PublicKey != "" {
+		key, ok := decodePublicKey(request.PublicKey)
+		if !ok {
+			http.Error(w, "The public key must be a base64-encoded Ed25519 key.", http.StatusBadRequest)
+			return
+		}
+		device.PublicKey = key
+	}
+
+	devicesMu.Lock()
+	if _, exists := devices[device.ID]; exists {
+		devicesMu.Unlock()
+		http.Error(w, "A device with that ID is already registered.", http.StatusConflict)
+		return
+	}
+	devices[device.ID] = device
+	apiKey := issueDeviceKey(device)
+	response := *device
+	devicesMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"device": response, "apiKey": apiKey})
+}
+
+func listDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	devicesMu.RLock()
+	list := make([]Device, 0, len(devices))
+	for _, device := range devices {
+		list = append(list, *device)
+	}
+	devicesMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"devices": list})
+}
+
+func getDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	devicesMu.RLock()
+	device, exists := devices[mux.Vars(r)["id"]]
+	var response Device
+	if exists {
+		response = *device
+	}
+	devicesMu.RUnlock()
+	if !exists {
+		http.Error(w, "No device found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// putDeviceKeyHandler sets a device's Ed25519 public key, replacing any earlier key.
+func putDeviceKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		PublicKey string `json:"publicKey"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "The device key is invalid.", http.StatusBadRequest)
+		return
+	}
+	key, ok := decodePublicKey(request.PublicKey)
+	if !ok {
+		http.Error(w, "The public key must be a base64-encoded Ed25519 key.", http.StatusBadRequest)
+		return
+	}
+
+	devicesMu.Lock()
+	device, exists := devices[mux.Vars(r)["id"]]
+	var response Device
+	if exists {
+		device.PublicKey = key
+		response = *device
+	}
+	devicesMu.Unlock()
+	if !exists {
+		http.Error(w, "No device found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// rotateDeviceCredentialsHandler issues a new API key for a device. The old key stops working
+// immediately.
+func rotateDeviceCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	devicesMu.Lock()
+	device, exists := devices[mux.Vars(r)["id"]]
+	var apiKey string
+	if exists {
+		apiKey = issueDeviceKey(device)
+	}
+	devicesMu.Unlock()
+	if !exists {
+		http.Error(w, "No device found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"apiKey": apiKey})
+}
+
+func deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	devicesMu.Lock()
+	device, exists := devices[id]
+	if exists {
+		delete(deviceKeys, device.keyHash)
+		delete(devices, id)
+	}
+	devicesMu.Unlock()
+	if !exists {
+		http.Error(w, "No device found for that ID.", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Dictionary holds the item keywords of one locale, such as the French product names used by
+// Quebec retailers. Dictionaries are given inline or loaded from files, keyed by locale.
+type Dictionary struct {
+	Categories map[string][]string `json:"categories"`
+}
+
+// normalizeLocale puts a locale tag in the form dictionaries are keyed by: "fr_CA" is "fr-ca".
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+func validateCategories(categories map[string][]string) error {
+	for category, keywords := range categories {
+		if len(keywords) == 0 || slices.Contains(keywords, "") {
+			return fmt.Errorf("category %q: keywords must be given and not empty", category)
+		}
+	}
+	return nil
+}
+
+// loadDictionaryFiles merges each locale's dictionary file into its inline dictionary, resolving
+// relative paths against dir.
+func (c *RulesConfig) loadDictionaryFiles(dir string) error {
+	for locale, path := range c.DictionaryFiles {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("dictionary %q: %w", locale, err)
+		}
+		var loaded Dictionary
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			return fmt.Errorf("dictionary %q: parse %s: %w", locale, path, err)
+		}
+		if c.Dictionaries == nil {
+			c.Dictionaries = make(map[string]Dictionary)
+		}
+		dictionary := c.Dictionaries[locale]
+		if dictionary.Categories == nil {
+			dictionary.Categories = make(map[string][]string)
+		}
+		for category, keywords := range loaded.Categories {
+			dictionary.Categories[category] = append(dictionary.Categories[category], keywords...)
+		}
+		c.Dictionaries[locale] = dictionary
+	}
+	return nil
+}
+
+func (c *RulesConfig) prepareDictionaries() error {
+	normalized := make(map[string]Dictionary, len(c.Dictionaries))
+	for locale, dictionary := range c.Dictionaries {
+		key := normalizeLocale(locale)
+		if key == "" {
+			return fmt.Errorf("dictionaries need a locale")
+		}
+		if _, duplicate := normalized[key]; duplicate {
+			return fmt.Errorf("locale %q has more than one dictionary", locale)
+		}
+		if err := validateCategories(dictionary.Categories); err != nil {
+			return fmt.Errorf("dictionary %q: %w", locale, err)
+		}
+		normalized[key] = dictionary
+	}
+	c.Dictionaries = normalized
+	return nil
+}
+
+// categoriesFor returns the categories of the dictionary for locale, falling back from a regional
+// locale ("fr-ca") to its language ("fr") and then to the default categories.
+func (c RulesConfig) categoriesFor(locale string) map[string][]string {
+	locale = normalizeLocale(locale)
+	if dictionary, ok := c.Dictionaries[locale]; ok {
+		return dictionary.Categories
+	}
+	if language, _, found := strings.Cut(locale, "-"); found {
+		if dictionary, ok := c.Dictionaries[language]; ok {
+			return dictionary.Categories
+		}
+	}
+	return c.Categories
+}
+
+// receiptLocale is the locale a receipt's items are read in: its own, or else the language
+// detected in its items, or else its tenant's. The tenant's locale is kept when it is a regional
+// form of the detected language, so Quebec receipts detected as French use the fr-CA dictionary.
+func receiptLocale(receipt ProcessedReceipt) string {
+	if receipt.Receipt.Locale != "" {
+		return receipt.Receipt.Locale
+	}
+	tenant := tenantLocale(receipt.TenantID)
+	if receipt.Language == "" {
+		return tenant
+	}
+	if language, _, _ := strings.Cut(normalizeLocale(tenant), "-"); language == receipt.Language {
+		return tenant
+	}
+	return receipt.Language
+}
+
+// itemCategory returns the category of an item description in the dictionary for locale, or "" if
+// it has none.
+func itemCategory(description, locale string) string {
+	categories := currentRules().categoriesFor(locale)
+	description = strings.ToLower(description)
+	names := make([]string, 0, len(categories))
+	for name := range categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if slices.ContainsFunc(categories[name], func(keyword string) bool {
+			return strings.Contains(description, strings.ToLower(keyword))
+		}) {
+			return name
+		}
+	}
+	return ""
+}
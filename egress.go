@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Destinations of outbound HTTP calls, whose timeouts can be set apart with -egress-timeouts.
+const (
+	egressWebhooks       = "webhooks"
+	egressScoringModel   = "scoring-model"
+	egressItemClassifier = "item-classifier"
+	egressS3             = "s3"
+	egressVault          = "vault"
+	egressAWSSecrets     = "aws-secrets"
+	egressEtcd           = "etcd"
+	egressOTLP           = "otlp"
+	egressGateway        = "gateway"
+)
+
+var egressDestinations = []string{egressWebhooks, egressScoringModel, egressItemClassifier, egressS3, egressVault, egressAWSSecrets, egressEtcd, egressOTLP, egressGateway}
+
+// egressOptions configure how outbound HTTP calls leave the network.
+type egressOptions struct {
+	proxy    string
+	noProxy  string
+	caBundle string
+	timeouts string
+}
+
+// egressFlags defines the egress flags on fs. Without -egress-proxy, the proxy is taken from the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+func egressFlags(fs *flag.FlagSet) *egressOptions {
+	opts := &egressOptions{}
+	fs.StringVar(&opts.proxy, "egress-proxy", os.Getenv("EGRESS_PROXY"), "proxy URL every outbound HTTP call goes through, e.g. http://proxy.internal:3128 (HTTPS_PROXY and HTTP_PROXY when empty)")
+	fs.StringVar(&opts.noProxy, "egress-no-proxy", os.Getenv("EGRESS_NO_PROXY"), "hosts reached without -egress-proxy, separated by commas; .example.com matches its subdomains")
+	fs.StringVar(&opts.caBundle, "egress-ca-bundle", os.Getenv("EGRESS_CA_BUNDLE"), "PEM file of CA certificates trusted for outbound HTTPS calls, besides the system's")
+	fs.StringVar(&opts.timeouts, "egress-timeouts", os.Getenv("EGRESS_TIMEOUTS"), "timeouts of outbound calls by destination, e.g. webhooks=5s,s3=1m; destinations: "+strings.Join(egressDestinations, ", "))
+	return opts
+}
+
+var (
+	// egressTransport carries every outbound HTTP call, through the configured proxy and CAs.
+	egressTransport http.RoundTripper = http.DefaultTransport
+	egressTimeouts                    = map[string]time.Duration{}
+)
+
+// configureEgress sets up the transport and timeouts of outbound HTTP calls. It must run before
+// any client is made with egressClient.
+func configureEgress(opts *egressOptions) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.proxy != "" {
+		proxyURL, err := url.Parse(opts.proxy)
+		if err != nil || proxyURL.Host == "" {
+			return fmt.Errorf("invalid -egress-proxy %q", opts.proxy)
+		}
+		bypassed := splitList(opts.noProxy)
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if bypassesProxy(req.URL.Hostname(), bypassed) {
+				return nil, nil
+			}
+			return proxyURL, nil
+		}
+	}
+	if opts.caBundle != "" {
+		pem, err := os.ReadFile(opts.caBundle)
+		if err != nil {
+			return fmt.Errorf("reading -egress-ca-bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("-egress-ca-bundle %s holds no PEM certificates", opts.caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	timeouts := map[string]time.Duration{}
+	for _, pair := range splitList(opts.timeouts) {
+		destination, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("egress timeout %q is not destination=duration", pair)
+		}
+		if !slices.Contains(egressDestinations, destination) {
+			return fmt.Errorf("unknown egress destination %q: must be one of %s", destination, strings.Join(egressDestinations, ", "))
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("invalid egress timeout %q for %s", value, destination)
+		}
+		timeouts[destination] = timeout
+	}
+	egressTransport, egressTimeouts = transport, timeouts
+	return nil
+}
+
+// egressClient returns a client for calls to destination, with its configured timeout or else
+// fallback (0 for none).
+func egressClient(destination string, fallback time.Duration) *http.Client {
+	timeout, ok := egressTimeouts[destination]
+	if !ok {
+		timeout = fallback
+	}
+	return &http.Client{Transport: egressTransport, Timeout: timeout}
+}
+
+// bypassesProxy reports whether host is reached directly: it is in bypassed, or a subdomain of an
+// entry starting with a dot, or is a loopback address.
+func bypassesProxy(host string, bypassed []string) bool {
+	if host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	return slices.ContainsFunc(bypassed, func(entry string) bool { return entry == "*" || hostMatches(host, entry) })
+}
+
+// hostMatches reports whether host is entry, or a subdomain of it if entry starts with a dot.
+func hostMatches(host, entry string) bool {
+	if strings.EqualFold(host, strings.TrimPrefix(entry, ".")) {
+		return true
+	}
+	return strings.HasPrefix(entry, ".") && strings.HasSuffix(strings.ToLower(host), strings.ToLower(entry))
+}
+
+// splitList splits a comma-separated list, dropping blank entries.
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultConfirmationSubject = `You earned {{.Points}} points at {{.Retailer}}`
+	defaultConfirmationBody    = `Thanks for your purchase at {{.Retailer}} on {{.PurchaseDate}}.
+
+Receipt {{.ReceiptID}} earned {{.Points}} points. Your balance is now {{.Balance}} points.
+`
+)
+
+// ConfirmationConfig enables confirmation emails for receipts submitted with a userId. Users are
+// looked up in UserDirectory, a JSON file mapping user IDs to email addresses. Templates are keyed
+// by tenant ID, falling back to the "default" entry and then the built-in template.
+type ConfirmationConfig struct {
+	SMTP          SMTPConfig               `json:"smtp"`
+	UserDirectory string                   `json:"userDirectory"`
+	Templates     map[string]EmailTemplate `json:"templates,omitempty"`
+	MaxAttempts   int                      `json:"maxAttempts,omitempty"`
+}
+
+type EmailTemplate struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// confirmationData is the data confirmation templates are rendered with.
+type confirmationData struct {
+	ReceiptID    string
+	UserID       string
+	TenantID     string
+	Retailer     string
+	PurchaseDate string
+	Total        string
+	Points       int
+	Balance      int
+}
+
+type confirmationEmail struct {
+	to      string
+	subject string
+	body    string
+}
+
+type confirmationTemplates struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+func loadConfirmationConfig(path string) (ConfirmationConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ConfirmationConfig{}, err
+	}
+	var cfg ConfirmationConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return ConfirmationConfig{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if cfg.SMTP.Host == "" || cfg.SMTP.From == "" {
+		return ConfirmationConfig{}, fmt.Errorf("%s: smtp host and from are required", path)
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	return cfg, nil
+}
+
+// startConfirmations sends a confirmation email whenever a receipt submitted by a known user is
+// scored. Emails are sent from a background queue and retried with exponential backoff.
+func startConfirmations(cfg ConfirmationConfig) error {
+	if err := resolveSecrets(&cfg.SMTP.Password); err != nil {
+		return err
+	}
+	users := map[string]string{}
+	data, err := os.ReadFile(cfg.UserDirectory)
+	if err != nil {
+		return fmt.Errorf("user directory: %w", err)
+	}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("user directory: parse %s: %w", cfg.UserDirectory, err)
+	}
+
+	templates := map[string]confirmationTemplates{}
+	for tenant, tmpl := range cfg.Templates {
+		parsed, err := parseConfirmationTemplates(tenant, tmpl)
+		if err != nil {
+			return err
+		}
+		templates[tenant] = parsed
+	}
+	fallback, err := parseConfirmationTemplates(defaultTenant, EmailTemplate{})
+	if err != nil {
+		return err
+	}
+
+	queue := make(chan confirmationEmail, 1000)
+	go sendConfirmations(cfg, queue)
+
+	subscribe(func(event Event) {
+		if event.Type != eventReceiptProcessed && event.Type != eventReceiptApproved {
+			return
+		}
+		receipt, exists := getReceipt(event.ReceiptID)
+		if !exists || receipt.Receipt.UserID == "" {
+			return
+		}
+		userID := receipt.Receipt.UserID
+		to, ok := users[userID]
+		if !ok {
+			return
+		}
+
+		tmpl, ok := templates[receipt.TenantID]
+		if !ok {
+			if tmpl, ok = templates[defaultTenant]; !ok {
+				tmpl = fallback
+			}
+		}
+		data := confirmationData{
+			ReceiptID:    receipt.ID,
+			UserID:       userID,
+			TenantID:     receipt.TenantID,
+			Retailer:     receipt.Receipt.Retailer,
+			PurchaseDate: receipt.Receipt.PurchaseDate,
+			Total:        receipt.Receipt.Total,
+			Points:       receipt.Points,
+			Balance:      userBalance(userID),
+		}
+		email, err := renderConfirmation(tmpl, to, data)
+		if err != nil {
+			log.Printf("Confirmation email for receipt %s: %v", receipt.ID, err)
+			return
+		}
+		select {
+		case queue <- email:
+		default:
+			log.Printf("Confirmation email for receipt %s dropped: queue full", receipt.ID)
+		}
+	})
+	return nil
+}
+
+func parseConfirmationTemplates(tenant string, tmpl EmailTemplate) (confirmationTemplates, error) {
+	subject, err := template.New(tenant + "-subject").Parse(orDefault(tmpl.Subject, defaultConfirmationSubject))
+	if err != nil {
+		return confirmationTemplates{}, fmt.Errorf("confirmation template %q: subject: %w", tenant, err)
+	}
+	body, err := template.New(tenant + "-body").Parse(orDefault(tmpl.Body, defaultConfirmationBody))
+	if err != nil {
+		return confirmationTemplates{}, fmt.Errorf("confirmation template %q: body: %w", tenant, err)
+	}
+	return confirmationTemplates{subject: subject, body: body}, nil
+}
+
+func renderConfirmation(tmpl confirmationTemplates, to string, data confirmationData) (confirmationEmail, error) {
+	var subject, body bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return confirmationEmail{}, err
+	}
+	if err := tmpl.body.Execute(&body, data); err != nil {
+		return confirmationEmail{}, err
+	}
+	return confirmationEmail{to: to, subject: subject.String(), body: body.String()}, nil
+}
+
+func sendConfirmations(cfg ConfirmationConfig, queue <-chan confirmationEmail) {
+	for email := range queue {
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err := sendMail(cfg.SMTP, []string{email.to}, email.subject, email.body)
+			if err == nil {
+				break
+			}
+			if attempt >= cfg.MaxAttempts {
+				log.Printf("Confirmation email to %s failed after %d attempts: %v", email.to, attempt, err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types published on receipt lifecycle changes.
+const (
+	eventReceiptProcessed   = "receipt.processed"
+	eventReceiptReprocessed = "receipt.reprocessed"
+	eventReceiptFlagged     = "receipt.flagged"
+	eventReceiptApproved    = "receipt.approved"
+	eventReceiptRejected    = "receipt.rejected"
+	eventReceiptDeleted     = "receipt.deleted"
+	eventReceiptRestored    = "receipt.restored"
+
+	eventPointsRedeemed = "points.redeemed"
+
+	eventAttachmentQuarantined = "attachment.quarantined"
+
+	// eventQuotaExceeded is published when a promotion's budget is spent.
+	eventQuotaExceeded = "quota.exceeded"
+	// eventStoreCircuitOpen is published when the gateway's breaker opens on the upstream store.
+	eventStoreCircuitOpen = "store.circuit_open"
+)
+
+// eventTypes lists every event type published.
+var eventTypes = []string{
+	eventReceiptProcessed, eventReceiptReprocessed, eventReceiptFlagged, eventReceiptApproved,
+	eventReceiptRejected, eventReceiptDeleted, eventReceiptRestored, eventPointsRedeemed,
+	eventAttachmentQuarantined, eventQuotaExceeded, eventStoreCircuitOpen,
+}
+
+// Event is the envelope every event is published and delivered in. ID is unique; Sequence numbers
+// the events of the instance in the order they were published, from 1 at startup. ServiceVersion
+// is the version of the build that published it.
+type Event struct {
+	ID             string         `json:"id"`
+	Sequence       int64          `json:"sequence"`
+	Type           string         `json:"type"`
+	ReceiptID      string         `json:"receiptId,omitempty"`
+	Time           time.Time      `json:"time"`
+	ServiceVersion string         `json:"serviceVersion"`
+	Data           map[string]any `json:"data,omitempty"`
+}
+
+var (
+	eventMu          sync.RWMutex
+	eventSubscribers []func(Event)
+
+	// eventLog holds the last eventLogSize events published, oldest first, for replays.
+	eventLogMu    sync.Mutex
+	eventLog      []Event
+	eventSequence int64
+	eventLogSize  = 10000
+)
+
+// subscribe registers fn to be called for every published event. Subscribers run synchronously on
+// the publishing goroutine and should hand off any slow work.
+func subscribe(fn func(Event)) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	eventSubscribers = append(eventSubscribers, fn)
+}
+
+func publishEvent(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	event.ID = uuid.New().String()
+	event.ServiceVersion = serviceVersion()
+	eventLogMu.Lock()
+	eventSequence++
+	event.Sequence = eventSequence
+	if eventLogSize > 0 {
+		if len(eventLog) >= eventLogSize {
+			eventLog = slices.Delete(eventLog, 0, len(eventLog)-eventLogSize+1)
+		}
+		eventLog = append(eventLog, event)
+	}
+	eventLogMu.Unlock()
+
+	eventMu.RLock()
+	subscribers := eventSubscribers
+	eventMu.RUnlock()
+
+	log.Printf("Event %s receipt=%s", event.Type, event.ReceiptID)
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
+
+// lastEventSequence is the sequence number of the last event published, 0 before the first.
+func lastEventSequence() int64 {
+	eventLogMu.Lock()
+	defer eventLogMu.Unlock()
+	return eventSequence
+}
+
+// publishReceiptEvent publishes an event about a stored receipt, adding the points, user and tenant
+// to data.
+func publishReceiptEvent(eventType string, receipt ProcessedReceipt, data map[string]any) {
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["points"] = receipt.Points
+	data["tenantId"] = receipt.TenantID
+	if receipt.Receipt.UserID != "" {
+		data["userId"] = receipt.Receipt.UserID
+	}
+	if receipt.DataQuality != nil {
+		data["dataQuality"] = receipt.DataQuality
+	}
+	publishEvent(Event{Type: eventType, ReceiptID: receipt.ID, Data: data})
+}
+
+// publishRedemption publishes the redemption of points by a user, posted as entry, with the
+// receipt it was made with or the reservation it committed, if any.
+func publishRedemption(userID string, entry LedgerEntry, reservationID string) {
+	data := map[string]any{
+		"points":   -entry.Points,
+		"tenantId": entry.TenantID,
+		"userId":   userID,
+		"entryId":  entry.ID,
+	}
+	if entry.Reference != "" {
+		data["reference"] = entry.Reference
+	}
+	if reservationID != "" {
+		data["reservationId"] = reservationID
+	}
+	publishEvent(Event{Type: eventPointsRedeemed, ReceiptID: entry.ReceiptID, Data: data})
+}
+
+// matchesEventType reports whether an event type is chosen by a filter of event types, each an
+// exact type or a pattern such as "receipt.*". "*" chooses every type.
+func matchesEventType(filter []string, eventType string) bool {
+	return slices.ContainsFunc(filter, func(pattern string) bool {
+		matched, _ := path.Match(pattern, eventType)
+		return matched
+	})
+}
+
+// validateEventFilter checks that every pattern of a filter chooses some event type, so a typo
+// doesn't silently choose nothing.
+func validateEventFilter(filter []string) error {
+	for _, pattern := range filter {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("event pattern %q: %w", pattern, err)
+		}
+		if !slices.ContainsFunc(eventTypes, func(eventType string) bool { return matchesEventType([]string{pattern}, eventType) }) {
+			return fmt.Errorf("no event type matches %q", pattern)
+		}
+	}
+	return nil
+}
+
+// eventsSince returns the retained events after the sequence number chosen by filter, oldest
+// first, and the sequence number of the oldest event retained, 0 if none is.
+func eventsSince(after int64, filter []string, limit int) (events []Event, oldest int64) {
+	eventLogMu.Lock()
+	defer eventLogMu.Unlock()
+	if len(eventLog) > 0 {
+		oldest = eventLog[0].Sequence
+	}
+	start, _ := slices.BinarySearchFunc(eventLog, after+1, func(event Event, sequence int64) int {
+		return cmp.Compare(event.Sequence, sequence)
+	})
+	for _, event := range eventLog[start:] {
+		if limit > 0 && len(events) == limit {
+			break
+		}
+		if matchesEventType(filter, event.Type) {
+			events = append(events, event)
+		}
+	}
+	return events, oldest
+}
+
+// listEventsHandler returns the retained events after the sequence number ?after= (0 by default),
+// of the types chosen by ?type= (every type when left out), for consumers catching up on the
+// events they missed. Up to ?limit= events are returned, 1000 by default.
+func listEventsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	after, err := strconv.ParseInt(orDefault(query.Get("after"), "0"), 10, 64)
+	if err != nil || after < 0 {
+		http.Error(w, "after must be a sequence number.", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(orDefault(query.Get("limit"), "1000"))
+	if err != nil || limit < 1 || limit > 10000 {
+		http.Error(w, "limit must be from 1 to 10000.", http.StatusBadRequest)
+		return
+	}
+	filter := query["type"]
+	if len(filter) == 0 {
+		filter = []string{"*"}
+	} else if err := validateEventFilter(filter); err != nil {
+		http.Error(w, "Invalid type: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	events, oldest := eventsSince(after, filter, limit)
+	if events == nil {
+		events = []Event{}
+	}
+	response := map[string]any{"events": events, "oldestSequence": oldest}
+	// Events between after and the oldest retained one were dropped from the log.
+	if oldest > after+1 {
+		response["missed"] = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExclusionRules keep items of restricted categories, such as alcohol and tobacco, from earning
+// points, as many programs must. An item is restricted when a keyword of Keywords appears in its
+// description, when its category, per categories and dictionaries, is one of Categories, or else
+// when the item classifier says so.
+type ExclusionRules struct {
+	Keywords   map[string][]string `json:"keywords"`
+	Categories []string            `json:"categories"`
+}
+
+func (e ExclusionRules) enabled() bool {
+	return len(e.Keywords) > 0 || len(e.Categories) > 0 || itemClassifier != nil
+}
+
+func (e *ExclusionRules) prepare() error {
+	if err := validateCategories(e.Keywords); err != nil {
+		return fmt.Errorf("keywords: %w", err)
+	}
+	if slices.Contains(e.Categories, "") {
+		return fmt.Errorf("categories must not be empty")
+	}
+	return nil
+}
+
+// keywordCategory returns the restricted category whose keyword appears in the description, the
+// first by name, or "".
+func (e ExclusionRules) keywordCategory(description string) string {
+	description = strings.ToLower(description)
+	names := make([]string, 0, len(e.Keywords))
+	for name := range e.Keywords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if slices.ContainsFunc(e.Keywords[name], func(keyword string) bool {
+			return strings.Contains(description, strings.ToLower(keyword))
+		}) {
+			return name
+		}
+	}
+	return ""
+}
+
+// An ItemClassifier tells the restricted category of the items of a receipt, "" for items that
+// aren't restricted. It is asked about the items the keywords didn't match.
+type ItemClassifier interface {
+	Classify(ctx context.Context, locale string, items map[int]Item) (map[int]string, error)
+}
+
+var (
+	// itemClassifier is nil when no classifier is configured, in which case the keywords and
+	// categories alone restrict items.
+	itemClassifier    ItemClassifier
+	classifierTimeout = 300 * time.Millisecond
+)
+
+// httpItemClassifier asks a classifier service over HTTP: the receipt's locale and items, by index,
+// are POSTed as JSON, and the categories of the restricted ones are read back.
+type httpItemClassifier struct {
+	url    string
+	client *http.Client
+}
+
+func (c httpItemClassifier) Classify(ctx context.Context, locale string, items map[int]Item) (map[int]string, error) {
+	type classifiedItem struct {
+		Index            int    `json:"index"`
+		ShortDescription string `json:"shortDescription,omitempty"`
+		Price            string `json:"price,omitempty"`
+		Category         string `json:"category,omitempty"`
+	}
+	request := struct {
+		Locale string           `json:"locale"`
+		Items  []classifiedItem `json:"items"`
+	}{Locale: locale, Items: []classifiedItem{}}
+	for index, item := range items {
+		request.Items = append(request.Items, classifiedItem{Index: index, ShortDescription: item.ShortDescription, Price: item.Price})
+	}
+	sort.Slice(request.Items, func(i, j int) bool { return request.Items[i].Index < request.Items[j].Index })
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("item classifier returned %s", resp.Status)
+	}
+	var response struct {
+		Items []classifiedItem `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("item classifier: %w", err)
+	}
+	categories := map[int]string{}
+	for _, item := range response.Items {
+		if _, asked := items[item.Index]; asked && item.Category != "" {
+			categories[item.Index] = item.Category
+		}
+	}
+	return categories, nil
+}
+
+// restrictedItems returns the restricted category of each restricted item of the receipt, by index.
+// Items the classifier can't be asked about, when it fails, are only restricted by the keywords
+// and categories.
+func restrictedItems(cfg RulesConfig, processed ProcessedReceipt) map[int]string {
+	restricted := map[int]string{}
+	unmatched := map[int]Item{}
+	locale := receiptLocale(processed)
+	for i, item := range processed.Receipt.Items {
+		if category := cfg.Exclusions.keywordCategory(item.ShortDescription); category != "" {
+			restricted[i] = category
+		} else if category := itemCategory(item.ShortDescription, locale); category != "" && slices.Contains(cfg.Exclusions.Categories, category) {
+			restricted[i] = category
+		} else {
+			unmatched[i] = item
+		}
+	}
+	if itemClassifier == nil || len(unmatched) == 0 {
+		return restricted
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), classifierTimeout)
+	defer cancel()
+	classified, err := itemClassifier.Classify(ctx, locale, unmatched)
+	if err != nil {
+		log.Printf("Item classifier on receipt %s: %v", processed.ID, err)
+		return restricted
+	}
+	for i, category := range classified {
+		restricted[i] = category
+	}
+	return restricted
+}
+
+// applyExclusions takes the points the rules awarded for restricted items back off, with an
+// "excluded: <category>" entry for each such item in the breakdown. Points awarded for the receipt
+// as a whole, such as for its total or number of items, are kept.
+func applyExclusions(cfg RulesConfig, processed *ProcessedReceipt) {
+	if !cfg.Exclusions.enabled() {
+		return
+	}
+	restricted := restrictedItems(cfg, *processed)
+	earned := map[int]int{}
+	for _, contribution := range processed.Breakdown {
+		if contribution.Item != nil {
+			earned[*contribution.Item] += contribution.Points
+		}
+	}
+	for i := range processed.Receipt.Items {
+		if category, ok := restricted[i]; ok {
+			processed.Breakdown.addItem("excluded: "+category, i, -earned[i])
+		}
+	}
+}
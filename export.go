@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Each export is a snapshot of the production receipts, written to the export store as Parquet
+// files under exports/<export id>/: one table of receipts and one of their item lines, both
+// partitioned Hive-style by tenant and processing date, e.g.
+// receipts/tenant=acme/date=2025-03-01/part-0.parquet. A _SUCCESS manifest listing the files is
+// written last, so readers can tell a finished export from one in progress.
+var exportStore BlobStore
+
+// exportReceiptRow is a row of the receipts table. The user is only given as its pseudonym.
+type exportReceiptRow struct {
+	ID           string    `parquet:"id"`
+	TenantID     string    `parquet:"tenant_id"`
+	UserIDHash   string    `parquet:"user_id_hash,optional"`
+	DeviceID     string    `parquet:"device_id,optional"`
+	Retailer     string    `parquet:"retailer"`
+	PurchaseDate int32     `parquet:"purchase_date,date"`
+	PurchaseTime string    `parquet:"purchase_time"`
+	Total        int64     `parquet:"total,decimal(2:18)"`
+	Items        int32     `parquet:"items"`
+	Locale       string    `parquet:"locale,optional"`
+	Language     string    `parquet:"language,optional"`
+	Status       string    `parquet:"status"`
+	Points       int64     `parquet:"points"`
+	Trusted      bool      `parquet:"trusted"`
+	ProcessedAt  time.Time `parquet:"processed_at,timestamp(millisecond)"`
+}
+
+// exportItemRow is a row of the item lines table.
+type exportItemRow struct {
+	ReceiptID        string `parquet:"receipt_id"`
+	TenantID         string `parquet:"tenant_id"`
+	Index            int32  `parquet:"index"`
+	ShortDescription string `parquet:"short_description"`
+	Price            int64  `parquet:"price,decimal(2:18)"`
+	Retailer         string `parquet:"retailer"`
+	Language         string `parquet:"language,optional"`
+	Points           int64  `parquet:"points"`
+}
+
+// ExportFile is a file written by an export.
+type ExportFile struct {
+	Key  string `json:"key"`
+	Rows int    `json:"rows"`
+}
+
+// ExportRun is an export, running or finished.
+type ExportRun struct {
+	ID          string       `json:"id"`
+	Status      string       `json:"status"`
+	StartedAt   time.Time    `json:"startedAt"`
+	CompletedAt *time.Time   `json:"completedAt,omitempty"`
+	Receipts    int          `json:"receipts"`
+	Items       int          `json:"items"`
+	Files       []ExportFile `json:"files"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// Export statuses.
+const (
+	exportRunning   = "running"
+	exportCompleted = "completed"
+	exportFailed    = "failed"
+)
+
+// maxExportRuns is how many exports are remembered for GET /admin/exports.
+const maxExportRuns = 50
+
+var (
+	exportsMu  sync.Mutex
+	exportRuns []*ExportRun
+)
+
+// epochDays is the date as days since 1970-01-01, the Parquet DATE type.
+func epochDays(date string) (int32, bool) {
+	day, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 0, false
+	}
+	return int32(day.Unix() / 86400), true
+}
+
+// startExport starts an export unless one is running, and returns it.
+func startExport() (*ExportRun, bool) {
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	if n := len(exportRuns); n > 0 && exportRuns[n-1].Status == exportRunning {
+		return exportRuns[n-1], false
+	}
+	started := time.Now().UTC()
+	run := &ExportRun{
+		ID:        started.Format("20060102T150405Z") + "-" + uuid.New().String()[:8],
+		Status:    exportRunning,
+		StartedAt: started,
+		Files:     []ExportFile{},
+	}
+	exportRuns = append(exportRuns, run)
+	if len(exportRuns) > maxExportRuns {
+		exportRuns = exportRuns[len(exportRuns)-maxExportRuns:]
+	}
+	go runExport(run)
+	return run, true
+}
+
+// runScheduledExport is the scheduled task starting an export.
+func runScheduledExport() {
+	if run, started := startExport(); !started {
+		log.Printf("Skipping the scheduled export: export %s is still running", run.ID)
+	}
+}
+
+func runExport(run *ExportRun) {
+	files, receipts, items, err := writeExport(run.ID)
+	exportsMu.Lock()
+	defer exportsMu.Unlock()
+	completed := time.Now().UTC()
+	run.CompletedAt = &completed
+	run.Files, run.Receipts, run.Items = files, receipts, items
+	if err != nil {
+		run.Status, run.Error = exportFailed, err.Error()
+		log.Printf("Export %s failed: %v", run.ID, err)
+		return
+	}
+	run.Status = exportCompleted
+	log.Printf("Export %s wrote %d receipts and %d items in %d files", run.ID, receipts, items, len(files))
+}
+
+// writeExport writes the receipts, then the item lines, then the manifest of an export.
+func writeExport(id string) (files []ExportFile, receipts, items int, err error) {
+	receiptPartitions := map[string][]exportReceiptRow{}
+	itemPartitions := map[string][]exportItemRow{}
+	for _, receipt := range listReceipts() {
+		if receipt.DeletedAt != nil {
+			continue
+		}
+		partition := "tenant=" + url.PathEscape(receipt.TenantID) + "/date=" + receipt.ProcessedAt.Format("2006-01-02")
+		row := exportReceiptRow{
+			ID:           receipt.ID,
+			TenantID:     receipt.TenantID,
+			DeviceID:     receipt.Receipt.DeviceID,
+			Retailer:     receipt.Receipt.Retailer,
+			PurchaseTime: receipt.Receipt.PurchaseTime,
+			Items:        int32(len(receipt.Receipt.Items)),
+			Locale:       receipt.Receipt.Locale,
+			Language:     receipt.Language,
+			Status:       receipt.Status,
+			Points:       int64(receipt.Points),
+			Trusted:      receipt.Trusted,
+			ProcessedAt:  receipt.ProcessedAt,
+		}
+		if receipt.Receipt.UserID != "" {
+			row.UserIDHash = userIDHashWith(identityKeys.current(), receipt.Receipt.UserID)
+		}
+		// Stored receipts passed validation, so their date and amounts parse.
+		row.PurchaseDate, _ = epochDays(receipt.Receipt.PurchaseDate)
+		total, _ := parseMoney(receipt.Receipt.Total)
+		row.Total = total.Cents()
+		receiptPartitions[partition] = append(receiptPartitions[partition], row)
+
+		itemPoints := map[int]int{}
+		for _, contribution := range receipt.Breakdown {
+			if contribution.Item != nil {
+				itemPoints[*contribution.Item] += contribution.Points
+			}
+		}
+		for i, item := range receipt.Receipt.Items {
+			price, _ := parseMoney(item.Price)
+			line := exportItemRow{
+				ReceiptID:        receipt.ID,
+				TenantID:         receipt.TenantID,
+				Index:            int32(i),
+				ShortDescription: strings.TrimSpace(item.ShortDescription),
+				Retailer:         receipt.Receipt.Retailer,
+				Language:         receipt.Language,
+				Price:            price.Cents(),
+				Points:           int64(itemPoints[i]),
+			}
+			itemPartitions[partition] = append(itemPartitions[partition], line)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	prefix := "exports/" + id + "/"
+	for _, partition := range sortedKeys(receiptPartitions) {
+		rows := receiptPartitions[partition]
+		key := prefix + "receipts/" + partition + "/part-0.parquet"
+		if err := writeParquet(ctx, key, rows); err != nil {
+			return files, receipts, items, err
+		}
+		files = append(files, ExportFile{Key: key, Rows: len(rows)})
+		receipts += len(rows)
+	}
+	for _, partition := range sortedKeys(itemPartitions) {
+		rows := itemPartitions[partition]
+		key := prefix + "items/" + partition + "/part-0.parquet"
+		if err := writeParquet(ctx, key, rows); err != nil {
+			return files, receipts, items, err
+		}
+		files = append(files, ExportFile{Key: key, Rows: len(rows)})
+		items += len(rows)
+	}
+
+	manifest, err := json.MarshalIndent(map[string]any{"id": id, "receipts": receipts, "items": items, "files": files}, "", "  ")
+	if err != nil {
+		return files, receipts, items, err
+	}
+	return files, receipts, items, exportStore.Put(ctx, prefix+"_SUCCESS", manifest, "application/json")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeParquet writes rows as one Snappy-compressed Parquet file.
+func writeParquet[T any](ctx context.Context, key string, rows []T) error {
+	var buf bytes.Buffer
+	writer := parquet.NewGenericWriter[T](&buf, parquet.Compression(&parquet.Snappy))
+	if _, err := writer.Write(rows); err != nil {
+		return fmt.Errorf("encoding %s: %w", key, err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("encoding %s: %w", key, err)
+	}
+	return exportStore.Put(ctx, key, buf.Bytes(), "application/vnd.apache.parquet")
+}
+
+// startExportHandler starts an export in the background.
+func startExportHandler(w http.ResponseWriter, r *http.Request) {
+	run, started := startExport()
+	exportsMu.Lock()
+	view := *run
+	exportsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if !started {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]any{"error": "An export is already running.", "export": view})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(view)
+}
+
+// listExportsHandler returns the latest exports, newest first.
+func listExportsHandler(w http.ResponseWriter, r *http.Request) {
+	exportsMu.Lock()
+	list := make([]ExportRun, 0, len(exportRuns))
+	for i := len(exportRuns) - 1; i >= 0; i-- {
+		list = append(list, *exportRuns[i])
+	}
+	exportsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"exports": list})
+}
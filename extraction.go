@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ExtractionTemplate turns OCR text from one retailer's receipts into a Receipt. Match detects the
+// retailer; each field regex must have one capture group, and Item is applied to every line with
+// named groups "description" and "price". Captured dates and times are parsed with DateLayout and
+// TimeLayout.
+type ExtractionTemplate struct {
+	Retailer   string            `json:"retailer"`
+	Match      string            `json:"match"`
+	Fields     map[string]string `json:"fields"`
+	Item       string            `json:"item"`
+	DateLayout string            `json:"dateLayout,omitempty"`
+	TimeLayout string            `json:"timeLayout,omitempty"`
+	Version    int               `json:"version"`
+	UpdatedAt  time.Time         `json:"updatedAt"`
+
+	match  *regexp.Regexp
+	fields map[string]*regexp.Regexp
+	item   *regexp.Regexp
+}
+
+var extractionFields = []string{"purchaseDate", "purchaseTime", "total"}
+
+// genericTemplate is used when no retailer template matches. The first line of text is taken as
+// the retailer name.
+var genericTemplate = mustCompileTemplate(ExtractionTemplate{
+	Retailer: "generic",
+	Fields: map[string]string{
+		"purchaseDate": `(\d{4}-\d{2}-\d{2})`,
+		"purchaseTime": `\b(\d{2}:\d{2})\b`,
+		"total":        `(?i)\btotal\b[^\d]*(\d+\.\d{2})`,
+	},
+	Item: `^\s*(?P<description>.*?\S)\s+\$?(?P<price>\d+\.\d{2})\s*$`,
+})
+
+var (
+	templatesMu sync.RWMutex
+	// extractionTemplates holds every version of each retailer's template, oldest first, keyed by
+	// lowercased retailer name.
+	extractionTemplates = map[string][]ExtractionTemplate{}
+)
+
+func (t *ExtractionTemplate) compile() error {
+	var err error
+	if t.Match != "" {
+		if t.match, err = regexp.Compile(t.Match); err != nil {
+			return fmt.Errorf("match: %w", err)
+		}
+	}
+	t.fields = map[string]*regexp.Regexp{}
+	for name, pattern := range t.Fields {
+		if !slices.Contains(extractionFields, name) {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", name, err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("field %s: a capture group is required", name)
+		}
+		t.fields[name] = re
+	}
+	if t.Item != "" {
+		if t.item, err = regexp.Compile(t.Item); err != nil {
+			return fmt.Errorf("item: %w", err)
+		}
+		if t.item.SubexpIndex("description") < 0 || t.item.SubexpIndex("price") < 0 {
+			return fmt.Errorf("item: named groups description and price are required")
+		}
+	}
+	return nil
+}
+
+func mustCompileTemplate(t ExtractionTemplate) ExtractionTemplate {
+	if err := t.compile(); err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// extract applies the template to text. Fields the template can't find are left empty.
+func (t ExtractionTemplate) extract(text string) Receipt {
+	receipt := Receipt{Retailer: t.Retailer, Items: []Item{}}
+	if t.match == nil {
+		if first, _, _ := strings.Cut(strings.TrimSpace(text), "\n"); first != "" {
+			receipt.Retailer = strings.TrimSpace(first)
+		}
+	}
+
+	find := func(name string) string {
+		if re, ok := t.fields[name]; ok {
+			if m := re.FindStringSubmatch(text); m != nil {
+				return strings.TrimSpace(m[1])
+			}
+		}
+		return ""
+	}
+	receipt.PurchaseDate = normalizeTimeField(find("purchaseDate"), t.DateLayout, "2006-01-02")
+	receipt.PurchaseTime = normalizeTimeField(find("purchaseTime"), t.TimeLayout, "15:04")
+	receipt.Total = find("total")
+
+	if t.item != nil {
+		description, price := t.item.SubexpIndex("description"), t.item.SubexpIndex("price")
+		for _, line := range strings.Split(text, "\n") {
+			m := t.item.FindStringSubmatch(line)
+			if m == nil || t.fields["total"] != nil && t.fields["total"].MatchString(line) {
+				continue
+			}
+			receipt.Items = append(receipt.Items, Item{ShortDescription: m[description], Price: m[price]})
+		}
+	}
+	return receipt
+}
+
+// normalizeTimeField reformats value from layout into the API's format, returning value unchanged
+// when no layout is given or it doesn't parse.
+func normalizeTimeField(value, layout, apiLayout string) string {
+	if value == "" || layout == "" {
+		return value
+	}
+	parsed, err := time.Parse(layout, value)
+	if err != nil {
+		return value
+	}
+	return parsed.Format(apiLayout)
+}
+
+// selectTemplate returns the current template of the first retailer, in name order, whose match
+// pattern is found in text, or the generic template.
+func selectTemplate(text string) ExtractionTemplate {
+	templatesMu.RLock()
+	defer templatesMu.RUnlock()
+
+	keys := make([]string, 0, len(extractionTemplates))
+	for key := range extractionTemplates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		versions := extractionTemplates[key]
+		current := versions[len(versions)-1]
+		if current.match != nil && current.match.MatchString(text) {
+			return current
+		}
+	}
+	return genericTemplate
+}
+
+// extractReceipt reads a receipt from text with the template that matches it, and returns the
+// retailer match when the generic template applied.
+func extractReceipt(text string) (Receipt, ExtractionTemplate, *RetailerMatch) {
+	template := selectTemplate(text)
+	receipt := template.extract(text)
+	if template.match != nil {
+		return receipt, template, nil
+	}
+	// OCR often mangles the retailer name, so the first line is resolved against the known
+	// retailers, whose template then applies if they have one.
+	resolved := resolveRetailer(receipt.Retailer)
+	if current, ok := currentTemplate(resolved.Retailer); ok && resolved.Method != "none" {
+		template, receipt = current, current.extract(text)
+	}
+	receipt.Retailer = resolved.Retailer
+	return receipt, template, &resolved
+}
+
+func extractReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Text) == "" {
+		http.Error(w, "The extraction request is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	receipt, template, match := extractReceipt(request.Text)
+	confidence := extractionConfidence(receipt, match)
+	receipt.OCRConfidence = &confidence
+	response := map[string]any{}
+	if match != nil {
+		response["retailerMatch"] = *match
+	}
+	response["receipt"] = receipt
+	response["template"] = template.Retailer
+	response["templateVersion"] = template.Version
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// currentTemplate returns the current template of a retailer, if it has one.
+func currentTemplate(retailer string) (ExtractionTemplate, bool) {
+	templatesMu.RLock()
+	defer templatesMu.RUnlock()
+	versions, ok := extractionTemplates[strings.ToLower(retailer)]
+	if !ok {
+		return ExtractionTemplate{}, false
+	}
+	return versions[len(versions)-1], true
+}
+
+func listTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	templatesMu.RLock()
+	templates := []ExtractionTemplate{}
+	for _, versions := range extractionTemplates {
+		templates = append(templates, versions[len(versions)-1])
+	}
+	templatesMu.RUnlock()
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Retailer < templates[j].Retailer })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"templates": templates})
+}
+
+// putTemplateHandler creates or replaces a retailer's template as a new version.
+func putTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	retailer := mux.Vars(r)["retailer"]
+
+	var template ExtractionTemplate
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		http.Error(w, "The template is invalid.", http.StatusBadRequest)
+		return
+	}
+	template.Retailer = retailer
+	if template.Match == "" {
+		template.Match = "(?i)" + regexp.QuoteMeta(retailer)
+	}
+	if err := template.compile(); err != nil {
+		http.Error(w, "The template is invalid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := strings.ToLower(retailer)
+	templatesMu.Lock()
+	template.Version = len(extractionTemplates[key]) + 1
+	template.UpdatedAt = time.Now().UTC()
+	extractionTemplates[key] = append(extractionTemplates[key], template)
+	templatesMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+func listTemplateVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.ToLower(mux.Vars(r)["retailer"])
+
+	templatesMu.RLock()
+	versions, exists := extractionTemplates[key]
+	versions = append([]ExtractionTemplate(nil), versions...)
+	templatesMu.RUnlock()
+	if !exists {
+		http.Error(w, "No template found for that retailer.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"versions": versions})
+}
+
+func deleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.ToLower(mux.Vars(r)["retailer"])
+
+	templatesMu.Lock()
+	_, exists := extractionTemplates[key]
+	delete(extractionTemplates, key)
+	templatesMu.Unlock()
+	if !exists {
+		http.Error(w, "No template found for that retailer.", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
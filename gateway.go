@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// upstreamResponseLimit is how much of the upstream's answer is read and passed on to the client.
+const upstreamResponseLimit = 64 << 10
+
+// gatewayOptions configure gateway mode, in which submitted receipts are forwarded, once scored, to
+// an upstream loyalty platform.
+type gatewayOptions struct {
+	upstream        string
+	retries         int
+	backoff         time.Duration
+	breakerFailures int
+	breakerCooldown time.Duration
+}
+
+// gatewayFlags defines the gateway flags on fs.
+func gatewayFlags(fs *flag.FlagSet) *gatewayOptions {
+	opts := &gatewayOptions{}
+	fs.StringVar(&opts.upstream, "gateway-upstream", os.Getenv("GATEWAY_UPSTREAM"), "URL scored receipts are forwarded to, running as a gateway in front of it (off when empty)")
+	fs.IntVar(&opts.retries, "gateway-retries", envInt("GATEWAY_RETRIES", 2), "retries of a forward the upstream failed with a network error, 429 or 5xx")
+	fs.DurationVar(&opts.backoff, "gateway-backoff", envDuration("GATEWAY_BACKOFF", 200*time.Millisecond), "wait before the first retry of a forward, doubled for each further one")
+	fs.IntVar(&opts.breakerFailures, "gateway-breaker-failures", envInt("GATEWAY_BREAKER_FAILURES", 5), "consecutive failed forwards after which the upstream isn't called until the cooldown passed")
+	fs.DurationVar(&opts.breakerCooldown, "gateway-breaker-cooldown", envDuration("GATEWAY_BREAKER_COOLDOWN", 30*time.Second), "how long forwards fail fast once the breaker opened, before one is tried again")
+	return opts
+}
+
+// errUpstreamUnavailable is a forward refused without calling the upstream, as its breaker is open.
+var errUpstreamUnavailable = errors.New("the upstream is unavailable")
+
+// upstreamStatusError is a forward the upstream answered with a status other than 2xx.
+type upstreamStatusError struct {
+	code   int
+	status string
+}
+
+func (e *upstreamStatusError) Error() string {
+	return "upstream answered " + e.status
+}
+
+// retryable reports whether a forward that failed with err may succeed if sent again.
+func retryable(err error) bool {
+	var status *upstreamStatusError
+	if errors.As(err, &status) {
+		return status.code == http.StatusTooManyRequests || status.code >= 500
+	}
+	return true
+}
+
+// upstreamGateway forwards receipts to the upstream, behind a circuit breaker: after
+// breakerFailures forwards in a row fail, forwards fail fast with errUpstreamUnavailable until the
+// cooldown passed. Then a single forward is let through: the breaker closes if it succeeds and
+// opens again if it fails.
+type upstreamGateway struct {
+	url             string
+	client          *http.Client
+	retries         int
+	backoff         time.Duration
+	breakerFailures int
+	breakerCooldown time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// gateway is the upstream receipts are forwarded to, nil unless running in gateway mode.
+var gateway *upstreamGateway
+
+// startGateway enters gateway mode if an upstream is configured.
+func startGateway(opts *gatewayOptions) error {
+	if opts.upstream == "" {
+		return nil
+	}
+	if opts.retries < 0 || opts.breakerFailures < 1 {
+		return fmt.Errorf("-gateway-retries must be at least 0 and -gateway-breaker-failures at least 1")
+	}
+	gateway = &upstreamGateway{
+		url:             opts.upstream,
+		client:          egressClient(egressGateway, 10*time.Second),
+		retries:         opts.retries,
+		backoff:         opts.backoff,
+		breakerFailures: opts.breakerFailures,
+		breakerCooldown: opts.breakerCooldown,
+	}
+	log.Printf("Running as a gateway: receipts are forwarded to %s", opts.upstream)
+	return nil
+}
+
+// admit reports whether a forward may call the upstream. Once the cooldown passed, only the first
+// forward is admitted until it is recorded.
+func (g *upstreamGateway) admit() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.failures < g.breakerFailures {
+		return true
+	}
+	if time.Now().Before(g.openUntil) || g.probing {
+		return false
+	}
+	g.probing = true
+	return true
+}
+
+// record closes the breaker after a successful forward, and counts a failed one, opening the
+// breaker when there have been too many in a row. Opening it publishes a store.circuit_open
+// event; opening it again after a failed probe doesn't.
+func (g *upstreamGateway) record(err error) {
+	g.mu.Lock()
+	g.probing = false
+	if err == nil {
+		g.failures = 0
+		g.mu.Unlock()
+		return
+	}
+	g.failures++
+	failures, opened := g.failures, g.failures == g.breakerFailures
+	if failures >= g.breakerFailures {
+		g.openUntil = time.Now().Add(g.breakerCooldown)
+		log.Printf("Gateway: %d forwards in a row failed; not calling the upstream for %v", failures, g.breakerCooldown)
+	}
+	g.mu.Unlock()
+
+	if opened {
+		publishEvent(Event{Type: eventStoreCircuitOpen, Data: map[string]any{
+			"upstream": g.url,
+			"failures": failures,
+			"cooldown": g.breakerCooldown.String(),
+			"reason":   err.Error(),
+		}})
+	}
+}
+
+// retryAfter is how long until the open breaker lets a forward through, at least a second.
+func (g *upstreamGateway) retryAfter() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return max(time.Until(g.openUntil), time.Second)
+}
+
+// forward sends a processed receipt to the upstream, retrying failures that may be temporary, and
+// returns the upstream's answer. It fails with errUpstreamUnavailable while the breaker is open.
+func (g *upstreamGateway) forward(ctx context.Context, processed ProcessedReceipt) (int, []byte, error) {
+	if !g.admit() {
+		recordGatewayForward(errUpstreamUnavailable)
+		return 0, nil, errUpstreamUnavailable
+	}
+	code, answer, err := g.sendWithRetries(ctx, processed)
+	g.record(err)
+	recordGatewayForward(err)
+	return code, answer, err
+}
+
+func (g *upstreamGateway) sendWithRetries(ctx context.Context, processed ProcessedReceipt) (int, []byte, error) {
+	body, err := json.Marshal(forwardedReceipt(processed))
+	if err != nil {
+		return 0, nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		code, answer, err := g.send(ctx, processed.ID, body)
+		if err == nil || attempt == g.retries || !retryable(err) {
+			return code, answer, err
+		}
+		select {
+		case <-time.After(g.backoff << attempt):
+		case <-ctx.Done():
+			return code, answer, ctx.Err()
+		}
+	}
+}
+
+func (g *upstreamGateway) send(ctx context.Context, id string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", id)
+	if requestID := requestIDFrom(ctx); requestID != "" {
+		req.Header.Set("X-Request-ID", requestID)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, upstreamResponseLimit))
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, answer, &upstreamStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return resp.StatusCode, answer, nil
+}
+
+// forwardedReceipt is the receipt as forwarded upstream: as submitted, enriched with its outcome.
+func forwardedReceipt(processed ProcessedReceipt) map[string]any {
+	forwarded := map[string]any{
+		"id":          processed.ID,
+		"tenantId":    processed.TenantID,
+		"receipt":     processed.Receipt,
+		"processedAt": processed.ProcessedAt,
+		"status":      processed.Status,
+	}
+	if processed.Status != statusPendingReview {
+		forwarded["points"] = processed.Points
+		forwarded["breakdown"] = processed.Breakdown
+	}
+	if processed.StatusReason != "" {
+		forwarded["reason"] = processed.StatusReason
+	}
+	if processed.RulesVersion != 0 {
+		forwarded["rulesVersion"] = processed.RulesVersion
+	}
+	if processed.DataQuality != nil {
+		forwarded["dataQuality"] = processed.DataQuality
+	}
+	return forwarded
+}
+
+// forwardToUpstream forwards a submitted receipt in gateway mode and adds the upstream's answer to
+// the response. When the forward fails, it writes a 502, or a 503 while the breaker is open, and
+// returns false. The receipt stays stored either way, so submitting it again forwards it again.
+func forwardToUpstream(w http.ResponseWriter, r *http.Request, processed ProcessedReceipt, response map[string]any) bool {
+	if gateway == nil {
+		return true
+	}
+	ctx, span := startSpan(r.Context(), "gateway.forward")
+	code, answer, err := gateway.forward(ctx, processed)
+	span.set("http.response.status_code", code)
+	span.fail(err)
+	span.End()
+
+	upstream := map[string]any{"status": code}
+	if json.Valid(answer) {
+		upstream["body"] = json.RawMessage(answer)
+	}
+	if err == nil {
+		response["upstream"] = upstream
+		return true
+	}
+
+	failure := map[string]any{"id": processed.ID, "error": "The receipt could not be forwarded upstream."}
+	status := http.StatusBadGateway
+	if errors.Is(err, errUpstreamUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(gateway.retryAfter().Round(time.Second).Seconds())))
+		status = http.StatusServiceUnavailable
+	} else {
+		log.Printf("Gateway: forwarding receipt %s: %v", processed.ID, err)
+		if code != 0 {
+			failure["upstream"] = upstream
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(failure)
+	return false
+}
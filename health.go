@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// A storagePinger is a receipt store on a server that can be unreachable, which readiness checks.
+type storagePinger interface {
+	Ping(ctx context.Context) error
+}
+
+// readinessTimeout is how long the readiness check waits for the storage to answer.
+const readinessTimeout = 2 * time.Second
+
+// healthzHandler reports that the process is alive. It checks nothing else, so a dependency being
+// down makes the instance unready rather than getting it restarted.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// pingStorage checks that the receipt storage answers, for stores on a database or Redis server.
+func pingStorage(ctx context.Context) error {
+	pinger, ok := receiptStore.(storagePinger)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	return pinger.Ping(ctx)
+}
+
+// readyzHandler reports whether the instance can serve traffic: it isn't shutting down and its
+// receipt storage is reachable, migrated to the schema version this release expects and writable.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]any{"status": "shutting-down", "reason": "The server is shutting down."})
+		return
+	}
+	pingErr := pingStorage(r.Context())
+	latest := latestMigration(storageMigrator)
+	version, err := storageMigrator.schemaVersion()
+	response := map[string]any{"schemaVersion": version, "latestSchemaVersion": latest}
+	status := http.StatusOK
+	switch {
+	case pingErr != nil:
+		response["status"], response["reason"] = "unavailable", "The receipt storage is unreachable: "+pingErr.Error()+"."
+		status = http.StatusServiceUnavailable
+	case err != nil:
+		response["status"], response["reason"] = "unavailable", "The storage schema version can't be read."
+		status = http.StatusServiceUnavailable
+	case readOnly:
+		response["status"], response["reason"] = "read-only", "The server is read-only."
+		status = http.StatusServiceUnavailable
+	case version != latest:
+		response["status"], response["reason"] = "unavailable", "The storage isn't at the latest schema version."
+		status = http.StatusServiceUnavailable
+	default:
+		response["status"] = "ready"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Household groups users whose points are pooled for display and capped together. A user
+// belongs to at most one household. Members are kept sealed like a stored receipt's user.
+type Household struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	memberHashes  []string
+	sealedMembers [][]byte
+}
+
+// householdEarning is a change in the points earned by a household's members, kept for caps.
+type householdEarning struct {
+	householdID string
+	points      int
+	at          time.Time
+}
+
+// householdMu guards the households and their earnings. It may be taken while holding the
+// receipt store or ledger locks, so nothing may lock either of those while holding it.
+var (
+	householdMu       sync.Mutex
+	households        = map[string]*Household{}
+	householdEarnings []householdEarning
+)
+
+// HouseholdRules cap the points a household's members earn together per UTC calendar day and
+// month. Either cap is disabled when zero.
+type HouseholdRules struct {
+	DailyCap   int `json:"dailyCap,omitempty"`
+	MonthlyCap int `json:"monthlyCap,omitempty"`
+}
+
+func (h *HouseholdRules) prepare() error {
+	if h.DailyCap < 0 || h.MonthlyCap < 0 {
+		return fmt.Errorf("caps can't be negative")
+	}
+	return nil
+}
+
+// addMemberLocked seals userID into the household. householdMu must be held.
+func (h *Household) addMemberLocked(userID string) {
+	hash, sealed := sealUserID(userID, h.ID)
+	h.memberHashes = append(h.memberHashes, hash)
+	h.sealedMembers = append(h.sealedMembers, sealed)
+}
+
+// memberIndexLocked returns the position of the member with one of the given pseudonyms, or -1.
+// householdMu must be held.
+func (h *Household) memberIndexLocked(hashes []string) int {
+	return slices.IndexFunc(h.memberHashes, func(hash string) bool { return slices.Contains(hashes, hash) })
+}
+
+// openLocked returns the household with its members' IDs decrypted. householdMu must be held.
+func (h *Household) openLocked() Household {
+	opened := Household{ID: h.ID, Name: h.Name, CreatedAt: h.CreatedAt, Members: []string{}}
+	for _, sealed := range h.sealedMembers {
+		userID, ok := openUserID(sealed, h.ID)
+		if !ok {
+			log.Printf("Decrypting member of household %s: no accepted identity key", h.ID)
+			continue
+		}
+		opened.Members = append(opened.Members, userID)
+	}
+	return opened
+}
+
+// householdOfLocked returns the household userID belongs to. householdMu must be held.
+func householdOfLocked(userID string) (*Household, bool) {
+	hashes := userIDHashes(userID)
+	for _, household := range households {
+		if household.memberIndexLocked(hashes) >= 0 {
+			return household, true
+		}
+	}
+	return nil, false
+}
+
+// recordHouseholdEarning counts points earned (or reversed) by userID towards their household's
+// caps.
+func recordHouseholdEarning(userID string, points int) {
+	householdMu.Lock()
+	defer householdMu.Unlock()
+	if household, ok := householdOfLocked(userID); ok {
+		householdEarnings = append(householdEarnings, householdEarning{household.ID, points, time.Now().UTC()})
+	}
+}
+
+// applyHouseholdCap reduces the points of a receipt whose user's household has reached a cap,
+// recording the reduction as a "household-cap" contribution.
+func applyHouseholdCap(processed *ProcessedReceipt) {
+	caps := currentRules().Households
+	if processed.Receipt.UserID == "" || (caps.DailyCap == 0 && caps.MonthlyCap == 0) || tenantIsSandbox(processed.TenantID) {
+		return
+	}
+	householdMu.Lock()
+	household, ok := householdOfLocked(processed.Receipt.UserID)
+	if !ok {
+		householdMu.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	earnedToday, earnedThisMonth := 0, 0
+	for _, earning := range householdEarnings {
+		if earning.householdID != household.ID || earning.at.Before(month) {
+			continue
+		}
+		earnedThisMonth += earning.points
+		if !earning.at.Before(today) {
+			earnedToday += earning.points
+		}
+	}
+	householdMu.Unlock()
+
+	points := processed.Breakdown.Total()
+	allowed := points
+	if caps.DailyCap > 0 {
+		allowed = min(allowed, max(caps.DailyCap-earnedToday, 0))
+	}
+	if caps.MonthlyCap > 0 {
+		allowed = min(allowed, max(caps.MonthlyCap-earnedThisMonth, 0))
+	}
+	processed.Breakdown.add("household-cap", allowed-points)
+}
+
+// resealHouseholds re-encrypts every household member with the current identity key, and returns
+// how many households it couldn't reseal.
+func resealHouseholds() (failed int) {
+	householdMu.Lock()
+	defer householdMu.Unlock()
+	for _, household := range households {
+		opened := household.openLocked()
+		if len(opened.Members) != len(household.sealedMembers) {
+			// Resealing would drop the members that can't be opened.
+			failed++
+			continue
+		}
+		household.memberHashes, household.sealedMembers = nil, nil
+		for _, userID := range opened.Members {
+			household.addMemberLocked(userID)
+		}
+	}
+	return failed
+}
+
+// householdBalances returns the pooled balance of the household's members and what they can
+// spend after reservations.
+func householdBalances(members []string) (balance, available int) {
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	for _, userID := range members {
+		balance += balanceLocked(userID)
+		available += availableLocked(userID)
+	}
+	return balance, available
+}
+
+func getHousehold(id string) (Household, bool) {
+	householdMu.Lock()
+	defer householdMu.Unlock()
+	household, exists := households[id]
+	if !exists {
+		return Household{}, false
+	}
+	return household.openLocked(), true
+}
+
+func createHouseholdHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name    string   `json:"name"`
+		Members []string `json:"members"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Name == "" {
+		http.Error(w, "A household needs a name.", http.StatusBadRequest)
+		return
+	}
+	household := &Household{ID: uuid.New().String(), Name: request.Name, CreatedAt: time.Now().UTC()}
+
+	householdMu.Lock()
+	seen := map[string]bool{}
+	for _, userID := range request.Members {
+		if _, taken := householdOfLocked(userID); taken || userID == "" || seen[userID] {
+			householdMu.Unlock()
+			http.Error(w, "A member is empty, repeated or already in a household.", http.StatusConflict)
+			return
+		}
+		seen[userID] = true
+	}
+	for _, userID := range request.Members {
+		household.addMemberLocked(userID)
+	}
+	households[household.ID] = household
+	response := household.openLocked()
+	householdMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func listHouseholdsHandler(w http.ResponseWriter, r *http.Request) {
+	householdMu.Lock()
+	list := make([]Household, 0, len(households))
+	for _, household := range households {
+		list = append(list, household.openLocked())
+	}
+	householdMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func addHouseholdMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	householdMu.Lock()
+	household, exists := households[vars["id"]]
+	if !exists {
+		householdMu.Unlock()
+		http.Error(w, "No household found for that ID.", http.StatusNotFound)
+		return
+	}
+	if current, taken := householdOfLocked(vars["userId"]); taken {
+		householdMu.Unlock()
+		if current != household {
+			http.Error(w, "The user is already in another household.", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	household.addMemberLocked(vars["userId"])
+	householdMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func removeHouseholdMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	householdMu.Lock()
+	household, exists := households[vars["id"]]
+	if !exists {
+		householdMu.Unlock()
+		http.Error(w, "No household found for that ID.", http.StatusNotFound)
+		return
+	}
+	if i := household.memberIndexLocked(userIDHashes(vars["userId"])); i >= 0 {
+		household.memberHashes = slices.Delete(household.memberHashes, i, i+1)
+		household.sealedMembers = slices.Delete(household.sealedMembers, i, i+1)
+	}
+	householdMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteHouseholdHandler(w http.ResponseWriter, r *http.Request) {
+	householdMu.Lock()
+	delete(households, mux.Vars(r)["id"])
+	householdMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getHouseholdHandler returns a household with its members' pooled balance.
+func getHouseholdHandler(w http.ResponseWriter, r *http.Request) {
+	household, exists := getHousehold(mux.Vars(r)["id"])
+	if !exists || !userInHousehold(r, household) {
+		http.Error(w, "No household found for that ID.", http.StatusNotFound)
+		return
+	}
+	balance, available := householdBalances(household.Members)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":        household.ID,
+		"name":      household.Name,
+		"members":   household.Members,
+		"balance":   balance,
+		"available": available,
+	})
+}
+
+// householdEntry is a ledger entry in a household's combined history.
+type householdEntry struct {
+	LedgerEntry
+	UserID string `json:"userId"`
+}
+
+// householdHistoryHandler lists the ledger entries of all current members, oldest first.
+func householdHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	household, exists := getHousehold(mux.Vars(r)["id"])
+	if !exists || !userInHousehold(r, household) {
+		http.Error(w, "No household found for that ID.", http.StatusNotFound)
+		return
+	}
+	history := []householdEntry{}
+	ledgerMu.Lock()
+	for _, userID := range household.Members {
+		hashes := userIDHashes(userID)
+		for _, entry := range ledger {
+			if slices.Contains(hashes, entry.userIDHash) {
+				history = append(history, householdEntry{entry, userID})
+			}
+		}
+	}
+	ledgerMu.Unlock()
+	sort.SliceStable(history, func(i, j int) bool { return history[i].CreatedAt.Before(history[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// User identifiers never sit in the receipt store in the clear: each is kept as an HMAC for
+// lookups and an AES-GCM ciphertext for reading it back, so a dump of the store can't be joined to
+// customer identity without the identity key. The user ID is the only customer identifier receipts
+// carry; there is no external ID to seal.
+var identityKeys *keyRing
+
+// initIdentityKey sets up the identity key ring from secret. A random secret is used when none is
+// configured, which is only allowed while receipts are kept in memory: with persistent storage,
+// the user IDs stored under it would be unreadable after a restart. A previous secret stays
+// accepted for reading, for data not yet resealed when a rotation was interrupted.
+func initIdentityKey(secret, previous string, persistent bool) error {
+	key := []byte(secret)
+	if secret == "" {
+		if persistent {
+			return errors.New("an identity key is required with persistent storage: set -identity-key, IDENTITY_KEY or the identity-key secret")
+		}
+		key = randomSecret()
+		log.Println("No identity key configured; stored user identifiers can't be read after a restart.")
+	}
+	identityKeys = newKeyRing(keyRingIdentity, key, resealIdentifiers)
+	if previous != "" {
+		identityKeys.keys = append(identityKeys.keys, ringKey{ID: newKeyID(), CreatedAt: time.Now().UTC(), secret: []byte(previous)})
+	}
+	return nil
+}
+
+// identityCipher derives the AES-GCM cipher for an identity key.
+func identityCipher(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(hmacSHA256(key, "receipt-processor user encryption"))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func userIDHashWith(key []byte, userID string) string {
+	return hex.EncodeToString(hmacSHA256(hmacSHA256(key, "receipt-processor user lookup"), userID))
+}
+
+// userIDHashes returns the pseudonyms of a user ID under every accepted identity key, current first.
+func userIDHashes(userID string) []string {
+	var hashes []string
+	for _, key := range identityKeys.accepted() {
+		hashes = append(hashes, userIDHashWith(key, userID))
+	}
+	return hashes
+}
+
+// sealUserID returns the pseudonym and ciphertext kept at rest for userID, binding the
+// ciphertext to the record it belongs to.
+func sealUserID(userID, recordID string) (string, []byte) {
+	key := identityKeys.current()
+	sealer := identityCipher(key)
+	nonce := make([]byte, sealer.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return userIDHashWith(key, userID), sealer.Seal(nonce, nonce, []byte(userID), []byte(recordID))
+}
+
+// openUserID decrypts a user ID sealed by sealUserID, trying every accepted identity key.
+func openUserID(sealed []byte, recordID string) (string, bool) {
+	for _, key := range identityKeys.accepted() {
+		opener := identityCipher(key)
+		nonceSize := opener.NonceSize()
+		userID, err := opener.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(recordID))
+		if err == nil {
+			return string(userID), true
+		}
+	}
+	return "", false
+}
+
+// sealIdentifiers returns the form of receipt kept in the store, with its user ID replaced by a
+// hash and ciphertext.
+func sealIdentifiers(receipt ProcessedReceipt) ProcessedReceipt {
+	if receipt.Receipt.UserID == "" {
+		return receipt
+	}
+	receipt.UserIDHash, receipt.SealedUserID = sealUserID(receipt.Receipt.UserID, receipt.ID)
+	receipt.Receipt.UserID = ""
+	return receipt
+}
+
+// openIdentifiers reverses sealIdentifiers for a receipt read from the store.
+func openIdentifiers(receipt ProcessedReceipt) ProcessedReceipt {
+	if receipt.SealedUserID == nil {
+		return receipt
+	}
+	userID, ok := openUserID(receipt.SealedUserID, receipt.ID)
+	if !ok {
+		log.Printf("Decrypting user of receipt %s: no accepted identity key", receipt.ID)
+		return receipt
+	}
+	receipt.Receipt.UserID = userID
+	receipt.UserIDHash, receipt.SealedUserID = "", nil
+	return receipt
+}
+
+// resealIdentifiers re-encrypts every stored user ID with the current identity key after a
+// rotation, so the previous key can retire. Records that can't be opened or stored again are
+// left as they are, and make it fail.
+func resealIdentifiers() error {
+	failed := 0
+	receiptStoreMu.Lock()
+	for _, store := range []ReceiptStore{receiptStore, sandboxStore} {
+		receipts, err := store.List()
+		if err != nil {
+			receiptStoreMu.Unlock()
+			return fmt.Errorf("listing receipts: %w", err)
+		}
+		for _, receipt := range receipts {
+			opened := openIdentifiers(receipt)
+			if opened.SealedUserID != nil {
+				failed++
+				continue
+			}
+			if err := store.Put(sealIdentifiers(opened)); err != nil {
+				log.Printf("Resealing receipt %s: %v", receipt.ID, err)
+				failed++
+			}
+		}
+	}
+	receiptStoreMu.Unlock()
+	failed += resealLedger() + resealHouseholds() + resealOffers()
+	if failed > 0 {
+		return fmt.Errorf("%d records could not be resealed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Image variants generated for uploaded receipt images.
+const (
+	variantThumbnail  = "thumbnail"
+	variantNormalized = "normalized"
+)
+
+// Attachment processing statuses.
+const (
+	processingPending = "pending"
+	processingDone    = "done"
+	processingFailed  = "failed"
+)
+
+const (
+	thumbnailSize = 256
+
+	// maxImagePixels caps the width times height of images processed, which a small compressed
+	// file can make large enough to exhaust memory once decoded.
+	maxImagePixels = 50_000_000
+
+	// Deskewing searches this many degrees either side of level.
+	maxSkewDegrees  = 5.0
+	skewStepDegrees = 0.25
+	skewSampleSize  = 800
+)
+
+// ImageVariant is a derived version of an image attachment stored next to the original.
+type ImageVariant struct {
+	ContentType string `json:"contentType"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	BlobKey     string `json:"-"`
+}
+
+type imageJob struct {
+	receiptID    string
+	attachmentID string
+}
+
+var (
+	imageJobs chan imageJob
+	// imageJobsPending counts the image jobs queued or in progress, for draining on shutdown.
+	imageJobsPending sync.WaitGroup
+)
+
+// startImagePipeline starts workers that generate thumbnails and normalized (deskewed,
+// contrast-stretched grayscale) versions of uploaded images in the background.
+func startImagePipeline(workers int) {
+	imageJobs = make(chan imageJob, 1000)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range imageJobs {
+				processImageAttachment(job)
+				imageJobsPending.Done()
+			}
+		}()
+	}
+}
+
+func isProcessableImage(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png"
+}
+
+// enqueueImageJob reports whether the job was queued; it never blocks the caller.
+func enqueueImageJob(job imageJob) bool {
+	imageJobsPending.Add(1)
+	select {
+	case imageJobs <- job:
+		return true
+	default:
+		imageJobsPending.Done()
+		return false
+	}
+}
+
+// drainImageJobs waits for the image jobs queued and in progress to finish, or for ctx to be done.
+func drainImageJobs(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		imageJobsPending.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func processImageAttachment(job imageJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	variants, err := generateImageVariants(ctx, job)
+	status := processingDone
+	if err != nil {
+		log.Printf("Processing attachment %s of receipt %s: %v", job.attachmentID, job.receiptID, err)
+		status = processingFailed
+	}
+
+	updateReceipt(job.receiptID, func(receipt *ProcessedReceipt) error {
+		for i := range receipt.Attachments {
+			if receipt.Attachments[i].ID == job.attachmentID {
+				receipt.Attachments[i].Processing = status
+				receipt.Attachments[i].Variants = variants
+			}
+		}
+		return nil
+	})
+}
+
+func generateImageVariants(ctx context.Context, job imageJob) (map[string]ImageVariant, error) {
+	receipt, exists := getReceipt(job.receiptID)
+	if !exists {
+		return nil, errReceiptNotFound
+	}
+	var original Attachment
+	for _, attachment := range receipt.Attachments {
+		if attachment.ID == job.attachmentID {
+			original = attachment
+		}
+	}
+
+	body, err := blobStore.Get(ctx, original.BlobKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, fmt.Errorf("the image is %dx%d, more than %d pixels", config.Width, config.Height, maxImagePixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	variants := map[string]ImageVariant{}
+
+	thumbnail := scaleToFit(img, thumbnailSize)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	variant := ImageVariant{
+		ContentType: "image/jpeg",
+		Width:       thumbnail.Bounds().Dx(),
+		Height:      thumbnail.Bounds().Dy(),
+		BlobKey:     original.BlobKey + "." + variantThumbnail,
+	}
+	if err := blobStore.Put(ctx, variant.BlobKey, buf.Bytes(), variant.ContentType); err != nil {
+		return nil, err
+	}
+	variants[variantThumbnail] = variant
+
+	normalized := deskew(stretchContrast(toGray(img)))
+	buf.Reset()
+	if err := png.Encode(&buf, normalized); err != nil {
+		return nil, err
+	}
+	variant = ImageVariant{
+		ContentType: "image/png",
+		Width:       normalized.Bounds().Dx(),
+		Height:      normalized.Bounds().Dy(),
+		BlobKey:     original.BlobKey + "." + variantNormalized,
+	}
+	if err := blobStore.Put(ctx, variant.BlobKey, buf.Bytes(), variant.ContentType); err != nil {
+		return nil, err
+	}
+	variants[variantNormalized] = variant
+
+	return variants, nil
+}
+
+func toGray(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			gray.Set(x, y, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return gray
+}
+
+// scaleToFit downsamples img by area averaging so neither side exceeds size. Smaller images are
+// returned unscaled.
+func scaleToFit(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	scale := math.Min(float64(size)/float64(w), float64(size)/float64(h))
+	if scale >= 1 {
+		return img
+	}
+	dw, dh := max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := dy*h/dh, max((dy+1)*h/dh, dy*h/dh+1)
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := dx*w/dw, max((dx+1)*w/dw, dx*w/dw+1)
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					cr, cg, cb, ca := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(dx, dy, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// stretchContrast maps the 1st to 99th percentile of brightness onto the full range.
+func stretchContrast(img *image.Gray) *image.Gray {
+	var histogram [256]int
+	for _, v := range img.Pix {
+		histogram[v]++
+	}
+	lo, hi := percentile(histogram, len(img.Pix), 0.01), percentile(histogram, len(img.Pix), 0.99)
+	if hi <= lo {
+		return img
+	}
+
+	out := image.NewGray(img.Rect)
+	for i, v := range img.Pix {
+		scaled := (int(v) - lo) * 255 / (hi - lo)
+		out.Pix[i] = uint8(min(max(scaled, 0), 255))
+	}
+	return out
+}
+
+func percentile(histogram [256]int, total int, p float64) int {
+	target := int(float64(total) * p)
+	seen := 0
+	for v, count := range histogram {
+		seen += count
+		if seen > target {
+			return v
+		}
+	}
+	return 255
+}
+
+// deskew estimates the text skew angle by finding the rotation whose horizontal projection of
+// dark pixels is sharpest, then rotates the image to level it.
+func deskew(img *image.Gray) *image.Gray {
+	sample := img
+	if img.Rect.Dx() > skewSampleSize || img.Rect.Dy() > skewSampleSize {
+		sample = toGray(scaleToFit(img, skewSampleSize))
+	}
+
+	var dark []image.Point
+	for y := 0; y < sample.Rect.Dy(); y++ {
+		for x := 0; x < sample.Rect.Dx(); x++ {
+			if sample.GrayAt(x, y).Y < 128 {
+				dark = append(dark, image.Point{x, y})
+			}
+		}
+	}
+	if len(dark) == 0 {
+		return img
+	}
+
+	bestAngle, bestScore := 0.0, -1.0
+	rows := make(map[int]int)
+	for degrees := -maxSkewDegrees; degrees <= maxSkewDegrees; degrees += skewStepDegrees {
+		angle := degrees * math.Pi / 180
+		sin, cos := math.Sincos(angle)
+		clear(rows)
+		for _, p := range dark {
+			rows[int(math.Round(-float64(p.X)*sin+float64(p.Y)*cos))]++
+		}
+		score := 0.0
+		for _, count := range rows {
+			score += float64(count) * float64(count)
+		}
+		if score > bestScore {
+			bestAngle, bestScore = angle, score
+		}
+	}
+	if bestAngle == 0 {
+		return img
+	}
+	return rotate(img, bestAngle)
+}
+
+// rotate applies the same transform deskew scored, around the image center, filling uncovered
+// pixels with white.
+func rotate(img *image.Gray, angle float64) *image.Gray {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	cx, cy := float64(w)/2, float64(h)/2
+	sin, cos := math.Sincos(angle)
+
+	out := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := float64(x)-cx, float64(y)-cy
+			sx := int(math.Round(dx*cos - dy*sin + cx))
+			sy := int(math.Round(dx*sin + dy*cos + cy))
+			if sx >= 0 && sx < w && sy >= 0 && sy < h {
+				out.Pix[y*out.Stride+x] = img.Pix[sy*img.Stride+sx]
+			} else {
+				out.Pix[y*out.Stride+x] = 255
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const maxImportSize = 64 << 20
+
+// ImportManifest describes a batch import: every file in the upload with its SHA-256 checksum and
+// the number of receipts it holds. Uploads that don't match their manifest are rejected whole.
+type ImportManifest struct {
+	ID    string               `json:"id"`
+	Files []ImportManifestFile `json:"files"`
+}
+
+type ImportManifestFile struct {
+	Name     string `json:"name"`
+	SHA256   string `json:"sha256"`
+	Receipts int    `json:"receipts"`
+}
+
+// ImportedFile tracks ingestion of one of a tenant's files, keyed by its checksum. Processed counts
+// the receipts already stored, so a re-upload after a failure resumes where it stopped instead of
+// awarding points twice.
+type ImportedFile struct {
+	Name        string    `json:"name"`
+	SHA256      string    `json:"sha256"`
+	ManifestID  string    `json:"manifestId"`
+	Receipts    int       `json:"receipts"`
+	Processed   int       `json:"processed"`
+	ReceiptIDs  []string  `json:"receiptIds"`
+	CompletedAt time.Time `json:"completedAt,omitzero"`
+}
+
+type ImportRecord struct {
+	Manifest   ImportManifest `json:"manifest"`
+	TenantID   string         `json:"tenantId"`
+	ReceivedAt time.Time      `json:"receivedAt"`
+}
+
+// Kinds of the records imports are kept as, keyed by tenant and manifest ID, and by tenant and
+// file checksum.
+const (
+	importRecordKind = "import"
+	importedFileKind = "imported-file"
+)
+
+// importProgressInterval is how many receipts of a file are ingested between saves of its
+// progress. Receipts ingested since the last save are submitted again when the import resumes, and
+// are counted as duplicates.
+const importProgressInterval = 100
+
+// importsMu is held for a whole ingestion so concurrent uploads of the same file can't both
+// process it.
+var importsMu sync.Mutex
+
+// loadImportRecord returns the record of a tenant's import, if there is one.
+func loadImportRecord(tenantID, id string) (ImportRecord, bool, error) {
+	var record ImportRecord
+	found, err := loadRecord(importRecordKind, tenantID+"/"+id, &record)
+	return record, found, err
+}
+
+// loadImportedFile returns the progress of a tenant's file, by its checksum, if it was imported.
+func loadImportedFile(tenantID, sha string) (*ImportedFile, bool, error) {
+	var file ImportedFile
+	found, err := loadRecord(importedFileKind, tenantID+"/"+sha, &file)
+	return &file, found, err
+}
+
+func saveImportedFile(tenantID string, file *ImportedFile) error {
+	return saveRecord(importedFileKind, tenantID+"/"+file.SHA256, file)
+}
+
+// importHandler ingests a multipart upload with a "manifest" JSON field and one "file" part per
+// manifest entry, each a JSON array of receipts. Files already ingested are skipped.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(maxImportSize); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "The import is too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "The import is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	var manifest ImportManifest
+	if err := json.Unmarshal([]byte(r.FormValue("manifest")), &manifest); err != nil || manifest.ID == "" || len(manifest.Files) == 0 {
+		http.Error(w, "The manifest is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	files := map[string][]byte{}
+	for _, header := range r.MultipartForm.File["file"] {
+		file, err := header.Open()
+		if err != nil {
+			http.Error(w, "The import is invalid.", http.StatusBadRequest)
+			return
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			http.Error(w, "The import is invalid.", http.StatusBadRequest)
+			return
+		}
+		files[filepath.Base(header.Filename)] = data
+	}
+	if len(files) != len(manifest.Files) {
+		http.Error(w, "The uploaded files don't match the manifest.", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Verify everything before storing anything, so a bad file can't leave a partial import.
+	receipts := make([][]Receipt, len(manifest.Files))
+	for i, entry := range manifest.Files {
+		data, ok := files[entry.Name]
+		if !ok {
+			http.Error(w, "File "+entry.Name+" is listed in the manifest but was not uploaded.", http.StatusUnprocessableEntity)
+			return
+		}
+		if sha256Hex(data) != entry.SHA256 {
+			http.Error(w, "File "+entry.Name+" does not match its checksum.", http.StatusUnprocessableEntity)
+			return
+		}
+		if err := json.Unmarshal(data, &receipts[i]); err != nil {
+			http.Error(w, "File "+entry.Name+" is not a JSON array of receipts.", http.StatusUnprocessableEntity)
+			return
+		}
+		if len(receipts[i]) != entry.Receipts {
+			http.Error(w, "File "+entry.Name+" does not contain the number of receipts in the manifest.", http.StatusUnprocessableEntity)
+			return
+		}
+		for j, receipt := range receipts[i] {
+			if errs, _ := validateReceipt(receipt, time.Now()); len(errs) > 0 {
+				http.Error(w, fmt.Sprintf("Receipt %d of file %s: %s", j, entry.Name, describeValidationErrors(errs)), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+	}
+
+	importsMu.Lock()
+	defer importsMu.Unlock()
+
+	tenantID := tenantFromRequest(r)
+	previous, exists, err := loadImportRecord(tenantID, manifest.ID)
+	if err != nil {
+		log.Printf("Import %s: reading the import: %v", manifest.ID, err)
+		http.Error(w, "The import could not be stored; upload it again to resume.", http.StatusInternalServerError)
+		return
+	}
+	if exists && !sameManifestFiles(previous.Manifest, manifest) {
+		http.Error(w, "A different manifest with that ID was already imported.", http.StatusConflict)
+		return
+	}
+	record := ImportRecord{Manifest: manifest, TenantID: tenantID, ReceivedAt: time.Now().UTC()}
+	if err := saveRecord(importRecordKind, tenantID+"/"+manifest.ID, record); err != nil {
+		log.Printf("Import %s: storing the import: %v", manifest.ID, err)
+		http.Error(w, "The import could not be stored; upload it again to resume.", http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]map[string]any, 0, len(manifest.Files))
+	for i, entry := range manifest.Files {
+		imported, exists, err := loadImportedFile(tenantID, entry.SHA256)
+		if err != nil {
+			log.Printf("Import %s: reading the progress of %s: %v", manifest.ID, entry.Name, err)
+			http.Error(w, "The import could not be stored; upload it again to resume.", http.StatusInternalServerError)
+			return
+		}
+		if exists && !imported.CompletedAt.IsZero() {
+			results = append(results, map[string]any{"name": entry.Name, "status": "skipped", "file": imported})
+			continue
+		}
+		if !exists {
+			imported = &ImportedFile{Name: entry.Name, SHA256: entry.SHA256, ManifestID: manifest.ID, Receipts: entry.Receipts}
+		}
+
+		for _, receipt := range receipts[i][imported.Processed:] {
+			// Receipts already stored, e.g. by an earlier import of an overlapping file, are counted
+			// as ingested under their stored ID.
+			processed, err := submitReceipt(r.Context(), receipt, tenantID, time.Now())
+			if errors.Is(err, errReplayedSignature) {
+				if err := saveImportedFile(tenantID, imported); err != nil {
+					log.Printf("Import %s: storing the progress of %s: %v", manifest.ID, entry.Name, err)
+				}
+				http.Error(w, fmt.Sprintf("Receipt %d of file %s: the device already signed another receipt with that nonce.", imported.Processed, entry.Name), http.StatusConflict)
+				return
+			}
+			if err != nil && !errors.Is(err, errDuplicateReceipt) {
+				log.Printf("Import %s: storing receipt %d of %s: %v", manifest.ID, imported.Processed, entry.Name, err)
+				if err := saveImportedFile(tenantID, imported); err != nil {
+					log.Printf("Import %s: storing the progress of %s: %v", manifest.ID, entry.Name, err)
+				}
+				http.Error(w, "The import could not be stored; upload it again to resume.", http.StatusInternalServerError)
+				return
+			}
+			imported.Processed++
+			imported.ReceiptIDs = append(imported.ReceiptIDs, processed.ID)
+			if imported.Processed%importProgressInterval == 0 {
+				if err := saveImportedFile(tenantID, imported); err != nil {
+					log.Printf("Import %s: storing the progress of %s: %v", manifest.ID, entry.Name, err)
+					http.Error(w, "The import could not be stored; upload it again to resume.", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+		imported.CompletedAt = time.Now().UTC()
+		if err := saveImportedFile(tenantID, imported); err != nil {
+			log.Printf("Import %s: storing the progress of %s: %v", manifest.ID, entry.Name, err)
+			http.Error(w, "The import could not be stored; upload it again to resume.", http.StatusInternalServerError)
+			return
+		}
+		results = append(results, map[string]any{"name": entry.Name, "status": "ingested", "file": imported})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"manifestId": manifest.ID, "files": results})
+}
+
+func sameManifestFiles(a, b ImportManifest) bool {
+	if len(a.Files) != len(b.Files) {
+		return false
+	}
+	for i := range a.Files {
+		if a.Files[i] != b.Files[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// getImportHandler returns one of the tenant's imports, with the progress of its files.
+func getImportHandler(w http.ResponseWriter, r *http.Request) {
+	tenantID := tenantFromRequest(r)
+	record, exists, err := loadImportRecord(tenantID, mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Reading import %s: %v", mux.Vars(r)["id"], err)
+		http.Error(w, "The import could not be read.", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "No import found for that ID.", http.StatusNotFound)
+		return
+	}
+	files := make([]*ImportedFile, 0, len(record.Manifest.Files))
+	for _, entry := range record.Manifest.Files {
+		imported, ok, err := loadImportedFile(tenantID, entry.SHA256)
+		if err != nil {
+			log.Printf("Reading import %s: %v", record.Manifest.ID, err)
+			http.Error(w, "The import could not be read.", http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			files = append(files, imported)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"manifest":   record.Manifest,
+		"tenantId":   record.TenantID,
+		"receivedAt": record.ReceivedAt,
+		"files":      files,
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Insight is one card of a user's home screen. Data is specific to its Type.
+type Insight struct {
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	Data  any    `json:"data"`
+}
+
+// insightInput is what insights are generated from: the user's receipts that count towards their
+// points, with their user ID opened.
+type insightInput struct {
+	userID   string
+	receipts []ProcessedReceipt
+	now      time.Time
+}
+
+// An insightGenerator derives insights from a user's activity, returning none when it has nothing
+// worth showing.
+type insightGenerator func(input insightInput) []Insight
+
+// insightPipeline lists the generators run for every request, in the order their insights are
+// shown. Adding a kind of insight is adding a generator here.
+var insightPipeline = []insightGenerator{
+	topCategoriesInsight,
+	missedPointsInsight,
+	upcomingExpirationsInsight,
+}
+
+const (
+	topCategoryCount    = 3
+	expirationLookahead = 7 * 24 * time.Hour
+)
+
+// topCategoriesInsight ranks the user's spending by item category, read with the dictionary of
+// each receipt's locale.
+func topCategoriesInsight(input insightInput) []Insight {
+	type categorySpend struct {
+		Category string  `json:"category"`
+		Items    int     `json:"items"`
+		Spent    float64 `json:"spent"`
+	}
+	spend := map[string]*categorySpend{}
+	for _, receipt := range input.receipts {
+		locale := receiptLocale(receipt)
+		for _, item := range receipt.Receipt.Items {
+			category := itemCategory(item.ShortDescription, locale)
+			price, err := strconv.ParseFloat(item.Price, 64)
+			if category == "" || err != nil {
+				continue
+			}
+			if spend[category] == nil {
+				spend[category] = &categorySpend{Category: category}
+			}
+			spend[category].Items++
+			spend[category].Spent += price
+		}
+	}
+	if len(spend) == 0 {
+		return nil
+	}
+	top := make([]categorySpend, 0, len(spend))
+	for _, category := range spend {
+		category.Spent = float64(int64(category.Spent*100+0.5)) / 100
+		top = append(top, *category)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Spent != top[j].Spent {
+			return top[i].Spent > top[j].Spent
+		}
+		return top[i].Category < top[j].Category
+	})
+	if len(top) > topCategoryCount {
+		top = top[:topCategoryCount]
+	}
+	return []Insight{{Type: "top-categories", Title: "You spend the most on " + top[0].Category, Data: top}}
+}
+
+// missedPointsInsight totals the points the user's receipts lost to household, partner and points
+// caps.
+func missedPointsInsight(input insightInput) []Insight {
+	byRule := map[string]int{}
+	total := 0
+	for _, receipt := range input.receipts {
+		for _, contribution := range receipt.Breakdown {
+			if (contribution.Rule == "household-cap" || contribution.Rule == "partner-cap" || contribution.Rule == "points-cap") && contribution.Points < 0 {
+				byRule[contribution.Rule] -= contribution.Points
+				total -= contribution.Points
+			}
+			if contribution.Uncapped != nil {
+				byRule["points-cap"] += *contribution.Uncapped - contribution.Points
+				total += *contribution.Uncapped - contribution.Points
+			}
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	return []Insight{{
+		Type:  "missed-points",
+		Title: strconv.Itoa(total) + " points were capped",
+		Data:  map[string]any{"points": total, "byRule": byRule},
+	}}
+}
+
+// upcomingExpirationsInsight lists the user's held reservations and offers with uses left that
+// expire within the lookahead.
+func upcomingExpirationsInsight(input insightInput) []Insight {
+	type expiration struct {
+		Kind      string    `json:"kind"`
+		ID        string    `json:"id"`
+		Name      string    `json:"name,omitempty"`
+		Points    int       `json:"points,omitempty"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	until := input.now.Add(expirationLookahead)
+	hashes := userIDHashes(input.userID)
+	expirations := []expiration{}
+
+	ledgerMu.Lock()
+	for _, res := range reservations {
+		res.expireLocked(input.now)
+		if res.Status == reservationHeld && slices.Contains(hashes, res.userIDHash) && res.ExpiresAt.Before(until) {
+			expirations = append(expirations, expiration{Kind: "reservation", ID: res.ID, Points: res.Points, ExpiresAt: res.ExpiresAt})
+		}
+	}
+	ledgerMu.Unlock()
+
+	offersMu.RLock()
+	for _, offer := range offers {
+		if !slices.Contains(hashes, offer.userIDHash) || offer.EndDate == "" {
+			continue
+		}
+		// Offers apply to purchases through their end date.
+		end, _ := time.Parse("2006-01-02", offer.EndDate)
+		end = end.AddDate(0, 0, 1)
+		if !end.After(input.now) || !end.Before(until) {
+			continue
+		}
+		if view := viewOffer(offer); offer.MaxUses == 0 || view.Uses < offer.MaxUses {
+			expirations = append(expirations, expiration{Kind: "offer", ID: offer.ID, Name: offer.Name, ExpiresAt: end})
+		}
+	}
+	offersMu.RUnlock()
+
+	if len(expirations) == 0 {
+		return nil
+	}
+	sort.Slice(expirations, func(i, j int) bool { return expirations[i].ExpiresAt.Before(expirations[j].ExpiresAt) })
+	return []Insight{{Type: "upcoming-expirations", Title: "Ending soon", Data: expirations}}
+}
+
+// getInsightsHandler runs the insight pipeline over a user's receipts.
+func getInsightsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+	now, ok := requestTime(w, r, tenantFromRequest(r))
+	if !ok {
+		return
+	}
+	input := insightInput{userID: userID, now: now.UTC()}
+	for _, receipt := range listUserReceipts(userID) {
+		if receipt.Status == statusScored && receipt.DeletedAt == nil {
+			input.receipts = append(input.receipts, receipt)
+		}
+	}
+
+	insights := []Insight{}
+	for _, generate := range insightPipeline {
+		insights = append(insights, generate(input)...)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"userId": userID, "insights": insights})
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Job statuses.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobCompleted = "completed"
+)
+
+// Job priorities. Each priority has its own queue and worker pool, so a large backfill can't
+// delay receipts submitted by live users.
+const (
+	priorityRealtime = "realtime"
+	priorityStandard = "standard"
+	priorityBackfill = "backfill"
+)
+
+const (
+	defaultResultsLimit = 100
+	maxResultsWait      = 30 * time.Second
+)
+
+// RetryPolicy controls how often a job retries an item that failed with a transient error, such
+// as a store failure, before moving it to the job's dead letters. The delay between attempts
+// starts at Backoff and doubles after each one.
+type RetryPolicy struct {
+	MaxAttempts int      `json:"maxAttempts"`
+	Backoff     duration `json:"backoff"`
+}
+
+var defaultRetryPolicy = RetryPolicy{MaxAttempts: 3, Backoff: duration(time.Second)}
+
+// Limits of retry policies, so an item isn't retried, or waited for, without end.
+const (
+	maxRetryAttempts = 10
+	maxRetryBackoff  = time.Hour
+)
+
+// delay is how long to wait before the next attempt at an item attempted attempts times: Backoff,
+// doubled after each attempt, up to maxRetryBackoff.
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	delay := time.Duration(p.Backoff)
+	for i := 1; i < attempts && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryBackoff)
+}
+
+// jobRetention is how long a job is kept once completed, for its results to be read. 0 keeps jobs
+// until the instance stops.
+var jobRetention = 24 * time.Hour
+
+// Job is an asynchronous batch of receipts. Results are appended in the order items finish, so a
+// cursor into them lets callers read completed results while the rest of the job is still running.
+type Job struct {
+	mu          sync.Mutex
+	id          string
+	tenantID    string
+	status      string
+	priority    string
+	createdAt   time.Time
+	completedAt time.Time
+	callbackURL string
+	retry       RetryPolicy
+	items       []jobItem
+	finished    int
+	results     []JobResult
+	// changed is closed and replaced whenever a result is added, waking long-polling readers.
+	changed chan struct{}
+}
+
+type jobItem struct {
+	raw           json.RawMessage
+	attempts      int
+	lastAttemptAt time.Time
+	// failure is set while the item is dead-lettered.
+	failure *JobFailure
+}
+
+type JobResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Points int    `json:"points"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// JobFailure is a dead-lettered item. Retryable failures can be re-queued with retry-failures;
+// the others, such as invalid receipts, would fail the same way again.
+type JobFailure struct {
+	Index         int             `json:"index"`
+	Error         string          `json:"error"`
+	Retryable     bool            `json:"retryable"`
+	Attempts      int             `json:"attempts"`
+	LastAttemptAt time.Time       `json:"lastAttemptAt"`
+	Receipt       json.RawMessage `json:"receipt"`
+}
+
+type jobTask struct {
+	job   *Job
+	index int
+}
+
+var (
+	jobsMu sync.RWMutex
+	jobs   = map[string]*Job{}
+
+	// jobQueues holds the task queue for each priority.
+	jobQueues = map[string]*tenantQueue{}
+)
+
+// startJobWorkers starts a worker pool per priority with the given number of workers. Every
+// priority gets at least one worker so its jobs always make progress.
+func startJobWorkers(workers map[string]int) {
+	for priority, n := range workers {
+		queue := newTenantQueue()
+		jobQueues[priority] = queue
+		for i := 0; i < max(n, 1); i++ {
+			go func() {
+				for {
+					task := queue.next()
+					runJobTask(task)
+					queue.done(task)
+				}
+			}()
+		}
+	}
+}
+
+// startJobSweeper removes the jobs completed more than jobRetention ago, every interval.
+func startJobSweeper(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			sweepCompletedJobs(time.Now())
+		}
+	}()
+}
+
+func sweepCompletedJobs(now time.Time) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for id, job := range jobs {
+		job.mu.Lock()
+		expired := job.status == jobCompleted && now.Sub(job.completedAt) > jobRetention
+		job.mu.Unlock()
+		if expired {
+			delete(jobs, id)
+		}
+	}
+}
+
+// drainJobQueues waits for the job workers to finish the items queued and in progress, or for ctx
+// to be done. Retries still waiting for their backoff aren't waited for.
+func drainJobQueues(ctx context.Context) error {
+	for {
+		idle := true
+		for _, queue := range jobQueues {
+			idle = idle && queue.idle()
+		}
+		if idle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (t jobTask) enqueue() {
+	jobQueues[t.job.priority].push(t)
+}
+
+func runJobTask(task jobTask) {
+	job := task.job
+	job.mu.Lock()
+	if job.status == jobQueued {
+		job.status = jobRunning
+	}
+	item := &job.items[task.index]
+	item.attempts++
+	item.lastAttemptAt = time.Now().UTC()
+	raw, attempts := item.raw, item.attempts
+	job.mu.Unlock()
+
+	var receipt Receipt
+	if err := json.Unmarshal(raw, &receipt); err != nil {
+		job.fail(task.index, "The receipt is invalid.", false)
+		return
+	}
+	if errs, _ := validateReceipt(receipt, time.Now()); len(errs) > 0 {
+		job.fail(task.index, describeValidationErrors(errs), false)
+		return
+	}
+	ctx, span := startSpan(context.Background(), "job.item")
+	span.set("job.id", job.id)
+	span.set("job.item", task.index)
+	processed, err := submitReceipt(ctx, receipt, job.tenantID, time.Now())
+	if !errors.Is(err, errDuplicateReceipt) {
+		span.fail(err)
+	}
+	span.End()
+	if errors.Is(err, errDuplicateReceipt) {
+		if duplicateResponse == duplicateConflict {
+			job.fail(task.index, "The receipt was already submitted as "+processed.ID+".", false)
+			return
+		}
+		err = nil
+	}
+	if errors.Is(err, errReplayedSignature) {
+		job.fail(task.index, "The device already signed another receipt with that nonce.", false)
+		return
+	}
+	if err != nil {
+		if attempts < job.retry.MaxAttempts {
+			delay := job.retry.delay(attempts)
+			log.Printf("Job %s item %d: attempt %d failed, retrying in %s: %v", job.id, task.index, attempts, delay, err)
+			time.AfterFunc(delay, task.enqueue)
+			return
+		}
+		job.fail(task.index, err.Error(), true)
+		return
+	}
+	job.finish(JobResult{Index: task.index, ID: processed.ID, Points: processed.Points, Status: processed.Status})
+}
+
+func (j *Job) fail(index int, message string, retryable bool) {
+	j.mu.Lock()
+	item := &j.items[index]
+	item.failure = &JobFailure{
+		Index:         index,
+		Error:         message,
+		Retryable:     retryable,
+		Attempts:      item.attempts,
+		LastAttemptAt: item.lastAttemptAt,
+		Receipt:       item.raw,
+	}
+	j.mu.Unlock()
+	j.finish(JobResult{Index: index, Error: message})
+}
+
+// finish records an item's final result, completing the job and firing its callback when it was
+// the last one outstanding.
+func (j *Job) finish(result JobResult) {
+	j.mu.Lock()
+	j.results = append(j.results, result)
+	j.finished++
+	close(j.changed)
+	j.changed = make(chan struct{})
+
+	done := j.finished == len(j.items)
+	if done {
+		j.status = jobCompleted
+		j.completedAt = time.Now().UTC()
+	}
+	j.mu.Unlock()
+
+	if done {
+		notifyJobCallback(j)
+	}
+}
+
+func (j *Job) summary() map[string]any {
+	failed := 0
+	for _, item := range j.items {
+		if item.failure != nil {
+			failed++
+		}
+	}
+	summary := map[string]any{
+		"id":        j.id,
+		"status":    j.status,
+		"priority":  j.priority,
+		"total":     len(j.items),
+		"completed": j.finished,
+		"failed":    failed,
+		"createdAt": j.createdAt,
+	}
+	if !j.completedAt.IsZero() {
+		summary["completedAt"] = j.completedAt
+	}
+	return summary
+}
+
+func notifyJobCallback(job *Job) {
+	job.mu.Lock()
+	url, summary := job.callbackURL, job.summary()
+	job.mu.Unlock()
+	if url == "" {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := postSignedJSON(ctx, url, nil, summary); err != nil {
+			log.Printf("Job %s: completion callback failed: %v", summary["id"], err)
+		}
+	}()
+}
+
+func createJobHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Receipts    []json.RawMessage `json:"receipts"`
+		CallbackURL string            `json:"callbackUrl"`
+		Retry       *RetryPolicy      `json:"retry"`
+		Priority    string            `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Receipts) == 0 {
+		http.Error(w, "The job is invalid.", http.StatusBadRequest)
+		return
+	}
+	if request.CallbackURL != "" {
+		if err := checkWebhookURL(request.CallbackURL); err != nil {
+			http.Error(w, "The callback URL is invalid: "+err.Error()+".", http.StatusBadRequest)
+			return
+		}
+	}
+	priority := orDefault(request.Priority, priorityStandard)
+	if _, ok := jobQueues[priority]; !ok {
+		http.Error(w, "The priority is invalid.", http.StatusBadRequest)
+		return
+	}
+	retry := defaultRetryPolicy
+	if request.Retry != nil {
+		retry = *request.Retry
+		if retry.MaxAttempts < 1 || retry.MaxAttempts > maxRetryAttempts || retry.Backoff < 0 || time.Duration(retry.Backoff) > maxRetryBackoff {
+			http.Error(w, "The retry policy is invalid.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	job := &Job{
+		id:          uuid.New().String(),
+		tenantID:    tenantFromRequest(r),
+		status:      jobQueued,
+		priority:    priority,
+		createdAt:   time.Now().UTC(),
+		callbackURL: request.CallbackURL,
+		retry:       retry,
+		items:       make([]jobItem, len(request.Receipts)),
+		changed:     make(chan struct{}),
+	}
+	for i, raw := range request.Receipts {
+		job.items[i].raw = raw
+	}
+	jobsMu.Lock()
+	jobs[job.id] = job
+	jobsMu.Unlock()
+
+	indexes := make([]int, len(job.items))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	enqueueJobItems(job, indexes)
+
+	job.mu.Lock()
+	summary := job.summary()
+	job.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(summary)
+}
+
+func enqueueJobItems(job *Job, indexes []int) {
+	for _, i := range indexes {
+		jobTask{job: job, index: i}.enqueue()
+	}
+}
+
+func getJob(id string) (*Job, bool) {
+	jobsMu.RLock()
+	defer jobsMu.RUnlock()
+	job, exists := jobs[id]
+	return job, exists
+}
+
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, exists := getJob(mux.Vars(r)["id"])
+	if !exists {
+		http.Error(w, "No job found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	job.mu.Lock()
+	summary := job.summary()
+	job.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// jobResultsHandler returns results completed after cursor. With wait=N it waits up to N seconds
+// for new results when none are available yet.
+func jobResultsHandler(w http.ResponseWriter, r *http.Request) {
+	job, exists := getJob(mux.Vars(r)["id"])
+	if !exists {
+		http.Error(w, "No job found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	cursor, err := parseNonNegative(query.Get("cursor"), 0)
+	if err != nil {
+		http.Error(w, "The cursor is invalid.", http.StatusBadRequest)
+		return
+	}
+	limit, err := parseNonNegative(query.Get("limit"), defaultResultsLimit)
+	if err != nil || limit == 0 {
+		http.Error(w, "The limit is invalid.", http.StatusBadRequest)
+		return
+	}
+	wait, err := parseNonNegative(query.Get("wait"), 0)
+	if err != nil {
+		http.Error(w, "The wait is invalid.", http.StatusBadRequest)
+		return
+	}
+	deadline := time.After(min(time.Duration(wait)*time.Second, maxResultsWait))
+
+	job.mu.Lock()
+	for cursor >= len(job.results) && job.status != jobCompleted && wait > 0 {
+		changed := job.changed
+		job.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			wait = 0
+		case <-r.Context().Done():
+			return
+		}
+		job.mu.Lock()
+	}
+	start := min(cursor, len(job.results))
+	end := min(start+limit, len(job.results))
+	results := append([]JobResult{}, job.results[start:end]...)
+	done := job.status == jobCompleted && end == len(job.results)
+	job.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"results":    results,
+		"nextCursor": strconv.Itoa(end),
+		"done":       done,
+	})
+}
+
+func jobFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	job, exists := getJob(mux.Vars(r)["id"])
+	if !exists {
+		http.Error(w, "No job found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	job.mu.Lock()
+	failures := []JobFailure{}
+	for _, item := range job.items {
+		if item.failure != nil {
+			failures = append(failures, *item.failure)
+		}
+	}
+	job.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"failures": failures})
+}
+
+// retryJobFailuresHandler re-queues every retryable dead letter with a fresh set of attempts.
+// Their new results are appended to the job's results as they finish.
+func retryJobFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	job, exists := getJob(mux.Vars(r)["id"])
+	if !exists {
+		http.Error(w, "No job found for that ID.", http.StatusNotFound)
+		return
+	}
+
+	job.mu.Lock()
+	var indexes []int
+	for i := range job.items {
+		item := &job.items[i]
+		if item.failure != nil && item.failure.Retryable {
+			item.failure = nil
+			item.attempts = 0
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) > 0 {
+		job.finished -= len(indexes)
+		job.status = jobRunning
+		job.completedAt = time.Time{}
+	}
+	job.mu.Unlock()
+
+	enqueueJobItems(job, indexes)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"retried": len(indexes)})
+}
+
+func parseNonNegative(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return n, nil
+}
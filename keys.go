@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Key rings for signed and encrypted artifacts.
+const (
+	keyRingWebhookSigning = "webhook-signing"
+	keyRingAttachmentURLs = "attachment-urls"
+	keyRingIdentity       = "identity"
+)
+
+const defaultRotationGrace = 24 * time.Hour
+
+// keyRing holds the current key for signing or encrypting, and earlier keys that are still accepted
+// until their grace period ends, so holders of old signatures or ciphertexts keep working while
+// they roll over.
+type keyRing struct {
+	name string
+	// reseal re-encrypts the data stored under the ring's keys with the current key. It is set
+	// for rings whose keys encrypt stored data rather than sign, and runs after a rotation with
+	// the ring unlocked. Earlier keys only start their grace period once it has succeeded.
+	reseal func() error
+
+	mu   sync.RWMutex
+	keys []ringKey
+}
+
+type ringKey struct {
+	ID        string     `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RetiresAt *time.Time `json:"retiresAt,omitempty"`
+	secret    []byte
+}
+
+var keyRings = map[string]*keyRing{}
+
+func newKeyRing(name string, secret []byte, reseal func() error) *keyRing {
+	ring := &keyRing{name: name, reseal: reseal}
+	if secret != nil {
+		ring.keys = []ringKey{{ID: newKeyID(), CreatedAt: time.Now().UTC(), secret: secret}}
+	}
+	keyRings[name] = ring
+	return ring
+}
+
+func newKeyID() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// randomSecret returns a new hex-encoded secret, usable as is by partners verifying signatures.
+func randomSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return []byte(hex.EncodeToString(secret))
+}
+
+// current returns the key new artifacts are made with, or nil if the ring is empty.
+func (k *keyRing) current() []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[0].secret
+}
+
+// currentKey returns the current key with its ID.
+func (k *keyRing) currentKey() (ringKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return ringKey{}, false
+	}
+	return k.keys[0], true
+}
+
+// accepted returns the current key followed by every earlier key still in its grace period.
+func (k *keyRing) accepted() [][]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	secrets := make([][]byte, 0, len(k.keys))
+	for _, key := range k.keys {
+		if key.RetiresAt == nil || now.Before(*key.RetiresAt) {
+			secrets = append(secrets, key.secret)
+		}
+	}
+	return secrets
+}
+
+// rotate makes secret the current key, keeping the previous keys accepted for grace, and drops
+// keys whose grace period has ended. On a ring that encrypts, the previous keys stay accepted
+// without a retirement date until the stored data is resealed with the new key; if that fails,
+// they stay accepted and the error is returned.
+func (k *keyRing) rotate(secret []byte, grace time.Duration) (ringKey, error) {
+	k.mu.Lock()
+	now := time.Now().UTC()
+	key := ringKey{ID: newKeyID(), CreatedAt: now, secret: secret}
+	k.keys = append([]ringKey{key}, k.keys...)
+	if k.reseal == nil {
+		k.retireLocked(now, grace)
+	}
+	k.mu.Unlock()
+
+	if k.reseal == nil {
+		return key, nil
+	}
+	if err := k.reseal(); err != nil {
+		return key, err
+	}
+	k.mu.Lock()
+	k.retireLocked(time.Now().UTC(), grace)
+	k.mu.Unlock()
+	return key, nil
+}
+
+// retireLocked starts the grace period of every key but the current one, and drops the keys whose
+// grace period has ended. k.mu must be held.
+func (k *keyRing) retireLocked(now time.Time, grace time.Duration) {
+	retires := now.Add(grace)
+	keys := k.keys[:1]
+	for _, old := range k.keys[1:] {
+		if old.RetiresAt == nil || old.RetiresAt.After(retires) {
+			old.RetiresAt = &retires
+		}
+		if old.RetiresAt.After(now) {
+			keys = append(keys, old)
+		}
+	}
+	k.keys = keys
+}
+
+func (k *keyRing) list() []ringKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]ringKey{}, k.keys...)
+}
+
+// webhookSignature returns the X-Receipt-Signature header for a webhook body sent at t: the
+// timestamp and an HMAC-SHA256 of "<timestamp>.<body>" with every accepted signing key, so
+// receivers configured with either the old or the new secret can verify it during a rotation.
+// It returns "" when no signing key is configured.
+func webhookSignature(body []byte, t time.Time) string {
+	secrets := keyRings[keyRingWebhookSigning].accepted()
+	if len(secrets) == 0 {
+		return ""
+	}
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	parts := []string{"t=" + timestamp}
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		parts = append(parts, "v1="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.Join(parts, ",")
+}
+
+func listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	response := map[string][]ringKey{}
+	for name, ring := range keyRings {
+		response[name] = ring.list()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"keyRings": response})
+}
+
+// rotateKeyHandler replaces the current key of a ring. The new webhook signing secret is returned
+// so it can be shared with partners; other secrets never leave the server.
+//
+// Rings that encrypt stored data need a grace period, for instances still sealing with the
+// previous key, and a new secret from the secrets provider, given as a "secret:" reference: a
+// random or inline secret would only be kept in memory, and the data resealed with it would be
+// unreadable after a restart.
+func rotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	ring, exists := keyRings[mux.Vars(r)["ring"]]
+	if !exists {
+		http.Error(w, "No key ring found with that name.", http.StatusNotFound)
+		return
+	}
+	request := struct {
+		GracePeriod duration `json:"gracePeriod"`
+		Secret      string   `json:"secret"`
+	}{GracePeriod: duration(defaultRotationGrace)}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.GracePeriod < 0 {
+			http.Error(w, "The rotation is invalid.", http.StatusBadRequest)
+			return
+		}
+	}
+	if ring.reseal != nil {
+		switch {
+		case request.GracePeriod == 0:
+			http.Error(w, "Keys that encrypt stored data need a grace period.", http.StatusBadRequest)
+			return
+		case !strings.HasPrefix(request.Secret, secretRefPrefix):
+			http.Error(w, "Keys that encrypt stored data must be rotated to a secret: reference to the secrets provider.", http.StatusBadRequest)
+			return
+		}
+		if err := resolveSecrets(&request.Secret); err != nil || request.Secret == "" {
+			http.Error(w, "The secret could not be loaded from the secrets provider.", http.StatusBadRequest)
+			return
+		}
+	}
+	secret := randomSecret()
+	if request.Secret != "" {
+		secret = []byte(request.Secret)
+	}
+
+	key, err := ring.rotate(secret, time.Duration(request.GracePeriod))
+	if err != nil {
+		log.Printf("Resealing after rotating key ring %s: %v", ring.name, err)
+		http.Error(w, "The key was rotated, but not all stored data could be re-encrypted with it; the previous keys stay accepted. Rotate again to retry.", http.StatusInternalServerError)
+		return
+	}
+	response := map[string]any{"keyRing": ring.name, "key": key, "keys": ring.list()}
+	if ring.name == keyRingWebhookSigning {
+		response["secret"] = string(secret)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
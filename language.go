@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// languageMarkers are the words and letters that give away the language of item descriptions.
+// Receipts abbreviate heavily, so a few common words and accented letters are a better signal than
+// any statistical model would get from a handful of short lines.
+var languageMarkers = map[string]struct {
+	words   []string
+	letters string
+}{
+	"en": {[]string{"and", "with", "of", "the", "pk", "oz", "lb", "chicken", "cheese", "milk", "water", "bread", "juice"}, ""},
+	"fr": {[]string{"et", "avec", "de", "du", "des", "le", "la", "les", "au", "aux", "poulet", "fromage", "lait", "eau", "pain", "jus", "sans"}, "àâçèéêëîïôûœ"},
+	"es": {[]string{"y", "con", "de", "del", "el", "la", "los", "las", "pollo", "queso", "leche", "agua", "pan", "jugo", "sin"}, "áíñóú¿¡"},
+}
+
+// detectLanguage guesses the language of a receipt's item descriptions, returning "" when no
+// language stands out.
+func detectLanguage(items []Item) string {
+	scores := map[string]int{}
+	for _, item := range items {
+		description := strings.ToLower(item.ShortDescription)
+		words := strings.FieldsFunc(description, func(r rune) bool { return !unicode.IsLetter(r) })
+		for language, markers := range languageMarkers {
+			for _, word := range words {
+				for _, marker := range markers.words {
+					if word == marker {
+						scores[language]++
+					}
+				}
+			}
+			for _, letter := range description {
+				if strings.ContainsRune(markers.letters, letter) {
+					scores[language] += 2
+				}
+			}
+		}
+	}
+
+	best, bestScore, tied := "", 0, false
+	for language, score := range scores {
+		switch {
+		case score > bestScore:
+			best, bestScore, tied = language, score, false
+		case score == bestScore:
+			tied = true
+		}
+	}
+	if tied {
+		return ""
+	}
+	return best
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Ledger entry types. Earn and reversal entries follow a receipt's points as it is scored,
+// approved, corrected, deleted or restored; redemption entries spend points. A transfer between
+// users posts a transfer-out and a transfer-fee entry to the sender and a transfer-in entry to the
+// recipient.
+const (
+	entryEarn        = "earn"
+	entryReversal    = "reversal"
+	entryRedemption  = "redemption"
+	entryTransferOut = "transfer-out"
+	entryTransferIn  = "transfer-in"
+	entryTransferFee = "transfer-fee"
+)
+
+// LedgerEntry is one signed movement of a user's points. Entries are only ever appended; a user's
+// balance is the sum of their entries. Each entry is also a balanced double-entry posting of
+// |Points| from the Debit to the Credit account (see accounting.go), and Hash chains it to the
+// entry before it.
+type LedgerEntry struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Points    int    `json:"points"`
+	TenantID  string `json:"tenantId"`
+	ReceiptID string `json:"receiptId,omitempty"`
+	Reference string `json:"reference,omitempty"`
+	// Contract is the partner contract an earn or reversal entry's receipt was scored under.
+	Contract *ContractRef `json:"contract,omitempty"`
+	// TransferID links the entries posted by one transfer.
+	TransferID string `json:"transferId,omitempty"`
+	// IdempotencyKey is the Idempotency-Key a redemption was made with, so a retry of it is
+	// recognized.
+	IdempotencyKey string    `json:"idempotencyKey,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	Debit          string    `json:"debit"`
+	Credit         string    `json:"credit"`
+	Hash           string    `json:"hash"`
+	// HashVersion is how Hash was computed; see entryHash.
+	HashVersion int `json:"hashVersion,omitempty"`
+
+	// The user is kept sealed like a stored receipt's; see sealUserID.
+	userIDHash   string
+	sealedUserID []byte
+}
+
+// ledgerLock guards the ledger. With a shared ledger store it also holds the store's lock, and
+// reads the entries other instances appended before the ledger is used. If the store can't be
+// locked or read, the ledger is read as this instance last saw it, and nothing is appended until
+// the lock is taken again.
+type ledgerLock struct {
+	mu     sync.Mutex
+	unlock func()
+	err    error
+}
+
+func (l *ledgerLock) Lock() {
+	l.mu.Lock()
+	shared, ok := ledgerStore.(sharedLedgerStore)
+	if !ok {
+		return
+	}
+	unlock, err := shared.Lock()
+	if err == nil {
+		l.unlock = unlock
+		err = syncLedgerLocked(shared)
+	}
+	if err != nil {
+		log.Printf("Locking the shared ledger: %v", err)
+		l.err = err
+	}
+}
+
+func (l *ledgerLock) Unlock() {
+	if l.unlock != nil {
+		l.unlock()
+	}
+	l.unlock, l.err = nil, nil
+	l.mu.Unlock()
+}
+
+// syncLedgerLocked appends the entries other instances appended to the store since this one last
+// read it. ledgerMu must be held.
+func syncLedgerLocked(store sharedLedgerStore) error {
+	entries, err := store.ListFrom(len(ledger))
+	if err != nil {
+		return err
+	}
+	ledger = append(ledger, entries...)
+	for _, entry := range entries {
+		if entry.Type == entryEarn || entry.Type == entryReversal {
+			receiptCredits[entry.ReceiptID] += entry.Points
+		}
+	}
+	return nil
+}
+
+var (
+	ledgerMu ledgerLock
+	ledger   []LedgerEntry
+	// ledgerStore keeps the entries across restarts. Entries are stored before they are appended
+	// to ledger.
+	ledgerStore LedgerStore = &memoryLedgerStore{}
+	// receiptCredits is the net points posted for each receipt so far.
+	receiptCredits = map[string]int{}
+)
+
+// loadLedger reads the entries of store back, which then keeps the entries appended from now on.
+func loadLedger(store LedgerStore) error {
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	ledgerStore, ledger = store, entries
+	receiptCredits = map[string]int{}
+	for _, entry := range entries {
+		if entry.Type == entryEarn || entry.Type == entryReversal {
+			receiptCredits[entry.ReceiptID] += entry.Points
+		}
+	}
+	return nil
+}
+
+// startLedger keeps the ledger in step with receipt lifecycle events. It must run before any
+// subscriber that reads balances, so they see the receipt's points already posted.
+func startLedger() {
+	subscribe(func(event Event) {
+		switch event.Type {
+		case eventReceiptProcessed, eventReceiptApproved, eventReceiptReprocessed,
+			eventReceiptRejected, eventReceiptDeleted, eventReceiptRestored:
+		default:
+			return
+		}
+		receipt, exists := getReceipt(event.ReceiptID)
+		if !exists {
+			return
+		}
+		ledgerMu.Lock()
+		defer ledgerMu.Unlock()
+		if err := postReceiptLocked(receipt); err != nil {
+			log.Printf("Posting receipt %s to the ledger: %v", receipt.ID, err)
+		}
+	})
+}
+
+// ledgerPosting is an entry to post against a user.
+type ledgerPosting struct {
+	userID string
+	entry  LedgerEntry
+}
+
+// receiptPostingLocked returns the posting that brings the points credited for receipt in line
+// with what it currently earns, if they aren't in line. Sandbox receipts are never posted. It
+// tracks the receipt's costs as it goes. ledgerMu must be held.
+func receiptPostingLocked(receipt ProcessedReceipt) (ledgerPosting, bool) {
+	if receipt.Receipt.UserID == "" || tenantIsSandbox(receipt.TenantID) {
+		return ledgerPosting{}, false
+	}
+	counted := receipt.Status == statusScored && receipt.DeletedAt == nil
+	trackReceiptCosts(receipt, counted)
+	earned := 0
+	if counted {
+		earned = receipt.Points
+	}
+	delta := earned - receiptCredits[receipt.ID]
+	if delta == 0 {
+		return ledgerPosting{}, false
+	}
+	entryType := entryEarn
+	if delta < 0 {
+		entryType = entryReversal
+	}
+	return ledgerPosting{receipt.Receipt.UserID, LedgerEntry{
+		Type:      entryType,
+		Points:    delta,
+		TenantID:  receipt.TenantID,
+		ReceiptID: receipt.ID,
+		Contract:  receipt.Contract,
+	}}, true
+}
+
+// postReceiptLocked posts the entry that brings the points credited for receipt in line with
+// what it currently earns. Posting a receipt that is already in line is a no-op, so it's safe to
+// repeat. ledgerMu must be held.
+func postReceiptLocked(receipt ProcessedReceipt) error {
+	posting, ok := receiptPostingLocked(receipt)
+	if !ok {
+		return nil
+	}
+	_, err := postEntriesLocked(posting)
+	return err
+}
+
+// appendEntryLocked records entry against userID. ledgerMu must be held.
+func appendEntryLocked(userID string, entry LedgerEntry) (LedgerEntry, error) {
+	entries, err := postEntriesLocked(ledgerPosting{userID, entry})
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	return entries[0], nil
+}
+
+// postEntriesLocked records the postings in order, all or none: they are stored together before
+// they are appended to the ledger. ledgerMu must be held.
+func postEntriesLocked(postings ...ledgerPosting) ([]LedgerEntry, error) {
+	if ledgerMu.err != nil {
+		return nil, fmt.Errorf("shared ledger unavailable: %w", ledgerMu.err)
+	}
+	previous := ""
+	if len(ledger) > 0 {
+		previous = ledger[len(ledger)-1].Hash
+	}
+	entries := make([]LedgerEntry, len(postings))
+	for i, posting := range postings {
+		entry := posting.entry
+		entry.ID = uuid.New().String()
+		entry.CreatedAt = time.Now().UTC()
+		entry.userIDHash, entry.sealedUserID = sealUserID(posting.userID, entry.ID)
+		entry.Debit, entry.Credit = entryAccounts(entry)
+		entry.HashVersion = ledgerHashUserBound
+		entry.Hash = entryHash(previous, entry, posting.userID)
+		previous = entry.Hash
+		entries[i] = entry
+	}
+	if err := ledgerStore.Append(entries...); err != nil {
+		return nil, err
+	}
+	ledger = append(ledger, entries...)
+	for i, entry := range entries {
+		if entry.Type == entryEarn || entry.Type == entryReversal {
+			receiptCredits[entry.ReceiptID] += entry.Points
+			recordHouseholdEarning(postings[i].userID, entry.Points)
+		}
+	}
+	return entries, nil
+}
+
+// balanceLocked sums the user's ledger entries. ledgerMu must be held.
+func balanceLocked(userID string) int {
+	hashes := userIDHashes(userID)
+	balance := 0
+	for _, entry := range ledger {
+		if slices.Contains(hashes, entry.userIDHash) {
+			balance += entry.Points
+		}
+	}
+	return balance
+}
+
+// userBalance returns the points a user currently holds.
+func userBalance(userID string) int {
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	return balanceLocked(userID)
+}
+
+// resealLedger re-encrypts the user of every ledger entry and reservation with the current
+// identity key, in memory and in the ledger store. An entry the store fails to reseal keeps its
+// previous seal, which stays readable until the previous key retires. It returns how many entries
+// and reservations it couldn't reseal.
+func resealLedger() (failed int) {
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	for i, entry := range ledger {
+		userID, ok := openUserID(entry.sealedUserID, entry.ID)
+		if !ok {
+			log.Printf("Decrypting user of ledger entry %s: no accepted identity key", entry.ID)
+			failed++
+			continue
+		}
+		entry.userIDHash, entry.sealedUserID = sealUserID(userID, entry.ID)
+		if err := ledgerStore.Reseal(entry); err != nil {
+			log.Printf("Resealing ledger entry %s: %v", entry.ID, err)
+			failed++
+			continue
+		}
+		ledger[i] = entry
+	}
+	return failed + resealReservationsLocked()
+}
+
+func getBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+	if !actsForUser(r, userID) {
+		http.Error(w, "Reading a balance needs the user's token or the admin token.", http.StatusForbidden)
+		return
+	}
+	ledgerMu.Lock()
+	balance := balanceLocked(userID)
+	held := heldLocked(userIDHashes(userID))
+	ledgerMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"userId":    userID,
+		"balance":   balance,
+		"held":      held,
+		"available": balance - held,
+	})
+}
+
+// listTransactionsHandler returns a user's ledger entries, oldest first, from the cursor on: the
+// number of the user's entries already read. As entries are only appended, the nextCursor of the
+// last page returns the entries posted since.
+func listTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+	if !actsForUser(r, userID) {
+		http.Error(w, "Reading transactions needs the user's token or the admin token.", http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+	cursor, err := parseNonNegative(query.Get("cursor"), 0)
+	if err != nil {
+		http.Error(w, "The cursor is invalid.", http.StatusBadRequest)
+		return
+	}
+	limit, err := parseNonNegative(query.Get("limit"), defaultResultsLimit)
+	if err != nil || limit == 0 {
+		http.Error(w, "The limit is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	hashes := userIDHashes(userID)
+	transactions := []LedgerEntry{}
+	seen := 0
+	ledgerMu.Lock()
+	for _, entry := range ledger {
+		if !slices.Contains(hashes, entry.userIDHash) {
+			continue
+		}
+		if seen >= cursor && len(transactions) < limit {
+			transactions = append(transactions, entry)
+		}
+		seen++
+	}
+	ledgerMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"userId":       userID,
+		"transactions": transactions,
+		"nextCursor":   strconv.Itoa(cursor + len(transactions)),
+	})
+}
+
+type processAndRedeemRequest struct {
+	Receipt    Receipt `json:"receipt"`
+	Redemption struct {
+		Points    int    `json:"points"`
+		Reference string `json:"reference"`
+	} `json:"redemption"`
+}
+
+// processAndRedeemHandler processes a receipt and spends points from the submitting user's
+// balance in one step. Either both happen or neither does: the receipt is only stored once the
+// redemption is known to be covered by the user's available points plus the receipt's own
+// points. Spending needs the user's own token or the admin token; submission tokens and device
+// keys only vouch for the submission. The receipt is scored before the ledger is locked, so a
+// slow scoring model doesn't hold up other users' ledger.
+func processAndRedeemHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, tenantID, ok := authenticateSubmitter(w, r)
+	if !ok {
+		return
+	}
+
+	var req processAndRedeemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		recordDeviceSubmission(deviceID, ProcessedReceipt{}, errors.New("invalid receipt JSON"))
+		http.Error(w, "The request is invalid.", http.StatusBadRequest)
+		return
+	}
+	if req.Receipt.UserID == "" {
+		http.Error(w, "A receipt userId is required to redeem points.", http.StatusBadRequest)
+		return
+	}
+	if req.Redemption.Points <= 0 {
+		http.Error(w, "redemption points must be positive.", http.StatusBadRequest)
+		return
+	}
+	if !actsForUser(r, req.Receipt.UserID) {
+		http.Error(w, "Redeeming points needs the user's token or the admin token.", http.StatusForbidden)
+		return
+	}
+	if tenantIsSandbox(tenantID) {
+		http.Error(w, "Sandbox receipts don't earn points that can be redeemed.", http.StatusForbidden)
+		return
+	}
+	if !admitReceipt(r.Context(), w, &req.Receipt, deviceID) {
+		return
+	}
+	userID := req.Receipt.UserID
+
+	// A receipt submitted again is refused in any case, its points having been counted already.
+	hash, unlock := lockContent(req.Receipt)
+	defer unlock()
+	switch err := claimDeviceNonce(req.Receipt, tenantID, hash); {
+	case errors.Is(err, errReplayedSignature):
+		recordDeviceSubmission(req.Receipt.DeviceID, ProcessedReceipt{}, err)
+		http.Error(w, "The device already signed another receipt with that nonce.", http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Storing receipt: %v", err)
+		http.Error(w, "The receipt could not be stored.", http.StatusInternalServerError)
+		return
+	}
+	processed := processReceipt(r.Context(), req.Receipt, tenantID, time.Now())
+	release, stored, err := claimContent(tenantID, hash, processed.ID)
+	switch {
+	case errors.Is(err, errDuplicateReceipt):
+		recordDeviceSubmission(req.Receipt.DeviceID, stored, errDuplicateReceipt)
+		writeDuplicateReceipt(w, stored)
+		return
+	case err != nil:
+		log.Printf("Storing receipt: %v", err)
+		http.Error(w, "The receipt could not be stored.", http.StatusInternalServerError)
+		return
+	}
+
+	ledgerMu.Lock()
+	available := availableLocked(userID)
+	if processed.Status == statusScored {
+		available += processed.Points
+	}
+	if available < req.Redemption.Points {
+		ledgerMu.Unlock()
+		release()
+		writeInsufficientPoints(w, available, req.Redemption.Points)
+		return
+	}
+	if err := saveReceipt(r.Context(), processed); err != nil {
+		ledgerMu.Unlock()
+		release()
+		log.Printf("Storing receipt: %v", err)
+		http.Error(w, "The receipt could not be stored.", http.StatusInternalServerError)
+		return
+	}
+	// The receipt's points and the redemption are posted together; if they can't be, the receipt
+	// is removed again.
+	var postings []ledgerPosting
+	if posting, ok := receiptPostingLocked(processed); ok {
+		postings = append(postings, posting)
+	}
+	postings = append(postings, ledgerPosting{userID, LedgerEntry{
+		Type:      entryRedemption,
+		Points:    -req.Redemption.Points,
+		TenantID:  tenantID,
+		ReceiptID: processed.ID,
+		Reference: req.Redemption.Reference,
+	}})
+	entries, err := postEntriesLocked(postings...)
+	if err != nil {
+		ledgerMu.Unlock()
+		log.Printf("Posting redemption for receipt %s: %v", processed.ID, err)
+		if _, err := purgeReceipt(processed.ID, func(ProcessedReceipt) bool { return true }); err != nil {
+			log.Printf("Removing receipt %s after its redemption failed: %v", processed.ID, err)
+		} else {
+			release()
+		}
+		http.Error(w, "The redemption could not be recorded.", http.StatusInternalServerError)
+		return
+	}
+	redemption := entries[len(entries)-1]
+	balance := balanceLocked(userID)
+	ledgerMu.Unlock()
+
+	recordDeviceSubmission(processed.Receipt.DeviceID, processed, nil)
+	publishSubmission(processed)
+	publishRedemption(userID, redemption, "")
+
+	receipt := map[string]any{"id": processed.ID, "status": processed.Status, "points": processed.Points}
+	if processed.Status != statusScored {
+		receipt["reason"] = processed.StatusReason
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"receipt":    receipt,
+		"redemption": redemption,
+		"balance":    balance,
+	})
+}
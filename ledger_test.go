@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserLedgerNeedsUserOrAdmin(t *testing.T) {
+	resetLedger(t)
+	earnPoints(t, "alice", 100)
+
+	for _, route := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{{"/users/alice/balance", getBalanceHandler}, {"/users/alice/transactions", listTransactionsHandler}} {
+		for asUser, want := range map[string]int{"": http.StatusForbidden, "mallory": http.StatusForbidden, "alice": http.StatusOK} {
+			w := httptest.NewRecorder()
+			route.handler(w, userRequest("GET", route.path, "", asUser, map[string]string{"id": "alice"}))
+			if w.Code != want {
+				t.Errorf("GET %s as %q = %d, want %d", route.path, asUser, w.Code, want)
+			}
+		}
+	}
+}
+
+func TestLedgerHashChain(t *testing.T) {
+	resetLedger(t)
+	earnPoints(t, "alice", 100)
+	earnPoints(t, "bob", 50)
+	if w := redeem("alice", `{"points": 30}`, "alice", "key-1"); w.Code != http.StatusCreated {
+		t.Fatalf("redeem = %d, want 201: %s", w.Code, w.Body)
+	}
+
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	if problems := checkLedgerLocked(); len(problems) > 0 {
+		t.Fatalf("problems in an untouched ledger: %v", problems)
+	}
+	for i, entry := range ledger {
+		if i > 0 && entry.Hash == ledger[i-1].Hash {
+			t.Errorf("entry %d has the hash of the entry before it", i)
+		}
+	}
+
+	original := ledger[2]
+	for name, tamper := range map[string]func(*LedgerEntry){
+		"points":          func(e *LedgerEntry) { e.Points = -3 },
+		"idempotency key": func(e *LedgerEntry) { e.IdempotencyKey = "key-2" },
+		"user":            func(e *LedgerEntry) { e.userIDHash, e.sealedUserID = sealUserID("bob", e.ID) },
+	} {
+		tampered := original
+		tamper(&tampered)
+		ledger[2] = tampered
+		if problems := checkLedgerLocked(); len(problems) == 0 {
+			t.Errorf("changing the %s of an entry went unnoticed", name)
+		}
+	}
+	ledger[2] = original
+
+	// Resealing under a new identity key keeps the chain verifiable.
+	userID, _ := openUserID(ledger[2].sealedUserID, ledger[2].ID)
+	identityKeys.keys = append([]ringKey{{ID: newKeyID(), secret: randomSecret()}}, identityKeys.keys...)
+	ledger[2].userIDHash, ledger[2].sealedUserID = sealUserID(userID, ledger[2].ID)
+	if ledger[2].userIDHash == original.userIDHash {
+		t.Fatal("resealing under a new identity key kept the pseudonym")
+	}
+	if problems := checkLedgerLocked(); len(problems) > 0 {
+		t.Errorf("problems after resealing an entry: %v", problems)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LedgerStore keeps the ledger entries in the order they were appended, with their users sealed.
+// Entries are never changed or removed, except for their sealed user, which Reseal replaces when
+// the identity key is rotated. Append stores its entries all or none. Implementations must be safe
+// for concurrent use.
+type LedgerStore interface {
+	Append(entries ...LedgerEntry) error
+	List() ([]LedgerEntry, error)
+	Reseal(entry LedgerEntry) error
+}
+
+// A sharedLedgerStore is a LedgerStore instances sharing the storage all append to. An instance
+// holds its lock while it uses the ledger, and first reads the entries appended from position on,
+// the ones it hasn't seen, so balances are checked and entries chained against the whole ledger.
+type sharedLedgerStore interface {
+	LedgerStore
+	Lock() (unlock func(), err error)
+	ListFrom(position int) ([]LedgerEntry, error)
+}
+
+// sharedLedgerLockTimeout is how long an instance waits for the lock of a shared ledger store.
+const sharedLedgerLockTimeout = 10 * time.Second
+
+// storedLedgerEntry is a ledger entry as backends that keep bytes serialize it, with its sealed
+// user.
+type storedLedgerEntry struct {
+	LedgerEntry
+	UserIDHash   string `json:"userIdHash"`
+	SealedUserID []byte `json:"sealedUserId"`
+}
+
+func encodeLedgerEntry(entry LedgerEntry) ([]byte, error) {
+	return json.Marshal(storedLedgerEntry{entry, entry.userIDHash, entry.sealedUserID})
+}
+
+func decodeLedgerEntry(data []byte) (LedgerEntry, error) {
+	var stored storedLedgerEntry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return LedgerEntry{}, err
+	}
+	entry := stored.LedgerEntry
+	entry.userIDHash, entry.sealedUserID = stored.UserIDHash, stored.SealedUserID
+	return entry, nil
+}
+
+// newLedgerStore returns the ledger store of the storage backend holding production, so the
+// ledger lives where the receipts do.
+func newLedgerStore(production ReceiptStore) LedgerStore {
+	switch store := production.(type) {
+	case *boltStore:
+		return &boltLedgerStore{db: store.db}
+	case *postgresStore:
+		return &postgresLedgerStore{db: store.db}
+	case *redisStore:
+		return &redisLedgerStore{client: store.client}
+	default:
+		return &memoryLedgerStore{}
+	}
+}
+
+// memoryLedgerStore is the ledger store of the memory storage, which keeps nothing across
+// restarts.
+type memoryLedgerStore struct {
+	mu      sync.Mutex
+	entries []LedgerEntry
+}
+
+func (s *memoryLedgerStore) Append(entries ...LedgerEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+func (s *memoryLedgerStore) List() ([]LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]LedgerEntry{}, s.entries...), nil
+}
+
+func (s *memoryLedgerStore) Reseal(entry LedgerEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.entries {
+		if s.entries[i].ID == entry.ID {
+			s.entries[i].userIDHash, s.entries[i].sealedUserID = entry.userIDHash, entry.sealedUserID
+			return nil
+		}
+	}
+	return fmt.Errorf("no ledger entry %s", entry.ID)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// LegalHold blocks deletion, retention sweeps and erasure of a receipt, or of every receipt of a
+// user, until it is released. Holds can't be edited or removed, only released, and every change is
+// recorded in the audit log.
+type LegalHold struct {
+	ID            string     `json:"id"`
+	ReceiptID     string     `json:"receiptId,omitempty"`
+	UserID        string     `json:"userId,omitempty"`
+	Reason        string     `json:"reason"`
+	PlacedBy      string     `json:"placedBy"`
+	PlacedAt      time.Time  `json:"placedAt"`
+	ReleasedBy    string     `json:"releasedBy,omitempty"`
+	ReleasedAt    *time.Time `json:"releasedAt,omitempty"`
+	ReleaseReason string     `json:"releaseReason,omitempty"`
+}
+
+type LegalHoldAuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	HoldID string    `json:"holdId"`
+	Actor  string    `json:"actor"`
+	Reason string    `json:"reason"`
+}
+
+// Kinds of the records legal holds are kept as, by hold ID, and their audit entries, by time.
+const (
+	legalHoldKind      = "legal-hold"
+	legalHoldAuditKind = "legal-hold-audit"
+)
+
+var (
+	legalHoldsMu    sync.RWMutex
+	legalHolds      = map[string]*LegalHold{}
+	legalHoldsAudit []LegalHoldAuditEntry
+)
+
+// loadLegalHolds reads the legal holds and their audit log from the record store.
+func loadLegalHolds() error {
+	holdRecords, err := recordStore.ListRecords(legalHoldKind)
+	if err != nil {
+		return err
+	}
+	holds := make(map[string]*LegalHold, len(holdRecords))
+	for id, data := range holdRecords {
+		var hold LegalHold
+		if err := json.Unmarshal(data, &hold); err != nil {
+			return fmt.Errorf("legal hold %s: %w", id, err)
+		}
+		holds[hold.ID] = &hold
+	}
+	auditRecords, err := recordStore.ListRecords(legalHoldAuditKind)
+	if err != nil {
+		return err
+	}
+	audit := make([]LegalHoldAuditEntry, 0, len(auditRecords))
+	for _, key := range slices.Sorted(maps.Keys(auditRecords)) {
+		var entry LegalHoldAuditEntry
+		if err := json.Unmarshal(auditRecords[key], &entry); err != nil {
+			return fmt.Errorf("legal hold audit entry %s: %w", key, err)
+		}
+		audit = append(audit, entry)
+	}
+
+	legalHoldsMu.Lock()
+	defer legalHoldsMu.Unlock()
+	legalHolds, legalHoldsAudit = holds, audit
+	return nil
+}
+
+// underLegalHold reports whether an active hold covers the receipt or its user. It works on
+// receipts as stored and as opened.
+func underLegalHold(receipt ProcessedReceipt) bool {
+	legalHoldsMu.RLock()
+	defer legalHoldsMu.RUnlock()
+	for _, hold := range legalHolds {
+		if hold.ReleasedAt == nil && hold.covers(receipt) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether the hold is on receipt, whether or not it was released.
+func (h *LegalHold) covers(receipt ProcessedReceipt) bool {
+	switch {
+	case h.ReceiptID != "":
+		return h.ReceiptID == receipt.ID
+	case receipt.Receipt.UserID != "":
+		return receipt.Receipt.UserID == h.UserID
+	}
+	return receipt.UserIDHash != "" && slices.Contains(userIDHashes(h.UserID), receipt.UserIDHash)
+}
+
+// keepHeldReceipts tells the stores that expire receipts on their own which of the receipts hold
+// covers are now under legal hold, after it was placed or released.
+func keepHeldReceipts(hold LegalHold) {
+	for _, store := range []ReceiptStore{receiptStore, sandboxStore} {
+		keeper, ok := store.(heldReceiptKeeper)
+		if !ok {
+			continue
+		}
+		var receipts []ProcessedReceipt
+		if hold.ReceiptID != "" {
+			if receipt, err := store.Get(hold.ReceiptID); err == nil {
+				receipts = append(receipts, receipt)
+			}
+		} else {
+			for _, receipt := range listStore(store) {
+				if hold.covers(receipt) {
+					receipts = append(receipts, receipt)
+				}
+			}
+		}
+		for _, receipt := range receipts {
+			if err := keeper.KeepHeld(receipt, underLegalHold(receipt)); err != nil {
+				log.Printf("Keeping receipt %s under legal hold %s: %v", receipt.ID, hold.ID, err)
+			}
+		}
+	}
+}
+
+// adminActor names the admin making a request, from the optional X-Admin-User header, for the audit
+// log.
+func adminActor(r *http.Request) string {
+	return orDefault(r.Header.Get("X-Admin-User"), "admin")
+}
+
+// recordLegalHoldChange stores hold and appends the change to the audit log, in the record store
+// and in memory. The change is in neither if it fails. legalHoldsMu must be held.
+func recordLegalHoldChange(action string, hold LegalHold, actor, reason string) error {
+	entry := LegalHoldAuditEntry{
+		Time:   time.Now().UTC(),
+		Action: action,
+		HoldID: hold.ID,
+		Actor:  actor,
+		Reason: reason,
+	}
+	if err := saveRecord(legalHoldKind, hold.ID, hold); err != nil {
+		return err
+	}
+	// Keys sort in the order of the entries.
+	key := fmt.Sprintf("%020d-%s-%s", entry.Time.UnixNano(), hold.ID, action)
+	if err := saveRecord(legalHoldAuditKind, key, entry); err != nil {
+		return err
+	}
+	legalHolds[hold.ID] = &hold
+	legalHoldsAudit = append(legalHoldsAudit, entry)
+	return nil
+}
+
+func placeLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ReceiptID string `json:"receiptId"`
+		UserID    string `json:"userId"`
+		Reason    string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || (request.ReceiptID == "") == (request.UserID == "") {
+		http.Error(w, "A legal hold needs either a receiptId or a userId.", http.StatusBadRequest)
+		return
+	}
+	if request.Reason == "" {
+		http.Error(w, "A reason is required to place a legal hold.", http.StatusBadRequest)
+		return
+	}
+	if request.ReceiptID != "" {
+		if _, exists := getReceipt(request.ReceiptID); !exists {
+			http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+			return
+		}
+	}
+
+	hold := LegalHold{
+		ID:        uuid.New().String(),
+		ReceiptID: request.ReceiptID,
+		UserID:    request.UserID,
+		Reason:    request.Reason,
+		PlacedBy:  adminActor(r),
+		PlacedAt:  time.Now().UTC(),
+	}
+	legalHoldsMu.Lock()
+	err := recordLegalHoldChange("placed", hold, hold.PlacedBy, hold.Reason)
+	legalHoldsMu.Unlock()
+	if err != nil {
+		log.Printf("Storing legal hold %s: %v", hold.ID, err)
+		http.Error(w, "The legal hold could not be stored.", http.StatusInternalServerError)
+		return
+	}
+	keepHeldReceipts(hold)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hold)
+}
+
+func releaseLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Reason == "" {
+		http.Error(w, "A reason is required to release a legal hold.", http.StatusBadRequest)
+		return
+	}
+
+	legalHoldsMu.Lock()
+	stored, exists := legalHolds[mux.Vars(r)["id"]]
+	if !exists {
+		legalHoldsMu.Unlock()
+		http.Error(w, "No legal hold found for that ID.", http.StatusNotFound)
+		return
+	}
+	if stored.ReleasedAt != nil {
+		legalHoldsMu.Unlock()
+		http.Error(w, "The legal hold was already released.", http.StatusConflict)
+		return
+	}
+	hold := *stored
+	now := time.Now().UTC()
+	hold.ReleasedAt, hold.ReleasedBy, hold.ReleaseReason = &now, adminActor(r), request.Reason
+	err := recordLegalHoldChange("released", hold, hold.ReleasedBy, request.Reason)
+	legalHoldsMu.Unlock()
+	if err != nil {
+		log.Printf("Storing the release of legal hold %s: %v", hold.ID, err)
+		http.Error(w, "The release of the legal hold could not be stored.", http.StatusInternalServerError)
+		return
+	}
+	keepHeldReceipts(hold)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hold)
+}
+
+// listLegalHoldsHandler returns active holds, or every hold with ?all=true.
+func listLegalHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	all := r.URL.Query().Get("all") == "true"
+
+	legalHoldsMu.RLock()
+	holds := []LegalHold{}
+	for _, hold := range legalHolds {
+		if all || hold.ReleasedAt == nil {
+			holds = append(holds, *hold)
+		}
+	}
+	legalHoldsMu.RUnlock()
+	slices.SortFunc(holds, func(a, b LegalHold) int { return a.PlacedAt.Compare(b.PlacedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"holds": holds})
+}
+
+func legalHoldAuditHandler(w http.ResponseWriter, r *http.Request) {
+	legalHoldsMu.RLock()
+	entries := append([]LegalHoldAuditEntry{}, legalHoldsAudit...)
+	legalHoldsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"entries": entries})
+}
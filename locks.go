@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A LockProvider hands out locks shared by every replica, so cluster-wide tasks run on one of
+// them. A held lock is kept by its replica, which renews it, until the replica stops.
+type LockProvider interface {
+	// Acquire takes the named lock, or renews it if this replica holds it, for ttl, and reports
+	// whether this replica holds it.
+	Acquire(ctx context.Context, name string, ttl time.Duration) (bool, error)
+}
+
+// lockProvider is the LockProvider of the cluster. The default suits a single replica.
+var lockProvider LockProvider = localLocks{}
+
+// replicaID identifies this replica as a lock holder.
+var replicaID = func() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}()
+
+func newLockProvider(kind string, storage *storageOptions, etcdEndpoint string) (LockProvider, error) {
+	switch kind {
+	case "", "local":
+		return localLocks{}, nil
+	case "postgres":
+		db, err := openPostgresDB(storage)
+		if err != nil {
+			return nil, err
+		}
+		return &postgresLocks{db: db.db, held: make(map[string]*sql.Conn)}, nil
+	case "redis":
+		if storage.redisAddr == "" {
+			return nil, fmt.Errorf("-redis-addr is required for redis locks")
+		}
+		return redisLocks{client: newRedisClient(storage.redisAddr, os.Getenv("REDIS_PASSWORD"))}, nil
+	case "etcd":
+		if etcdEndpoint == "" {
+			return nil, fmt.Errorf("-etcd-endpoint is required for etcd locks")
+		}
+		return &etcdLocks{
+			endpoint: strings.TrimSuffix(etcdEndpoint, "/"),
+			client:   egressClient(egressEtcd, 10*time.Second),
+			leases:   make(map[string]string),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown lock provider %q", kind)
+	}
+}
+
+// localLocks is the LockProvider of a single replica, which holds every lock.
+type localLocks struct{}
+
+func (localLocks) Acquire(context.Context, string, time.Duration) (bool, error) { return true, nil }
+
+// postgresLocks holds Postgres advisory locks, each on a connection of its own for as long as the
+// replica runs. They don't expire: a lock is released when its connection closes, which Postgres
+// notices when the replica dies.
+type postgresLocks struct {
+	db   *sql.DB
+	mu   sync.Mutex
+	held map[string]*sql.Conn
+}
+
+func advisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+func (p *postgresLocks) Acquire(ctx context.Context, name string, _ time.Duration) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn, ok := p.held[name]; ok {
+		if err := conn.PingContext(ctx); err == nil {
+			return true, nil
+		}
+		// The connection, and the lock with it, was lost.
+		conn.Close()
+		delete(p.held, name)
+	}
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, advisoryLockKey(name)).Scan(&locked); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if !locked {
+		conn.Close()
+		return false, nil
+	}
+	p.held[name] = conn
+	return true, nil
+}
+
+// redisLocks are Redis keys holding the replica ID of their holder, which expire unless renewed.
+type redisLocks struct {
+	client *redisClient
+}
+
+// redisAcquireScript renews the lock in KEYS[1] if ARGV[1] holds it, or else takes it if it is
+// free, for ARGV[2] milliseconds.
+const redisAcquireScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+return 0`
+
+func (r redisLocks) Acquire(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	reply, err := r.client.do(ctx, "EVAL", redisAcquireScript, "1", "lock:"+name, replicaID, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+// etcdLocks are etcd keys attached to a lease of their holder, which expires unless kept alive.
+// They are taken through etcd's JSON gateway.
+type etcdLocks struct {
+	endpoint string
+	client   *http.Client
+	mu       sync.Mutex
+	// leases are the IDs of the leases of the locks this replica holds, by name.
+	leases map[string]string
+}
+
+func (e *etcdLocks) call(ctx context.Context, path string, request, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("etcd: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd: %s returned %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func (e *etcdLocks) Acquire(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if lease, ok := e.leases[name]; ok {
+		var kept struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		if err := e.call(ctx, "/v3/lease/keepalive", map[string]string{"ID": lease}, &kept); err != nil {
+			return false, err
+		}
+		if remaining, _ := strconv.Atoi(kept.Result.TTL); remaining > 0 {
+			return true, nil
+		}
+		// The lease expired, and the key with it: this replica no longer holds the lock.
+		delete(e.leases, name)
+	}
+
+	var granted struct {
+		ID string `json:"ID"`
+	}
+	seconds := max(int64(ttl/time.Second), 1)
+	if err := e.call(ctx, "/v3/lease/grant", map[string]any{"TTL": strconv.FormatInt(seconds, 10)}, &granted); err != nil {
+		return false, err
+	}
+	key := base64.StdEncoding.EncodeToString([]byte("receipt-processor/locks/" + name))
+	var txn struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err := e.call(ctx, "/v3/kv/txn", map[string]any{
+		// The key is only put if it doesn't exist, i.e. no replica holds the lock.
+		"compare": []map[string]any{{"key": key, "target": "CREATE", "result": "EQUAL", "create_revision": "0"}},
+		"success": []map[string]any{{"request_put": map[string]any{
+			"key":   key,
+			"value": base64.StdEncoding.EncodeToString([]byte(replicaID)),
+			"lease": granted.ID,
+		}}},
+	}, &txn)
+	if err != nil || !txn.Succeeded {
+		var revoked struct{}
+		e.call(ctx, "/v3/lease/revoke", map[string]string{"ID": granted.ID}, &revoked)
+		return false, err
+	}
+	e.leases[name] = granted.ID
+	return true, nil
+}
+
+var (
+	// stopScheduling is closed on shutdown, so scheduled tasks don't start again.
+	stopScheduling = make(chan struct{})
+	// scheduledTasks counts the scheduling goroutines, each until its task isn't running.
+	scheduledTasks sync.WaitGroup
+)
+
+// scheduleTask runs task every interval on the one replica holding its lock. The lock outlives an
+// interval by half of one, so its holder renews it before it expires, and another replica takes
+// over within that long of the holder stopping. Ticks where the lock can't be checked are skipped,
+// rather than risking the task running twice.
+func scheduleTask(name string, interval time.Duration, task func()) {
+	scheduledTasks.Add(1)
+	go func() {
+		defer scheduledTasks.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		holding := false
+		for {
+			select {
+			case <-stopScheduling:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			held, err := lockProvider.Acquire(ctx, name, interval+interval/2)
+			cancel()
+			switch {
+			case err != nil:
+				log.Printf("Checking the lock of task %s: %v", name, err)
+				continue
+			case held != holding:
+				holding = held
+				if held {
+					log.Printf("Running task %s on this replica (%s)", name, replicaID)
+				}
+			}
+			if held {
+				task()
+			}
+		}
+	}()
+}
+
+// stopScheduledTasks keeps scheduled tasks from starting again and waits for those running to
+// finish, or for ctx to be done.
+func stopScheduledTasks(ctx context.Context) error {
+	close(stopScheduling)
+	stopped := make(chan struct{})
+	go func() {
+		scheduledTasks.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
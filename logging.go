@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// loggingOptions configure the log output.
+type loggingOptions struct {
+	level  string
+	format string
+}
+
+// loggingFlags defines the logging flags on fs, defaulting to LOG_LEVEL and LOG_FORMAT.
+func loggingFlags(fs *flag.FlagSet) *loggingOptions {
+	opts := &loggingOptions{}
+	fs.StringVar(&opts.level, "log-level", orDefault(os.Getenv("LOG_LEVEL"), "info"), "lowest level logged: debug, info, warn or error")
+	fs.StringVar(&opts.format, "log-format", orDefault(os.Getenv("LOG_FORMAT"), "text"), "log line format: text (key=value pairs) or json")
+	return opts
+}
+
+// configureLogging writes the logs to stderr in the configured format from the configured level on,
+// each line with the service version. It becomes the default logger, so messages of the log package
+// come out the same way, at info.
+func configureLogging(opts *loggingOptions) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.level)); err != nil {
+		return fmt.Errorf("unknown log level %q: must be debug, info, warn or error", opts.level)
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(opts.format) {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, handlerOpts)
+	default:
+		return fmt.Errorf("unknown log format %q: must be text or json", opts.format)
+	}
+	handler = handler.WithAttrs([]slog.Attr{slog.String("version", serviceVersion())})
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+	return nil
+}
+
+// requestIDHandler adds the request ID to the records logged with a request's context.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// requestEntry is what a request's log line tells beyond the request and response: filled in by
+// the router and the handlers as they learn it.
+type requestEntry struct {
+	route     string
+	receiptID string
+	// apiKey is the name of the API key the request was made with.
+	apiKey string
+}
+
+type requestEntryKey struct{}
+
+// logReceiptID records the receipt a request concerns in its log line, for requests that don't
+// have it in their path, such as submissions.
+func logReceiptID(r *http.Request, id string) {
+	if entry, ok := r.Context().Value(requestEntryKey{}).(*requestEntry); ok {
+		entry.receiptID = id
+	}
+}
+
+// logRequests logs every request once it is answered, with its method, path, status, latency,
+// request ID and the receipt it concerns. It must run inside assignRequestIDs. Server errors are
+// logged at error level, the rest at info. The query string isn't logged, as it may hold
+// credentials.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &requestEntry{}
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestEntryKey{}, entry)))
+		latency := time.Since(start)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Float64("latency_ms", float64(latency.Microseconds())/1000),
+		}
+		if entry.route != "" {
+			attrs = append(attrs, slog.String("route", entry.route))
+		}
+		if entry.receiptID != "" {
+			attrs = append(attrs, slog.String("receipt_id", entry.receiptID))
+		}
+		if entry.apiKey != "" {
+			attrs = append(attrs, slog.String("api_key", entry.apiKey))
+		}
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// logRoutes records the route template of a request in its log line, and the receipt ID of
+// /receipts/{id} routes. It is router middleware, as only the router knows them.
+func logRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if entry, ok := r.Context().Value(requestEntryKey{}).(*requestEntry); ok {
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					entry.route = template
+				}
+			}
+			if id := mux.Vars(r)["id"]; id != "" && strings.HasPrefix(entry.route, "/receipts/") {
+				entry.receiptID = id
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Buckets of the Prometheus histograms: request durations in seconds and points per scored receipt.
+var (
+	durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	pointsBuckets   = []float64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+)
+
+// promHistogram is a Prometheus histogram. counts holds the observations of each bucket alone; they
+// are made cumulative when written.
+type promHistogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newPromHistogram(bounds []float64) *promHistogram {
+	return &promHistogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *promHistogram) observe(value float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, value)]++
+	h.sum += value
+	h.count++
+}
+
+// write writes the histogram's series with the given labels, e.g. `route="/receipts/process"`.
+func (h *promHistogram) write(b *strings.Builder, name, labels string) {
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{%sle=\"%s\"} %d\n", name, prefix, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, braced(labels), strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, braced(labels), h.count)
+}
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+type requestSeries struct {
+	method, route string
+	status        int
+}
+
+type routeSeries struct {
+	method, route string
+}
+
+var (
+	metricsMu         sync.Mutex
+	httpRequests      = map[requestSeries]uint64{}
+	httpDurations     = map[routeSeries]*promHistogram{}
+	receiptsProcessed = map[string]uint64{}
+	pointsAwarded     = newPromHistogram(pointsBuckets)
+	skippedRuleCounts = map[string]uint64{}
+	gatewayForwards   = map[string]uint64{}
+)
+
+// instrumentRequests counts the requests of every route and times them, by the route's path
+// template so receipt IDs don't each make a series. It is router middleware, applying to every
+// route registered on the router and its subrouters.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		elapsed := time.Since(start).Seconds()
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		metricsMu.Lock()
+		defer metricsMu.Unlock()
+		httpRequests[requestSeries{r.Method, route, recorder.status}]++
+		series := routeSeries{r.Method, route}
+		histogram, exists := httpDurations[series]
+		if !exists {
+			histogram = newPromHistogram(durationBuckets)
+			httpDurations[series] = histogram
+		}
+		histogram.observe(elapsed)
+	})
+}
+
+// recordReceiptMetrics counts a newly stored receipt by status, and the points of scored ones and
+// the rules skipped on them, as recordTenantReceipt does.
+func recordReceiptMetrics(processed ProcessedReceipt) {
+	var skipped []RuleWarning
+	if processed.Status == statusScored {
+		skipped = receiptSkippedRules(processed)
+	}
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	receiptsProcessed[processed.Status]++
+	if processed.Status == statusScored {
+		pointsAwarded.observe(float64(processed.Points))
+	}
+	for _, warning := range skipped {
+		skippedRuleCounts[warning.Rule]++
+	}
+}
+
+// recordGatewayForward counts a forward to the gateway's upstream by its result: forwarded, failed,
+// or unavailable when the breaker was open.
+func recordGatewayForward(err error) {
+	result := "forwarded"
+	switch {
+	case errors.Is(err, errUpstreamUnavailable):
+		result = "unavailable"
+	case err != nil:
+		result = "failed"
+	}
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	gatewayForwards[result]++
+}
+
+// storeSize counts the receipts of a store, reading them all when it can't count them itself.
+func storeSize(store ReceiptStore) (int, error) {
+	if counter, ok := store.(receiptCounter); ok {
+		return counter.Count()
+	}
+	receipts, err := store.List()
+	return len(receipts), err
+}
+
+// metricsHandler writes the metrics in the Prometheus text format. Server errors are the requests
+// with a 5xx status, so error rates are ratios of the request counts by status.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	metricsMu.Lock()
+	b.WriteString("# HELP receipt_processor_http_requests_total HTTP requests by method, route and status.\n")
+	b.WriteString("# TYPE receipt_processor_http_requests_total counter\n")
+	requests := make([]requestSeries, 0, len(httpRequests))
+	for series := range httpRequests {
+		requests = append(requests, series)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, series := range requests {
+		fmt.Fprintf(&b, "receipt_processor_http_requests_total{method=%q,route=%q,status=\"%d\"} %d\n", series.method, series.route, series.status, httpRequests[series])
+	}
+
+	b.WriteString("# HELP receipt_processor_http_request_duration_seconds HTTP request latency by method and route.\n")
+	b.WriteString("# TYPE receipt_processor_http_request_duration_seconds histogram\n")
+	routes := make([]routeSeries, 0, len(httpDurations))
+	for series := range httpDurations {
+		routes = append(routes, series)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	for _, series := range routes {
+		httpDurations[series].write(&b, "receipt_processor_http_request_duration_seconds", fmt.Sprintf("method=%q,route=%q", series.method, series.route))
+	}
+
+	b.WriteString("# HELP receipt_processor_receipts_processed_total Receipts stored, by status.\n")
+	b.WriteString("# TYPE receipt_processor_receipts_processed_total counter\n")
+	for _, status := range []string{statusScored, statusIneligible, statusPendingReview} {
+		fmt.Fprintf(&b, "receipt_processor_receipts_processed_total{status=%q} %d\n", status, receiptsProcessed[status])
+	}
+
+	b.WriteString("# HELP receipt_processor_points_awarded Points awarded per scored receipt.\n")
+	b.WriteString("# TYPE receipt_processor_points_awarded histogram\n")
+	pointsAwarded.write(&b, "receipt_processor_points_awarded", "")
+
+	b.WriteString("# HELP receipt_processor_skipped_rules_total Rules skipped on scored receipts because a field they need is missing or doesn't parse, by rule.\n")
+	b.WriteString("# TYPE receipt_processor_skipped_rules_total counter\n")
+	rules := make([]string, 0, len(skippedRuleCounts))
+	for rule := range skippedRuleCounts {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		fmt.Fprintf(&b, "receipt_processor_skipped_rules_total{rule=%q} %d\n", rule, skippedRuleCounts[rule])
+	}
+
+	if gateway != nil {
+		b.WriteString("# HELP receipt_processor_gateway_forwards_total Receipts forwarded to the gateway's upstream, by result.\n")
+		b.WriteString("# TYPE receipt_processor_gateway_forwards_total counter\n")
+		for _, result := range []string{"forwarded", "failed", "unavailable"} {
+			fmt.Fprintf(&b, "receipt_processor_gateway_forwards_total{result=%q} %d\n", result, gatewayForwards[result])
+		}
+	}
+	metricsMu.Unlock()
+
+	writeNotifierMetrics(&b)
+	writeDeprecationMetrics(&b)
+
+	b.WriteString("# HELP receipt_processor_stored_receipts Receipts in each receipt store.\n")
+	b.WriteString("# TYPE receipt_processor_stored_receipts gauge\n")
+	for _, store := range []struct {
+		name  string
+		store ReceiptStore
+	}{{"production", receiptStore}, {"sandbox", sandboxStore}} {
+		size, err := storeSize(store.store)
+		if err != nil {
+			log.Printf("Metrics: counting the %s receipts: %v", store.name, err)
+			continue
+		}
+		fmt.Fprintf(&b, "receipt_processor_stored_receipts{store=%q} %d\n", store.name, size)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+)
+
+// migration is one step of a storage backend's schema. Versions start at 1 and increase by one.
+type migration struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+}
+
+// A migrator is a storage backend's side of schema migrations. Each backend keeps its own list of
+// migrations, such as SQL files or Go steps, and records the version it was migrated to in its
+// own storage.
+type migrator interface {
+	migrations() []migration
+	// schemaVersion returns the version of the last migration applied, 0 for new storage.
+	schemaVersion() (int, error)
+	// migrate applies each migration after the current version up to target, in order, calling
+	// applied after each. It holds a lock that keeps other instances from migrating the same
+	// storage at once, and records each version with its migration, so a failed step leaves the
+	// storage at the previous version.
+	migrate(target int, applied func(migration)) error
+}
+
+// errNewerSchema is returned for storage migrated by a later release than this one.
+var errNewerSchema = errors.New("schema is newer than this release")
+
+// storageMigrator is the migrator of the configured receipt storage.
+var storageMigrator migrator = noMigrations{}
+
+// noMigrations is the migrator of storage without a schema, such as the memory store.
+type noMigrations struct{}
+
+func (noMigrations) migrations() []migration                     { return nil }
+func (noMigrations) schemaVersion() (int, error)                 { return 0, nil }
+func (noMigrations) migrate(target int, _ func(migration)) error { return nil }
+
+func latestMigration(m migrator) int {
+	return len(m.migrations())
+}
+
+// migrateStorage migrates storage to target, which is the latest version if negative. Storage
+// migrated further than this release knows is refused: rolling back a release doesn't roll back its
+// migrations.
+func migrateStorage(m migrator, target int) error {
+	latest := latestMigration(m)
+	if target < 0 {
+		target = latest
+	}
+	current, err := m.schemaVersion()
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	switch {
+	case current > latest:
+		return fmt.Errorf("%w: version %d, this release knows %d", errNewerSchema, current, latest)
+	case target > latest:
+		return fmt.Errorf("no schema version %d; the latest is %d", target, latest)
+	case target < current:
+		return fmt.Errorf("schema version %d is already past %d; migrations can't be reverted", current, target)
+	case target == current:
+		return nil
+	}
+	return m.migrate(target, func(step migration) {
+		log.Printf("Migrated storage to schema version %d: %s", step.Version, step.Description)
+	})
+}
+
+// migrateCommand implements "receipt-processor migrate", which shows or migrates the schema of the
+// configured storage without starting the server.
+func migrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	storage := storageFlags(flags)
+	target := flags.Int("to", -1, "schema version to migrate to (default the latest)")
+	status := flags.Bool("status", false, "list the migrations and which are applied, without migrating")
+	flags.Parse(args)
+
+	if err := resolveSecrets(&storage.databaseURL); err != nil {
+		return err
+	}
+	_, _, m, err := newReceiptStores(storage)
+	if err != nil {
+		return err
+	}
+	if *status {
+		current, err := m.schemaVersion()
+		if err != nil {
+			return err
+		}
+		for _, step := range m.migrations() {
+			state := "pending"
+			if step.Version <= current {
+				state = "applied"
+			}
+			fmt.Printf("%3d  %-7s  %s\n", step.Version, state, step.Description)
+		}
+		fmt.Printf("schema version %d of %d\n", current, latestMigration(m))
+		return nil
+	}
+	if err := migrateStorage(m, *target); err != nil {
+		return err
+	}
+	current, err := m.schemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version %d of %d\n", current, latestMigration(m))
+	return nil
+}
@@ -0,0 +1,15 @@
+-- Receipts are stored whole in record, as serialized by encodeStoredReceipt. The other columns
+-- copy what receipts are looked up and reported by.
+CREATE TABLE receipts (
+	id             text PRIMARY KEY,
+	sandbox        boolean NOT NULL DEFAULT false,
+	tenant_id      text NOT NULL DEFAULT '',
+	user_id_hash   text NOT NULL DEFAULT '',
+	status         text NOT NULL,
+	processed_at   timestamptz NOT NULL,
+	schema_version integer NOT NULL,
+	record         jsonb NOT NULL
+);
+
+CREATE INDEX receipts_sandbox_idx ON receipts (sandbox);
+CREATE INDEX receipts_user_id_hash_idx ON receipts (user_id_hash) WHERE user_id_hash <> '';
@@ -0,0 +1,6 @@
+-- The points awarded to each receipt, and the rules they came from, for reporting.
+CREATE TABLE points (
+	receipt_id text PRIMARY KEY REFERENCES receipts (id) ON DELETE CASCADE,
+	points     integer NOT NULL,
+	breakdown  jsonb NOT NULL
+);
@@ -0,0 +1,24 @@
+-- The ledger entries, in the order they were appended, as serialized by encodeLedgerEntry without
+-- their user, which is kept sealed in its own columns. Entries are append-only: only their user
+-- columns can change, when the identity key is rotated.
+CREATE TABLE ledger_entries (
+	seq            bigserial PRIMARY KEY,
+	id             text NOT NULL UNIQUE,
+	user_id_hash   text NOT NULL,
+	sealed_user_id bytea NOT NULL,
+	record         jsonb NOT NULL
+);
+
+CREATE INDEX ledger_entries_user_id_hash_idx ON ledger_entries (user_id_hash);
+
+CREATE FUNCTION ledger_entries_append_only() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'DELETE' OR NEW.seq <> OLD.seq OR NEW.id <> OLD.id OR NEW.record <> OLD.record THEN
+		RAISE EXCEPTION 'ledger entries are append-only';
+	END IF;
+	RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER ledger_entries_append_only BEFORE UPDATE OR DELETE ON ledger_entries
+	FOR EACH ROW EXECUTE FUNCTION ledger_entries_append_only();
@@ -0,0 +1,8 @@
+-- Records of the service's own state, such as imports, as RecordStore keeps them: JSON documents
+-- grouped by kind and keyed within it.
+CREATE TABLE records (
+	kind   text NOT NULL,
+	key    text NOT NULL,
+	record jsonb NOT NULL,
+	PRIMARY KEY (kind, key)
+);
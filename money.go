@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in integer cents, so amounts compare and divide exactly where floating point
+// would misjudge values such as 35.10.
+type Money int64
+
+// parseMoney parses an amount given with exactly two decimals, such as "35.35".
+func parseMoney(amount string) (Money, error) {
+	if !amountPattern.MatchString(amount) {
+		return 0, fmt.Errorf("invalid amount %q: must have two decimals", amount)
+	}
+	cents, err := strconv.ParseInt(strings.Replace(amount, ".", "", 1), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q: %w", amount, err)
+	}
+	return Money(cents), nil
+}
+
+// parseOptionalMoney parses an amount that may be left empty, returning nil then.
+func parseOptionalMoney(amount string) (*Money, error) {
+	if amount == "" {
+		return nil, nil
+	}
+	money, err := parseMoney(amount)
+	if err != nil {
+		return nil, err
+	}
+	return &money, nil
+}
+
+// Cents is the amount in cents.
+func (m Money) Cents() int64 {
+	return int64(m)
+}
+
+// String formats the amount with two decimals.
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, m/100, m%100)
+}
+
+// IsWhole reports whether the amount has no cents.
+func (m Money) IsWhole() bool {
+	return m%100 == 0
+}
+
+// IsMultipleOf reports whether the amount is a multiple of a positive amount.
+func (m Money) IsMultipleOf(unit Money) bool {
+	return m%unit == 0
+}
@@ -0,0 +1,186 @@
+package main
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount string
+		want   Money
+		ok     bool
+	}{
+		{"35.10", 3510, true},
+		{"35.35", 3535, true},
+		// 1.15 * 100 is 114.99999999999999 in float64.
+		{"1.15", 115, true},
+		{"4.35", 435, true},
+		{"0.01", 1, true},
+		{"0.00", 0, true},
+		{"1.00", 100, true},
+		{"9.99", 999, true},
+		{"0.29", 29, true},
+		{"1000000.00", 100000000, true},
+		{"35.1", 0, false},
+		{"35", 0, false},
+		{"35.100", 0, false},
+		{".10", 0, false},
+		{"-1.00", 0, false},
+		{"1,00", 0, false},
+		{" 1.00", 0, false},
+		{"", 0, false},
+		{"99999999999999999999.00", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseMoney(test.amount)
+		if (err == nil) != test.ok {
+			t.Errorf("parseMoney(%q) error = %v, want ok %v", test.amount, err, test.ok)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseMoney(%q) = %d, want %d", test.amount, got, test.want)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{3510, "35.10"},
+		{1, "0.01"},
+		{0, "0.00"},
+		{-250, "-2.50"},
+		{-5, "-0.05"},
+	}
+	for _, test := range tests {
+		if got := test.money.String(); got != test.want {
+			t.Errorf("Money(%d).String() = %q, want %q", test.money, got, test.want)
+		}
+	}
+}
+
+// baseRulePoints prepares rule and returns the points it awards receipt under the default rules.
+func baseRulePoints(t *testing.T, rule BaseRule, receipt Receipt) int {
+	t.Helper()
+	if err := rule.prepare(); err != nil {
+		t.Fatalf("prepare %s: %v", rule.Type, err)
+	}
+	return rule.contributions(RulesConfig{}, receipt).Total()
+}
+
+func TestRoundTotalRule(t *testing.T) {
+	rule := BaseRule{Type: baseRoundTotal, Points: 50}
+	tests := []struct {
+		total string
+		want  int
+	}{
+		{"35.00", 50},
+		{"0.00", 50},
+		{"100.00", 50},
+		{"35.10", 0},
+		{"35.01", 0},
+		{"34.99", 0},
+		{"0.99", 0},
+		{"35", 0},
+	}
+	for _, test := range tests {
+		if got := baseRulePoints(t, rule, Receipt{Total: test.total}); got != test.want {
+			t.Errorf("round-total of %s = %d, want %d", test.total, got, test.want)
+		}
+	}
+}
+
+func TestTotalMultipleRule(t *testing.T) {
+	rule := BaseRule{Type: baseTotalMultiple, Points: 25, Multiple: "0.25"}
+	tests := []struct {
+		total string
+		want  int
+	}{
+		{"35.00", 25},
+		{"35.25", 25},
+		{"35.50", 25},
+		{"35.75", 25},
+		{"0.25", 25},
+		{"0.00", 25},
+		{"35.10", 0},
+		{"35.35", 0},
+		{"0.30", 0},
+		{"9.24", 0},
+		{"9.26", 0},
+		{"1.2", 0},
+	}
+	for _, test := range tests {
+		if got := baseRulePoints(t, rule, Receipt{Total: test.total}); got != test.want {
+			t.Errorf("total-multiple 0.25 of %s = %d, want %d", test.total, got, test.want)
+		}
+	}
+
+	for _, multiple := range []string{"0.00", "-0.25", "0.2", ""} {
+		rule := BaseRule{Type: baseTotalMultiple, Points: 25, Multiple: multiple}
+		if err := rule.prepare(); err == nil {
+			t.Errorf("total-multiple %q prepared, want an error", multiple)
+		}
+	}
+}
+
+// TestItemDescriptionRule checks the item price bonus, 0.2 times the price of items whose trimmed
+// description is a multiple of 3 long, rounded up, on prices such as 35.10 that float64 can't
+// hold exactly.
+func TestItemDescriptionRule(t *testing.T) {
+	rule := BaseRule{Type: baseItemDescription, Length: 3, Multiplier: "0.2"}
+	tests := []struct {
+		description string
+		price       string
+		want        int
+	}{
+		{"Emils Cheese Pizza", "12.25", 3},
+		{"   Klarbrunn 12-PK 12 FL OZ  ", "12.00", 3},
+		{"Mountain Dew 12PK", "6.49", 0},
+		{"abc", "35.10", 8},
+		{"abc", "35.00", 7},
+		{"abc", "15.00", 3},
+		{"abc", "0.05", 1},
+		{"abc", "0.01", 1},
+		{"abc", "0.00", 0},
+		{"abc", "5", 0},
+	}
+	for _, test := range tests {
+		receipt := Receipt{Items: []Item{{ShortDescription: test.description, Price: test.price}}}
+		if got := baseRulePoints(t, rule, receipt); got != test.want {
+			t.Errorf("item-description of %q at %s = %d, want %d", test.description, test.price, got, test.want)
+		}
+	}
+
+	rounding := RulesConfig{Rounding: map[string]string{baseItemDescription: roundHalfEven}}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	receipt := Receipt{Items: []Item{{ShortDescription: "abc", Price: "12.50"}, {ShortDescription: "abc", Price: "17.50"}}}
+	if got := rule.contributions(rounding, receipt).Total(); got != 2+4 {
+		t.Errorf("item-description with half-even rounding = %d, want 6", got)
+	}
+}
+
+func TestItemPriceRules(t *testing.T) {
+	rule := ItemPriceRule{Name: "premium-item", Over: "35.10", Points: 10}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := RulesConfig{ItemPriceRules: []ItemPriceRule{rule}}
+	tests := []struct {
+		price string
+		want  int
+	}{
+		{"35.11", 10},
+		{"100.00", 10},
+		{"35.10", 0},
+		{"35.09", 0},
+		{"35.1", 0},
+	}
+	for _, test := range tests {
+		receipt := Receipt{Items: []Item{{ShortDescription: "item", Price: test.price}}}
+		if got := itemPriceContributions(cfg, receipt).Total(); got != test.want {
+			t.Errorf("item price bonus over 35.10 at %s = %d, want %d", test.price, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var (
+	// nearDuplicateWindow is how long receipts are remembered for spotting near-duplicates of them
+	// submitted by other users. 0 doesn't look for near-duplicates.
+	nearDuplicateWindow time.Duration
+	// nearDuplicateDistance is the most bits in which the fingerprints of near-duplicates differ.
+	nearDuplicateDistance = 6
+)
+
+// maxFingerprints is how many recent receipts of a tenant are remembered; older ones are
+// forgotten first, even within the window.
+const maxFingerprints = 50000
+
+// receiptFingerprint is a remembered receipt: its SimHash and who submitted it.
+type receiptFingerprint struct {
+	hash        uint64
+	receiptID   string
+	userID      string
+	submittedAt time.Time
+}
+
+var (
+	fingerprintsMu sync.Mutex
+	// fingerprints are the remembered receipts of each tenant, oldest first.
+	fingerprints = map[string][]receiptFingerprint{}
+)
+
+// fingerprintFeatures are what a receipt's fingerprint is computed from: its retailer, total and
+// item descriptions, whole and word by word, so receipts with a few items or words changed, or a
+// different total, still share most of them.
+func fingerprintFeatures(receipt Receipt) []string {
+	features := []string{
+		"retailer:" + strings.ToLower(strings.TrimSpace(receipt.Retailer)),
+		"total:" + receipt.Total,
+	}
+	for _, item := range receipt.Items {
+		words := strings.FieldsFunc(strings.ToLower(item.ShortDescription), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		features = append(features, "item:"+strings.Join(words, " "))
+		for _, word := range words {
+			features = append(features, "word:"+word)
+		}
+	}
+	return features
+}
+
+// simHash is the 64-bit SimHash of the features: each bit is set when most of the features' hashes
+// have it set. Similar receipts get fingerprints differing in few bits.
+func simHash(features []string) uint64 {
+	var votes [64]int
+	for _, feature := range features {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+		for bit := range votes {
+			if sum&(1<<bit) != 0 {
+				votes[bit]++
+			} else {
+				votes[bit]--
+			}
+		}
+	}
+	var hash uint64
+	for bit, vote := range votes {
+		if vote > 0 {
+			hash |= 1 << bit
+		}
+	}
+	return hash
+}
+
+// nearDuplicateReason returns why a receipt should be held for review as a near-duplicate of a
+// recent receipt of its tenant submitted by another user, or "" if it shouldn't be. Receipts
+// without a user aren't compared.
+func nearDuplicateReason(processed ProcessedReceipt) string {
+	if nearDuplicateWindow <= 0 || processed.Receipt.UserID == "" {
+		return ""
+	}
+	hash := simHash(fingerprintFeatures(processed.Receipt))
+	since := time.Now().Add(-nearDuplicateWindow)
+	fingerprintsMu.Lock()
+	defer fingerprintsMu.Unlock()
+	recent := fingerprints[processed.TenantID]
+	for i := len(recent) - 1; i >= 0 && recent[i].submittedAt.After(since); i-- {
+		seen := recent[i]
+		if seen.receiptID == processed.ID || seen.userID == processed.Receipt.UserID {
+			continue
+		}
+		if distance := bits.OnesCount64(hash ^ seen.hash); distance <= nearDuplicateDistance {
+			return fmt.Sprintf("near-duplicate of receipt %s of another user (%d bits apart)", seen.receiptID, distance)
+		}
+	}
+	return ""
+}
+
+// rememberFingerprint remembers a newly stored receipt for spotting near-duplicates of it.
+func rememberFingerprint(processed ProcessedReceipt) {
+	if nearDuplicateWindow <= 0 || processed.Receipt.UserID == "" {
+		return
+	}
+	now := time.Now()
+	fingerprint := receiptFingerprint{
+		hash:        simHash(fingerprintFeatures(processed.Receipt)),
+		receiptID:   processed.ID,
+		userID:      processed.Receipt.UserID,
+		submittedAt: now,
+	}
+	fingerprintsMu.Lock()
+	defer fingerprintsMu.Unlock()
+	recent := fingerprints[processed.TenantID]
+	expired := 0
+	for expired < len(recent) && now.Sub(recent[expired].submittedAt) > nearDuplicateWindow {
+		expired++
+	}
+	expired = max(expired, len(recent)+1-maxFingerprints)
+	fingerprints[processed.TenantID] = append(recent[expired:], fingerprint)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/smtp"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultNotificationTemplate = `{{.Type}}{{with .ReceiptID}}: receipt {{.}}{{end}}{{with .Data.reason}} ({{.}}){{end}}`
+
+// Notification is a rendered event ready for delivery.
+type Notification struct {
+	Subject string
+	Text    string
+	Event   Event
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+type NotificationsConfig struct {
+	Notifiers []NotifierConfig `json:"notifiers"`
+}
+
+// NotifierConfig describes one delivery channel. Events lists the event types it fires on, as
+// exact types or patterns such as "receipt.*", or "*" for all of them. RatePerMinute caps
+// deliveries; notifications over the limit are dropped. A notifier with a TenantID fires only on
+// that tenant's events, and the tenant can manage it if it is a webhook.
+type NotifierConfig struct {
+	Name            string            `json:"name"`
+	Type            string            `json:"type"`
+	TenantID        string            `json:"tenantId,omitempty"`
+	Events          []string          `json:"events"`
+	Template        string            `json:"template,omitempty"`
+	SubjectTemplate string            `json:"subjectTemplate,omitempty"`
+	RatePerMinute   int               `json:"ratePerMinute,omitempty"`
+	URL             string            `json:"url,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	SMTP            *SMTPConfig       `json:"smtp,omitempty"`
+}
+
+type SMTPConfig struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+func loadNotificationsConfig(path string) (NotificationsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return NotificationsConfig{}, err
+	}
+	var cfg NotificationsConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return NotificationsConfig{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// notifierRoute is a started notifier: the events it fires on, how they are rendered, its
+// delivery queue and its delivery state.
+type notifierRoute struct {
+	name, kind, tenantID string
+	events               []string
+	subject, text        *template.Template
+	notifier             Notifier
+	queue                chan Notification
+
+	mu sync.Mutex
+	// resumed is closed while the notifier isn't paused; pausedAfter is the sequence number of the
+	// last event published before it was paused.
+	resumed     chan struct{}
+	pausedAfter int64
+	stats       DeliveryStats
+}
+
+// fires reports whether the notifier delivers an event.
+func (route *notifierRoute) fires(event Event) bool {
+	if !matchesEventType(route.events, event.Type) {
+		return false
+	}
+	return route.tenantID == "" || event.Data["tenantId"] == route.tenantID
+}
+
+// notifierRoutes are the started notifiers by name, for replays and management.
+var notifierRoutes = map[string]*notifierRoute{}
+
+// startNotifiers subscribes every configured notifier to the events it fires on. Each notifier
+// delivers from its own queue so a slow channel can't hold up request handling or other channels.
+func startNotifiers(cfg NotificationsConfig) error {
+	for _, nc := range cfg.Notifiers {
+		if _, exists := notifierRoutes[nc.Name]; exists {
+			return fmt.Errorf("notifier %q is configured twice", nc.Name)
+		}
+		if err := validateEventFilter(nc.Events); err != nil {
+			return fmt.Errorf("notifier %q: %w", nc.Name, err)
+		}
+		notifier, err := newNotifier(nc)
+		if err != nil {
+			return fmt.Errorf("notifier %q: %w", nc.Name, err)
+		}
+		text, err := template.New(nc.Name).Parse(orDefault(nc.Template, defaultNotificationTemplate))
+		if err != nil {
+			return fmt.Errorf("notifier %q: template: %w", nc.Name, err)
+		}
+		subject, err := template.New(nc.Name + "-subject").Parse(orDefault(nc.SubjectTemplate, "Receipt processor: {{.Type}}"))
+		if err != nil {
+			return fmt.Errorf("notifier %q: subject template: %w", nc.Name, err)
+		}
+
+		var limiter *tokenBucket
+		if nc.RatePerMinute > 0 {
+			limiter = newTokenBucket(float64(nc.RatePerMinute)/60, nc.RatePerMinute)
+		}
+
+		route := &notifierRoute{
+			name: nc.Name, kind: nc.Type, tenantID: nc.TenantID, events: nc.Events,
+			subject: subject, text: text, notifier: notifier, queue: make(chan Notification, 100),
+			resumed: make(chan struct{}),
+		}
+		close(route.resumed)
+		notifierRoutes[nc.Name] = route
+		go route.deliver()
+
+		name := nc.Name
+		subscribe(func(event Event) {
+			if !route.fires(event) || route.skipsWhilePaused(event) {
+				return
+			}
+			if limiter != nil && !limiter.allow() {
+				log.Printf("Notifier %s: rate limit exceeded, dropping %s", name, event.Type)
+				route.recordDrop()
+				return
+			}
+			notification, err := renderNotification(subject, text, event)
+			if err != nil {
+				log.Printf("Notifier %s: %v", name, err)
+				return
+			}
+			select {
+			case route.queue <- notification:
+			default:
+				log.Printf("Notifier %s: queue full, dropping %s", name, event.Type)
+				route.recordDrop()
+			}
+		})
+	}
+	return nil
+}
+
+// deliver sends the notifications queued for the notifier, holding them while it is paused.
+func (route *notifierRoute) deliver() {
+	for notification := range route.queue {
+		route.mu.Lock()
+		resumed := route.resumed
+		route.mu.Unlock()
+		<-resumed
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		start := time.Now()
+		err := route.notifier.Notify(ctx, notification)
+		route.recordDelivery(time.Since(start), err)
+		if err != nil {
+			log.Printf("Notifier %s: delivering %s: %v", route.name, notification.Event.Type, err)
+		}
+		cancel()
+	}
+}
+
+func renderNotification(subject, text *template.Template, event Event) (Notification, error) {
+	var subjectBuf, textBuf bytes.Buffer
+	if err := subject.Execute(&subjectBuf, event); err != nil {
+		return Notification{}, fmt.Errorf("render subject: %w", err)
+	}
+	if err := text.Execute(&textBuf, event); err != nil {
+		return Notification{}, fmt.Errorf("render text: %w", err)
+	}
+	return Notification{Subject: subjectBuf.String(), Text: textBuf.String(), Event: event}, nil
+}
+
+// newNotifier creates the notifier for cfg. Its URL, headers and SMTP password may be "secret:"
+// references. The URL of a Slack or webhook notifier must be an allowed webhook destination.
+func newNotifier(cfg NotifierConfig) (Notifier, error) {
+	values := []*string{&cfg.URL}
+	headers := make(map[string]string, len(cfg.Headers))
+	for name, value := range cfg.Headers {
+		if err := resolveSecrets(&value); err != nil {
+			return nil, err
+		}
+		headers[name] = value
+	}
+	cfg.Headers = headers
+	if cfg.SMTP != nil {
+		smtp := *cfg.SMTP
+		cfg.SMTP = &smtp
+		values = append(values, &smtp.Password)
+	}
+	if err := resolveSecrets(values...); err != nil {
+		return nil, err
+	}
+
+	switch cfg.Type {
+	case "slack":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		if err := checkWebhookURL(cfg.URL); err != nil {
+			return nil, err
+		}
+		return slackNotifier{url: cfg.URL}, nil
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		if err := checkWebhookURL(cfg.URL); err != nil {
+			return nil, err
+		}
+		return webhookNotifier{url: cfg.URL, headers: cfg.Headers}, nil
+	case "email":
+		if cfg.SMTP == nil || cfg.SMTP.Host == "" || cfg.SMTP.From == "" || len(cfg.SMTP.To) == 0 {
+			return nil, fmt.Errorf("smtp host, from and to are required")
+		}
+		return emailNotifier{cfg: *cfg.SMTP}, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q", cfg.Type)
+	}
+}
+
+type slackNotifier struct {
+	url string
+}
+
+func (n slackNotifier) Notify(ctx context.Context, notification Notification) error {
+	return postJSON(ctx, n.url, nil, map[string]string{"text": notification.Text})
+}
+
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+}
+
+func (n webhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	return postSignedJSON(ctx, n.url, n.headers, webhookPayload(notification))
+}
+
+func webhookPayload(notification Notification) map[string]any {
+	return map[string]any{"subject": notification.Subject, "text": notification.Text, "event": notification.Event}
+}
+
+type emailNotifier struct {
+	cfg SMTPConfig
+}
+
+func (n emailNotifier) Notify(ctx context.Context, notification Notification) error {
+	return sendMail(n.cfg, n.cfg.To, notification.Subject, notification.Text)
+}
+
+func sendMail(cfg SMTPConfig, to []string, subject, body string) error {
+	port := cfg.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body)
+
+	addr := cfg.Host + ":" + strconv.Itoa(port)
+	return smtp.SendMail(addr, auth, cfg.From, to, []byte(msg.String()))
+}
+
+func postJSON(ctx context.Context, url string, headers map[string]string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postBody(ctx, url, headers, body)
+}
+
+// postSignedJSON is postJSON with an X-Receipt-Signature header when webhook signing is configured.
+func postSignedJSON(ctx context.Context, url string, headers map[string]string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postBody(ctx, url, signedHeaders(headers, body), body)
+}
+
+// signedHeaders returns headers with the X-Receipt-Signature of body added, when webhook signing
+// is configured.
+func signedHeaders(headers map[string]string, body []byte) map[string]string {
+	signature := webhookSignature(body, time.Now())
+	if signature == "" {
+		return headers
+	}
+	headers = maps.Clone(headers)
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	headers["X-Receipt-Signature"] = signature
+	return headers
+}
+
+// statusError is a delivery the receiver answered with a status other than 2xx.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "unexpected status " + e.status
+}
+
+func postBody(ctx context.Context, url string, headers map[string]string, body []byte) error {
+	resp, err := sendBody(ctx, url, headers, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
+
+// sendBody POSTs a JSON body, returning the receiver's response whatever its status.
+func sendBody(ctx context.Context, url string, headers map[string]string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return webhookClient().Do(req)
+}
+
+// orDefault returns value, or fallback when value is empty.
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// replay queues the retained events after a sequence number that the notifier fires on, returning
+// how many there are and the sequence number of the oldest event retained.
+func (route *notifierRoute) replay(after int64) (replayed int, oldest int64) {
+	events, oldest := eventsSince(after, route.events, 0)
+	events = slices.DeleteFunc(events, func(event Event) bool { return !route.fires(event) })
+	go func() {
+		for _, event := range events {
+			notification, err := renderNotification(route.subject, route.text, event)
+			if err != nil {
+				log.Printf("Notifier %s: %v", route.name, err)
+				continue
+			}
+			route.queue <- notification
+		}
+	}()
+	return len(events), oldest
+}
+
+// replayNotifierHandler delivers the retained events from the sequence number ?from= on to a
+// notifier again, those it fires on, for a subscriber catching up after an outage. Replays are
+// queued behind live deliveries and aren't rate limited.
+func replayNotifierHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	route, exists := notifierRoutes[name]
+	if !exists {
+		http.Error(w, "No notifier of that name.", http.StatusNotFound)
+		return
+	}
+	from, err := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+	if err != nil || from < 1 {
+		http.Error(w, "from must be a sequence number.", http.StatusBadRequest)
+		return
+	}
+	replayed, oldest := route.replay(from - 1)
+	response := map[string]any{"notifier": name, "replayed": replayed, "oldestSequence": oldest}
+	if oldest > from {
+		response["missed"] = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
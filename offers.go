@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Offer is a promotion assigned to one user, such as "5x at coffee shops this week". It applies to
+// the user's receipts from its retailers purchased between StartDate and EndDate, multiplying the
+// points the rules award by Multiplier and adding Bonus, up to MaxUses receipts. It shows in
+// breakdowns as "offer:<id>", which is also how its uses are counted.
+type Offer struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Multiplier  string    `json:"multiplier,omitempty"`
+	Bonus       int       `json:"bonus,omitempty"`
+	Retailers   []string  `json:"retailers,omitempty"`
+	StartDate   string    `json:"startDate,omitempty"`
+	EndDate     string    `json:"endDate,omitempty"`
+	MaxUses     int       `json:"maxUses,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	multiplier   *big.Rat
+	userIDHash   string
+	sealedUserID []byte
+}
+
+var (
+	offersMu sync.RWMutex
+	offers   = map[string]*Offer{}
+)
+
+func (o *Offer) prepare() error {
+	if o.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	multiplier, ok := new(big.Rat).SetString(strings.TrimSpace(orDefault(o.Multiplier, "1")))
+	if !ok || multiplier.Cmp(big.NewRat(1, 1)) < 0 {
+		return fmt.Errorf("multiplier must be a decimal of at least 1")
+	}
+	o.multiplier = multiplier
+	if o.Bonus < 0 || o.MaxUses < 0 {
+		return fmt.Errorf("bonus and maxUses can't be negative")
+	}
+	for _, date := range []string{o.StartDate, o.EndDate} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			return fmt.Errorf("invalid date %q", date)
+		}
+	}
+	return nil
+}
+
+func (o *Offer) rule() string { return "offer:" + o.ID }
+
+func (o *Offer) matches(receipt Receipt) bool {
+	if o.StartDate != "" && receipt.PurchaseDate < o.StartDate {
+		return false
+	}
+	if o.EndDate != "" && receipt.PurchaseDate > o.EndDate {
+		return false
+	}
+	return len(o.Retailers) == 0 || slices.ContainsFunc(o.Retailers, func(retailer string) bool {
+		return strings.EqualFold(strings.TrimSpace(retailer), strings.TrimSpace(receipt.Retailer))
+	})
+}
+
+// offerUsesLocked counts the receipts the offer has been credited on, and the points it added.
+// costsMu must be held.
+func offerUsesLocked(rule string, except string) (uses, points int) {
+	for receiptID, lines := range receiptCosts {
+		if line, ok := lines[rule]; ok && receiptID != except {
+			uses++
+			points += line.points
+		}
+	}
+	return uses, points
+}
+
+// applyOffers adds the user's offers that match the receipt and have uses left. A rescored receipt
+// keeps an offer it was already credited with.
+func applyOffers(processed *ProcessedReceipt) {
+	if processed.Receipt.UserID == "" {
+		return
+	}
+	hashes := userIDHashes(processed.Receipt.UserID)
+	base := processed.Breakdown.Total()
+	mode := currentRules().roundingFor("offer")
+
+	offersMu.RLock()
+	var matched []*Offer
+	for _, offer := range offers {
+		if slices.Contains(hashes, offer.userIDHash) && offer.matches(processed.Receipt) {
+			matched = append(matched, offer)
+		}
+	}
+	offersMu.RUnlock()
+	sort.Slice(matched, func(i, j int) bool { return matched[i].CreatedAt.Before(matched[j].CreatedAt) })
+
+	for _, offer := range matched {
+		if offer.MaxUses > 0 {
+			costsMu.Lock()
+			uses, _ := offerUsesLocked(offer.rule(), processed.ID)
+			costsMu.Unlock()
+			if uses >= offer.MaxUses {
+				continue
+			}
+		}
+		boosted := new(big.Rat).Mul(offer.multiplier, new(big.Rat).SetInt64(int64(base)))
+		extra := int(roundRatio(boosted.Num().Int64(), boosted.Denom().Int64(), mode)) - base + offer.Bonus
+		if extra != 0 {
+			processed.Breakdown = append(processed.Breakdown, Contribution{Rule: offer.rule(), Points: extra, Rounding: mode})
+		}
+	}
+}
+
+// resealOffers re-encrypts the user of every offer with the current identity key, and returns how
+// many offers it couldn't reseal.
+func resealOffers() (failed int) {
+	offersMu.Lock()
+	defer offersMu.Unlock()
+	for _, offer := range offers {
+		userID, ok := openUserID(offer.sealedUserID, offer.ID)
+		if !ok {
+			log.Printf("Decrypting user of offer %s: no accepted identity key", offer.ID)
+			failed++
+			continue
+		}
+		offer.userIDHash, offer.sealedUserID = sealUserID(userID, offer.ID)
+	}
+	return failed
+}
+
+// offerView is an offer with how much of it has been used.
+type offerView struct {
+	Offer
+	UserID string `json:"userId,omitempty"`
+	Uses   int    `json:"uses"`
+	Points int    `json:"points"`
+}
+
+func viewOffer(offer *Offer) offerView {
+	costsMu.Lock()
+	uses, points := offerUsesLocked(offer.rule(), "")
+	costsMu.Unlock()
+	userID, _ := openUserID(offer.sealedUserID, offer.ID)
+	return offerView{Offer: *offer, UserID: userID, Uses: uses, Points: points}
+}
+
+// assignOfferHandler assigns an offer to a user.
+func assignOfferHandler(w http.ResponseWriter, r *http.Request) {
+	var offer Offer
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		http.Error(w, "The offer is invalid.", http.StatusBadRequest)
+		return
+	}
+	if err := offer.prepare(); err != nil {
+		http.Error(w, "The offer is invalid: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	offer.ID = uuid.New().String()
+	offer.CreatedAt = time.Now().UTC()
+	offer.userIDHash, offer.sealedUserID = sealUserID(mux.Vars(r)["id"], offer.ID)
+
+	offersMu.Lock()
+	offers[offer.ID] = &offer
+	offersMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(viewOffer(&offer))
+}
+
+// listUserOffersHandler lists a user's offers with their uses, newest first.
+func listUserOffersHandler(w http.ResponseWriter, r *http.Request) {
+	hashes := userIDHashes(mux.Vars(r)["id"])
+	offersMu.RLock()
+	list := []offerView{}
+	for _, offer := range offers {
+		if slices.Contains(hashes, offer.userIDHash) {
+			list = append(list, viewOffer(offer))
+		}
+	}
+	offersMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"offers": list})
+}
+
+// revokeOfferHandler withdraws an offer. Points it already added are kept.
+func revokeOfferHandler(w http.ResponseWriter, r *http.Request) {
+	offersMu.Lock()
+	_, exists := offers[mux.Vars(r)["offerId"]]
+	delete(offers, mux.Vars(r)["offerId"])
+	offersMu.Unlock()
+	if !exists {
+		http.Error(w, "No offer found for that ID.", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
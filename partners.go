@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PartnerProgram is a tenant's contract with the program: how its receipts earn and how the
+// points are settled. Contracts are effective-dated, and the one in force on a receipt's purchase
+// date applies to it.
+type PartnerProgram struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	TenantID  string            `json:"tenantId"`
+	Contracts []PartnerContract `json:"contracts"`
+}
+
+// PartnerContract is one version of a program's terms, in force from EffectiveFrom until
+// EffectiveTo (exclusive, open-ended when empty). EarnRate multiplies the points receipts earn
+// under the rules, MaxPointsPerReceipt caps them, and PointValue is what the partner pays per
+// point in SettlementCurrency.
+type PartnerContract struct {
+	Version             int    `json:"version"`
+	EffectiveFrom       string `json:"effectiveFrom"`
+	EffectiveTo         string `json:"effectiveTo,omitempty"`
+	EarnRate            string `json:"earnRate"`
+	MaxPointsPerReceipt int    `json:"maxPointsPerReceipt,omitempty"`
+	SettlementCurrency  string `json:"settlementCurrency"`
+	PointValue          string `json:"pointValue"`
+
+	from, to   time.Time
+	earnRate   *big.Rat
+	pointValue *big.Rat
+}
+
+// ContractRef identifies the contract a receipt was scored under.
+type ContractRef struct {
+	ProgramID string `json:"programId"`
+	Version   int    `json:"version"`
+}
+
+type PartnersConfig struct {
+	Programs []PartnerProgram `json:"programs"`
+}
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// partnerPrograms maps tenant IDs to their program. It is set once at startup.
+var partnerPrograms = map[string]*PartnerProgram{}
+
+func loadPartnersConfig(path string) (map[string]*PartnerProgram, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg PartnersConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	programs := map[string]*PartnerProgram{}
+	for i := range cfg.Programs {
+		program := &cfg.Programs[i]
+		if err := program.prepare(); err != nil {
+			return nil, fmt.Errorf("%s: program %q: %w", path, program.ID, err)
+		}
+		if _, taken := programs[program.TenantID]; taken {
+			return nil, fmt.Errorf("%s: tenant %q has more than one program", path, program.TenantID)
+		}
+		programs[program.TenantID] = program
+	}
+	return programs, nil
+}
+
+func (p *PartnerProgram) prepare() error {
+	if p.ID == "" || p.TenantID == "" {
+		return fmt.Errorf("id and tenantId are required")
+	}
+	versions := map[int]bool{}
+	for i := range p.Contracts {
+		contract := &p.Contracts[i]
+		if versions[contract.Version] {
+			return fmt.Errorf("duplicate contract version %d", contract.Version)
+		}
+		versions[contract.Version] = true
+		if err := contract.prepare(); err != nil {
+			return fmt.Errorf("contract version %d: %w", contract.Version, err)
+		}
+	}
+	return nil
+}
+
+func (c *PartnerContract) prepare() error {
+	var err error
+	if c.from, err = time.Parse("2006-01-02", c.EffectiveFrom); err != nil {
+		return fmt.Errorf("invalid effectiveFrom %q", c.EffectiveFrom)
+	}
+	if c.EffectiveTo != "" {
+		if c.to, err = time.Parse("2006-01-02", c.EffectiveTo); err != nil || !c.to.After(c.from) {
+			return fmt.Errorf("invalid effectiveTo %q", c.EffectiveTo)
+		}
+	}
+	var ok bool
+	if c.earnRate, ok = new(big.Rat).SetString(strings.TrimSpace(orDefault(c.EarnRate, "1"))); !ok || c.earnRate.Sign() < 0 {
+		return fmt.Errorf("invalid earnRate %q", c.EarnRate)
+	}
+	if c.pointValue, ok = new(big.Rat).SetString(strings.TrimSpace(orDefault(c.PointValue, "0"))); !ok || c.pointValue.Sign() < 0 {
+		return fmt.Errorf("invalid pointValue %q", c.PointValue)
+	}
+	if !currencyPattern.MatchString(c.SettlementCurrency) {
+		return fmt.Errorf("settlementCurrency must be an ISO 4217 code")
+	}
+	if c.MaxPointsPerReceipt < 0 {
+		return fmt.Errorf("maxPointsPerReceipt can't be negative")
+	}
+	return nil
+}
+
+// contractOn returns the contract in force on date: the one with the latest effective date not
+// after it, and the latest version among those.
+func (p *PartnerProgram) contractOn(date time.Time) (*PartnerContract, bool) {
+	var found *PartnerContract
+	for i := range p.Contracts {
+		contract := &p.Contracts[i]
+		if contract.from.After(date) || (!contract.to.IsZero() && !date.Before(contract.to)) {
+			continue
+		}
+		if found == nil || contract.from.After(found.from) || (contract.from.Equal(found.from) && contract.Version > found.Version) {
+			found = contract
+		}
+	}
+	return found, found != nil
+}
+
+// applyPartnerContract scores processed under its tenant's contract in force on the purchase
+// date, applying its earn rate as a "partner-earn-rate" contribution. Receipts of tenants without
+// a program, or without a contract in force, are left as the rules scored them.
+func applyPartnerContract(processed *ProcessedReceipt) {
+	processed.Contract = nil
+	program, ok := partnerPrograms[processed.TenantID]
+	if !ok {
+		return
+	}
+	date, err := time.Parse("2006-01-02", processed.Receipt.PurchaseDate)
+	if err != nil {
+		return
+	}
+	contract, ok := program.contractOn(date)
+	if !ok {
+		return
+	}
+	processed.Contract = &ContractRef{ProgramID: program.ID, Version: contract.Version}
+
+	points := processed.Breakdown.Total()
+	mode := currentRules().roundingFor("partner-earn-rate")
+	rated := new(big.Rat).Mul(contract.earnRate, new(big.Rat).SetInt64(int64(points)))
+	earned := int(roundRatio(rated.Num().Int64(), rated.Denom().Int64(), mode))
+	if earned != points {
+		processed.Breakdown = append(processed.Breakdown, Contribution{Rule: "partner-earn-rate", Points: earned - points, Rounding: mode})
+	}
+}
+
+// applyPartnerCap caps the points of a receipt scored under a partner contract at its maximum per
+// receipt, taking the points over it off as a "partner-cap" contribution.
+func applyPartnerCap(processed *ProcessedReceipt) {
+	if processed.Contract == nil {
+		return
+	}
+	program, ok := partnerPrograms[processed.TenantID]
+	if !ok {
+		return
+	}
+	for _, contract := range program.Contracts {
+		if contract.Version != processed.Contract.Version {
+			continue
+		}
+		if points := processed.Breakdown.Total(); contract.MaxPointsPerReceipt > 0 && points > contract.MaxPointsPerReceipt {
+			processed.Breakdown.add("partner-cap", contract.MaxPointsPerReceipt-points)
+		}
+		return
+	}
+}
+
+func listPartnersHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]PartnerProgram, 0, len(partnerPrograms))
+	for _, program := range partnerPrograms {
+		list = append(list, *program)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"programs": list})
+}
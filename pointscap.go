@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Strategies for bringing a receipt's points down to the cap.
+const (
+	// capTruncate takes the points over the cap off as a single "points-cap" contribution.
+	capTruncate = "truncate"
+	// capProrate scales every rule's points down by the same ratio.
+	capProrate = "prorate"
+)
+
+// PointsCapRules cap the points of any receipt at MaxPoints, so a pathological receipt can't earn
+// an absurd score. The cap is disabled when MaxPoints is zero.
+type PointsCapRules struct {
+	MaxPoints int    `json:"maxPoints,omitempty"`
+	Strategy  string `json:"strategy,omitempty"`
+}
+
+func (c *PointsCapRules) prepare() error {
+	if c.MaxPoints < 0 {
+		return fmt.Errorf("maxPoints can't be negative")
+	}
+	switch c.Strategy {
+	case "":
+		c.Strategy = capTruncate
+	case capTruncate, capProrate:
+	default:
+		return fmt.Errorf("unknown strategy %q: must be truncate or prorate", c.Strategy)
+	}
+	return nil
+}
+
+// applyPointsCap brings the points of a receipt over the cap down to it. Truncating records the
+// difference as a "points-cap" contribution. Prorating scales each contribution by the cap over the
+// points instead, recording what it was before as its Uncapped points; the points left over from
+// rounding down go to the largest remainders, so the total is exactly the cap.
+func applyPointsCap(cfg RulesConfig, processed *ProcessedReceipt) {
+	limit := cfg.PointsCap.MaxPoints
+	points := processed.Breakdown.Total()
+	if limit == 0 || points <= limit {
+		return
+	}
+	if cfg.PointsCap.Strategy == capTruncate {
+		processed.Breakdown.add("points-cap", limit-points)
+		return
+	}
+
+	type share struct {
+		index     int
+		remainder int
+	}
+	shares := make([]share, 0, len(processed.Breakdown))
+	breakdown := make(Breakdown, len(processed.Breakdown))
+	copy(breakdown, processed.Breakdown)
+	kept := 0
+	for i, contribution := range breakdown {
+		// Rounded down, so negative contributions are scaled like the others.
+		scaled := contribution.Points * limit
+		prorated := scaled / points
+		if scaled%points < 0 {
+			prorated--
+		}
+		breakdown[i].Points = prorated
+		kept += prorated
+		shares = append(shares, share{i, scaled - prorated*points})
+	}
+	sort.SliceStable(shares, func(a, b int) bool { return shares[a].remainder > shares[b].remainder })
+	for _, s := range shares[:limit-kept] {
+		breakdown[s.index].Points++
+	}
+	for i, contribution := range processed.Breakdown {
+		if breakdown[i].Points != contribution.Points {
+			uncapped := contribution.Points
+			breakdown[i].Uncapped = &uncapped
+		}
+	}
+	processed.Breakdown = breakdown
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresMigrationFiles are the schema of the Postgres database, one SQL file per version named
+// "<version>_<description>.sql". Bumping receiptSchemaVersion also needs a migration rewriting the
+// stored records, as for BoltDB.
+//
+//go:embed migrations/postgres/*.sql
+var postgresMigrationFiles embed.FS
+
+// postgresMigrationLock is the key of the advisory lock held while migrating, so instances
+// starting together migrate one at a time.
+const postgresMigrationLock = 7271001
+
+// postgresDB is a Postgres database holding the production and sandbox receipt stores, told apart
+// by the sandbox column, and the ledger.
+type postgresDB struct {
+	db *sql.DB
+
+	// Statements are prepared on first use, as the tables only exist once migrated.
+	mu         sync.Mutex
+	statements map[string]*sql.Stmt
+}
+
+// postgresStore is the ReceiptStore of either the production or the sandbox receipts of a
+// postgresDB.
+type postgresStore struct {
+	db      *postgresDB
+	sandbox bool
+}
+
+// postgresQueries are the prepared statements of the store, by name.
+var postgresQueries = map[string]string{
+	"get":  `SELECT record FROM receipts WHERE id = $1 AND sandbox = $2`,
+	"list": `SELECT record FROM receipts WHERE sandbox = $1`,
+	"put": `INSERT INTO receipts (id, sandbox, tenant_id, user_id_hash, status, processed_at, schema_version, record)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET sandbox = excluded.sandbox, tenant_id = excluded.tenant_id,
+			user_id_hash = excluded.user_id_hash, status = excluded.status, processed_at = excluded.processed_at,
+			schema_version = excluded.schema_version, record = excluded.record`,
+	"putPoints": `INSERT INTO points (receipt_id, points, breakdown) VALUES ($1, $2, $3)
+		ON CONFLICT (receipt_id) DO UPDATE SET points = excluded.points, breakdown = excluded.breakdown`,
+	"delete": `DELETE FROM receipts WHERE id = $1 AND sandbox = $2`,
+	"count":  `SELECT count(*) FROM receipts WHERE sandbox = $1`,
+
+	"appendLedger": `INSERT INTO ledger_entries (id, user_id_hash, sealed_user_id, record) VALUES ($1, $2, $3, $4)`,
+	"listLedger":   `SELECT user_id_hash, sealed_user_id, record FROM ledger_entries ORDER BY seq OFFSET $1`,
+	"resealLedger": `UPDATE ledger_entries SET user_id_hash = $2, sealed_user_id = $3 WHERE id = $1`,
+
+	"putRecord": `INSERT INTO records (kind, key, record) VALUES ($1, $2, $3)
+		ON CONFLICT (kind, key) DO UPDATE SET record = excluded.record`,
+	"getRecord":   `SELECT record FROM records WHERE kind = $1 AND key = $2`,
+	"listRecords": `SELECT key, record FROM records WHERE kind = $1`,
+	"createRecord": `INSERT INTO records (kind, key, record) VALUES ($1, $2, $3)
+		ON CONFLICT (kind, key) DO NOTHING`,
+	"swapRecord":   `UPDATE records SET record = $4 WHERE kind = $1 AND key = $2 AND record = $3::jsonb`,
+	"removeRecord": `DELETE FROM records WHERE kind = $1 AND key = $2 AND record = $3::jsonb`,
+}
+
+// openPostgresDB connects to the database at databaseURL with the pool settings of opts.
+func openPostgresDB(opts *storageOptions) (*postgresDB, error) {
+	if opts.databaseURL == "" {
+		return nil, errors.New("DATABASE_URL is required for the postgres storage")
+	}
+	db, err := sql.Open("pgx", opts.databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(opts.maxOpenConns)
+	db.SetMaxIdleConns(opts.maxIdleConns)
+	db.SetConnMaxLifetime(opts.connMaxLifetime)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	return &postgresDB{db: db, statements: make(map[string]*sql.Stmt)}, nil
+}
+
+func (p *postgresDB) stores() (production, sandbox *postgresStore) {
+	return &postgresStore{db: p}, &postgresStore{db: p, sandbox: true}
+}
+
+func (s *postgresStore) Ping(ctx context.Context) error {
+	return s.db.db.PingContext(ctx)
+}
+
+// Close closes the prepared statements and the connections of the pool.
+func (p *postgresDB) Close() error {
+	return p.db.Close()
+}
+
+func (p *postgresDB) statement(name string) (*sql.Stmt, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if stmt, ok := p.statements[name]; ok {
+		return stmt, nil
+	}
+	stmt, err := p.db.Prepare(postgresQueries[name])
+	if err != nil {
+		return nil, fmt.Errorf("prepare %s: %w", name, err)
+	}
+	p.statements[name] = stmt
+	return stmt, nil
+}
+
+type postgresMigration struct {
+	migration
+	sql string
+}
+
+func postgresMigrations() []postgresMigration {
+	names, _ := fs.Glob(postgresMigrationFiles, "migrations/postgres/*.sql")
+	sort.Strings(names)
+	steps := make([]postgresMigration, 0, len(names))
+	for i, name := range names {
+		base := strings.TrimSuffix(name[strings.LastIndex(name, "/")+1:], ".sql")
+		number, description, _ := strings.Cut(base, "_")
+		if version, err := strconv.Atoi(number); err != nil || version != i+1 {
+			panic(fmt.Sprintf("migration %s is out of sequence", name))
+		}
+		data, _ := postgresMigrationFiles.ReadFile(name)
+		steps = append(steps, postgresMigration{
+			migration: migration{Version: i + 1, Description: strings.ReplaceAll(description, "_", " ")},
+			sql:       string(data),
+		})
+	}
+	return steps
+}
+
+func (p *postgresDB) migrations() []migration {
+	var steps []migration
+	for _, step := range postgresMigrations() {
+		steps = append(steps, step.migration)
+	}
+	return steps
+}
+
+const createSchemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version     integer PRIMARY KEY,
+	description text NOT NULL,
+	applied_at  timestamptz NOT NULL DEFAULT now()
+)`
+
+func (p *postgresDB) schemaVersion() (int, error) {
+	var version sql.NullInt64
+	err := p.db.QueryRow(`SELECT max(version) FROM schema_migrations`).Scan(&version)
+	if pgErr := (*pgconn.PgError)(nil); errors.As(err, &pgErr) && pgErr.Code == "42P01" {
+		// The table doesn't exist yet: nothing was migrated.
+		return 0, nil
+	}
+	return int(version.Int64), err
+}
+
+// migrate applies each migration in its own transaction, which also records its version, holding
+// an advisory lock on one connection throughout.
+func (p *postgresDB) migrate(target int, applied func(migration)) error {
+	ctx := context.Background()
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, postgresMigrationLock)
+	if _, err := conn.ExecContext(ctx, createSchemaMigrations); err != nil {
+		return err
+	}
+
+	// Another instance may have migrated while this one waited for the lock.
+	var current sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT max(version) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	if int(current.Int64) >= target {
+		return nil
+	}
+	for _, step := range postgresMigrations()[current.Int64:target] {
+		err := func() error {
+			tx, err := conn.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			if _, err := tx.ExecContext(ctx, step.sql); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, description) VALUES ($1, $2)`, step.Version, step.Description); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}()
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", step.Version, step.Description, err)
+		}
+		applied(step.migration)
+	}
+	return nil
+}
+
+// Put stores the receipt and its points in one transaction.
+func (s *postgresStore) Put(receipt ProcessedReceipt) error {
+	data, err := encodeStoredReceipt(receipt)
+	if err != nil {
+		return err
+	}
+	breakdown, err := json.Marshal(receipt.Breakdown)
+	if err != nil {
+		return err
+	}
+	put, err := s.db.statement("put")
+	if err != nil {
+		return err
+	}
+	putPoints, err := s.db.statement("putPoints")
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Stmt(put).Exec(receipt.ID, s.sandbox, receipt.TenantID, receipt.UserIDHash, receipt.Status,
+		receipt.ProcessedAt, receiptSchemaVersion, data)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(putPoints).Exec(receipt.ID, receipt.Points, breakdown); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) Get(id string) (ProcessedReceipt, error) {
+	get, err := s.db.statement("get")
+	if err != nil {
+		return ProcessedReceipt{}, err
+	}
+	var data []byte
+	switch err := get.QueryRow(id, s.sandbox).Scan(&data); {
+	case errors.Is(err, sql.ErrNoRows):
+		return ProcessedReceipt{}, errReceiptNotFound
+	case err != nil:
+		return ProcessedReceipt{}, err
+	}
+	receipt, err := decodeStoredReceipt(data)
+	if err != nil {
+		return ProcessedReceipt{}, fmt.Errorf("receipt %s: %w", id, err)
+	}
+	return receipt, nil
+}
+
+// Delete removes the receipt, and its points with it.
+func (s *postgresStore) Delete(id string) error {
+	del, err := s.db.statement("delete")
+	if err != nil {
+		return err
+	}
+	_, err = del.Exec(id, s.sandbox)
+	return err
+}
+
+func (s *postgresStore) Count() (int, error) {
+	count, err := s.db.statement("count")
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = count.QueryRow(s.sandbox).Scan(&n)
+	return n, err
+}
+
+func (s *postgresStore) List() ([]ProcessedReceipt, error) {
+	list, err := s.db.statement("list")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := list.Query(s.sandbox)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	receipts := []ProcessedReceipt{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		receipt, err := decodeStoredReceipt(data)
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
+
+// postgresLedgerStore is the LedgerStore of a postgresDB. The table refuses changes to an entry
+// other than its user's seal.
+type postgresLedgerStore struct {
+	db *postgresDB
+}
+
+// Append inserts the entries in one transaction.
+func (s *postgresLedgerStore) Append(entries ...LedgerEntry) error {
+	appendEntry, err := s.db.statement("appendLedger")
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, entry := range entries {
+		record, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Stmt(appendEntry).Exec(entry.ID, entry.userIDHash, entry.sealedUserID, record); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresLedgerStore) List() ([]LedgerEntry, error) {
+	return s.ListFrom(0)
+}
+
+func (s *postgresLedgerStore) ListFrom(position int) ([]LedgerEntry, error) {
+	list, err := s.db.statement("listLedger")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := list.Query(position)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		var entry LedgerEntry
+		var record []byte
+		if err := rows.Scan(&entry.userIDHash, &entry.sealedUserID, &record); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(record, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// postgresLedgerLock is the key of the advisory lock instances hold while they use the ledger.
+const postgresLedgerLock = 7271002
+
+// Lock takes the ledger's advisory lock on a connection of its own, which holds it until unlock.
+func (s *postgresLedgerStore) Lock() (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sharedLedgerLockTimeout)
+	defer cancel()
+	conn, err := s.db.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresLedgerLock); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, postgresLedgerLock); err != nil {
+			// The connection is dropped instead, which releases the lock.
+			log.Printf("Releasing the ledger lock: %v", err)
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}, nil
+}
+
+func (s *postgresLedgerStore) Reseal(entry LedgerEntry) error {
+	reseal, err := s.db.statement("resealLedger")
+	if err != nil {
+		return err
+	}
+	result, err := reseal.Exec(entry.ID, entry.userIDHash, entry.sealedUserID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("no ledger entry %s", entry.ID)
+	}
+	return nil
+}
+
+// postgresRecordStore is the RecordStore of a postgresDB, in the records table.
+type postgresRecordStore struct {
+	db *postgresDB
+}
+
+func (s *postgresRecordStore) PutRecord(kind, key string, record []byte) error {
+	put, err := s.db.statement("putRecord")
+	if err != nil {
+		return err
+	}
+	_, err = put.Exec(kind, key, record)
+	return err
+}
+
+func (s *postgresRecordStore) GetRecord(kind, key string) ([]byte, error) {
+	get, err := s.db.statement("getRecord")
+	if err != nil {
+		return nil, err
+	}
+	var record []byte
+	switch err := get.QueryRow(kind, key).Scan(&record); {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, errRecordNotFound
+	case err != nil:
+		return nil, err
+	}
+	return record, nil
+}
+
+// SwapRecord inserts, updates or deletes the record in one statement, which the primary key on
+// kind and key makes atomic. Records compare as JSON.
+func (s *postgresRecordStore) SwapRecord(kind, key string, old, new []byte) (bool, error) {
+	var (
+		statement *sql.Stmt
+		err       error
+		args      = []any{kind, key}
+	)
+	switch {
+	case old == nil:
+		statement, err = s.db.statement("createRecord")
+		args = append(args, new)
+	case new == nil:
+		statement, err = s.db.statement("removeRecord")
+		args = append(args, old)
+	default:
+		statement, err = s.db.statement("swapRecord")
+		args = append(args, old, new)
+	}
+	if err != nil {
+		return false, err
+	}
+	result, err := statement.Exec(args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (s *postgresRecordStore) ListRecords(kind string) (map[string][]byte, error) {
+	list, err := s.db.statement("listRecords")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := list.Query(kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := map[string][]byte{}
+	for rows.Next() {
+		var key string
+		var record []byte
+		if err := rows.Scan(&key, &record); err != nil {
+			return nil, err
+		}
+		records[key] = record
+	}
+	return records, rows.Err()
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"log"
-	"math"
 	"net/http"
-	"strconv"
-	"strings"
+	"os"
+	"slices"
+	"sync"
 	"time"
-	"unicode"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -20,6 +22,18 @@ type Receipt struct {
 	PurchaseTime string `json:"purchaseTime"`
 	Total        string `json:"total"`
 	Items        []Item `json:"items"`
+	UserID       string `json:"userId,omitempty"`
+	DeviceID     string `json:"deviceId,omitempty"`
+	// Locale is the language of the receipt, e.g. "fr-CA". The tenant's locale applies when empty.
+	Locale string `json:"locale,omitempty"`
+	// Signature is a base64 Ed25519 signature of the receipt by the POS device DeviceID.
+	Signature string `json:"signature,omitempty"`
+	// Nonce is signed with the receipt by the device, which uses each value once, e.g. a sequence
+	// number, so its signature can't be replayed on another receipt.
+	Nonce string `json:"nonce,omitempty"`
+	// OCRConfidence is the confidence of the extraction, from 0 to 1, of a receipt read from OCR
+	// text by the extract endpoint or from a wallet pass.
+	OCRConfidence *float64 `json:"ocrConfidence,omitempty"`
 }
 
 type Item struct {
@@ -27,112 +41,1031 @@ type Item struct {
 	Price            string `json:"price"`
 }
 
+// Receipt statuses. Only scored receipts have points; ineligible and rejected receipts earn nothing
+// and receipts pending review are scored once approved.
+const (
+	statusScored        = "scored"
+	statusIneligible    = "ineligible"
+	statusPendingReview = "pending_review"
+	statusRejected      = "rejected"
+)
+
 type ProcessedReceipt struct {
-	ID     string
-	Points int
+	ID           string
+	TenantID     string
+	Receipt      Receipt
+	ProcessedAt  time.Time
+	Points       int
+	Breakdown    Breakdown
+	Status       string
+	StatusReason string
+	// Trusted is set when the receipt was signed by a registered POS device.
+	Trusted bool
+	// Contract is the partner contract the receipt was scored under, if any.
+	Contract *ContractRef
+	// Language is the language detected in the item descriptions, e.g. "fr", if any.
+	Language    string
+	Review      *Review
+	Attachments []Attachment
+	// DeletedAt is set while the receipt is soft-deleted and can still be restored.
+	DeletedAt *time.Time
+	// ExpiresAt is when a sandbox tenant's receipt is removed.
+	ExpiresAt *time.Time
+	// UserIDHash and SealedUserID hold the receipt's user ID in the store, which keeps
+	// Receipt.UserID empty. See sealIdentifiers.
+	UserIDHash   string
+	SealedUserID []byte
+	// SchemaVersion is the version of the stored format the receipt was written in. See
+	// receiptSchemaVersion.
+	SchemaVersion int
+	// Archive is set once the receipt was archived. See archive.go.
+	Archive *ArchiveRef `json:",omitempty"`
+	// RulesVersion is the version of the rule set the receipt was last scored by, 0 if it was
+	// scored before versions were recorded.
+	RulesVersion int `json:",omitempty"`
+	// DataQuality lists the data-quality flags of the receipt, e.g. "time-missing". See
+	// dataQualityFlags.
+	DataQuality []string `json:",omitempty"`
 }
 
-var receiptStore = make(map[string]ProcessedReceipt)
+// Contribution is the number of points a single rule awarded. Item is the index of the receipt item
+// the points were awarded for, if the rule applies per item.
+type Contribution struct {
+	Rule   string `json:"rule"`
+	Points int    `json:"points"`
+	Item   *int   `json:"item,omitempty"`
+	// Rounding is the rounding mode applied, for rules that award a fraction of an amount.
+	Rounding string `json:"rounding,omitempty"`
+	// Model is the scoring model's verdict, on its model-adjustment entry.
+	Model *ModelVerdict `json:"model,omitempty"`
+	// Uncapped is the points the rule awarded before the points cap prorated them.
+	Uncapped *int `json:"uncapped,omitempty"`
+}
 
-func calculatePoints(receipt Receipt) int {
-	totalPoints := 0
-	// One point for every alphanumeric character in the retailer name.
-	for _, char := range receipt.Retailer {
-		if unicode.IsLetter(char) || unicode.IsDigit(char) {
-			totalPoints++
-		}
+type Breakdown []Contribution
+
+func (b *Breakdown) add(rule string, points int) {
+	if points != 0 {
+		*b = append(*b, Contribution{Rule: rule, Points: points})
+	}
+}
+
+func (b *Breakdown) addItem(rule string, item int, points int) {
+	if points != 0 {
+		*b = append(*b, Contribution{Rule: rule, Points: points, Item: &item})
+	}
+}
+
+// explainedContribution is a Contribution with the description of its rule, as returned by the API.
+type explainedContribution struct {
+	Contribution
+	Description string `json:"description,omitempty"`
+}
+
+// explainBreakdown describes the rules of a breakdown as they were in the rule set of the given
+// version, or as they are now when it isn't kept.
+func explainBreakdown(b Breakdown, version int) []explainedContribution {
+	cfg, ok := rulesAt(version)
+	if !ok {
+		cfg = currentRules()
 	}
+	explained := make([]explainedContribution, len(b))
+	for i, contribution := range b {
+		explained[i] = explainedContribution{contribution, describeRule(cfg, contribution.Rule)}
+	}
+	return explained
+}
 
-	total, err := strconv.ParseFloat(receipt.Total, 64)
-	if err == nil {
+func (b Breakdown) Total() int {
+	total := 0
+	for _, contribution := range b {
+		total += contribution.Points
+	}
+	return total
+}
+
+var errReceiptNotFound = errors.New("receipt not found")
+
+var (
+	// receiptStoreMu serializes writes to the receipt stores, so updates read and write a receipt
+	// without another write in between. Reads don't need it.
+	receiptStoreMu sync.Mutex
+	receiptStore   ReceiptStore = newMemoryStore()
+	// sandboxStore keeps the receipts of sandbox tenants apart from production data. Lookups by
+	// ID see both stores; listings only see production receipts.
+	sandboxStore ReceiptStore = newMemoryStore()
+)
 
-		// 50 points if the total is a round dollar amount with no cents.
-		if total == math.Trunc(total) {
-			totalPoints += 50
+// findStoredReceipt returns the receipt with id as stored, and the store holding it.
+func findStoredReceipt(id string) (ReceiptStore, ProcessedReceipt, error) {
+	for _, store := range []ReceiptStore{receiptStore, sandboxStore} {
+		receipt, err := store.Get(id)
+		if !errors.Is(err, errReceiptNotFound) {
+			return store, receipt, err
 		}
+	}
+	return nil, ProcessedReceipt{}, errReceiptNotFound
+}
 
-		// 25 points if the total is a multiple of 0.25.
-		if math.Mod(total, 0.25) == 0 {
-			totalPoints += 25
+// lookupReceipt returns the receipt with id, retrieving it first if it is archived. It fails with
+// errReceiptArchived while the retrieval is in progress.
+func lookupReceipt(id string) (ProcessedReceipt, error) {
+	_, receipt, err := findStoredReceipt(id)
+	if err == nil && isArchived(receipt) {
+		receipt, err = retrieveArchivedReceipt(id)
+	}
+	if err != nil {
+		if !errors.Is(err, errReceiptNotFound) && !errors.Is(err, errReceiptArchived) {
+			log.Printf("Reading receipt %s: %v", id, err)
 		}
+		return ProcessedReceipt{}, err
+	}
+	return openIdentifiers(receipt), nil
+}
+
+func getReceipt(id string) (ProcessedReceipt, bool) {
+	receipt, err := lookupReceipt(id)
+	return receipt, err == nil
+}
+
+// findReceipt returns the stored receipt with id, read back in full if it is archived, and the
+// store holding it. receiptStoreMu must be held.
+func findReceipt(id string) (ReceiptStore, ProcessedReceipt, error) {
+	store, receipt, err := findStoredReceipt(id)
+	if err == nil && isArchived(receipt) {
+		receipt, err = hydrateArchivedReceipt(receipt)
 	}
+	return store, receipt, err
+}
 
-	// 5 points for every two items on the receipt.
-	numItems := len(receipt.Items)
-	totalPoints += (numItems / 2) * 5
+func saveReceipt(ctx context.Context, receipt ProcessedReceipt) error {
+	_, span := startSpan(ctx, "storage.put")
+	defer span.End()
+	store, storeName := receiptStore, "production"
+	if tenantIsSandbox(receipt.TenantID) {
+		store, storeName = sandboxStore, "sandbox"
+	}
+	span.set("receipt.id", receipt.ID)
+	span.set("store", storeName)
+	receiptStoreMu.Lock()
+	defer receiptStoreMu.Unlock()
+	err := store.Put(sealIdentifiers(receipt))
+	span.fail(err)
+	return err
+}
+
+// updateReceipt applies fn to a copy of the stored receipt and saves the result unless fn fails,
+// holding the store lock so concurrent updates can't overwrite each other. Stores shared by
+// instances update the receipt atomically, so updates made by other instances aren't lost either.
+func updateReceipt(id string, fn func(*ProcessedReceipt) error) (ProcessedReceipt, error) {
+	receiptStoreMu.Lock()
+	defer receiptStoreMu.Unlock()
 
-	// If the trimmed length of the item description is a multiple of 3, multiply the price by 0.2 and round up to the nearest integer. The result is the number of points earned.
-	for _, item := range receipt.Items {
-		description := strings.TrimSpace(item.ShortDescription)
-		if len(description)%3 == 0 {
-			price, err := strconv.ParseFloat(item.Price, 64)
-			if err == nil {
-				points := int(math.Ceil(price * 0.2))
-				totalPoints += points
+	store, stored, err := findStoredReceipt(id)
+	if err != nil {
+		return ProcessedReceipt{}, err
+	}
+	var updated ProcessedReceipt
+	update := func(stored ProcessedReceipt) (ProcessedReceipt, error) {
+		if isArchived(stored) {
+			hydrated, err := hydrateArchivedReceipt(stored)
+			if err != nil {
+				return ProcessedReceipt{}, err
 			}
+			stored = hydrated
 		}
+		receipt := openIdentifiers(stored)
+		receipt.Attachments = slices.Clone(receipt.Attachments)
+		if err := fn(&receipt); err != nil {
+			return ProcessedReceipt{}, err
+		}
+		updated = receipt
+		return sealIdentifiers(receipt), nil
+	}
+	if updater, ok := store.(receiptUpdater); ok {
+		if _, err := updater.Update(id, update); err != nil {
+			return ProcessedReceipt{}, err
+		}
+		return updated, nil
+	}
+	sealed, err := update(stored)
+	if err != nil {
+		return ProcessedReceipt{}, err
+	}
+	if err := store.Put(sealed); err != nil {
+		return ProcessedReceipt{}, err
+	}
+	return updated, nil
+}
+
+// purgeReceipt permanently removes a receipt if check still holds for it under the store lock, and
+// returns what was removed.
+func purgeReceipt(id string, check func(ProcessedReceipt) bool) (ProcessedReceipt, error) {
+	receiptStoreMu.Lock()
+	defer receiptStoreMu.Unlock()
+
+	store, receipt, err := findReceipt(id)
+	if err != nil {
+		return ProcessedReceipt{}, err
+	}
+	receipt = openIdentifiers(receipt)
+	if !check(receipt) {
+		return ProcessedReceipt{}, errReceiptNotFound
 	}
+	if err := store.Delete(id); err != nil {
+		return ProcessedReceipt{}, err
+	}
+	forgetReceiptStats(id)
+	return receipt, nil
+}
 
-	// 6 points if the day in the purchase date is odd.
-	purchaseDate, err := time.Parse("2006-01-02", receipt.PurchaseDate)
-	if err == nil && purchaseDate.Day()%2 == 1 {
-		totalPoints += 6
+// listStore returns the receipts of store as stored, logging and returning none if it can't be
+// read.
+func listStore(store ReceiptStore) []ProcessedReceipt {
+	receipts, err := store.List()
+	if err != nil {
+		log.Printf("Listing receipts: %v", err)
 	}
+	return receipts
+}
 
-	// 10 points if the time of purchase is after 2:00pm and before 4:00pm
-	purchaseTime, err := time.Parse("15:04", receipt.PurchaseTime)
-	if err == nil {
-		hour, minute, _ := purchaseTime.Clock()
-		totalMinutes := hour*60 + minute
-		if totalMinutes >= 14*60 && totalMinutes < 16*60 {
-			totalPoints += 10
+// listReceipts returns every production receipt that isn't archived.
+func listReceipts() []ProcessedReceipt {
+	var receipts []ProcessedReceipt
+	for _, receipt := range listStore(receiptStore) {
+		if !isArchived(receipt) {
+			receipts = append(receipts, openIdentifiers(receipt))
 		}
 	}
+	return receipts
+}
 
-	return totalPoints
+// listUserReceipts returns the receipts submitted by a user that aren't archived, found by the hash
+// of their ID.
+func listUserReceipts(userID string) []ProcessedReceipt {
+	hashes := userIDHashes(userID)
+	var receipts []ProcessedReceipt
+	for _, receipt := range listStore(receiptStore) {
+		if slices.Contains(hashes, receipt.UserIDHash) && !isArchived(receipt) {
+			receipts = append(receipts, openIdentifiers(receipt))
+		}
+	}
+	return receipts
 }
 
 func processReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, tenantID, ok := authenticateSubmitter(w, r)
+	if !ok {
+		return
+	}
+
 	var receipt Receipt
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&receipt); err != nil {
+		recordDeviceSubmission(deviceID, ProcessedReceipt{}, errors.New("invalid receipt JSON"))
 		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
 		return
 	}
+	if !admitReceipt(r.Context(), w, &receipt, deviceID) {
+		return
+	}
+	processAdmittedReceipt(w, r, receipt, tenantID, map[string]any{})
+}
+
+// processAdmittedReceipt processes and stores a receipt admitted for the tenant and writes the
+// response of the process endpoints, which adds the receipt's ID and outcome to response.
+func processAdmittedReceipt(w http.ResponseWriter, r *http.Request, receipt Receipt, tenantID string, response map[string]any) {
+	now, ok := requestTime(w, r, tenantID)
+	if !ok {
+		return
+	}
+	processed, err := submitReceipt(r.Context(), receipt, tenantID, now)
+	logReceiptID(r, processed.ID)
+	recordDeviceSubmission(receipt.DeviceID, processed, err)
+	duplicate := errors.Is(err, errDuplicateReceipt)
+	switch {
+	case duplicate && duplicateResponse == duplicateConflict:
+		writeDuplicateReceipt(w, processed)
+		return
+	case errors.Is(err, errReplayedSignature):
+		http.Error(w, "The device already signed another receipt with that nonce.", http.StatusConflict)
+		return
+	case err != nil && !duplicate:
+		log.Printf("Storing receipt: %v", err)
+		http.Error(w, "The receipt could not be stored.", http.StatusInternalServerError)
+		return
+	}
+
+	response["id"] = processed.ID
+	statusCode := http.StatusOK
+	if processed.Status != statusScored {
+		response["status"] = processed.Status
+		response["reason"] = processed.StatusReason
+	}
+	if warnings := receiptSkippedRules(processed); warnings != nil {
+		response["warnings"] = warnings
+	}
+	if duplicate {
+		response["duplicate"] = true
+	} else if processed.Status == statusPendingReview {
+		statusCode = http.StatusAccepted
+	}
+	if !forwardToUpstream(w, r, processed, response) {
+		return
+	}
+	writeReceiptResponse(w, r, statusCode, response, processed)
+}
+
+// authenticateSubmitter resolves the device and tenant a receipt submission comes from, writing
+// a 401 when its credentials are invalid.
+func authenticateSubmitter(w http.ResponseWriter, r *http.Request) (deviceID, tenantID string, ok bool) {
+	deviceID, tenantID, err := submitterFromRequest(r)
+	switch {
+	case errors.Is(err, errInvalidSubmissionToken):
+		http.Error(w, "Invalid or expired submission token.", http.StatusUnauthorized)
+		return "", "", false
+	case err != nil:
+		http.Error(w, "Invalid device credentials.", http.StatusUnauthorized)
+		return "", "", false
+	}
+	return deviceID, tenantID, true
+}
+
+// admissionError is why a submitted receipt can't be accepted: the response status and message,
+// and the validation errors of an invalid receipt.
+type admissionError struct {
+	status  int
+	message string
+	errs    []ValidationIssue
+}
+
+// checkAdmission validates a submitted receipt, binds it to the authenticated device and user and
+// applies the abuse rate limit, and returns why the receipt can't be accepted, if it can't.
+func checkAdmission(ctx context.Context, receipt *Receipt, deviceID string) *admissionError {
+	_, span := startSpan(ctx, "receipt.validate")
+	errs, _ := validateReceipt(*receipt, time.Now())
+	span.set("validation.errors", len(errs))
+	span.End()
+	if len(errs) > 0 {
+		recordDeviceSubmission(deviceID, ProcessedReceipt{}, errors.New("invalid receipt"))
+		return &admissionError{status: http.StatusBadRequest, message: "The receipt is invalid.", errs: errs}
+	}
+	if deviceID != "" {
+		if receipt.DeviceID != "" && receipt.DeviceID != deviceID {
+			recordDeviceSubmission(deviceID, ProcessedReceipt{}, errDeviceKeyMismatch)
+			return &admissionError{status: http.StatusBadRequest, message: "The receipt's deviceId does not match the device credentials."}
+		}
+		receipt.DeviceID = deviceID
+	}
+	if user := authenticatedUser(ctx); user != "" {
+		if receipt.UserID != "" && receipt.UserID != user {
+			return &admissionError{status: http.StatusForbidden, message: "The receipt's userId does not match the user token."}
+		}
+		receipt.UserID = user
+	}
+	if !allowSubmission(*receipt) {
+		recordDeviceSubmission(deviceID, ProcessedReceipt{}, errors.New("rate limited after abuse reports"))
+		return &admissionError{status: http.StatusTooManyRequests, message: "Too many receipts submitted."}
+	}
+	return nil
+}
+
+// admitReceipt checks the admission of a submitted receipt, writing the error response when it
+// can't be accepted.
+func admitReceipt(ctx context.Context, w http.ResponseWriter, receipt *Receipt, deviceID string) bool {
+	refused := checkAdmission(ctx, receipt, deviceID)
+	switch {
+	case refused == nil:
+		return true
+	case refused.errs != nil:
+		writeValidationErrors(w, refused.errs)
+	case refused.status == http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, refused.message, refused.status)
+	default:
+		http.Error(w, refused.message, refused.status)
+	}
+	return false
+}
+
+// submitReceipt processes and stores a newly submitted receipt and publishes its events. A receipt
+// the tenant already has stored isn't processed again: the stored one is returned with
+// errDuplicateReceipt.
+func submitReceipt(ctx context.Context, receipt Receipt, tenantID string, now time.Time) (ProcessedReceipt, error) {
+	hash, unlock := lockContent(receipt)
+	defer unlock()
+	if err := claimDeviceNonce(receipt, tenantID, hash); err != nil {
+		return ProcessedReceipt{}, err
+	}
+	processed := processReceipt(ctx, receipt, tenantID, now)
+	release, stored, err := claimContent(tenantID, hash, processed.ID)
+	if err != nil {
+		return stored, err
+	}
+	if err := saveReceipt(ctx, processed); err != nil {
+		release()
+		return ProcessedReceipt{}, err
+	}
+	publishSubmission(processed)
+	return processed, nil
+}
+
+// publishSubmission counts a newly stored receipt in its tenant's and the instance's metrics, remembers it for spotting
+// near-duplicates and publishes its event.
+func publishSubmission(processed ProcessedReceipt) {
+	recordTenantReceipt(processed)
+	recordReceiptMetrics(processed)
+	rememberFingerprint(processed)
+	switch processed.Status {
+	case statusPendingReview:
+		publishReceiptEvent(eventReceiptFlagged, processed, map[string]any{"reason": processed.StatusReason})
+	case statusScored:
+		publishReceiptEvent(eventReceiptProcessed, processed, nil)
+	}
+}
 
-	points := calculatePoints(receipt)
-	id := uuid.New().String()
-	receiptStore[id] = ProcessedReceipt{
-		ID:     id,
-		Points: points,
+// processReceipt checks the eligibility gates and scores the receipt if it passes them, as
+// processed at now.
+func processReceipt(ctx context.Context, receipt Receipt, tenantID string, now time.Time) ProcessedReceipt {
+	_, span := startSpan(ctx, "receipt.score")
+	defer span.End()
+	processed := ProcessedReceipt{
+		ID:          newReceiptID(tenantID, uuid.New().String()),
+		TenantID:    tenantID,
+		Receipt:     receipt,
+		ProcessedAt: now.UTC(),
 	}
+	if ttl, ok := sandboxTTL(tenantID); ok {
+		expiresAt := now.Add(ttl).UTC()
+		processed.ExpiresAt = &expiresAt
+	}
+	evaluateReceipt(&processed)
+	span.set("receipt.id", processed.ID)
+	span.set("receipt.status", processed.Status)
+	span.set("receipt.points", processed.Points)
+	return processed
+}
 
-	response := map[string]string{"id": id}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// evaluateReceipt sets the status and points of processed from its receipt, replacing any earlier
+// result. Receipts that need review are given a pending Review and no points. A signature that
+// fails verification always sends the receipt to review.
+func evaluateReceipt(processed *ProcessedReceipt) {
+	processed.Points, processed.Breakdown, processed.Review = 0, Breakdown{}, nil
+	processed.Language = detectLanguage(processed.Receipt.Items)
+	processed.DataQuality = dataQualityFlags(processed.Receipt)
+	trusted, err := verifyReceiptSignature(processed.Receipt)
+	processed.Trusted = trusted
+	if err != nil {
+		processed.Status, processed.StatusReason = statusPendingReview, signatureFailedReason+": "+err.Error()
+	} else if reason := abuseReviewReason(processed.Receipt); reason != "" {
+		processed.Status, processed.StatusReason = statusPendingReview, reason
+	} else if reason := nearDuplicateReason(*processed); reason != "" {
+		processed.Status, processed.StatusReason = statusPendingReview, reason
+	} else {
+		cfg := currentRules()
+		processed.Status, processed.StatusReason = cfg.Eligibility.check(processed.Receipt, trusted && cfg.TrustedDevices.BypassReview)
+	}
+	if processed.Status == statusScored {
+		if err := scoreProcessedReceipt(processed); err != nil {
+			processed.Points, processed.Breakdown = 0, Breakdown{}
+			processed.Status, processed.StatusReason = statusPendingReview, err.Error()
+		}
+	}
+	if processed.Status == statusPendingReview {
+		processed.Review = &Review{FlaggedAt: time.Now().UTC(), FlagReason: processed.StatusReason}
+	}
+}
+
+// scoreProcessedReceipt awards points to processed by the scoring plan under the rules in effect.
+// It fails with errModelUnavailable, having awarded the rules' points, when the model failed and
+// the receipt is to be held for review instead.
+func scoreProcessedReceipt(processed *ProcessedReceipt) error {
+	cfg := currentRules()
+	processed.RulesVersion = cfg.Version
+	processed.Breakdown = Breakdown{}
+	err := runScoringPlan(cfg, processed)
+	processed.Points = processed.Breakdown.Total()
+	return err
 }
 
 func getPointsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	receipt, exists := receiptStore[id]
-	if !exists {
+	receipt, err := lookupTenantReceipt(r, id)
+	switch {
+	case errors.Is(err, errReceiptArchived):
+		writeReceiptRetrieving(w, id)
+		return
+	case err != nil:
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
+	if receipt.Status == statusPendingReview {
+		http.Error(w, "The receipt is pending review.", http.StatusConflict)
+		return
+	}
+
+	response := map[string]any{"points": receipt.Points}
+	if receipt.DataQuality != nil {
+		response["dataQuality"] = receipt.DataQuality
+	}
+	if !withUnit(w, r, response, receipt) {
+		return
+	}
+	writeReceiptResponse(w, r, http.StatusOK, response, receipt)
+}
+
+func getBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	receipt, err := lookupTenantReceipt(r, id)
+	switch {
+	case errors.Is(err, errReceiptArchived):
+		writeReceiptRetrieving(w, id)
+		return
+	case err != nil:
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	}
+	if receipt.Status == statusPendingReview {
+		http.Error(w, "The receipt is pending review.", http.StatusConflict)
+		return
+	}
+
+	response := map[string]any{"points": receipt.Points, "breakdown": explainBreakdown(receipt.Breakdown, receipt.RulesVersion)}
+	if receipt.Contract != nil {
+		response["contract"] = receipt.Contract
+	}
+	if receipt.Language != "" {
+		response["language"] = receipt.Language
+	}
+	if receipt.RulesVersion != 0 {
+		response["rulesVersion"] = receipt.RulesVersion
+	}
+	if receipt.DataQuality != nil {
+		response["dataQuality"] = receipt.DataQuality
+	}
+	if !withUnit(w, r, response, receipt) {
+		return
+	}
+	writeReceiptResponse(w, r, http.StatusOK, response, receipt)
+}
+
+// getReceiptHandler returns the receipt as it was submitted, with its outcome. The points of a
+// receipt pending review aren't known yet and are left out.
+func getReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	receipt, err := lookupTenantReceipt(r, id)
+	switch {
+	case errors.Is(err, errReceiptArchived):
+		writeReceiptRetrieving(w, id)
+		return
+	case err != nil:
 		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
 		return
 	}
 
-	response := map[string]int{"points": receipt.Points}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	response := map[string]any{
+		"id":          receipt.ID,
+		"receipt":     receipt.Receipt,
+		"status":      receipt.Status,
+		"processedAt": receipt.ProcessedAt,
+	}
+	if receipt.Status != statusPendingReview {
+		response["points"] = receipt.Points
+	}
+	if receipt.StatusReason != "" {
+		response["reason"] = receipt.StatusReason
+	}
+	if receipt.DataQuality != nil {
+		response["dataQuality"] = receipt.DataQuality
+	}
+	writeReceiptResponse(w, r, http.StatusOK, response, receipt)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrateCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to migrate: %v", err)
+		}
+		return
+	}
+	rulesPath := flag.String("rules", os.Getenv("RULES_CONFIG"), "path to a JSON or YAML scoring rules config, reloaded on SIGHUP")
+	flag.StringVar(&environment, "environment", orDefault(os.Getenv("ENVIRONMENT"), environment), "deployment environment; anything but production honors X-Test-Clock")
+	secretsKind := flag.String("secrets", os.Getenv("SECRETS_PROVIDER"), "secrets provider: env (default), file, vault or aws")
+	secretsRefresh := flag.Duration("secrets-refresh", 5*time.Minute, "how often to renew provider credentials and re-read rotatable secrets")
+	adminTokenFlag := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token for the admin API (disabled when empty)")
+	notificationsPath := flag.String("notifications", os.Getenv("NOTIFICATIONS_CONFIG"), "path to a JSON notifications config")
+	apiKeysPath := flag.String("api-keys-file", os.Getenv("API_KEYS_FILE"), "path to a JSON config of the API keys required on the /receipts routes")
+	apiKeysList := flag.String("api-keys", os.Getenv("API_KEYS"), "API keys required on the /receipts routes, as name=key pairs separated by commas")
+	deprecationsPath := flag.String("deprecations", os.Getenv("DEPRECATIONS_CONFIG"), "path to a JSON config of the deprecated routes")
+	partnersPath := flag.String("partners", os.Getenv("PARTNERS_CONFIG"), "path to a JSON partner programs config")
+	confirmationsPath := flag.String("confirmations", os.Getenv("CONFIRMATIONS_CONFIG"), "path to a JSON confirmation email config")
+	flag.BoolVar(&readOnly, "read-only", os.Getenv("READ_ONLY") == "true", "serve reads only, refusing requests that would write to storage")
+	newerSchema := flag.String("newer-schema", orDefault(os.Getenv("NEWER_SCHEMA"), "refuse"), "what to do when storage was migrated by a later release: refuse to start, or run read-only")
+	server := serverFlags(flag.CommandLine)
+	logging := loggingFlags(flag.CommandLine)
+	apiVersionFlags(flag.CommandLine)
+	tracing := tracingFlags(flag.CommandLine)
+	egress := egressFlags(flag.CommandLine)
+	webhookGuard := webhookGuardFlags(flag.CommandLine)
+	gatewayOpts := gatewayFlags(flag.CommandLine)
+	userAuth := userAuthFlags(flag.CommandLine)
+	storage := storageFlags(flag.CommandLine)
+	lockProviderKind := flag.String("lock-provider", orDefault(os.Getenv("LOCK_PROVIDER"), "local"), "provider of the locks that run scheduled tasks on one replica: local, postgres, redis or etcd")
+	etcdEndpoint := flag.String("etcd-endpoint", os.Getenv("ETCD_ENDPOINT"), "etcd JSON gateway URL, e.g. http://localhost:2379")
+	blobStoreKind := flag.String("blob-store", orDefault(os.Getenv("BLOB_STORE"), "local"), "attachment storage backend: local or s3")
+	blobDir := flag.String("blob-dir", orDefault(os.Getenv("BLOB_DIR"), "data/blobs"), "directory for the local blob store")
+	flag.Int64Var(&maxAttachmentSize, "max-attachment-size", maxAttachmentSize, "maximum attachment size in bytes")
+	flag.IntVar(&abuseBaseRate, "abuse-base-rate", abuseBaseRate, "submissions per minute allowed after one abuse report, halved by each further report")
+	flag.IntVar(&abuseReviewThreshold, "abuse-review-threshold", abuseReviewThreshold, "abuse reports after which a principal's receipts are held for review")
+	flag.StringVar(&validationMode, "validation", orDefault(os.Getenv("VALIDATION"), validationMode), "how receipts with a total, time or item price that doesn't parse are handled: strict (rejected) or lenient (scored without the rules that need them)")
+	flag.Float64Var(&ocrConfidenceThreshold, "ocr-confidence-threshold", ocrConfidenceThreshold, "lowest extraction confidence, from 0 to 1, at which a receipt read from OCR text isn't flagged ocr-low-confidence")
+	flag.Float64Var(&retailerMatchThreshold, "retailer-match-threshold", retailerMatchThreshold, "lowest confidence, from 0 to 1, at which an extracted retailer name is corrected to a known retailer")
+	scoringModelURL := flag.String("scoring-model-url", os.Getenv("SCORING_MODEL_URL"), "URL of a model service consulted on scored receipts to adjust or veto their points")
+	flag.DurationVar(&modelTimeout, "scoring-model-timeout", modelTimeout, "how long to wait for the scoring model before falling back")
+	flag.StringVar(&modelFallback, "scoring-model-fallback", modelFallback, "what to do when the scoring model fails: keep (the rules' points) or review (hold the receipt)")
+	classifierURL := flag.String("item-classifier-url", os.Getenv("ITEM_CLASSIFIER_URL"), "URL of a classifier service telling restricted items, such as alcohol, that earn no points")
+	flag.DurationVar(&classifierTimeout, "item-classifier-timeout", classifierTimeout, "how long to wait for the item classifier before going by the keywords alone")
+	flag.StringVar(&duplicateResponse, "duplicate-response", orDefault(os.Getenv("DUPLICATE_RESPONSE"), duplicateResponse), "how a receipt submitted again is answered: existing (its stored ID) or conflict (409)")
+	flag.DurationVar(&nearDuplicateWindow, "near-duplicate-window", nearDuplicateWindow, "how long receipts are compared with near-duplicates submitted by other users (0 doesn't compare)")
+	flag.IntVar(&nearDuplicateDistance, "near-duplicate-distance", nearDuplicateDistance, "most bits in which the fingerprints of near-duplicate receipts differ")
+	flag.IntVar(&eventLogSize, "event-log-size", eventLogSize, "how many of the latest events are kept for replays (0 keeps none)")
+	flag.DurationVar(&restoreWindow, "restore-window", restoreWindow, "how long deleted receipts can be restored before they are purged")
+	identityKey := flag.String("identity-key", os.Getenv("IDENTITY_KEY"), "secret used to encrypt and pseudonymize stored user IDs")
+	previousIdentityKey := flag.String("identity-previous-key", os.Getenv("IDENTITY_PREVIOUS_KEY"), "earlier identity key still accepted for reading user IDs not yet re-encrypted after a rotation")
+	ledgerIntegrityKeyFlag := flag.String("ledger-integrity-key", os.Getenv("LEDGER_INTEGRITY_KEY"), "secret binding users into the ledger's entry hashes; unlike the identity key, it is never rotated")
+	webhookSecret := flag.String("webhook-signing-secret", os.Getenv("WEBHOOK_SIGNING_SECRET"), "secret used to sign webhook and job callback deliveries (unsigned when empty)")
+	settlementKey := flag.String("settlement-signing-key", os.Getenv("SETTLEMENT_SIGNING_KEY"), "secret the Ed25519 settlement signing key is derived from")
+	attachmentSecret := flag.String("attachment-url-secret", os.Getenv("ATTACHMENT_URL_SECRET"), "secret used to sign attachment download URLs")
+	jobWorkers := flag.Int("job-workers", 4, "number of workers processing standard-priority batch jobs")
+	realtimeJobWorkers := flag.Int("realtime-job-workers", 2, "number of workers processing realtime-priority batch jobs")
+	backfillJobWorkers := flag.Int("backfill-job-workers", 1, "number of workers processing backfill-priority batch jobs")
+	flag.DurationVar(&jobRetention, "job-retention", jobRetention, "how long a completed batch job and its results are kept (0 keeps them until the instance stops)")
+	flag.IntVar(&tenantJobConcurrency, "tenant-job-concurrency", tenantJobConcurrency, "job items of one tenant processed at once per priority, unless the tenant sets maxConcurrency (0 for no limit)")
+	shardFlag := flag.String("shard", os.Getenv("SHARD"), "the tenants whose batch jobs and imports this instance takes, as <index>/<count>, e.g. 0/3 (all when empty)")
+	flag.DurationVar(&archiveAfter, "archive-after", archiveAfter, "age after which receipts are moved to the archive tier, unless their tenant sets archiveAfter (0 never archives)")
+	flag.DurationVar(&keepRetrieved, "archive-keep-retrieved", keepRetrieved, "how long a receipt retrieved from the archive stays in the receipt store before it is archived again")
+	archiveTierKind := flag.String("archive-tier", orDefault(os.Getenv("ARCHIVE_TIER"), "blob"), "where archived receipts are kept: blob (the blob store) or glacier (the S3 blob store's bucket, in the GLACIER storage class)")
+	archiveRestoreDays := flag.Int("archive-restore-days", 7, "days a receipt restored from Glacier stays readable")
+	exportStoreKind := flag.String("export-store", orDefault(os.Getenv("EXPORT_STORE"), "local"), "where Parquet exports are written: local or s3")
+	exportDir := flag.String("export-dir", orDefault(os.Getenv("EXPORT_DIR"), "data"), "directory under which local Parquet exports are written")
+	exportInterval := flag.Duration("export-interval", 0, "how often to export the receipts to Parquet (0 only exports when triggered)")
+	imageWorkers := flag.Int("image-workers", 2, "number of background workers generating image thumbnails and normalized versions")
+	clamAVAddr := flag.String("clamav-addr", os.Getenv("CLAMAV_ADDR"), "clamd TCP address for scanning attachments, e.g. localhost:3310")
+	flag.BoolVar(&allowUnscannedUploads, "allow-unscanned-uploads", os.Getenv("ALLOW_UNSCANNED_UPLOADS") == "true", "store attachments unscanned when no virus scanner is configured, for development (refused otherwise)")
+	flag.Parse()
+
+	if err := configureLogging(logging); err != nil {
+		log.Fatalf("Failed to configure logging: %v", err)
+	}
+	if err := checkDefaultAPIVersion(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureEgress(egress); err != nil {
+		log.Fatalf("Failed to configure egress: %v", err)
+	}
+	if err := configureWebhookGuard(webhookGuard); err != nil {
+		log.Fatalf("Failed to configure webhook destinations: %v", err)
+	}
+	provider, err := newSecretsProvider(*secretsKind)
+	if err != nil {
+		log.Fatalf("Failed to configure secrets: %v", err)
+	}
+	secrets = provider
+	if err := startTracing(tracing); err != nil {
+		log.Fatalf("Failed to configure tracing: %v", err)
+	}
+	if err := startGateway(gatewayOpts); err != nil {
+		log.Fatalf("Failed to configure the gateway: %v", err)
+	}
+	if instanceShard, err = parseShard(*shardFlag); err != nil {
+		log.Fatal(err)
+	}
+	// Secrets not given directly come from the provider. Only those can be rotated there.
+	rotateAdminToken := *adminTokenFlag == ""
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	for name, value := range map[string]*string{
+		"admin-token":            adminTokenFlag,
+		"identity-key":           identityKey,
+		"identity-previous-key":  previousIdentityKey,
+		"ledger-integrity-key":   ledgerIntegrityKeyFlag,
+		"attachment-url-secret":  attachmentSecret,
+		"webhook-signing-secret": webhookSecret,
+		"settlement-signing-key": settlementKey,
+		"database-url":           &storage.databaseURL,
+	} {
+		if *value, err = lookupSecret(ctx, *value, name); err != nil {
+			log.Fatalf("Failed to load secret %s: %v", name, err)
+		}
+	}
+	cancel()
+	adminToken.Set(*adminTokenFlag)
+	var webhookKey []byte
+	if *webhookSecret != "" {
+		webhookKey = []byte(*webhookSecret)
+	}
+	newKeyRing(keyRingWebhookSigning, webhookKey, nil)
+	newKeyRing(keyRingSubmissionTokens, randomSecret(), nil)
+	initSettlementKey(*settlementKey)
+	if err := initIdentityKey(*identityKey, *previousIdentityKey, storage.kind != "memory"); err != nil {
+		log.Fatalf("Failed to configure the identity key: %v", err)
+	}
+	if err := initLedgerIntegrityKey(*ledgerIntegrityKeyFlag, storage.kind != "memory"); err != nil {
+		log.Fatalf("Failed to configure the ledger integrity key: %v", err)
+	}
+	if _, isEnv := secrets.(envSecrets); rotateAdminToken && !isEnv {
+		watchSecrets(*secretsRefresh, map[string]*secretValue{"admin-token": &adminToken})
+	}
+
+	if *rulesPath != "" {
+		cfg, err := loadRulesConfig(*rulesPath)
+		if err != nil {
+			log.Fatalf("Failed to load rules: %v", err)
+		}
+		setRules(cfg, "", "loaded from "+*rulesPath)
+		reloadRulesOnHangup(*rulesPath)
+	} else {
+		setRules(defaultRulesConfig(), "", "default rules")
+	}
+
+	if apiKeys, err = loadAPIKeys(*apiKeysPath, *apiKeysList); err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
+	if err := configureUserAuth(userAuth); err != nil {
+		log.Fatalf("Failed to configure user tokens: %v", err)
+	}
+
+	if *deprecationsPath != "" {
+		if deprecations, err = loadDeprecationsConfig(*deprecationsPath); err != nil {
+			log.Fatalf("Failed to load deprecations: %v", err)
+		}
+	}
+
+	if *partnersPath != "" {
+		programs, err := loadPartnersConfig(*partnersPath)
+		if err != nil {
+			log.Fatalf("Failed to load partner programs: %v", err)
+		}
+		partnerPrograms = programs
+	}
+
+	if *notificationsPath != "" {
+		cfg, err := loadNotificationsConfig(*notificationsPath)
+		if err != nil {
+			log.Fatalf("Failed to load notifications: %v", err)
+		}
+		if err := startNotifiers(cfg); err != nil {
+			log.Fatalf("Failed to start notifiers: %v", err)
+		}
+	}
+
+	startLedger()
+	startStats()
+
+	if *confirmationsPath != "" {
+		cfg, err := loadConfirmationConfig(*confirmationsPath)
+		if err != nil {
+			log.Fatalf("Failed to load confirmations: %v", err)
+		}
+		if err := startConfirmations(cfg); err != nil {
+			log.Fatalf("Failed to start confirmations: %v", err)
+		}
+	}
+
+	if receiptStore, sandboxStore, storageMigrator, err = newReceiptStores(storage); err != nil {
+		log.Fatalf("Failed to open receipt storage: %v", err)
+	}
+	if modelFallback != modelFallbackKeep && modelFallback != modelFallbackReview {
+		log.Fatalf("Unknown -scoring-model-fallback %q: must be keep or review", modelFallback)
+	}
+	if *classifierURL != "" {
+		itemClassifier = httpItemClassifier{url: *classifierURL, client: egressClient(egressItemClassifier, 0)}
+	}
+	if *scoringModelURL != "" {
+		scoringModel = httpScoringModel{url: *scoringModelURL, client: egressClient(egressScoringModel, 0)}
+	}
+	if validationMode != validationStrict && validationMode != validationLenient {
+		log.Fatalf("Unknown -validation %q: must be strict or lenient", validationMode)
+	}
+	if duplicateResponse != duplicateExisting && duplicateResponse != duplicateConflict {
+		log.Fatalf("Unknown -duplicate-response %q: must be existing or conflict", duplicateResponse)
+	}
+	if *newerSchema != "refuse" && *newerSchema != "read-only" {
+		log.Fatalf("Unknown -newer-schema %q: must be refuse or read-only", *newerSchema)
+	}
+	switch err := migrateStorage(storageMigrator, -1); {
+	case errors.Is(err, errNewerSchema) && *newerSchema == "read-only":
+		log.Printf("Receipt storage %v; running read-only", err)
+		readOnly = true
+	case errors.Is(err, errNewerSchema):
+		log.Fatalf("Refusing to start: receipt storage %v. Run with -newer-schema=read-only to serve reads only.", err)
+	case err != nil:
+		log.Fatalf("Failed to migrate receipt storage: %v", err)
+	}
+	if readOnly {
+		enterReadOnlyMode()
+	}
+	if err := loadLedger(newLedgerStore(receiptStore)); err != nil {
+		log.Fatalf("Failed to load the ledger: %v", err)
+	}
+	recordStore = newRecordStore(receiptStore)
+	if err := loadLegalHolds(); err != nil {
+		log.Fatalf("Failed to load the legal holds: %v", err)
+	}
+	store, err := newBlobStore(*blobStoreKind, *blobDir)
+	if err != nil {
+		log.Fatalf("Failed to configure blob store: %v", err)
+	}
+	blobStore = store
+	initAttachmentSecret(*attachmentSecret)
+	indexReceiptStats()
+	startImagePipeline(*imageWorkers)
+	if lockProvider, err = newLockProvider(*lockProviderKind, storage, *etcdEndpoint); err != nil {
+		log.Fatalf("Failed to configure locks: %v", err)
+	}
+	if !readOnly {
+		startDeletionSweeper(time.Hour)
+		startSandboxSweeper(time.Hour)
+	}
+	if exportStore, err = newBlobStore(*exportStoreKind, *exportDir); err != nil {
+		log.Fatalf("Failed to configure the export store: %v", err)
+	}
+	if *exportInterval > 0 {
+		scheduleTask("parquet-export", *exportInterval, runScheduledExport)
+	}
+	if archiveTier, err = newArchiveTier(*archiveTierKind, blobStore, *archiveRestoreDays); err != nil {
+		log.Fatalf("Failed to configure the archive tier: %v", err)
+	}
+	// Read-only instances don't take submissions, and may not be able to write to the store.
+	if !readOnly {
+		if err := indexContentHashes(); err != nil {
+			log.Fatalf("Failed to index the receipts by content: %v", err)
+		}
+	}
+	if !readOnly && archiveAfter > 0 {
+		startArchiveSweeper(time.Hour)
+	}
+	startJobWorkers(map[string]int{
+		priorityRealtime: *realtimeJobWorkers,
+		priorityStandard: *jobWorkers,
+		priorityBackfill: *backfillJobWorkers,
+	})
+	if jobRetention > 0 {
+		startJobSweeper(min(jobRetention, time.Hour))
+	}
+	storageBackends = map[string]string{
+		"receipts": storage.kind,
+		"blobs":    *blobStoreKind,
+		"archive":  *archiveTierKind,
+		"exports":  *exportStoreKind,
+		"locks":    *lockProviderKind,
+	}
+	if *clamAVAddr != "" {
+		virusScanner = clamAVScanner{addr: *clamAVAddr, timeout: 30 * time.Second}
+	} else if allowUnscannedUploads {
+		log.Println("No virus scanner configured; attachments will be stored unscanned.")
+	} else {
+		log.Println("No virus scanner configured; attachment uploads will be refused.")
+	}
+
 	router := mux.NewRouter()
+	router.Use(logRoutes, traceRequests, instrumentRequests, requireAPIKey, authenticateUsers, announceDeprecations)
 
+	router.HandleFunc("/healthz", healthzHandler).Methods("GET")
+	router.HandleFunc("/readyz", readyzHandler).Methods("GET")
+	router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	router.HandleFunc("/meta/version", versionHandler).Methods("GET")
+	router.HandleFunc("/meta/capabilities", capabilitiesHandler).Methods("GET")
+	router.HandleFunc("/meta/deprecations", listDeprecationsHandler).Methods("GET")
+	router.HandleFunc("/rules/plan", rulesPlanHandler).Methods("GET")
+	router.HandleFunc("/stats", statsHandler).Methods("GET")
+	router.HandleFunc("/leaderboard", leaderboardHandler).Methods("GET")
 	router.HandleFunc("/receipts/process", processReceiptHandler).Methods("POST")
+	router.HandleFunc("/receipts/process/batch", processBatchHandler).Methods("POST")
+	router.HandleFunc("/receipts/process/wallet-pass", processWalletPassHandler).Methods("POST")
+	router.HandleFunc("/receipts/process-and-redeem", processAndRedeemHandler).Methods("POST")
+	router.HandleFunc("/receipts/validate", validateReceiptHandler).Methods("POST")
+	router.HandleFunc("/receipts/score", scoreReceiptHandler).Methods("POST")
+	router.HandleFunc("/receipts/compare", compareReceiptsHandler).Methods("POST")
+	router.HandleFunc("/receipts/extract", extractReceiptHandler).Methods("POST")
 	router.HandleFunc("/receipts/{id}/points", getPointsHandler).Methods("GET")
+	router.HandleFunc("/receipts/{id}/breakdown", getBreakdownHandler).Methods("GET")
+	router.HandleFunc("/receipts/{id}", getReceiptHandler).Methods("GET")
+	router.HandleFunc("/receipts/{id}", deleteReceiptHandler).Methods("DELETE")
+	router.HandleFunc("/receipts/{id}/restore", restoreReceiptHandler).Methods("POST")
+	router.HandleFunc("/users/{id}/balance", getBalanceHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/transactions", listTransactionsHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/redeem", redeemHandler).Methods("POST")
+	router.HandleFunc("/users/{from}/transfer", transferHandler).Methods("POST")
+	router.HandleFunc("/users/{id}/reservations", createReservationHandler).Methods("POST")
+	router.HandleFunc("/users/{id}/reservations/{reservationId}", getReservationHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/reservations/{reservationId}/commit", commitReservationHandler).Methods("POST")
+	router.HandleFunc("/users/{id}/reservations/{reservationId}/cancel", cancelReservationHandler).Methods("POST")
+	router.HandleFunc("/users/{id}/offers", listUserOffersHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/insights", getInsightsHandler).Methods("GET")
+	router.HandleFunc("/households/{id}", getHouseholdHandler).Methods("GET")
+	router.HandleFunc("/households/{id}/history", householdHistoryHandler).Methods("GET")
+	router.HandleFunc("/jobs", createJobHandler).Methods("POST")
+	router.HandleFunc("/jobs/{id}", getJobHandler).Methods("GET")
+	router.HandleFunc("/jobs/{id}/results", jobResultsHandler).Methods("GET")
+	router.HandleFunc("/jobs/{id}/failures", jobFailuresHandler).Methods("GET")
+	router.HandleFunc("/jobs/{id}/retry-failures", retryJobFailuresHandler).Methods("POST")
+	router.HandleFunc("/imports", importHandler).Methods("POST")
+	router.HandleFunc("/imports/{id}", getImportHandler).Methods("GET")
+	router.HandleFunc("/receipts/{id}/extraction", correctExtractionHandler).Methods("PATCH")
+	router.HandleFunc("/receipts/{id}/attachments", uploadAttachmentHandler).Methods("POST")
+	router.HandleFunc("/receipts/{id}/attachments", listAttachmentsHandler).Methods("GET")
+	router.HandleFunc("/receipts/{id}/attachments/{attachmentId}", downloadAttachmentHandler).Methods("GET")
+	router.HandleFunc("/webhooks", listWebhooksHandler).Methods("GET")
+	router.HandleFunc("/webhooks/{id}", tenantWebhook(getNotifierHandler)).Methods("GET")
+	router.HandleFunc("/webhooks/{id}/test", tenantWebhook(testNotifierHandler)).Methods("POST")
+	router.HandleFunc("/webhooks/{id}/pause", tenantWebhook(pauseNotifierHandler)).Methods("POST")
+	router.HandleFunc("/webhooks/{id}/resume", tenantWebhook(resumeNotifierHandler)).Methods("POST")
+
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/reviews", listReviewsHandler).Methods("GET")
+	admin.HandleFunc("/reviews/{id}/approve", approveReviewHandler).Methods("POST")
+	admin.HandleFunc("/reviews/{id}/reject", rejectReviewHandler).Methods("POST")
+	admin.HandleFunc("/corrections", listCorrectionsHandler).Methods("GET")
+	admin.HandleFunc("/events", listEventsHandler).Methods("GET")
+	admin.HandleFunc("/notifiers", listNotifiersHandler).Methods("GET")
+	admin.HandleFunc("/notifiers/{name}", namedNotifier(getNotifierHandler)).Methods("GET")
+	admin.HandleFunc("/notifiers/{name}/test", namedNotifier(testNotifierHandler)).Methods("POST")
+	admin.HandleFunc("/notifiers/{name}/pause", namedNotifier(pauseNotifierHandler)).Methods("POST")
+	admin.HandleFunc("/notifiers/{name}/resume", namedNotifier(resumeNotifierHandler)).Methods("POST")
+	admin.HandleFunc("/notifiers/{name}/replay", replayNotifierHandler).Methods("POST")
+	admin.HandleFunc("/retailers", listRetailersHandler).Methods("GET")
+	admin.HandleFunc("/retailers/{name}", putRetailerHandler).Methods("PUT")
+	admin.HandleFunc("/retailers/{name}", deleteRetailerHandler).Methods("DELETE")
+	admin.HandleFunc("/extraction-templates", listTemplatesHandler).Methods("GET")
+	admin.HandleFunc("/extraction-templates/{retailer}", putTemplateHandler).Methods("PUT")
+	admin.HandleFunc("/extraction-templates/{retailer}", deleteTemplateHandler).Methods("DELETE")
+	admin.HandleFunc("/extraction-templates/{retailer}/versions", listTemplateVersionsHandler).Methods("GET")
+	admin.HandleFunc("/households", listHouseholdsHandler).Methods("GET")
+	admin.HandleFunc("/households", createHouseholdHandler).Methods("POST")
+	admin.HandleFunc("/households/{id}", deleteHouseholdHandler).Methods("DELETE")
+	admin.HandleFunc("/households/{id}/members/{userId}", addHouseholdMemberHandler).Methods("PUT")
+	admin.HandleFunc("/households/{id}/members/{userId}", removeHouseholdMemberHandler).Methods("DELETE")
+	admin.HandleFunc("/ledger/trial-balance", trialBalanceHandler).Methods("GET")
+	admin.HandleFunc("/ledger/integrity", ledgerIntegrityHandler).Methods("GET")
+	admin.HandleFunc("/users/{id}/offers", assignOfferHandler).Methods("POST")
+	admin.HandleFunc("/offers/{offerId}", revokeOfferHandler).Methods("DELETE")
+	admin.HandleFunc("/rules", listRulesHandler).Methods("GET")
+	admin.HandleFunc("/rules/versions", listRuleVersionsHandler).Methods("GET")
+	admin.HandleFunc("/rules/versions/{version}", getRuleVersionHandler).Methods("GET")
+	admin.HandleFunc("/rules/{kind}", addRuleHandler).Methods("POST")
+	admin.HandleFunc("/rules/{kind}/{name}", putRuleHandler).Methods("PUT")
+	admin.HandleFunc("/rules/{kind}/{name}/{action}", transitionRuleHandler).Methods("POST")
+	admin.HandleFunc("/campaigns", listCampaignsHandler).Methods("GET")
+	admin.HandleFunc("/campaigns/{id}", getCampaignHandler).Methods("GET")
+	admin.HandleFunc("/campaigns/{id}", putCampaignHandler).Methods("PUT")
+	admin.HandleFunc("/campaigns/{id}", deleteCampaignHandler).Methods("DELETE")
+	admin.HandleFunc("/campaigns/{id}/{action}", transitionCampaignHandler).Methods("POST")
+	admin.HandleFunc("/costs", listCostsHandler).Methods("GET")
+	admin.HandleFunc("/budgets", listBudgetsHandler).Methods("GET")
+	admin.HandleFunc("/partners", listPartnersHandler).Methods("GET")
+	admin.HandleFunc("/partners/{id}/settlements/{period}", getSettlementHandler).Methods("GET")
+	admin.HandleFunc("/partners/{id}/settlements/{period}/signature", getSettlementSignatureHandler).Methods("GET")
+	admin.HandleFunc("/settlement-keys", listSettlementKeysHandler).Methods("GET")
+	admin.HandleFunc("/legal-holds", listLegalHoldsHandler).Methods("GET")
+	admin.HandleFunc("/legal-holds", placeLegalHoldHandler).Methods("POST")
+	admin.HandleFunc("/legal-holds/audit", legalHoldAuditHandler).Methods("GET")
+	admin.HandleFunc("/legal-holds/{id}/release", releaseLegalHoldHandler).Methods("POST")
+	admin.HandleFunc("/submission-tokens", createSubmissionTokenHandler).Methods("POST")
+	admin.HandleFunc("/abuse-reports", listAbuseReportsHandler).Methods("GET")
+	admin.HandleFunc("/abuse-reports", reportAbuseHandler).Methods("POST")
+	admin.HandleFunc("/units", listUnitsHandler).Methods("GET")
+	admin.HandleFunc("/units/{unit}/rates", addUnitRateHandler).Methods("POST")
+	admin.HandleFunc("/selftest", selftestHandler).Methods("POST")
+	admin.HandleFunc("/exports", listExportsHandler).Methods("GET")
+	admin.HandleFunc("/exports", startExportHandler).Methods("POST")
+	admin.HandleFunc("/keys", listKeysHandler).Methods("GET")
+	admin.HandleFunc("/keys/{ring}/rotate", rotateKeyHandler).Methods("POST")
+	admin.HandleFunc("/job-queues", jobQueuesHandler).Methods("GET")
+	admin.HandleFunc("/tenants", listTenantsHandler).Methods("GET")
+	admin.HandleFunc("/tenants/{id}", putTenantHandler).Methods("PUT")
+	admin.HandleFunc("/tenants/{id}/metrics", tenantMetricsHandler).Methods("GET")
+	admin.HandleFunc("/devices", listDevicesHandler).Methods("GET")
+	admin.HandleFunc("/devices", registerDeviceHandler).Methods("POST")
+	admin.HandleFunc("/devices/{id}", getDeviceHandler).Methods("GET")
+	admin.HandleFunc("/devices/{id}/key", putDeviceKeyHandler).Methods("PUT")
+	admin.HandleFunc("/devices/{id}/credentials", rotateDeviceCredentialsHandler).Methods("POST")
+	admin.HandleFunc("/devices/{id}", deleteDeviceHandler).Methods("DELETE")
+
+	if err := checkDeprecatedRoutes(router); err != nil {
+		log.Fatalf("Failed to load deprecations: %v", err)
+	}
+	if err := reserveRouteSegments(router); err != nil {
+		log.Fatalf("Failed to reserve the route prefixes: %v", err)
+	}
 
-	log.Println("Server is running on port 8087...")
-	log.Fatal(http.ListenAndServe(":8087", router))
+	if err := serve(server, assignRequestIDs(logRequests(negotiateAPIVersion(tenantVanityPaths(resolveTenants(countTenantRequests(readOnlyGuard(requireTenantShard(router))))))))); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+)
+
+// RecordStore keeps records of the service's own state, such as imports, in the storage backend
+// next to the receipts, so they survive restarts and are shared by the instances sharing it.
+// Records are JSON documents grouped by kind and keyed within it. Implementations must be safe for
+// concurrent use.
+type RecordStore interface {
+	PutRecord(kind, key string, record []byte) error
+	// GetRecord fails with errRecordNotFound if there is no such record.
+	GetRecord(kind, key string) ([]byte, error)
+	ListRecords(kind string) (map[string][]byte, error)
+	// SwapRecord sets the record to new if it is old, and reports whether it did. A nil old means
+	// there must be no such record, and a nil new removes it.
+	SwapRecord(kind, key string, old, new []byte) (bool, error)
+}
+
+var errRecordNotFound = errors.New("record not found")
+
+// recordStore is the RecordStore of the storage backend.
+var recordStore RecordStore = newMemoryRecordStore()
+
+// newRecordStore returns the record store of the storage backend holding production.
+func newRecordStore(production ReceiptStore) RecordStore {
+	switch store := production.(type) {
+	case *boltStore:
+		return &boltRecordStore{db: store.db}
+	case *postgresStore:
+		return &postgresRecordStore{db: store.db}
+	case *redisStore:
+		return &redisRecordStore{client: store.client}
+	default:
+		return newMemoryRecordStore()
+	}
+}
+
+// memoryRecordStore is the record store of the memory storage, which keeps nothing across
+// restarts.
+type memoryRecordStore struct {
+	mu      sync.Mutex
+	records map[string]map[string][]byte
+}
+
+func newMemoryRecordStore() *memoryRecordStore {
+	return &memoryRecordStore{records: map[string]map[string][]byte{}}
+}
+
+func (s *memoryRecordStore) PutRecord(kind, key string, record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records[kind] == nil {
+		s.records[kind] = map[string][]byte{}
+	}
+	s.records[kind][key] = record
+	return nil
+}
+
+func (s *memoryRecordStore) GetRecord(kind, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[kind][key]
+	if !ok {
+		return nil, errRecordNotFound
+	}
+	return record, nil
+}
+
+func (s *memoryRecordStore) ListRecords(kind string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.records[kind]), nil
+}
+
+func (s *memoryRecordStore) SwapRecord(kind, key string, old, new []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, exists := s.records[kind][key]
+	if exists != (old != nil) || !bytes.Equal(current, old) {
+		return false, nil
+	}
+	if new == nil {
+		delete(s.records[kind], key)
+		return true, nil
+	}
+	if s.records[kind] == nil {
+		s.records[kind] = map[string][]byte{}
+	}
+	s.records[kind][key] = new
+	return true, nil
+}
+
+// loadRecord decodes the record of kind with key into v, and reports whether there is one.
+func loadRecord(kind, key string, v any) (bool, error) {
+	data, err := recordStore.GetRecord(kind, key)
+	if errors.Is(err, errRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("%s %s: %w", kind, key, err)
+	}
+	return true, nil
+}
+
+// saveRecord stores v as the record of kind with key.
+func saveRecord(kind, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return recordStore.PutRecord(kind, key, data)
+}
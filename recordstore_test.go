@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRecordStores(t *testing.T) {
+	for name, store := range map[string]RecordStore{
+		"memory": newMemoryRecordStore(),
+		"bolt":   &boltRecordStore{db: openTestBoltDB(t).db},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.GetRecord("claim", "a"); !errors.Is(err, errRecordNotFound) {
+				t.Fatalf("GetRecord of a missing record = %v, want errRecordNotFound", err)
+			}
+			swaps := []struct {
+				old, new string
+				absent   bool
+				want     bool
+			}{
+				{absent: true, new: "1", want: true},
+				{absent: true, new: "2", want: false},
+				{old: "2", new: "3", want: false},
+				{old: "1", new: "2", want: true},
+			}
+			for _, swap := range swaps {
+				var old []byte
+				if !swap.absent {
+					old = []byte(swap.old)
+				}
+				swapped, err := store.SwapRecord("claim", "a", old, []byte(swap.new))
+				if err != nil || swapped != swap.want {
+					t.Errorf("SwapRecord(%q, %q) = %v, %v, want %v", swap.old, swap.new, swapped, err, swap.want)
+				}
+			}
+			if record, err := store.GetRecord("claim", "a"); err != nil || string(record) != "2" {
+				t.Errorf("record after swaps = %q, %v, want 2", record, err)
+			}
+
+			if err := store.PutRecord("claim", "b", []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.PutRecord("other", "c", []byte("y")); err != nil {
+				t.Fatal(err)
+			}
+			records, err := store.ListRecords("claim")
+			if err != nil || len(records) != 2 || string(records["b"]) != "x" {
+				t.Errorf("ListRecords = %q, %v, want the 2 claims", records, err)
+			}
+
+			if swapped, err := store.SwapRecord("claim", "a", []byte("2"), nil); err != nil || !swapped {
+				t.Errorf("removing the record = %v, %v, want removed", swapped, err)
+			}
+			if _, err := store.GetRecord("claim", "a"); !errors.Is(err, errRecordNotFound) {
+				t.Errorf("GetRecord of a removed record = %v, want errRecordNotFound", err)
+			}
+		})
+	}
+}
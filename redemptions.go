@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+)
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key accepted.
+const maxIdempotencyKeyLength = 255
+
+// redemptionByKeyLocked finds the redemption the user made with an idempotency key. ledgerMu must
+// be held.
+func redemptionByKeyLocked(hashes []string, key string) (LedgerEntry, bool) {
+	for _, entry := range ledger {
+		if entry.IdempotencyKey == key && entry.Type == entryRedemption && slices.Contains(hashes, entry.userIDHash) {
+			return entry, true
+		}
+	}
+	return LedgerEntry{}, false
+}
+
+// redeemHandler spends points from a user's available points, refusing with 409 what they don't
+// cover. The check and the redemption entry happen under the ledger lock, so concurrent
+// redemptions can't overdraw the balance together. A redemption retried with the same
+// Idempotency-Key is answered with the original entry instead of redeeming again; the key is kept
+// on the entry, so this holds across restarts. Only the user or an admin may redeem.
+func redeemHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+	if !actsForUser(r, userID) {
+		http.Error(w, "Redeeming points needs the user's token or the admin token.", http.StatusForbidden)
+		return
+	}
+	var request struct {
+		Points    int    `json:"points"`
+		Reference string `json:"reference"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Points <= 0 {
+		http.Error(w, "A redemption needs a positive number of points.", http.StatusBadRequest)
+		return
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, "The Idempotency-Key is too long.", http.StatusBadRequest)
+		return
+	}
+	tenantID := tenantFromRequest(r)
+	if tenantIsSandbox(tenantID) {
+		http.Error(w, "Sandbox receipts don't earn points that can be redeemed.", http.StatusForbidden)
+		return
+	}
+
+	ledgerMu.Lock()
+	if key != "" {
+		if previous, exists := redemptionByKeyLocked(userIDHashes(userID), key); exists {
+			balance := balanceLocked(userID)
+			ledgerMu.Unlock()
+			if previous.Points != -request.Points || previous.Reference != request.Reference || previous.TenantID != tenantID {
+				http.Error(w, "The Idempotency-Key was used for a different redemption.", http.StatusUnprocessableEntity)
+				return
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeRedemption(w, previous, balance)
+			return
+		}
+	}
+	available := availableLocked(userID)
+	if available < request.Points {
+		ledgerMu.Unlock()
+		writeInsufficientPoints(w, available, request.Points)
+		return
+	}
+	redemption, err := appendEntryLocked(userID, LedgerEntry{
+		Type:           entryRedemption,
+		Points:         -request.Points,
+		TenantID:       tenantID,
+		Reference:      request.Reference,
+		IdempotencyKey: key,
+	})
+	if err != nil {
+		ledgerMu.Unlock()
+		log.Printf("Posting redemption: %v", err)
+		http.Error(w, "The redemption could not be recorded.", http.StatusInternalServerError)
+		return
+	}
+	balance := balanceLocked(userID)
+	ledgerMu.Unlock()
+
+	publishRedemption(userID, redemption, "")
+	writeRedemption(w, redemption, balance)
+}
+
+func writeRedemption(w http.ResponseWriter, redemption LedgerEntry, balance int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"redemption": redemption,
+		"balance":    balance,
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// resetLedger starts the test with an empty in-memory ledger and no reservations.
+func resetLedger(t *testing.T) {
+	t.Helper()
+	if err := initIdentityKey("", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := initLedgerIntegrityKey("", false); err != nil {
+		t.Fatal(err)
+	}
+	ledgerMu.Lock()
+	ledger, ledgerStore, receiptCredits = nil, &memoryLedgerStore{}, map[string]int{}
+	reservations = map[string]*Reservation{}
+	ledgerMu.Unlock()
+}
+
+// earnPoints posts an earn entry of points to the user.
+func earnPoints(t *testing.T, userID string, points int) {
+	t.Helper()
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	if _, err := appendEntryLocked(userID, LedgerEntry{Type: entryEarn, Points: points, TenantID: defaultTenant, ReceiptID: "receipt-" + userID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// userRequest is a request to a /users route with its path variables, made with the token of
+// asUser, if any.
+func userRequest(method, target, body, asUser string, vars map[string]string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if asUser != "" {
+		r = r.WithContext(context.WithValue(r.Context(), authenticatedUserKey{}, asUser))
+	}
+	return mux.SetURLVars(r, vars)
+}
+
+func redeem(userID, body, asUser, key string) *httptest.ResponseRecorder {
+	r := userRequest("POST", "/users/"+userID+"/redeem", body, asUser, map[string]string{"id": userID})
+	if key != "" {
+		r.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	redeemHandler(w, r)
+	return w
+}
+
+func TestRedeemNeedsUserOrAdmin(t *testing.T) {
+	resetLedger(t)
+	earnPoints(t, "alice", 100)
+	adminToken.Set("admin-secret")
+	t.Cleanup(func() { adminToken.Set("") })
+
+	for name, asUser := range map[string]string{"anonymous": "", "another user": "mallory"} {
+		if w := redeem("alice", `{"points": 10}`, asUser, ""); w.Code != http.StatusForbidden {
+			t.Errorf("%s redeem = %d, want 403", name, w.Code)
+		}
+	}
+	if got := userBalance("alice"); got != 100 {
+		t.Fatalf("balance after refused redeems = %d, want 100", got)
+	}
+
+	if w := redeem("alice", `{"points": 10}`, "alice", ""); w.Code != http.StatusCreated {
+		t.Errorf("user's own redeem = %d, want 201: %s", w.Code, w.Body)
+	}
+	r := userRequest("POST", "/users/alice/redeem", `{"points": 10}`, "", map[string]string{"id": "alice"})
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	w := httptest.NewRecorder()
+	redeemHandler(w, r)
+	if w.Code != http.StatusCreated {
+		t.Errorf("admin redeem = %d, want 201: %s", w.Code, w.Body)
+	}
+	if got := userBalance("alice"); got != 80 {
+		t.Errorf("balance = %d, want 80", got)
+	}
+}
+
+func TestRedeemOverdraft(t *testing.T) {
+	resetLedger(t)
+	earnPoints(t, "alice", 100)
+
+	w := redeem("alice", `{"points": 101}`, "alice", "")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("redeeming more than the balance = %d, want 409", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"available":100`) {
+		t.Errorf("409 body = %s, want the available points", w.Body)
+	}
+	if w := reserve("alice", `{"points": 30}`, "alice"); w.Code != http.StatusCreated {
+		t.Fatalf("reservation = %d, want 201: %s", w.Code, w.Body)
+	}
+	if w := redeem("alice", `{"points": 80}`, "alice", ""); w.Code != http.StatusConflict {
+		t.Errorf("redeeming points held by a reservation = %d, want 409", w.Code)
+	}
+	if got := userBalance("alice"); got != 100 {
+		t.Errorf("balance after refused redemptions = %d, want 100", got)
+	}
+	if w := redeem("alice", `{"points": 70}`, "alice", ""); w.Code != http.StatusCreated {
+		t.Errorf("redeeming the available points = %d, want 201: %s", w.Code, w.Body)
+	}
+}
+
+func TestRedeemIdempotentReplay(t *testing.T) {
+	resetLedger(t)
+	earnPoints(t, "alice", 100)
+
+	first := redeem("alice", `{"points": 40, "reference": "order-1"}`, "alice", "key-1")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("redeem = %d, want 201: %s", first.Code, first.Body)
+	}
+	replay := redeem("alice", `{"points": 40, "reference": "order-1"}`, "alice", "key-1")
+	if replay.Code != http.StatusCreated || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("replay = %d, Idempotent-Replayed %q, want 201 replayed", replay.Code, replay.Header().Get("Idempotent-Replayed"))
+	}
+	var a, b struct {
+		Redemption LedgerEntry `json:"redemption"`
+	}
+	json.Unmarshal(first.Body.Bytes(), &a)
+	json.Unmarshal(replay.Body.Bytes(), &b)
+	if a.Redemption.ID == "" || a.Redemption.ID != b.Redemption.ID {
+		t.Errorf("replay answered entry %q, want the original %q", b.Redemption.ID, a.Redemption.ID)
+	}
+	if got := userBalance("alice"); got != 60 {
+		t.Errorf("balance after a replay = %d, want 60", got)
+	}
+
+	if w := redeem("alice", `{"points": 50, "reference": "order-1"}`, "alice", "key-1"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reusing the key for other points = %d, want 422", w.Code)
+	}
+	// Keys are per user.
+	earnPoints(t, "bob", 100)
+	if w := redeem("bob", `{"points": 40, "reference": "order-1"}`, "bob", "key-1"); w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("another user's redeem with the same key = %d, replayed %q, want a new redemption", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if got := userBalance("alice"); got != 60 {
+		t.Errorf("balance = %d, want 60", got)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisClient speaks enough of the Redis protocol (RESP2) for locks and the receipt store. It keeps
+// a small pool of connections, each used by one command at a time.
+type redisClient struct {
+	addr     string
+	password string
+	timeout  time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// errRedisNil is the reply to a command on a key that doesn't exist.
+var errRedisNil = errors.New("redis: nil")
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func newRedisClient(addr, password string) *redisClient {
+	return &redisClient{addr: addr, password: password, timeout: 5 * time.Second, idle: make(chan *redisConn, 16)}
+}
+
+func (c *redisClient) dial(ctx context.Context) (*redisConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if c.password != "" {
+		if _, err := rc.do(c.timeout, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs a command and returns its reply: a string, an int64, nil or a []any of those. An error
+// reply is a redisError; a nil reply to a command expecting a value is errRedisNil.
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	var rc *redisConn
+	select {
+	case rc = <-c.idle:
+	default:
+		var err error
+		if rc, err = c.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := rc.do(c.timeout, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) && !errors.Is(err, errRedisNil) {
+		// The connection may be half way through a reply.
+		rc.conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+func (rc *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	rc.conn.SetDeadline(time.Now().Add(timeout))
+	command := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		command = append(command, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		command = append(command, arg...)
+		command = append(command, "\r\n"...)
+	}
+	if _, err := rc.conn.Write(command); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	reply, err := rc.read()
+	if err == nil && reply == nil {
+		return nil, errRedisNil
+	}
+	return reply, err
+}
+
+func (rc *redisConn) read() (any, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: reading reply: %w", err)
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, data); err != nil {
+			return nil, fmt.Errorf("redis: reading reply: %w", err)
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(body)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]any, count)
+		for i := range items {
+			// Errors inside arrays, as from EXEC, are returned as items.
+			item, err := rc.read()
+			var replyErr redisError
+			if err != nil && !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			if err != nil {
+				item = err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+}
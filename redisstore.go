@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// redisStore is a ReceiptStore in Redis, so several instances share their receipts. Each receipt
+// is a key holding its record, "<prefix>:<id>", listed in the set "<prefix>s". With a ttl receipts
+// expire that long after they were first stored, unless they are under legal hold; the set is
+// cleaned of them as it is listed.
+type redisStore struct {
+	client *redisClient
+	prefix string
+	ttl    time.Duration
+}
+
+// redisPutScript stores ARGV[1] in KEYS[1] and adds ARGV[3] to the set KEYS[2]. A new key expires
+// in ARGV[2] milliseconds, unless that is 0; an existing key keeps its expiry, so updating a receipt
+// doesn't extend its life. A receipt under legal hold, ARGV[4] '1', never expires. With ARGV[5],
+// the SHA-1 of the record the update was made from, nothing is stored and 0 returned if the
+// record changed since.
+const redisPutScript = `
+if ARGV[5] ~= '' then
+	local current = redis.call('GET', KEYS[1])
+	if not current or redis.sha1hex(current) ~= ARGV[5] then
+		return 0
+	end
+end
+if ARGV[4] == '1' then
+	redis.call('SET', KEYS[1], ARGV[1])
+elseif redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('SET', KEYS[1], ARGV[1], 'KEEPTTL')
+elseif ARGV[2] == '0' then
+	redis.call('SET', KEYS[1], ARGV[1])
+else
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+end
+redis.call('SADD', KEYS[2], ARGV[3])
+return 1`
+
+const redisDeleteScript = `
+redis.call('DEL', KEYS[1])
+redis.call('SREM', KEYS[2], ARGV[1])
+return 1`
+
+// redisListBatch is how many receipts are read with one MGET.
+const redisListBatch = 500
+
+func newRedisStores(client *redisClient, ttl time.Duration) (production, sandbox *redisStore) {
+	return &redisStore{client: client, prefix: "receipt", ttl: ttl}, &redisStore{client: client, prefix: "sandbox-receipt", ttl: ttl}
+}
+
+func (s *redisStore) key(id string) string { return s.prefix + ":" + id }
+func (s *redisStore) index() string        { return s.prefix + "s" }
+
+func (s *redisStore) Ping(ctx context.Context) error {
+	_, err := s.client.do(ctx, "PING")
+	return err
+}
+
+func (s *redisStore) Put(receipt ProcessedReceipt) error {
+	_, err := s.put(receipt, "")
+	return err
+}
+
+// put stores receipt, if the stored record still has the SHA-1 previous when that is set, and
+// reports whether it did.
+func (s *redisStore) put(receipt ProcessedReceipt, previous string) (bool, error) {
+	data, err := encodeStoredReceipt(receipt)
+	if err != nil {
+		return false, err
+	}
+	held := "0"
+	if s.ttl > 0 && underLegalHold(receipt) {
+		held = "1"
+	}
+	reply, err := s.client.do(context.Background(), "EVAL", redisPutScript, "2", s.key(receipt.ID), s.index(),
+		string(data), strconv.FormatInt(s.ttl.Milliseconds(), 10), receipt.ID, held, previous)
+	stored, _ := reply.(int64)
+	return stored == 1, err
+}
+
+func (s *redisStore) Get(id string) (ProcessedReceipt, error) {
+	receipt, _, err := s.get(id)
+	return receipt, err
+}
+
+// get returns the receipt with id and the SHA-1 of its record, its version for put.
+func (s *redisStore) get(id string) (ProcessedReceipt, string, error) {
+	reply, err := s.client.do(context.Background(), "GET", s.key(id))
+	if errors.Is(err, errRedisNil) {
+		return ProcessedReceipt{}, "", errReceiptNotFound
+	}
+	if err != nil {
+		return ProcessedReceipt{}, "", err
+	}
+	data, _ := reply.(string)
+	receipt, err := decodeStoredReceipt([]byte(data))
+	if err != nil {
+		return ProcessedReceipt{}, "", fmt.Errorf("receipt %s: %w", id, err)
+	}
+	digest := sha1.Sum([]byte(data))
+	return receipt, hex.EncodeToString(digest[:]), nil
+}
+
+// redisUpdateAttempts is how many times an update is retried when other instances keep changing
+// the receipt under it.
+const redisUpdateAttempts = 10
+
+// Update stores what fn makes of the stored receipt, as a compare-and-set on the record, so an
+// update made by another instance in between isn't overwritten: fn runs again on the new record
+// instead.
+func (s *redisStore) Update(id string, fn func(ProcessedReceipt) (ProcessedReceipt, error)) (ProcessedReceipt, error) {
+	for range redisUpdateAttempts {
+		receipt, version, err := s.get(id)
+		if err != nil {
+			return ProcessedReceipt{}, err
+		}
+		updated, err := fn(receipt)
+		if err != nil {
+			return ProcessedReceipt{}, err
+		}
+		stored, err := s.put(updated, version)
+		if err != nil {
+			return ProcessedReceipt{}, err
+		}
+		if stored {
+			return updated, nil
+		}
+	}
+	return ProcessedReceipt{}, fmt.Errorf("receipt %s kept changing while it was updated", id)
+}
+
+// KeepHeld stops a receipt under legal hold from expiring, and sets a released one to expire when
+// it would have.
+func (s *redisStore) KeepHeld(receipt ProcessedReceipt, held bool) error {
+	if s.ttl == 0 {
+		return nil
+	}
+	var err error
+	if held {
+		_, err = s.client.do(context.Background(), "PERSIST", s.key(receipt.ID))
+	} else {
+		expiresAt := receipt.ProcessedAt.Add(s.ttl).UnixMilli()
+		_, err = s.client.do(context.Background(), "PEXPIREAT", s.key(receipt.ID), strconv.FormatInt(expiresAt, 10))
+	}
+	return err
+}
+
+func (s *redisStore) Delete(id string) error {
+	_, err := s.client.do(context.Background(), "EVAL", redisDeleteScript, "2", s.key(id), s.index(), id)
+	return err
+}
+
+// Count counts the receipts in the index, which can include receipts that expired since they were
+// last listed.
+func (s *redisStore) Count() (int, error) {
+	reply, err := s.client.do(context.Background(), "SCARD", s.index())
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	return int(n), nil
+}
+
+func (s *redisStore) List() ([]ProcessedReceipt, error) {
+	ctx := context.Background()
+	reply, err := s.client.do(ctx, "SMEMBERS", s.index())
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]any)
+	receipts := []ProcessedReceipt{}
+	var expired []string
+	for start := 0; start < len(members); start += redisListBatch {
+		batch := members[start:min(start+redisListBatch, len(members))]
+		args := []string{"MGET"}
+		for _, id := range batch {
+			args = append(args, s.key(id.(string)))
+		}
+		reply, err := s.client.do(ctx, args...)
+		if err != nil {
+			return nil, err
+		}
+		values, _ := reply.([]any)
+		for i, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				expired = append(expired, batch[i].(string))
+				continue
+			}
+			receipt, err := decodeStoredReceipt([]byte(data))
+			if err != nil {
+				return nil, fmt.Errorf("receipt %s: %w", batch[i], err)
+			}
+			receipts = append(receipts, receipt)
+		}
+	}
+	if len(expired) > 0 {
+		if _, err := s.client.do(ctx, append([]string{"SREM", s.index()}, expired...)...); err != nil {
+			return receipts, err
+		}
+	}
+	return receipts, nil
+}
+
+// redisLedgerKey is the Redis list of the ledger entries, oldest first.
+const redisLedgerKey = "ledger"
+
+// redisLedgerStore is the LedgerStore in Redis, shared by the instances. Entries never expire,
+// whatever -redis-ttl.
+type redisLedgerStore struct {
+	client *redisClient
+}
+
+// Append pushes the entries with one RPUSH, so they are stored together.
+func (s *redisLedgerStore) Append(entries ...LedgerEntry) error {
+	args := []string{"RPUSH", redisLedgerKey}
+	for _, entry := range entries {
+		data, err := encodeLedgerEntry(entry)
+		if err != nil {
+			return err
+		}
+		args = append(args, string(data))
+	}
+	_, err := s.client.do(context.Background(), args...)
+	return err
+}
+
+func (s *redisLedgerStore) List() ([]LedgerEntry, error) {
+	return s.ListFrom(0)
+}
+
+func (s *redisLedgerStore) ListFrom(position int) ([]LedgerEntry, error) {
+	reply, err := s.client.do(context.Background(), "LRANGE", redisLedgerKey, strconv.Itoa(position), "-1")
+	if err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]any)
+	entries := make([]LedgerEntry, 0, len(values))
+	for i, value := range values {
+		data, _ := value.(string)
+		entry, err := decodeLedgerEntry([]byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("ledger entry %d: %w", position+i, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// redisLedgerLockKey holds the token of the instance using the ledger. It expires after
+// redisLedgerLockTTL, should the instance die holding it.
+const (
+	redisLedgerLockKey = "ledger-lock"
+	redisLedgerLockTTL = 30 * time.Second
+)
+
+const redisUnlockScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+end
+return 1`
+
+// Lock takes the ledger lock, polling until the instance holding it releases it.
+func (s *redisLedgerStore) Lock() (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sharedLedgerLockTimeout)
+	defer cancel()
+	token := uuid.New().String()
+	for {
+		_, err := s.client.do(ctx, "SET", redisLedgerLockKey, token, "NX", "PX", strconv.FormatInt(redisLedgerLockTTL.Milliseconds(), 10))
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errRedisNil) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("the ledger lock is held by another instance: %w", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return func() {
+		if _, err := s.client.do(context.Background(), "EVAL", redisUnlockScript, "1", redisLedgerLockKey, token); err != nil {
+			log.Printf("Releasing the ledger lock: %v", err)
+		}
+	}, nil
+}
+
+// Reseal rewrites the entry with its new seal at its position in the list.
+func (s *redisLedgerStore) Reseal(entry LedgerEntry) error {
+	entries, err := s.List()
+	if err != nil {
+		return err
+	}
+	for i, stored := range entries {
+		if stored.ID != entry.ID {
+			continue
+		}
+		data, err := encodeLedgerEntry(entry)
+		if err != nil {
+			return err
+		}
+		_, err = s.client.do(context.Background(), "LSET", redisLedgerKey, strconv.Itoa(i), string(data))
+		return err
+	}
+	return fmt.Errorf("no ledger entry %s", entry.ID)
+}
+
+// redisRecordStore is the RecordStore in Redis: a hash per kind, "records:<kind>", of the records
+// by key. Records never expire, whatever -redis-ttl.
+type redisRecordStore struct {
+	client *redisClient
+}
+
+func (s *redisRecordStore) PutRecord(kind, key string, record []byte) error {
+	_, err := s.client.do(context.Background(), "HSET", "records:"+kind, key, string(record))
+	return err
+}
+
+func (s *redisRecordStore) GetRecord(kind, key string) ([]byte, error) {
+	reply, err := s.client.do(context.Background(), "HGET", "records:"+kind, key)
+	if errors.Is(err, errRedisNil) {
+		return nil, errRecordNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, _ := reply.(string)
+	return []byte(data), nil
+}
+
+// redisSwapRecordScript sets field ARGV[1] of hash KEYS[1] to ARGV[3] if it is ARGV[2], an empty
+// string standing for no field, and returns 1 if it did.
+const redisSwapRecordScript = `
+if (redis.call('HGET', KEYS[1], ARGV[1]) or '') ~= ARGV[2] then
+	return 0
+end
+if ARGV[3] == '' then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+else
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+end
+return 1`
+
+func (s *redisRecordStore) SwapRecord(kind, key string, old, new []byte) (bool, error) {
+	reply, err := s.client.do(context.Background(), "EVAL", redisSwapRecordScript, "1", "records:"+kind, key, string(old), string(new))
+	swapped, _ := reply.(int64)
+	return swapped == 1, err
+}
+
+func (s *redisRecordStore) ListRecords(kind string) (map[string][]byte, error) {
+	reply, err := s.client.do(context.Background(), "HGETALL", "records:"+kind)
+	if err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]any)
+	records := make(map[string][]byte, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		key, _ := values[i].(string)
+		data, _ := values[i+1].(string)
+		records[key] = []byte(data)
+	}
+	return records, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// validRequestID is what an X-Request-ID from a client must look like to be kept; other IDs are
+// replaced, so they can't forge log lines or headers.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID of the request ctx belongs to, if any.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// assignRequestIDs gives every request an ID: the client's X-Request-ID if it sent a valid one,
+// or else a new UUID. The ID is returned in the X-Request-ID response header, logged with the
+// request, sent on to the gateway's upstream, and appended to plain-text error messages.
+func assignRequestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(&requestIDWriter{ResponseWriter: w, id: id}, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDWriter appends the request ID to the plain-text messages of error responses, such as
+// those of http.Error, so clients reporting a failure can quote it.
+type requestIDWriter struct {
+	http.ResponseWriter
+	id       string
+	failed   bool
+	appended bool
+}
+
+func (w *requestIDWriter) WriteHeader(status int) {
+	w.failed = status >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *requestIDWriter) Write(data []byte) (int, error) {
+	if !w.failed || w.appended {
+		return w.ResponseWriter.Write(data)
+	}
+	w.appended = true
+	message := bytes.TrimSuffix(data, []byte("\n"))
+	if _, err := w.ResponseWriter.Write([]byte(string(message) + " (request ID " + w.id + ")\n")); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Flush lets long-polling and streaming handlers flush through the writer.
+func (w *requestIDWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
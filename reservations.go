@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Reservation statuses. A held reservation counts against the user's available points until it
+// is committed, cancelled or expires.
+const (
+	reservationHeld      = "held"
+	reservationCommitted = "committed"
+	reservationCancelled = "cancelled"
+	reservationExpired   = "expired"
+)
+
+const (
+	defaultReservationTTL = 5 * time.Minute
+	maxReservationTTL     = time.Hour
+)
+
+// Reservation holds points for a pending redemption, such as one waiting on payment
+// authorization at a POS.
+type Reservation struct {
+	ID        string    `json:"id"`
+	Points    int       `json:"points"`
+	Reference string    `json:"reference,omitempty"`
+	TenantID  string    `json:"tenantId"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// EntryID is the redemption ledger entry of a committed reservation.
+	EntryID string `json:"entryId,omitempty"`
+
+	userIDHash   string
+	sealedUserID []byte
+}
+
+// reservations is guarded by ledgerMu, so holds, commits and earns are serialized against each
+// other.
+var reservations = map[string]*Reservation{}
+
+// expireLocked marks the reservation expired once its TTL has passed. ledgerMu must be held.
+func (res *Reservation) expireLocked(now time.Time) {
+	if res.Status == reservationHeld && !now.Before(res.ExpiresAt) {
+		res.Status = reservationExpired
+	}
+}
+
+// heldLocked sums the points held by the user's live reservations. ledgerMu must be held.
+func heldLocked(hashes []string) int {
+	now := time.Now()
+	held := 0
+	for _, res := range reservations {
+		res.expireLocked(now)
+		if res.Status == reservationHeld && slices.Contains(hashes, res.userIDHash) {
+			held += res.Points
+		}
+	}
+	return held
+}
+
+// availableLocked returns the points the user can spend: their balance less any held
+// reservations. ledgerMu must be held.
+func availableLocked(userID string) int {
+	return balanceLocked(userID) - heldLocked(userIDHashes(userID))
+}
+
+// resealReservationsLocked re-encrypts the user of every reservation with the current identity
+// key. ledgerMu must be held.
+func resealReservationsLocked() (failed int) {
+	for _, res := range reservations {
+		userID, ok := openUserID(res.sealedUserID, res.ID)
+		if !ok {
+			failed++
+			continue
+		}
+		res.userIDHash, res.sealedUserID = sealUserID(userID, res.ID)
+	}
+	return failed
+}
+
+// userReservationLocked finds a reservation made for userID, as it stands at now. ledgerMu must
+// be held.
+func userReservationLocked(userID, id string, now time.Time) (*Reservation, bool) {
+	res, exists := reservations[id]
+	if !exists || !slices.Contains(userIDHashes(userID), res.userIDHash) {
+		return nil, false
+	}
+	res.expireLocked(now)
+	return res, true
+}
+
+// createReservationHandler holds points of the user, who must be the one asking, or an admin.
+func createReservationHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+	if !actsForUser(r, userID) {
+		http.Error(w, "Reserving points needs the user's token or the admin token.", http.StatusForbidden)
+		return
+	}
+	request := struct {
+		Points    int      `json:"points"`
+		Reference string   `json:"reference"`
+		TTL       duration `json:"ttl"`
+	}{TTL: duration(defaultReservationTTL)}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Points <= 0 {
+		http.Error(w, "A reservation needs a positive number of points.", http.StatusBadRequest)
+		return
+	}
+	if ttl := time.Duration(request.TTL); ttl <= 0 || ttl > maxReservationTTL {
+		http.Error(w, "ttl must be positive and at most 1h.", http.StatusBadRequest)
+		return
+	}
+	now, ok := requestTime(w, r, tenantFromRequest(r))
+	if !ok {
+		return
+	}
+	now = now.UTC()
+
+	ledgerMu.Lock()
+	available := availableLocked(userID)
+	if available < request.Points {
+		ledgerMu.Unlock()
+		writeInsufficientPoints(w, available, request.Points)
+		return
+	}
+	res := &Reservation{
+		ID:        uuid.New().String(),
+		Points:    request.Points,
+		Reference: request.Reference,
+		TenantID:  tenantFromRequest(r),
+		Status:    reservationHeld,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(request.TTL)),
+	}
+	res.userIDHash, res.sealedUserID = sealUserID(userID, res.ID)
+	reservations[res.ID] = res
+	response := *res
+	ledgerMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func getReservationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	now, ok := requestTime(w, r, tenantFromRequest(r))
+	if !ok {
+		return
+	}
+	ledgerMu.Lock()
+	res, exists := userReservationLocked(vars["id"], vars["reservationId"], now)
+	var response Reservation
+	if exists {
+		response = *res
+	}
+	ledgerMu.Unlock()
+	if !exists {
+		http.Error(w, "No reservation found for that ID.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// commitReservationHandler turns a held reservation into a redemption ledger entry.
+func commitReservationHandler(w http.ResponseWriter, r *http.Request) {
+	settleReservation(w, r, reservationCommitted)
+}
+
+func cancelReservationHandler(w http.ResponseWriter, r *http.Request) {
+	settleReservation(w, r, reservationCancelled)
+}
+
+// settleReservation moves a held reservation to status. Committing or cancelling it again is
+// answered with the reservation as it stands, so retries after a lost response are safe. Only the
+// user the reservation was made for, or an admin, may settle it.
+func settleReservation(w http.ResponseWriter, r *http.Request, status string) {
+	vars := mux.Vars(r)
+	userID := vars["id"]
+	if !actsForUser(r, userID) {
+		http.Error(w, "Settling a reservation needs the user's token or the admin token.", http.StatusForbidden)
+		return
+	}
+	now, ok := requestTime(w, r, tenantFromRequest(r))
+	if !ok {
+		return
+	}
+	ledgerMu.Lock()
+	res, exists := userReservationLocked(userID, vars["reservationId"], now)
+	if !exists {
+		ledgerMu.Unlock()
+		http.Error(w, "No reservation found for that ID.", http.StatusNotFound)
+		return
+	}
+	var redemption *LedgerEntry
+	switch res.Status {
+	case status:
+	case reservationHeld:
+		if status == reservationCommitted {
+			entry, err := appendEntryLocked(userID, LedgerEntry{
+				Type:      entryRedemption,
+				Points:    -res.Points,
+				TenantID:  res.TenantID,
+				Reference: res.Reference,
+			})
+			if err != nil {
+				ledgerMu.Unlock()
+				log.Printf("Committing reservation %s: %v", res.ID, err)
+				http.Error(w, "The redemption could not be recorded.", http.StatusInternalServerError)
+				return
+			}
+			res.EntryID = entry.ID
+			redemption = &entry
+		}
+		res.Status = status
+	case reservationExpired:
+		ledgerMu.Unlock()
+		http.Error(w, "The reservation has expired.", http.StatusGone)
+		return
+	default:
+		current := res.Status
+		ledgerMu.Unlock()
+		http.Error(w, "The reservation is already "+current+".", http.StatusConflict)
+		return
+	}
+	response := map[string]any{"reservation": *res, "balance": balanceLocked(userID)}
+	reservationID := res.ID
+	ledgerMu.Unlock()
+	if redemption != nil {
+		publishRedemption(userID, *redemption, reservationID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeInsufficientPoints answers a redemption the user's available points don't cover.
+func writeInsufficientPoints(w http.ResponseWriter, available, requested int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":     "insufficient points",
+		"available": available,
+		"requested": requested,
+	})
+}
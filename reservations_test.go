@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func reserve(userID, body, asUser string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	createReservationHandler(w, userRequest("POST", "/users/"+userID+"/reservations", body, asUser, map[string]string{"id": userID}))
+	return w
+}
+
+func settle(userID, reservationID, status, asUser string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := userRequest("POST", "/users/"+userID+"/reservations/"+reservationID, "", asUser, map[string]string{"id": userID, "reservationId": reservationID})
+	settleReservation(w, r, status)
+	return w
+}
+
+func TestReservationsNeedOwner(t *testing.T) {
+	resetLedger(t)
+	earnPoints(t, "alice", 100)
+
+	if w := reserve("alice", `{"points": 40}`, ""); w.Code != http.StatusForbidden {
+		t.Errorf("anonymous reservation = %d, want 403", w.Code)
+	}
+	if w := reserve("alice", `{"points": 40}`, "mallory"); w.Code != http.StatusForbidden {
+		t.Errorf("another user's reservation = %d, want 403", w.Code)
+	}
+	w := reserve("alice", `{"points": 40}`, "alice")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("user's reservation = %d, want 201: %s", w.Code, w.Body)
+	}
+	var res Reservation
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, status := range []string{reservationCommitted, reservationCancelled} {
+		if w := settle("alice", res.ID, status, ""); w.Code != http.StatusForbidden {
+			t.Errorf("anonymous %s = %d, want 403", status, w.Code)
+		}
+		if w := settle("mallory", res.ID, status, "mallory"); w.Code != http.StatusNotFound {
+			t.Errorf("%s by another user = %d, want 404", status, w.Code)
+		}
+	}
+	if got := userBalance("alice"); got != 100 {
+		t.Fatalf("balance after refused commits = %d, want 100", got)
+	}
+	if w := settle("alice", res.ID, reservationCommitted, "alice"); w.Code != http.StatusOK {
+		t.Fatalf("user's commit = %d, want 200: %s", w.Code, w.Body)
+	}
+	if got := userBalance("alice"); got != 60 {
+		t.Errorf("balance after commit = %d, want 60", got)
+	}
+}
+
+func TestReservationExpires(t *testing.T) {
+	resetLedger(t)
+	environment = "staging"
+	t.Cleanup(func() { environment = "production" })
+	earnPoints(t, "alice", 100)
+
+	// Points held count against the balance as of the real time, so the reservation is made now.
+	start := time.Now().UTC().Truncate(time.Second)
+	at := func(r *http.Request, clock time.Time) *http.Request {
+		r.Header.Set("X-Test-Clock", clock.Format(time.RFC3339))
+		return r
+	}
+	w := httptest.NewRecorder()
+	createReservationHandler(w, at(userRequest("POST", "/users/alice/reservations", `{"points": 80, "ttl": "5m"}`, "alice", map[string]string{"id": "alice"}), start))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("reservation = %d, want 201: %s", w.Code, w.Body)
+	}
+	var res Reservation
+	json.NewDecoder(w.Body).Decode(&res)
+	if want := start.Add(5 * time.Minute); !res.ExpiresAt.Equal(want) {
+		t.Errorf("expiresAt = %s, want %s", res.ExpiresAt, want)
+	}
+	if w := redeem("alice", `{"points": 30}`, "alice", ""); w.Code != http.StatusConflict {
+		t.Errorf("redeeming held points = %d, want 409", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	vars := map[string]string{"id": "alice", "reservationId": res.ID}
+	settleReservation(w, at(userRequest("POST", "/users/alice/reservations/"+res.ID+"/commit", "", "alice", vars), start.Add(5*time.Minute)), reservationCommitted)
+	if w.Code != http.StatusGone {
+		t.Errorf("committing at expiry = %d, want 410", w.Code)
+	}
+	if got := userBalance("alice"); got != 100 {
+		t.Errorf("balance after an expired commit = %d, want 100", got)
+	}
+	if w := redeem("alice", `{"points": 100}`, "alice", ""); w.Code != http.StatusCreated {
+		t.Errorf("redeeming points an expired reservation held = %d, want 201: %s", w.Code, w.Body)
+	}
+}
+
+func TestReservationCommitIsIdempotent(t *testing.T) {
+	resetLedger(t)
+	earnPoints(t, "alice", 100)
+
+	w := reserve("alice", `{"points": 40}`, "alice")
+	var res Reservation
+	json.NewDecoder(w.Body).Decode(&res)
+	for range 2 {
+		if w := settle("alice", res.ID, reservationCommitted, "alice"); w.Code != http.StatusOK {
+			t.Fatalf("commit = %d, want 200: %s", w.Code, w.Body)
+		}
+	}
+	if got := userBalance("alice"); got != 60 {
+		t.Errorf("balance after committing twice = %d, want 60", got)
+	}
+	if w := settle("alice", res.ID, reservationCancelled, "alice"); w.Code != http.StatusConflict {
+		t.Errorf("cancelling a committed reservation = %d, want 409", w.Code)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// RetailerEntry is a retailer in the directory, with the other names it appears under on
+// receipts, e.g. "TGT" for Target.
+type RetailerEntry struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// RetailerMatch is how an extracted retailer name was resolved against the directory. Method is
+// "exact" for a name or alias, "fuzzy" for the closest one within the confidence threshold, and
+// "none" when the raw text was kept.
+type RetailerMatch struct {
+	Raw        string  `json:"raw"`
+	Retailer   string  `json:"retailer"`
+	Method     string  `json:"method"`
+	Confidence float64 `json:"confidence"`
+}
+
+// retailerMatchThreshold is the lowest confidence at which a fuzzy match replaces the raw text.
+var retailerMatchThreshold = 0.75
+
+var (
+	retailersMu sync.RWMutex
+	// retailerDirectory is keyed by lowercased retailer name.
+	retailerDirectory = map[string]RetailerEntry{}
+)
+
+// ocrConfusions maps the digits OCR commonly reads letters as back to the letters.
+var ocrConfusions = strings.NewReplacer("0", "o", "1", "l", "3", "e", "4", "a", "5", "s", "8", "b", "|", "l")
+
+// foldRetailerName reduces a name to the letters and digits that identify it, undoing common OCR
+// confusions, so "TARG3T " and "Target" fold the same.
+func foldRetailerName(name string) string {
+	name = ocrConfusions.Replace(strings.ToLower(name))
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, name)
+}
+
+// editDistance is the Levenshtein distance between a and b, in runes.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+// retailerCandidates lists every name a retailer can be recognized by, mapped to the retailer: the
+// directory's names and aliases, and the retailers with extraction templates.
+func retailerCandidates() map[string]string {
+	candidates := map[string]string{}
+	templatesMu.RLock()
+	for _, versions := range extractionTemplates {
+		retailer := versions[len(versions)-1].Retailer
+		candidates[retailer] = retailer
+	}
+	templatesMu.RUnlock()
+	retailersMu.RLock()
+	for _, entry := range retailerDirectory {
+		candidates[entry.Name] = entry.Name
+		for _, alias := range entry.Aliases {
+			candidates[alias] = entry.Name
+		}
+	}
+	retailersMu.RUnlock()
+	return candidates
+}
+
+// resolveRetailer matches an extracted retailer name against the known retailers.
+func resolveRetailer(raw string) RetailerMatch {
+	match := RetailerMatch{Raw: raw, Retailer: raw, Method: "none"}
+	folded := foldRetailerName(raw)
+	if folded == "" {
+		return match
+	}
+
+	candidates := retailerCandidates()
+	names := make([]string, 0, len(candidates))
+	for name := range candidates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	best, bestConfidence := "", 0.0
+	for _, name := range names {
+		candidate := foldRetailerName(name)
+		if candidate == "" {
+			continue
+		}
+		if candidate == folded {
+			return RetailerMatch{Raw: raw, Retailer: candidates[name], Method: "exact", Confidence: 1}
+		}
+		length := max(len([]rune(candidate)), len([]rune(folded)))
+		if confidence := 1 - float64(editDistance(candidate, folded))/float64(length); confidence > bestConfidence {
+			best, bestConfidence = candidates[name], confidence
+		}
+	}
+	if best != "" && bestConfidence >= retailerMatchThreshold {
+		match.Retailer, match.Method = best, "fuzzy"
+	}
+	match.Confidence = float64(int(bestConfidence*100+0.5)) / 100
+	return match
+}
+
+func listRetailersHandler(w http.ResponseWriter, r *http.Request) {
+	retailersMu.RLock()
+	list := make([]RetailerEntry, 0, len(retailerDirectory))
+	for _, entry := range retailerDirectory {
+		list = append(list, entry)
+	}
+	retailersMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"retailers": list})
+}
+
+// putRetailerHandler adds a retailer to the directory or replaces its aliases.
+func putRetailerHandler(w http.ResponseWriter, r *http.Request) {
+	var entry RetailerEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, "The retailer is invalid.", http.StatusBadRequest)
+		return
+	}
+	entry.Name = mux.Vars(r)["name"]
+	if foldRetailerName(entry.Name) == "" {
+		http.Error(w, "The retailer name needs a letter or digit.", http.StatusBadRequest)
+		return
+	}
+
+	retailersMu.Lock()
+	retailerDirectory[strings.ToLower(entry.Name)] = entry
+	retailersMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+func deleteRetailerHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.ToLower(mux.Vars(r)["name"])
+	retailersMu.Lock()
+	_, exists := retailerDirectory[key]
+	delete(retailerDirectory, key)
+	retailersMu.Unlock()
+	if !exists {
+		http.Error(w, "No retailer found for that name.", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Review records why a receipt was held for manual review and the admin decision on it.
+type Review struct {
+	FlaggedAt      time.Time  `json:"flaggedAt"`
+	FlagReason     string     `json:"flagReason"`
+	Decision       string     `json:"decision,omitempty"`
+	DecisionReason string     `json:"decisionReason,omitempty"`
+	DecidedAt      *time.Time `json:"decidedAt,omitempty"`
+}
+
+var errNotPendingReview = errors.New("receipt is not pending review")
+
+type reviewDecision struct {
+	Reason string `json:"reason"`
+}
+
+func listReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	type pendingReview struct {
+		ID      string  `json:"id"`
+		Review  Review  `json:"review"`
+		Receipt Receipt `json:"receipt"`
+	}
+
+	pending := []pendingReview{}
+	for _, receipt := range listReceipts() {
+		if receipt.Status == statusPendingReview && receipt.Review != nil && receipt.DeletedAt == nil {
+			pending = append(pending, pendingReview{ID: receipt.ID, Review: *receipt.Review, Receipt: receipt.Receipt})
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Review.FlaggedAt.Before(pending[j].Review.FlaggedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"reviews": pending})
+}
+
+func approveReviewHandler(w http.ResponseWriter, r *http.Request) {
+	decideReview(w, r, statusScored)
+}
+
+func rejectReviewHandler(w http.ResponseWriter, r *http.Request) {
+	decideReview(w, r, statusRejected)
+}
+
+// decideReview moves a pending receipt to the given status. Approved receipts are scored; rejected
+// receipts keep zero points and require a reason.
+func decideReview(w http.ResponseWriter, r *http.Request, status string) {
+	id := mux.Vars(r)["id"]
+
+	var decision reviewDecision
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+			http.Error(w, "The review decision is invalid.", http.StatusBadRequest)
+			return
+		}
+	}
+	if status == statusRejected && decision.Reason == "" {
+		http.Error(w, "A reason is required to reject a receipt.", http.StatusBadRequest)
+		return
+	}
+
+	eventType := eventReceiptRejected
+	receipt, err := updateReceipt(id, func(receipt *ProcessedReceipt) error {
+		if receipt.DeletedAt != nil {
+			return errReceiptNotFound
+		}
+		if receipt.Status != statusPendingReview || receipt.Review == nil {
+			return errNotPendingReview
+		}
+
+		now := time.Now().UTC()
+		review := *receipt.Review
+		review.DecisionReason = decision.Reason
+		review.DecidedAt = &now
+
+		receipt.Status = status
+		if status == statusScored {
+			review.Decision = "approved"
+			// An approved receipt isn't held again if the scoring model fails: it keeps the rules' points.
+			scoreProcessedReceipt(receipt)
+			eventType = eventReceiptApproved
+		} else {
+			review.Decision = "rejected"
+			receipt.StatusReason = decision.Reason
+		}
+		receipt.Review = &review
+		return nil
+	})
+	switch {
+	case errors.Is(err, errReceiptNotFound):
+		http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+		return
+	case errors.Is(err, errNotPendingReview):
+		http.Error(w, "The receipt is not pending review.", http.StatusConflict)
+		return
+	}
+
+	publishReceiptEvent(eventType, receipt, map[string]any{"reason": decision.Reason})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "status": receipt.Status, "points": receipt.Points})
+}
@@ -0,0 +1,61 @@
+package main
+
+import "fmt"
+
+// Rounding modes for rules that award a fraction of an amount.
+const (
+	roundCeil     = "ceil"
+	roundFloor    = "floor"
+	roundHalfUp   = "half-up"
+	roundHalfEven = "half-even"
+)
+
+// defaultRounding is the mode of rules without a configured one.
+const defaultRounding = roundCeil
+
+func validRoundingMode(mode string) error {
+	switch mode {
+	case roundCeil, roundFloor, roundHalfUp, roundHalfEven:
+		return nil
+	}
+	return fmt.Errorf("unknown rounding mode %q", mode)
+}
+
+// roundingFor returns the rounding mode configured for a rule.
+func (c RulesConfig) roundingFor(rule string) string {
+	if mode, ok := c.Rounding[rule]; ok {
+		return mode
+	}
+	return defaultRounding
+}
+
+// roundRatio rounds num/den to an integer with the given mode, exactly. den must be positive.
+// Halves round away from zero with half-up.
+func roundRatio(num, den int64, mode string) int64 {
+	if num < 0 {
+		switch mode {
+		case roundCeil:
+			mode = roundFloor
+		case roundFloor:
+			mode = roundCeil
+		}
+		return -roundRatio(-num, den, mode)
+	}
+
+	quotient, remainder := num/den, num%den
+	switch mode {
+	case roundCeil:
+		if remainder > 0 {
+			quotient++
+		}
+	case roundHalfUp:
+		if 2*remainder >= den {
+			quotient++
+		}
+	case roundHalfEven:
+		if 2*remainder > den || (2*remainder == den && quotient%2 == 1) {
+			quotient++
+		}
+	}
+	return quotient
+}
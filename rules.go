@@ -0,0 +1,650 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Strategies for resolving several time-window rules matching the same purchase.
+const (
+	overlapSum   = "sum"
+	overlapMax   = "max"
+	overlapFirst = "first"
+)
+
+type RulesConfig struct {
+	// Version numbers the rule sets put in effect since startup, the first being 1. See setRules.
+	Version int `json:"-"`
+	// BaseRules are the rules every receipt is scored by, replacing the default ones when given.
+	BaseRules         []BaseRule         `json:"baseRules"`
+	TimeWindows       []TimeWindowRule   `json:"timeWindows"`
+	TimeWindowOverlap string             `json:"timeWindowOverlap"`
+	DayOfWeekBonuses  []DayOfWeekRule    `json:"dayOfWeekBonuses"`
+	Holidays          HolidayRules       `json:"holidays"`
+	ItemPriceRules    []ItemPriceRule    `json:"itemPriceRules"`
+	BigTicketRules    []ItemPriceRule    `json:"bigTicketRules"`
+	Eligibility       EligibilityGates   `json:"eligibility"`
+	TrustedDevices    TrustedDeviceRules `json:"trustedDevices"`
+	Transfers         TransferRules      `json:"transfers"`
+	Households        HouseholdRules     `json:"households"`
+	Costs             CostRules          `json:"costs"`
+	Exclusions        ExclusionRules     `json:"exclusions"`
+	PointsCap         PointsCapRules     `json:"pointsCap"`
+	// Categories maps item categories to keywords; an item belongs to the first category, by name,
+	// with a keyword in its description. Categories are only used for insights. Dictionaries
+	// replace them for receipts in their locale.
+	Categories      map[string][]string   `json:"categories"`
+	Dictionaries    map[string]Dictionary `json:"dictionaries,omitempty"`
+	DictionaryFiles map[string]string     `json:"dictionaryFiles,omitempty"`
+	// Rounding maps rule names to the rounding mode of the points they award.
+	Rounding map[string]string `json:"rounding"`
+}
+
+type TimeWindowRule struct {
+	Name     string   `json:"name"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Points   int      `json:"points"`
+	Days     []string `json:"days,omitempty"`
+	Disabled bool     `json:"disabled,omitempty"`
+
+	startMinute int
+	endMinute   int
+	weekdays    map[time.Weekday]bool
+}
+
+type DayOfWeekRule struct {
+	Name     string   `json:"name"`
+	Days     []string `json:"days"`
+	Points   int      `json:"points"`
+	Disabled bool     `json:"disabled,omitempty"`
+
+	weekdays map[time.Weekday]bool
+}
+
+// ItemPriceRule awards Points for items priced strictly over Over. As an item price rule it applies
+// to each such item; as a big-ticket rule it applies once if any item qualifies.
+type ItemPriceRule struct {
+	Name     string `json:"name"`
+	Over     string `json:"over"`
+	Points   int    `json:"points"`
+	Disabled bool   `json:"disabled,omitempty"`
+
+	over Money
+}
+
+// EligibilityGates are checked against the receipt total before scoring. Receipts under MinTotal earn
+// nothing, and receipts over ReviewAbove are held for manual review instead of being scored. Either
+// gate is disabled when empty.
+type EligibilityGates struct {
+	MinTotal    string `json:"minTotal,omitempty"`
+	ReviewAbove string `json:"reviewAbove,omitempty"`
+
+	minTotal    *Money
+	reviewAbove *Money
+}
+
+// HolidayRules awards points for purchases on holidays of the active region's calendar.
+// Calendars can be given inline or loaded from files, keyed by region.
+type HolidayRules struct {
+	Region        string               `json:"region"`
+	Points        int                  `json:"points"`
+	Calendars     map[string][]Holiday `json:"calendars,omitempty"`
+	CalendarFiles map[string]string    `json:"calendarFiles,omitempty"`
+
+	byDate map[string]Holiday
+}
+
+// Holiday dates are either a full date ("2025-11-27") or a month and day recurring every year ("12-25").
+// Points, when set, overrides the calendar-wide value.
+type Holiday struct {
+	Name   string `json:"name"`
+	Date   string `json:"date"`
+	Points int    `json:"points,omitempty"`
+}
+
+// RuleSetVersion is a rule set that was put in effect, kept so the points of receipts scored by it
+// can still be explained after it was replaced.
+type RuleSetVersion struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Actor     string    `json:"actor,omitempty"`
+	Change    string    `json:"change"`
+
+	rules RulesConfig
+}
+
+var (
+	rulesMu sync.RWMutex
+	// activeRules is the rules config in effect, replaced as a whole when it is reloaded or changed.
+	activeRules = defaultRulesConfig()
+	// rulesVersions are the rule sets put in effect since startup, oldest first.
+	rulesVersions []RuleSetVersion
+)
+
+// currentRules returns the rules config in effect. Reading it once for a receipt scores the whole
+// receipt by the same config, even if it is reloaded meanwhile.
+func currentRules() RulesConfig {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	return activeRules
+}
+
+// setRules puts cfg in effect as a new version of the rule set, recording who changed what.
+func setRules(cfg RulesConfig, actor, change string) RulesConfig {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	return setRulesLocked(cfg, actor, change)
+}
+
+// setRulesLocked is setRules with rulesMu held.
+func setRulesLocked(cfg RulesConfig, actor, change string) RulesConfig {
+	cfg.Version = len(rulesVersions) + 1
+	rulesVersions = append(rulesVersions, RuleSetVersion{
+		Version:   cfg.Version,
+		CreatedAt: time.Now().UTC(),
+		Actor:     actor,
+		Change:    change,
+		rules:     cfg,
+	})
+	activeRules = cfg
+	return cfg
+}
+
+// rulesAt returns the rule set of the given version, if it was put in effect since startup.
+func rulesAt(version int) (RulesConfig, bool) {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	if version < 1 || version > len(rulesVersions) {
+		return RulesConfig{}, false
+	}
+	return rulesVersions[version-1].rules, true
+}
+
+// reloadRulesOnHangup reloads the rules config from path on every SIGHUP. A config that fails to
+// load is logged and the one in effect is kept.
+func reloadRulesOnHangup(path string) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			cfg, err := loadRulesConfig(path)
+			if err != nil {
+				log.Printf("Reloading rules: %v; keeping the current rules", err)
+				continue
+			}
+			cfg = setRules(cfg, "", "reloaded from "+path)
+			log.Printf("Reloaded rules from %s as version %d", path, cfg.Version)
+		}
+	}()
+}
+
+func defaultRulesConfig() RulesConfig {
+	cfg := RulesConfig{
+		BaseRules: defaultBaseRules(),
+		TimeWindows: []TimeWindowRule{
+			{Name: "afternoon", Start: "14:00", End: "16:00", Points: 10},
+		},
+		TimeWindowOverlap: overlapSum,
+	}
+	if err := cfg.prepare(); err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+// loadRulesConfig reads a JSON rules file, or a YAML one with the same keys if it is named .yaml or
+// .yml. Sections missing from the file keep their defaults.
+func loadRulesConfig(path string) (RulesConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RulesConfig{}, err
+	}
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		// YAML is converted to JSON, so the config has one set of keys.
+		var document any
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return RulesConfig{}, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if data, err = json.Marshal(document); err != nil {
+			return RulesConfig{}, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	cfg := defaultRulesConfig()
+	// Decoding into the default base rules would merge the file's into them, field by field.
+	cfg.BaseRules = nil
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return RulesConfig{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if cfg.BaseRules == nil {
+		cfg.BaseRules = defaultBaseRules()
+	}
+	if err := cfg.Holidays.loadCalendarFiles(filepath.Dir(path)); err != nil {
+		return RulesConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.loadDictionaryFiles(filepath.Dir(path)); err != nil {
+		return RulesConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.prepare(); err != nil {
+		return RulesConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *RulesConfig) prepare() error {
+	names := map[string]bool{}
+	for i := range c.BaseRules {
+		rule := &c.BaseRules[i]
+		if err := rule.prepare(); err != nil {
+			return fmt.Errorf("base rule %d (%s): %w", i, rule.Type, err)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("base rule %d: duplicate name %q", i, rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	switch c.TimeWindowOverlap {
+	case "":
+		c.TimeWindowOverlap = overlapSum
+	case overlapSum, overlapMax, overlapFirst:
+	default:
+		return fmt.Errorf("unknown timeWindowOverlap %q", c.TimeWindowOverlap)
+	}
+
+	for i := range c.TimeWindows {
+		if err := c.TimeWindows[i].prepare(); err != nil {
+			return fmt.Errorf("time window %q: %w", c.TimeWindows[i].Name, err)
+		}
+	}
+	for i := range c.DayOfWeekBonuses {
+		if err := c.DayOfWeekBonuses[i].prepare(); err != nil {
+			return fmt.Errorf("day-of-week bonus %q: %w", c.DayOfWeekBonuses[i].Name, err)
+		}
+	}
+	for i := range c.ItemPriceRules {
+		if err := c.ItemPriceRules[i].prepare(); err != nil {
+			return fmt.Errorf("item price rule %q: %w", c.ItemPriceRules[i].Name, err)
+		}
+	}
+	for i := range c.BigTicketRules {
+		if err := c.BigTicketRules[i].prepare(); err != nil {
+			return fmt.Errorf("big-ticket rule %q: %w", c.BigTicketRules[i].Name, err)
+		}
+	}
+	if err := c.Holidays.prepare(); err != nil {
+		return fmt.Errorf("holidays: %w", err)
+	}
+	if err := c.Eligibility.prepare(); err != nil {
+		return fmt.Errorf("eligibility: %w", err)
+	}
+	if err := c.Transfers.prepare(); err != nil {
+		return fmt.Errorf("transfers: %w", err)
+	}
+	if err := c.Households.prepare(); err != nil {
+		return fmt.Errorf("households: %w", err)
+	}
+	if err := c.Costs.prepare(); err != nil {
+		return fmt.Errorf("costs: %w", err)
+	}
+	if err := c.Exclusions.prepare(); err != nil {
+		return fmt.Errorf("exclusions: %w", err)
+	}
+	if err := c.PointsCap.prepare(); err != nil {
+		return fmt.Errorf("pointsCap: %w", err)
+	}
+	if err := validateCategories(c.Categories); err != nil {
+		return err
+	}
+	if err := c.prepareDictionaries(); err != nil {
+		return err
+	}
+	for rule, mode := range c.Rounding {
+		if err := validRoundingMode(mode); err != nil {
+			return fmt.Errorf("rounding for %q: %w", rule, err)
+		}
+	}
+	return nil
+}
+
+func (w *TimeWindowRule) prepare() error {
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start %q", w.Start)
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return fmt.Errorf("invalid end %q", w.End)
+	}
+	w.startMinute = start.Hour()*60 + start.Minute()
+	w.endMinute = end.Hour()*60 + end.Minute()
+	if w.startMinute == w.endMinute {
+		return fmt.Errorf("start and end must differ")
+	}
+
+	w.weekdays, err = parseWeekdays(w.Days)
+	return err
+}
+
+func (r *DayOfWeekRule) prepare() error {
+	weekdays, err := parseWeekdays(r.Days)
+	if err != nil {
+		return err
+	}
+	if weekdays == nil {
+		return fmt.Errorf("no days given")
+	}
+	r.weekdays = weekdays
+	return nil
+}
+
+func (r *ItemPriceRule) prepare() error {
+	over, err := parseMoney(r.Over)
+	if err != nil {
+		return fmt.Errorf("invalid over %q", r.Over)
+	}
+	r.over = over
+	return nil
+}
+
+func (g *EligibilityGates) prepare() error {
+	var err error
+	if g.minTotal, err = parseOptionalMoney(g.MinTotal); err != nil {
+		return fmt.Errorf("invalid minTotal %q", g.MinTotal)
+	}
+	if g.reviewAbove, err = parseOptionalMoney(g.ReviewAbove); err != nil {
+		return fmt.Errorf("invalid reviewAbove %q", g.ReviewAbove)
+	}
+	return nil
+}
+
+// TrustedDeviceRules apply to receipts signed by a registered POS device. Points is a bonus for
+// every trusted receipt, and BypassReview skips the reviewAbove gate for them.
+type TrustedDeviceRules struct {
+	Points       int  `json:"points"`
+	BypassReview bool `json:"bypassReview"`
+}
+
+// TransferRules limit point transfers between users. MaxPoints caps a single transfer and
+// DailyLimit the points a user sends in any 24 hours; either is disabled when zero. The sender
+// also pays a fee of FeeBasisPoints hundredths of a percent of the amount, rounded with the
+// "transfer-fee" rounding mode, and at least MinFee.
+type TransferRules struct {
+	Disabled       bool `json:"disabled"`
+	MaxPoints      int  `json:"maxPoints,omitempty"`
+	DailyLimit     int  `json:"dailyLimit,omitempty"`
+	FeeBasisPoints int  `json:"feeBasisPoints,omitempty"`
+	MinFee         int  `json:"minFee,omitempty"`
+}
+
+func (t *TransferRules) prepare() error {
+	if t.MaxPoints < 0 || t.DailyLimit < 0 || t.FeeBasisPoints < 0 || t.MinFee < 0 {
+		return fmt.Errorf("limits and fees can't be negative")
+	}
+	return nil
+}
+
+// check returns the status a receipt should enter before scoring, and why. Receipts with an
+// unparsable total pass both gates, and skipReview disables the review gate.
+func (g EligibilityGates) check(receipt Receipt, skipReview bool) (string, string) {
+	total, ok := receiptTotal(receipt)
+	if !ok {
+		return statusScored, ""
+	}
+	if g.minTotal != nil && total < *g.minTotal {
+		return statusIneligible, fmt.Sprintf("total is under the minimum of %s", g.MinTotal)
+	}
+	if g.reviewAbove != nil && total > *g.reviewAbove && !skipReview {
+		return statusPendingReview, fmt.Sprintf("total is over the review threshold of %s", g.ReviewAbove)
+	}
+	return statusScored, ""
+}
+
+// matches reports whether the window covers the given minute of the day. A window whose end is
+// before its start wraps past midnight.
+func (w TimeWindowRule) matches(minute int, day time.Weekday, dayKnown bool) bool {
+	if w.weekdays != nil && (!dayKnown || !w.weekdays[day]) {
+		return false
+	}
+	if w.startMinute < w.endMinute {
+		return minute >= w.startMinute && minute < w.endMinute
+	}
+	return minute >= w.startMinute || minute < w.endMinute
+}
+
+func timeWindowContributions(cfg RulesConfig, receipt Receipt) Breakdown {
+	purchaseTime, err := time.Parse("15:04", receipt.PurchaseTime)
+	if err != nil {
+		return nil
+	}
+	hour, minute, _ := purchaseTime.Clock()
+	totalMinutes := hour*60 + minute
+
+	purchaseDate, err := time.Parse("2006-01-02", receipt.PurchaseDate)
+	dayKnown := err == nil
+
+	var matched Breakdown
+	for _, window := range cfg.TimeWindows {
+		if window.Disabled || !window.matches(totalMinutes, purchaseDate.Weekday(), dayKnown) {
+			continue
+		}
+		switch cfg.TimeWindowOverlap {
+		case overlapFirst:
+			matched.add(window.Name, window.Points)
+			return matched
+		case overlapMax:
+			if len(matched) == 0 || window.Points > matched[0].Points {
+				matched = Breakdown{{Rule: window.Name, Points: window.Points}}
+			}
+		default:
+			matched.add(window.Name, window.Points)
+		}
+	}
+	return matched
+}
+
+// loadCalendarFiles appends holidays from each region's calendar file, resolving relative paths
+// against dir.
+func (h *HolidayRules) loadCalendarFiles(dir string) error {
+	for region, path := range h.CalendarFiles {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("holiday calendar %q: %w", region, err)
+		}
+		var holidays []Holiday
+		if err := json.Unmarshal(data, &holidays); err != nil {
+			return fmt.Errorf("holiday calendar %q: parse %s: %w", region, path, err)
+		}
+		if h.Calendars == nil {
+			h.Calendars = make(map[string][]Holiday)
+		}
+		h.Calendars[region] = append(h.Calendars[region], holidays...)
+	}
+	return nil
+}
+
+func (h *HolidayRules) prepare() error {
+	h.byDate = nil
+	if h.Region == "" {
+		return nil
+	}
+	calendar, ok := h.Calendars[h.Region]
+	if !ok {
+		return fmt.Errorf("no calendar for region %q", h.Region)
+	}
+
+	h.byDate = make(map[string]Holiday, len(calendar))
+	for _, holiday := range calendar {
+		if _, err := time.Parse("2006-01-02", holiday.Date); err != nil {
+			if _, err := time.Parse("01-02", holiday.Date); err != nil {
+				return fmt.Errorf("holiday %q: invalid date %q", holiday.Name, holiday.Date)
+			}
+		}
+		if holiday.Points == 0 {
+			holiday.Points = h.Points
+		}
+		h.byDate[holiday.Date] = holiday
+	}
+	return nil
+}
+
+// lookup finds the holiday on the given date, preferring a full-date entry over a recurring one.
+func (h HolidayRules) lookup(date time.Time) (Holiday, bool) {
+	if holiday, ok := h.byDate[date.Format("2006-01-02")]; ok {
+		return holiday, true
+	}
+	holiday, ok := h.byDate[date.Format("01-02")]
+	return holiday, ok
+}
+
+func calendarContributions(cfg RulesConfig, receipt Receipt) Breakdown {
+	purchaseDate, err := time.Parse("2006-01-02", receipt.PurchaseDate)
+	if err != nil {
+		return nil
+	}
+
+	var breakdown Breakdown
+	for _, rule := range cfg.DayOfWeekBonuses {
+		if !rule.Disabled && rule.weekdays[purchaseDate.Weekday()] {
+			breakdown.add(rule.Name, rule.Points)
+		}
+	}
+	if holiday, ok := cfg.Holidays.lookup(purchaseDate); ok {
+		breakdown.add("holiday: "+holiday.Name, holiday.Points)
+	}
+	return breakdown
+}
+
+func itemPriceContributions(cfg RulesConfig, receipt Receipt) Breakdown {
+	prices := make([]Money, len(receipt.Items))
+	valid := make([]bool, len(receipt.Items))
+	for i, item := range receipt.Items {
+		price, err := parseMoney(item.Price)
+		prices[i], valid[i] = price, err == nil
+	}
+
+	var breakdown Breakdown
+	for _, rule := range cfg.ItemPriceRules {
+		if rule.Disabled {
+			continue
+		}
+		for i := range receipt.Items {
+			if valid[i] && prices[i] > rule.over {
+				breakdown.addItem(rule.Name, i, rule.Points)
+			}
+		}
+	}
+
+	// A big-ticket bonus is awarded once per receipt, attributed to its most expensive qualifying item.
+	for _, rule := range cfg.BigTicketRules {
+		if rule.Disabled {
+			continue
+		}
+		best := -1
+		for i := range receipt.Items {
+			if valid[i] && prices[i] > rule.over && (best < 0 || prices[i] > prices[best]) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			breakdown.addItem(rule.Name, best, rule.Points)
+		}
+	}
+	return breakdown
+}
+
+func parseWeekdays(names []string) (map[time.Weekday]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	weekdays := make(map[time.Weekday]bool, len(names))
+	for _, name := range names {
+		day, err := parseWeekday(name)
+		if err != nil {
+			return nil, err
+		}
+		weekdays[day] = true
+	}
+	return weekdays, nil
+}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(name, day.String()) || strings.EqualFold(name, day.String()[:3]) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day of week %q", name)
+}
+
+// fixedRuleDescriptions explain the rules whose names and conditions aren't configurable.
+var fixedRuleDescriptions = map[string]string{
+	"verified-device":   "The receipt was signed by a registered POS device.",
+	"household-cap":     "Points over the household's cap for the period were taken off.",
+	"points-cap":        "Points over the most a receipt can earn were taken off.",
+	"partner-earn-rate": "The tenant's partner contract changes the points earned.",
+	"partner-cap":       "Points over the partner contract's cap per receipt were taken off.",
+	"model-adjustment":  "The scoring model adjusted the points.",
+	"model-veto":        "The scoring model withheld the points.",
+}
+
+// describeRule explains to end users what earns the points of the rule in a breakdown, or returns
+// "" for rules it doesn't know, such as those of campaigns.
+func describeRule(cfg RulesConfig, rule string) string {
+	if description, ok := fixedRuleDescriptions[rule]; ok {
+		return description
+	}
+	for _, base := range cfg.BaseRules {
+		if base.Name == rule {
+			return base.describe()
+		}
+	}
+	if name, ok := strings.CutPrefix(rule, "holiday: "); ok {
+		return "The purchase was made on " + name + "."
+	}
+	if category, ok := strings.CutPrefix(rule, "excluded: "); ok {
+		return "The item is in the restricted category " + category + " and earns no points."
+	}
+	if strings.HasPrefix(rule, "offer:") {
+		return "An offer given to the user."
+	}
+	for _, window := range cfg.TimeWindows {
+		if window.Name == rule {
+			description := "The purchase was made between " + window.Start + " and " + window.End
+			if len(window.Days) > 0 {
+				description += " on " + strings.Join(window.Days, ", ")
+			}
+			return description + "."
+		}
+	}
+	for _, bonus := range cfg.DayOfWeekBonuses {
+		if bonus.Name == rule {
+			return "The purchase was made on " + strings.Join(bonus.Days, ", ") + "."
+		}
+	}
+	for _, priceRule := range cfg.ItemPriceRules {
+		if priceRule.Name == rule {
+			return "The item costs more than " + priceRule.Over + "."
+		}
+	}
+	for _, bigTicket := range cfg.BigTicketRules {
+		if bigTicket.Name == rule {
+			return "The receipt's most expensive item costs more than " + bigTicket.Over + "."
+		}
+	}
+	return ""
+}
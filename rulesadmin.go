@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errRuleNotFound = errors.New("no such rule")
+	errRuleExists   = errors.New("a rule of that name already exists")
+)
+
+// ruleKind is a list of named rules of the rules config that can be managed through the admin API.
+type ruleKind interface {
+	list(cfg RulesConfig) any
+	// add, replace and setDisabled change the list of cfg, replacing it rather than writing to the
+	// one cfg shares with the rule set in effect, and return the rule as changed.
+	add(cfg *RulesConfig, data []byte) (any, error)
+	replace(cfg *RulesConfig, name string, data []byte) (any, error)
+	setDisabled(cfg *RulesConfig, name string, disabled bool) (any, error)
+}
+
+// ruleSection is the ruleKind of the rules of type R, given how to reach their list in the config
+// and each rule's name and disabled flag.
+type ruleSection[R any] struct {
+	rules    func(cfg *RulesConfig) *[]R
+	name     func(rule *R) *string
+	disabled func(rule *R) *bool
+	prepare  func(rule *R) error
+}
+
+func (s ruleSection[R]) list(cfg RulesConfig) any {
+	rules := *s.rules(&cfg)
+	if rules == nil {
+		return []R{}
+	}
+	return rules
+}
+
+func (s ruleSection[R]) find(rules []R, name string) int {
+	return slices.IndexFunc(rules, func(rule R) bool { return *s.name(&rule) == name })
+}
+
+func (s ruleSection[R]) decode(data []byte) (R, error) {
+	var rule R
+	if err := json.Unmarshal(data, &rule); err != nil {
+		return rule, err
+	}
+	if err := s.prepare(&rule); err != nil {
+		return rule, err
+	}
+	if *s.name(&rule) == "" {
+		return rule, fmt.Errorf("a name is required")
+	}
+	return rule, nil
+}
+
+func (s ruleSection[R]) add(cfg *RulesConfig, data []byte) (any, error) {
+	rule, err := s.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	rules := s.rules(cfg)
+	if s.find(*rules, *s.name(&rule)) >= 0 {
+		return nil, errRuleExists
+	}
+	*rules = append(slices.Clip(*rules), rule)
+	return rule, nil
+}
+
+func (s ruleSection[R]) replace(cfg *RulesConfig, name string, data []byte) (any, error) {
+	rules := s.rules(cfg)
+	i := s.find(*rules, name)
+	if i < 0 {
+		return nil, errRuleNotFound
+	}
+	// The rule keeps its name: it is what its points are reported as.
+	var named map[string]any
+	if err := json.Unmarshal(data, &named); err != nil {
+		return nil, err
+	}
+	if named == nil {
+		return nil, fmt.Errorf("a rule object is required")
+	}
+	named["name"] = name
+	data, _ = json.Marshal(named)
+	rule, err := s.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	*rules = slices.Clone(*rules)
+	(*rules)[i] = rule
+	return rule, nil
+}
+
+func (s ruleSection[R]) setDisabled(cfg *RulesConfig, name string, disabled bool) (any, error) {
+	rules := s.rules(cfg)
+	i := s.find(*rules, name)
+	if i < 0 {
+		return nil, errRuleNotFound
+	}
+	*rules = slices.Clone(*rules)
+	*s.disabled(&(*rules)[i]) = disabled
+	return (*rules)[i], nil
+}
+
+// ruleKinds are the kinds of rules managed through the admin API, by the name used in its routes.
+var ruleKinds = map[string]ruleKind{
+	"base-rules": ruleSection[BaseRule]{
+		rules:    func(cfg *RulesConfig) *[]BaseRule { return &cfg.BaseRules },
+		name:     func(rule *BaseRule) *string { return &rule.Name },
+		disabled: func(rule *BaseRule) *bool { return &rule.Disabled },
+		prepare:  (*BaseRule).prepare,
+	},
+	"time-windows": ruleSection[TimeWindowRule]{
+		rules:    func(cfg *RulesConfig) *[]TimeWindowRule { return &cfg.TimeWindows },
+		name:     func(rule *TimeWindowRule) *string { return &rule.Name },
+		disabled: func(rule *TimeWindowRule) *bool { return &rule.Disabled },
+		prepare:  (*TimeWindowRule).prepare,
+	},
+	"day-of-week-bonuses": ruleSection[DayOfWeekRule]{
+		rules:    func(cfg *RulesConfig) *[]DayOfWeekRule { return &cfg.DayOfWeekBonuses },
+		name:     func(rule *DayOfWeekRule) *string { return &rule.Name },
+		disabled: func(rule *DayOfWeekRule) *bool { return &rule.Disabled },
+		prepare:  (*DayOfWeekRule).prepare,
+	},
+	"item-price-rules": ruleSection[ItemPriceRule]{
+		rules:    func(cfg *RulesConfig) *[]ItemPriceRule { return &cfg.ItemPriceRules },
+		name:     func(rule *ItemPriceRule) *string { return &rule.Name },
+		disabled: func(rule *ItemPriceRule) *bool { return &rule.Disabled },
+		prepare:  (*ItemPriceRule).prepare,
+	},
+	"big-ticket-rules": ruleSection[ItemPriceRule]{
+		rules:    func(cfg *RulesConfig) *[]ItemPriceRule { return &cfg.BigTicketRules },
+		name:     func(rule *ItemPriceRule) *string { return &rule.Name },
+		disabled: func(rule *ItemPriceRule) *bool { return &rule.Disabled },
+		prepare:  (*ItemPriceRule).prepare,
+	},
+}
+
+// viewRules lists the managed rules of a rule set by kind.
+func viewRules(cfg RulesConfig) map[string]any {
+	rules := make(map[string]any, len(ruleKinds))
+	for name, kind := range ruleKinds {
+		rules[name] = kind.list(cfg)
+	}
+	return rules
+}
+
+func listRulesHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentRules()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"version": cfg.Version, "rules": viewRules(cfg)})
+}
+
+func listRuleVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	rulesMu.RLock()
+	versions := slices.Clone(rulesVersions)
+	rulesMu.RUnlock()
+	if versions == nil {
+		versions = []RuleSetVersion{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"versions": versions})
+}
+
+func getRuleVersionHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	rulesMu.RLock()
+	found := err == nil && version >= 1 && version <= len(rulesVersions)
+	var ruleSet RuleSetVersion
+	if found {
+		ruleSet = rulesVersions[version-1]
+	}
+	rulesMu.RUnlock()
+	if !found {
+		http.Error(w, "No rule set of that version.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		RuleSetVersion
+		Rules map[string]any `json:"rules"`
+	}{ruleSet, viewRules(ruleSet.rules)})
+}
+
+// changeRules applies change to a copy of the rule set in effect and puts the result in effect as
+// its next version, answering with the rule as changed.
+func changeRules(w http.ResponseWriter, r *http.Request, description string, statusCode int, change func(kind ruleKind, cfg *RulesConfig) (any, error)) {
+	kind, ok := ruleKinds[mux.Vars(r)["kind"]]
+	if !ok {
+		http.Error(w, "No such kind of rules.", http.StatusNotFound)
+		return
+	}
+	rulesMu.Lock()
+	cfg := activeRules
+	rule, err := change(kind, &cfg)
+	if err == nil {
+		cfg = setRulesLocked(cfg, adminActor(r), description)
+	}
+	rulesMu.Unlock()
+	switch {
+	case errors.Is(err, errRuleNotFound):
+		http.Error(w, "No rule of that name.", http.StatusNotFound)
+		return
+	case errors.Is(err, errRuleExists):
+		http.Error(w, "A rule of that name already exists.", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "The rule is invalid: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]any{"version": cfg.Version, "rule": rule})
+}
+
+func addRuleHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := readRuleBody(w, r)
+	if err != nil {
+		return
+	}
+	// Base rules are named after their type by default.
+	var named struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	json.Unmarshal(data, &named)
+	description := fmt.Sprintf("added %s %q", mux.Vars(r)["kind"], orDefault(named.Name, named.Type))
+	changeRules(w, r, description, http.StatusCreated, func(kind ruleKind, cfg *RulesConfig) (any, error) {
+		return kind.add(cfg, data)
+	})
+}
+
+func putRuleHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := readRuleBody(w, r)
+	if err != nil {
+		return
+	}
+	vars := mux.Vars(r)
+	description := fmt.Sprintf("changed %s %q", vars["kind"], vars["name"])
+	changeRules(w, r, description, http.StatusOK, func(kind ruleKind, cfg *RulesConfig) (any, error) {
+		return kind.replace(cfg, vars["name"], data)
+	})
+}
+
+// transitionRuleHandler disables or enables a rule.
+func transitionRuleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var disabled bool
+	switch vars["action"] {
+	case "disable":
+		disabled = true
+	case "enable":
+	default:
+		http.Error(w, "Unknown action: use disable or enable.", http.StatusNotFound)
+		return
+	}
+	description := fmt.Sprintf("%sd %s %q", vars["action"], vars["kind"], vars["name"])
+	changeRules(w, r, description, http.StatusOK, func(kind ruleKind, cfg *RulesConfig) (any, error) {
+		return kind.setDisabled(cfg, vars["name"], disabled)
+	})
+}
+
+// maxRuleSize is the largest rule accepted by the admin API.
+const maxRuleSize = 64 << 10
+
+func readRuleBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var data json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRuleSize)).Decode(&data); err != nil {
+		http.Error(w, "The rule is invalid.", http.StatusBadRequest)
+		return nil, err
+	}
+	return data, nil
+}
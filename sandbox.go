@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Sandbox tenants let partners test their integration against the real rules without touching
+// production data. Their receipts are kept in a store of their own and removed after the tenant's
+// DataTTL. They are never posted to the ledger, so they earn no balance and count towards no
+// costs, budgets, campaign stats, household caps or settlements. Requests on their behalf can set
+// the time they are handled at with the X-Test-Clock header, even in production.
+
+const defaultSandboxTTL = 72 * time.Hour
+
+func tenantIsSandbox(tenantID string) bool {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	return tenants[tenantID].Sandbox
+}
+
+// sandboxTTL returns how long the tenant's receipts are kept, if it is a sandbox tenant.
+func sandboxTTL(tenantID string) (time.Duration, bool) {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	tenant := tenants[tenantID]
+	switch {
+	case !tenant.Sandbox:
+		return 0, false
+	case tenant.DataTTL == 0:
+		return defaultSandboxTTL, true
+	}
+	return time.Duration(tenant.DataTTL), true
+}
+
+// startSandboxSweeper periodically removes sandbox receipts that have expired, with their
+// attachment files.
+func startSandboxSweeper(interval time.Duration) {
+	scheduleTask("sandbox-sweep", interval, sweepSandboxReceipts)
+}
+
+func sweepSandboxReceipts() {
+	now := time.Now()
+	var expired []string
+	for _, receipt := range listStore(sandboxStore) {
+		if receipt.ExpiresAt != nil && now.After(*receipt.ExpiresAt) {
+			expired = append(expired, receipt.ID)
+		}
+	}
+
+	for _, id := range expired {
+		purged, err := purgeReceipt(id, func(receipt ProcessedReceipt) bool {
+			return receipt.ExpiresAt != nil && now.After(*receipt.ExpiresAt) && !underLegalHold(receipt)
+		})
+		if err != nil {
+			continue
+		}
+		deleteAttachmentBlobs(purged)
+		log.Printf("Removed sandbox receipt %s of tenant %s", purged.ID, purged.TenantID)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tenantJobConcurrency is how many job items of one tenant each priority's workers process at
+// once, unless the tenant sets its own maxConcurrency. 0 leaves tenants limited by the pool only.
+var tenantJobConcurrency = 0
+
+// tenantQueue is the queue of one priority's workers. Each tenant waits in a queue of its own, and
+// workers take from the tenants in turn, skipping those at their concurrency limit, so a tenant
+// with a huge backlog only delays the others by its share of the workers.
+type tenantQueue struct {
+	mu    sync.Mutex
+	ready *sync.Cond
+	// pending holds the waiting tasks of each tenant, and order the tenants with any, in the
+	// order they are served.
+	pending map[string][]jobTask
+	order   []string
+	running map[string]int
+}
+
+func newTenantQueue() *tenantQueue {
+	q := &tenantQueue{pending: map[string][]jobTask{}, running: map[string]int{}}
+	q.ready = sync.NewCond(&q.mu)
+	return q
+}
+
+// tenantConcurrency is the limit on the tenant's job items in progress per priority, 0 for none.
+func tenantConcurrency(tenantID string) int {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	if limit := tenants[tenantID].MaxConcurrency; limit > 0 {
+		return limit
+	}
+	return tenantJobConcurrency
+}
+
+func (q *tenantQueue) push(task jobTask) {
+	q.mu.Lock()
+	tenant := task.job.tenantID
+	if len(q.pending[tenant]) == 0 {
+		q.order = append(q.order, tenant)
+	}
+	q.pending[tenant] = append(q.pending[tenant], task)
+	q.mu.Unlock()
+	q.ready.Signal()
+}
+
+// next waits for a task of a tenant below its limit and takes it. The tenant moves to the back of
+// the order.
+func (q *tenantQueue) next() jobTask {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for i, tenant := range q.order {
+			if limit := tenantConcurrency(tenant); limit > 0 && q.running[tenant] >= limit {
+				continue
+			}
+			tasks := q.pending[tenant]
+			task := tasks[0]
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			if len(tasks) > 1 {
+				q.pending[tenant] = tasks[1:]
+				q.order = append(q.order, tenant)
+			} else {
+				delete(q.pending, tenant)
+			}
+			q.running[tenant]++
+			return task
+		}
+		q.ready.Wait()
+	}
+}
+
+// done records that a task taken with next finished, freeing a place for its tenant.
+func (q *tenantQueue) done(task jobTask) {
+	q.mu.Lock()
+	tenant := task.job.tenantID
+	if q.running[tenant]--; q.running[tenant] == 0 {
+		delete(q.running, tenant)
+	}
+	q.mu.Unlock()
+	// Any idle worker may be waiting on this tenant.
+	q.ready.Broadcast()
+}
+
+// idle reports whether no task waits or is in progress.
+func (q *tenantQueue) idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) == 0 && len(q.running) == 0
+}
+
+// queued returns how many tasks wait, and how many are in progress, per tenant.
+func (q *tenantQueue) queued() (pending, running map[string]int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending, running = map[string]int{}, map[string]int{}
+	for tenant, tasks := range q.pending {
+		pending[tenant] = len(tasks)
+	}
+	for tenant, n := range q.running {
+		running[tenant] = n
+	}
+	return pending, running
+}
+
+// shard is the part of the tenants whose bulk work this instance takes when tenants are sharded
+// across instances with -shard, e.g. 1/3 for the second of three. A zero count is unsharded.
+type shard struct {
+	index, count int
+}
+
+var instanceShard shard
+
+func parseShard(value string) (shard, error) {
+	if value == "" {
+		return shard{}, nil
+	}
+	index, count, found := strings.Cut(value, "/")
+	i, err1 := strconv.Atoi(index)
+	n, err2 := strconv.Atoi(count)
+	if !found || err1 != nil || err2 != nil || n < 1 || i < 0 || i >= n {
+		return shard{}, fmt.Errorf("invalid shard %q: want <index>/<count>, e.g. 0/3", value)
+	}
+	return shard{index: i, count: n}, nil
+}
+
+// tenantShard is the index of the shard of count taking the tenant's bulk work.
+func tenantShard(tenantID string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(tenantID))
+	return int(h.Sum32() % uint32(count))
+}
+
+// shardedRequests are the bulk submissions only served by the instance of the tenant's shard.
+var shardedRequests = map[string]bool{
+	"POST /jobs":                   true,
+	"POST /imports":                true,
+	"POST /receipts/process/batch": true,
+}
+
+// requireTenantShard sends bulk submissions of tenants of other shards away with 421 Misdirected
+// Request and the index of their shard in X-Tenant-Shard, for the gateway to route.
+func requireTenantShard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if instanceShard.count > 1 && shardedRequests[r.Method+" "+r.URL.Path] {
+			if owner := tenantShard(tenantFromRequest(r), instanceShard.count); owner != instanceShard.index {
+				w.Header().Set("X-Tenant-Shard", strconv.Itoa(owner))
+				http.Error(w, fmt.Sprintf("This tenant's bulk work is taken by shard %d of %d.", owner, instanceShard.count), http.StatusMisdirectedRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// jobQueuesHandler reports the job items waiting and in progress per priority and tenant.
+func jobQueuesHandler(w http.ResponseWriter, r *http.Request) {
+	queues := map[string]any{}
+	for priority, queue := range jobQueues {
+		pending, running := queue.queued()
+		queues[priority] = map[string]any{"pending": pending, "running": running}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"queues": queues})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// receiptSchemaVersion is the version of the stored receipt format this release writes. Records
+// without a SchemaVersion predate versioning and are version 1.
+//
+// Version 2 added Language, the language detected in the items.
+const receiptSchemaVersion = 2
+
+// receiptMigrations upgrade a stored record from version i+1 to i+2, so records written by earlier
+// releases can still be read and re-scored. They work on the record's JSON document rather than a
+// ProcessedReceipt, so a field can change type from one version to the next. Changing the stored
+// format is bumping receiptSchemaVersion and appending a migration here.
+var receiptMigrations = []func(record map[string]any) error{
+	migrateReceiptLanguage,
+}
+
+// migrateReceiptLanguage detects the language of records stored before it was recorded on them.
+func migrateReceiptLanguage(record map[string]any) error {
+	if _, exists := record["Language"]; exists {
+		return nil
+	}
+	data, err := json.Marshal(record["Receipt"])
+	if err != nil {
+		return err
+	}
+	var receipt Receipt
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		return fmt.Errorf("receipt: %w", err)
+	}
+	record["Language"] = detectLanguage(receipt.Items)
+	return nil
+}
+
+// storedReceipt is the serialized form of a stored receipt. The blob keys of attachments and their
+// variants are left out of their JSON, which the API shares, so they are kept alongside: by
+// attachment ID, and by "<attachment ID>/<variant>".
+type storedReceipt struct {
+	ProcessedReceipt
+	BlobKeys map[string]string `json:",omitempty"`
+}
+
+// encodeStoredReceipt serializes a receipt, as stored, for backends that keep bytes.
+func encodeStoredReceipt(receipt ProcessedReceipt) ([]byte, error) {
+	receipt.SchemaVersion = receiptSchemaVersion
+	stored := storedReceipt{ProcessedReceipt: receipt}
+	for _, attachment := range receipt.Attachments {
+		if stored.BlobKeys == nil {
+			stored.BlobKeys = make(map[string]string)
+		}
+		stored.BlobKeys[attachment.ID] = attachment.BlobKey
+		for name, variant := range attachment.Variants {
+			stored.BlobKeys[attachment.ID+"/"+name] = variant.BlobKey
+		}
+	}
+	return json.Marshal(stored)
+}
+
+// decodeStoredReceipt reads a receipt serialized by encodeStoredReceipt of this or an earlier
+// release, migrating it to the current version. Records from a later release are an error rather
+// than being read with the fields this release doesn't know dropped, unless the instance is
+// read-only and so won't write them back.
+func decodeStoredReceipt(data []byte) (ProcessedReceipt, error) {
+	var record map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&record); err != nil {
+		return ProcessedReceipt{}, err
+	}
+	version := 1
+	if raw, exists := record["SchemaVersion"]; exists {
+		number, ok := raw.(json.Number)
+		parsed, err := number.Int64()
+		if !ok || err != nil || parsed < 1 {
+			return ProcessedReceipt{}, fmt.Errorf("invalid schema version %v", raw)
+		}
+		version = int(parsed)
+	}
+	if version > receiptSchemaVersion && !readOnly {
+		return ProcessedReceipt{}, fmt.Errorf("schema version %d is newer than this release's %d", version, receiptSchemaVersion)
+	}
+
+	if version < receiptSchemaVersion {
+		for ; version < receiptSchemaVersion; version++ {
+			if err := receiptMigrations[version-1](record); err != nil {
+				return ProcessedReceipt{}, fmt.Errorf("migrate from schema version %d: %w", version, err)
+			}
+		}
+		record["SchemaVersion"] = receiptSchemaVersion
+		var err error
+		if data, err = json.Marshal(record); err != nil {
+			return ProcessedReceipt{}, err
+		}
+	}
+	var stored storedReceipt
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return ProcessedReceipt{}, err
+	}
+	receipt := stored.ProcessedReceipt
+	for i, attachment := range receipt.Attachments {
+		receipt.Attachments[i].BlobKey = stored.BlobKeys[attachment.ID]
+		for name, variant := range attachment.Variants {
+			variant.BlobKey = stored.BlobKeys[attachment.ID+"/"+name]
+			attachment.Variants[name] = variant
+		}
+	}
+	return receipt, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Fallbacks for when the scoring model can't be reached or doesn't answer in time.
+const (
+	// modelFallbackKeep keeps the points the rules awarded.
+	modelFallbackKeep = "keep"
+	// modelFallbackReview holds the receipt for manual review.
+	modelFallbackReview = "review"
+)
+
+// errModelUnavailable holds a receipt for review when the scoring model failed.
+var errModelUnavailable = errors.New("the scoring model was unavailable")
+
+// ModelVerdict is a scoring model's judgement of a scored receipt. Adjustment is added to the points
+// the rules awarded, and Veto withholds all of them. The scores are recorded for auditing.
+type ModelVerdict struct {
+	Adjustment       int      `json:"adjustment"`
+	Veto             bool     `json:"veto"`
+	Reason           string   `json:"reason,omitempty"`
+	FraudProbability *float64 `json:"fraudProbability,omitempty"`
+	QualityScore     *float64 `json:"qualityScore,omitempty"`
+	Model            string   `json:"model,omitempty"`
+}
+
+// A ScoringModel is consulted after the rules scored a receipt, and may adjust or veto its points.
+type ScoringModel interface {
+	Judge(ctx context.Context, processed ProcessedReceipt) (ModelVerdict, error)
+}
+
+var (
+	// scoringModel is nil when no model is configured, in which case the rules alone score receipts.
+	scoringModel  ScoringModel
+	modelTimeout  = 500 * time.Millisecond
+	modelFallback = modelFallbackKeep
+)
+
+// httpScoringModel asks a model service over HTTP: the receipt, with its user as a pseudonym, and
+// the rules' points and breakdown are POSTed as JSON, and the ModelVerdict is read back.
+type httpScoringModel struct {
+	url    string
+	client *http.Client
+}
+
+func (m httpScoringModel) Judge(ctx context.Context, processed ProcessedReceipt) (ModelVerdict, error) {
+	receipt := processed.Receipt
+	userIDHash := ""
+	if receipt.UserID != "" {
+		userIDHash = userIDHashWith(identityKeys.current(), receipt.UserID)
+		receipt.UserID = ""
+	}
+	body, err := json.Marshal(map[string]any{
+		"id":         processed.ID,
+		"tenantId":   processed.TenantID,
+		"receipt":    receipt,
+		"userIdHash": userIDHash,
+		"trusted":    processed.Trusted,
+		"language":   processed.Language,
+		"points":     processed.Breakdown.Total(),
+		"breakdown":  processed.Breakdown,
+	})
+	if err != nil {
+		return ModelVerdict{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return ModelVerdict{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return ModelVerdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ModelVerdict{}, fmt.Errorf("scoring model returned %s", resp.Status)
+	}
+	var verdict ModelVerdict
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return ModelVerdict{}, fmt.Errorf("scoring model: %w", err)
+	}
+	return verdict, nil
+}
+
+// applyScoringModel consults the scoring model, if one is configured, on a receipt the rules
+// scored, and records its verdict in the breakdown: a "model-adjustment" entry with the points it
+// added or took off, always recorded so its scores are kept, and a "model-veto" entry taking off
+// the rest if it vetoed them. It fails with errModelUnavailable when the model failed and the
+// fallback is to hold the receipt for review.
+func applyScoringModel(processed *ProcessedReceipt) error {
+	if scoringModel == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), modelTimeout)
+	defer cancel()
+	verdict, err := scoringModel.Judge(ctx, *processed)
+	if err != nil {
+		log.Printf("Scoring model on receipt %s: %v", processed.ID, err)
+		if modelFallback == modelFallbackReview {
+			return errModelUnavailable
+		}
+		return nil
+	}
+	verdict.Adjustment = max(verdict.Adjustment, -processed.Breakdown.Total())
+	processed.Breakdown = append(processed.Breakdown, Contribution{Rule: "model-adjustment", Points: verdict.Adjustment, Model: &verdict})
+	if verdict.Veto {
+		processed.Breakdown = append(processed.Breakdown, Contribution{Rule: "model-veto", Points: -processed.Breakdown.Total()})
+	}
+	return nil
+}
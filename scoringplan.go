@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// Scoring phases, in the order they are evaluated. Each phase works on the points of the phases
+// before it, so the effect of combining rules doesn't depend on how they are configured.
+const (
+	phaseBase        = "base"
+	phaseExclusions  = "exclusions"
+	phasePromotions  = "promotions"
+	phaseMultipliers = "multipliers"
+	phaseAdjustments = "adjustments"
+	phaseCaps        = "caps"
+)
+
+var phaseDescriptions = map[string]string{
+	phaseBase:        "Rules scoring the receipt itself, each independently of the others.",
+	phaseExclusions:  "Points of restricted items are taken back off.",
+	phasePromotions:  "Offers and campaigns add bonuses and multiples of the points of the earlier phases; promotions out of budget are dropped.",
+	phaseMultipliers: "The partner contract's earn rate multiplies all points so far.",
+	phaseAdjustments: "The scoring model adjusts or vetoes the points.",
+	phaseCaps:        "Caps take off the points over them, last, so no earlier phase can exceed them.",
+}
+
+// scoringStage is a step of the scoring plan. rules lists the breakdown entries it can add under
+// a rules config.
+type scoringStage struct {
+	name        string
+	phase       string
+	description string
+	rules       func(cfg RulesConfig) []string
+	apply       func(cfg RulesConfig, processed *ProcessedReceipt) error
+}
+
+// scoringPlan is how receipts are scored, in order. Stages are listed by phase.
+var scoringPlan = []scoringStage{
+	{
+		name: "base-rules", phase: phaseBase,
+		description: "The base rules, in the order they are configured.",
+		rules: func(cfg RulesConfig) []string {
+			var names []string
+			for _, rule := range cfg.BaseRules {
+				if !rule.Disabled {
+					names = append(names, rule.Name)
+				}
+			}
+			return names
+		},
+		apply: func(cfg RulesConfig, processed *ProcessedReceipt) error {
+			for _, rule := range cfg.BaseRules {
+				if !rule.Disabled {
+					processed.Breakdown = append(processed.Breakdown, rule.contributions(cfg, processed.Receipt)...)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		name: "item-price-rules", phase: phaseBase,
+		description: "Item price threshold bonuses, per item, then big-ticket bonuses, once per receipt.",
+		rules: func(cfg RulesConfig) []string {
+			var names []string
+			for _, rules := range [][]ItemPriceRule{cfg.ItemPriceRules, cfg.BigTicketRules} {
+				for _, rule := range rules {
+					if !rule.Disabled {
+						names = append(names, rule.Name)
+					}
+				}
+			}
+			return names
+		},
+		apply: baseStage(itemPriceContributions),
+	},
+	{
+		name: "calendar", phase: phaseBase,
+		description: "Day-of-week bonuses, then the holiday bonus of the calendar's region.",
+		rules: func(cfg RulesConfig) []string {
+			var names []string
+			for _, bonus := range cfg.DayOfWeekBonuses {
+				if !bonus.Disabled {
+					names = append(names, bonus.Name)
+				}
+			}
+			if cfg.Holidays.Region != "" {
+				names = append(names, "holiday: <holiday>")
+			}
+			return names
+		},
+		apply: baseStage(calendarContributions),
+	},
+	{
+		name: "time-windows", phase: phaseBase,
+		description: "Time-window bonuses, combined by the timeWindowOverlap strategy.",
+		rules: func(cfg RulesConfig) []string {
+			var names []string
+			for _, window := range cfg.TimeWindows {
+				if !window.Disabled {
+					names = append(names, window.Name)
+				}
+			}
+			return names
+		},
+		apply: baseStage(timeWindowContributions),
+	},
+	{
+		name: "exclusions", phase: phaseExclusions,
+		description: "The points the base phase awarded restricted items are taken off.",
+		rules: func(cfg RulesConfig) []string {
+			if !cfg.Exclusions.enabled() {
+				return nil
+			}
+			return []string{"excluded: <category>"}
+		},
+		apply: func(cfg RulesConfig, processed *ProcessedReceipt) error {
+			applyExclusions(cfg, processed)
+			return nil
+		},
+	},
+	{
+		name: "offers", phase: phasePromotions,
+		description: "The user's offers multiply the points of the earlier phases and add their bonus.",
+		rules:       fixedRules("offer:<offer id>"),
+		apply:       stage(applyOffers),
+	},
+	{
+		name: "verified-device", phase: phasePromotions,
+		description: "The bonus for receipts signed by a registered POS device.",
+		rules: func(cfg RulesConfig) []string {
+			if cfg.TrustedDevices.Points == 0 {
+				return nil
+			}
+			return []string{"verified-device"}
+		},
+		apply: func(cfg RulesConfig, processed *ProcessedReceipt) error {
+			if bonus := cfg.TrustedDevices.Points; processed.Trusted && bonus > 0 {
+				processed.Breakdown.add("verified-device", bonus)
+			}
+			return nil
+		},
+	},
+	{
+		name: "campaigns", phase: phasePromotions,
+		description: "The promotions of active campaigns, their multipliers applying to the points before campaigns.",
+		rules: func(cfg RulesConfig) []string {
+			campaignsMu.RLock()
+			defer campaignsMu.RUnlock()
+			var names []string
+			for _, campaign := range campaigns {
+				if campaign.Status != campaignActive {
+					continue
+				}
+				for _, promotion := range campaign.Promotions {
+					names = append(names, campaign.promotionRule(promotion))
+				}
+			}
+			sort.Strings(names)
+			return names
+		},
+		apply: stage(applyCampaigns),
+	},
+	{
+		name: "budgets", phase: phasePromotions,
+		description: "Promotions whose budget is spent are dropped.",
+		rules:       fixedRules(),
+		apply:       stage(applyBudgets),
+	},
+	{
+		name: "partner-earn-rate", phase: phaseMultipliers,
+		description: "The earn rate of the tenant's partner contract in force on the purchase date.",
+		rules:       partnerRules("partner-earn-rate"),
+		apply:       stage(applyPartnerContract),
+	},
+	{
+		name: "scoring-model", phase: phaseAdjustments,
+		description: "The scoring model's adjustment or veto, if a model is configured.",
+		rules: func(cfg RulesConfig) []string {
+			if scoringModel == nil {
+				return nil
+			}
+			return []string{"model-adjustment", "model-veto"}
+		},
+		apply: func(cfg RulesConfig, processed *ProcessedReceipt) error {
+			return applyScoringModel(processed)
+		},
+	},
+	{
+		name: "points-cap", phase: phaseCaps,
+		description: "The most points any receipt can earn, truncating or prorating the points over it.",
+		rules: func(cfg RulesConfig) []string {
+			if cfg.PointsCap.MaxPoints == 0 {
+				return nil
+			}
+			return []string{"points-cap"}
+		},
+		apply: func(cfg RulesConfig, processed *ProcessedReceipt) error {
+			applyPointsCap(cfg, processed)
+			return nil
+		},
+	},
+	{
+		name: "partner-cap", phase: phaseCaps,
+		description: "The partner contract's cap on the points of a receipt.",
+		rules:       partnerRules("partner-cap"),
+		apply:       stage(applyPartnerCap),
+	},
+	{
+		name: "household-cap", phase: phaseCaps,
+		description: "The daily and monthly caps of the user's household.",
+		rules: func(cfg RulesConfig) []string {
+			if cfg.Households.DailyCap == 0 && cfg.Households.MonthlyCap == 0 {
+				return nil
+			}
+			return []string{"household-cap"}
+		},
+		apply: stage(applyHouseholdCap),
+	},
+}
+
+// baseStage applies one of the scorers of the base phase.
+func baseStage(score func(cfg RulesConfig, receipt Receipt) Breakdown) func(RulesConfig, *ProcessedReceipt) error {
+	return func(cfg RulesConfig, processed *ProcessedReceipt) error {
+		processed.Breakdown = append(processed.Breakdown, score(cfg, processed.Receipt)...)
+		return nil
+	}
+}
+
+// stage applies a step that reads what it needs of the rules config itself.
+func stage(apply func(processed *ProcessedReceipt)) func(RulesConfig, *ProcessedReceipt) error {
+	return func(_ RulesConfig, processed *ProcessedReceipt) error {
+		apply(processed)
+		return nil
+	}
+}
+
+func fixedRules(names ...string) func(RulesConfig) []string {
+	return func(RulesConfig) []string { return names }
+}
+
+func partnerRules(name string) func(RulesConfig) []string {
+	return func(RulesConfig) []string {
+		if len(partnerPrograms) == 0 {
+			return nil
+		}
+		return []string{name}
+	}
+}
+
+// runScoringPlan scores processed by every stage of the plan in turn. A stage failing doesn't stop
+// the later ones; the first failure is returned.
+func runScoringPlan(cfg RulesConfig, processed *ProcessedReceipt) error {
+	var failure error
+	for _, stage := range scoringPlan {
+		if err := stage.apply(cfg, processed); err != nil && failure == nil {
+			failure = err
+		}
+	}
+	return failure
+}
+
+// rulesPlanHandler returns the scoring plan under the rules in effect: its phases in order, each
+// with its stages and the breakdown entries they can add.
+func rulesPlanHandler(w http.ResponseWriter, r *http.Request) {
+	type stageView struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Rules       []string `json:"rules"`
+	}
+	type phaseView struct {
+		Name        string      `json:"name"`
+		Description string      `json:"description"`
+		Stages      []stageView `json:"stages"`
+	}
+	cfg := currentRules()
+	var phases []phaseView
+	for _, stage := range scoringPlan {
+		if len(phases) == 0 || phases[len(phases)-1].Name != stage.phase {
+			phases = append(phases, phaseView{Name: stage.phase, Description: phaseDescriptions[stage.phase]})
+		}
+		rules := stage.rules(cfg)
+		if rules == nil {
+			rules = []string{}
+		}
+		current := &phases[len(phases)-1]
+		current.Stages = append(current.Stages, stageView{stage.name, stage.description, rules})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"rulesVersion": cfg.Version, "phases": phases})
+}
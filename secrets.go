@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretsProvider looks up secrets such as admin tokens, signing secrets, encryption keys and
+// credentials by name.
+type SecretsProvider interface {
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+// secretRenewer is implemented by providers holding credentials that expire unless renewed.
+type secretRenewer interface {
+	Renew(ctx context.Context) error
+}
+
+var errSecretNotFound = errors.New("secret not found")
+
+// secretRefPrefix marks config values that name a secret instead of holding it, e.g.
+// "secret:slack-webhook-token".
+const secretRefPrefix = "secret:"
+
+var secrets SecretsProvider = envSecrets{}
+
+func newSecretsProvider(kind string) (SecretsProvider, error) {
+	switch kind {
+	case "", "env":
+		return envSecrets{}, nil
+	case "file":
+		return fileSecrets{dir: orDefault(os.Getenv("SECRETS_DIR"), "/run/secrets")}, nil
+	case "vault":
+		addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+		if addr == "" || token == "" {
+			return nil, errors.New("VAULT_ADDR and VAULT_TOKEN are required")
+		}
+		return &vaultSecrets{
+			addr:   strings.TrimSuffix(addr, "/"),
+			token:  token,
+			path:   orDefault(os.Getenv("VAULT_SECRET_PATH"), "secret/data/receipt-processor"),
+			client: egressClient(egressVault, 10*time.Second),
+		}, nil
+	case "aws":
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			return nil, errors.New("AWS_REGION is required")
+		}
+		return &awsSecretsManager{
+			region: region,
+			prefix: os.Getenv("AWS_SECRET_PREFIX"),
+			creds:  awsCredentialsFromEnv(),
+			client: egressClient(egressAWSSecrets, 10*time.Second),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown secrets provider %q", kind)
+}
+
+// resolveSecret returns value, or the named secret if value is a "secret:" reference.
+func resolveSecret(ctx context.Context, value string) (string, error) {
+	name, ok := strings.CutPrefix(value, secretRefPrefix)
+	if !ok {
+		return value, nil
+	}
+	secret, err := secrets.GetSecret(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %w", name, err)
+	}
+	return secret, nil
+}
+
+// resolveSecrets replaces every "secret:" reference among values with the secret it names.
+func resolveSecrets(values ...*string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, value := range values {
+		secret, err := resolveSecret(ctx, *value)
+		if err != nil {
+			return err
+		}
+		*value = secret
+	}
+	return nil
+}
+
+// lookupSecret returns value if it is set. Otherwise it fetches the named secret from the
+// provider, returning "" when the provider doesn't have it.
+func lookupSecret(ctx context.Context, value, name string) (string, error) {
+	if value != "" {
+		return resolveSecret(ctx, value)
+	}
+	secret, err := secrets.GetSecret(ctx, name)
+	if errors.Is(err, errSecretNotFound) {
+		return "", nil
+	}
+	return secret, err
+}
+
+// secretValue holds a secret that may be replaced while the server is running.
+type secretValue struct {
+	mu    sync.RWMutex
+	value string
+}
+
+func (s *secretValue) Get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+func (s *secretValue) Set(value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.value = value
+}
+
+// watchSecrets renews the provider's credentials and re-reads the named secrets every interval,
+// so rotating them in the provider takes effect without a restart.
+func watchSecrets(interval time.Duration, watched map[string]*secretValue) {
+	go func() {
+		for range time.Tick(interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if renewer, ok := secrets.(secretRenewer); ok {
+				if err := renewer.Renew(ctx); err != nil {
+					log.Printf("Renewing secrets provider credentials: %v", err)
+				}
+			}
+			for name, value := range watched {
+				secret, err := secrets.GetSecret(ctx, name)
+				if err != nil {
+					log.Printf("Refreshing secret %s: %v", name, err)
+					continue
+				}
+				if secret != value.Get() {
+					log.Printf("Secret %s was rotated", name)
+					value.Set(secret)
+				}
+			}
+			cancel()
+		}
+	}()
+}
+
+// envSecrets reads secrets from environment variables, e.g. "admin-token" from ADMIN_TOKEN.
+type envSecrets struct{}
+
+func (envSecrets) GetSecret(ctx context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(strings.ToUpper(strings.ReplaceAll(name, "-", "_")))
+	if !ok {
+		return "", errSecretNotFound
+	}
+	return value, nil
+}
+
+// fileSecrets reads each secret from a file of the same name, as mounted by Docker and Kubernetes.
+type fileSecrets struct {
+	dir string
+}
+
+func (s fileSecrets) GetSecret(ctx context.Context, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, filepath.Base(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", errSecretNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// vaultSecrets reads secrets as the fields of one HashiCorp Vault KV version 2 secret.
+type vaultSecrets struct {
+	addr   string
+	path   string
+	client *http.Client
+
+	mu    sync.RWMutex
+	token string
+}
+
+func (v *vaultSecrets) do(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.RLock()
+	req.Header.Set("X-Vault-Token", v.token)
+	v.mu.RUnlock()
+	return v.client.Do(req)
+}
+
+func (v *vaultSecrets) GetSecret(ctx context.Context, name string) (string, error) {
+	resp, err := v.do(ctx, http.MethodGet, v.path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errSecretNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault read %s: %s", v.path, resp.Status)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("vault read %s: %w", v.path, err)
+	}
+	value, ok := body.Data.Data[name]
+	if !ok {
+		return "", errSecretNotFound
+	}
+	return value, nil
+}
+
+// Renew extends the lease of the Vault token so it doesn't expire while the server runs.
+func (v *vaultSecrets) Renew(ctx context.Context) error {
+	resp, err := v.do(ctx, http.MethodPost, "auth/token/renew-self")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault token renewal: %s", resp.Status)
+	}
+	var body struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err == nil && body.Auth.ClientToken != "" {
+		v.mu.Lock()
+		v.token = body.Auth.ClientToken
+		v.mu.Unlock()
+	}
+	return nil
+}
+
+// awsSecretsManager reads each secret from AWS Secrets Manager as the string value of the secret
+// named prefix+name.
+type awsSecretsManager struct {
+	region string
+	prefix string
+	creds  awsCredentials
+	client *http.Client
+}
+
+func (s *awsSecretsManager) GetSecret(ctx context.Context, name string) (string, error) {
+	payload, err := json.Marshal(map[string]string{"SecretId": s.prefix + name})
+	if err != nil {
+		return "", err
+	}
+	url := "https://secretsmanager." + s.region + ".amazonaws.com/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, sha256Hex(payload), s.creds, s.region, "secretsmanager", time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Type         string `json:"__type"`
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("secrets manager get %s: %s", name, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if strings.HasSuffix(body.Type, "ResourceNotFoundException") {
+			return "", errSecretNotFound
+		}
+		return "", fmt.Errorf("secrets manager get %s: %s %s", name, resp.Status, body.Type)
+	}
+	return body.SecretString, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// selftestReceipts are the receipts the self-test scores: the examples from the README, so their
+// points on a default instance are known.
+var selftestReceipts = []Receipt{
+	{
+		Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Total: "35.35",
+		Items: []Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+			{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+			{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+			{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+			{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+		},
+	},
+	{
+		Retailer: "M&M Corner Market", PurchaseDate: "2022-03-20", PurchaseTime: "14:33", Total: "9.00",
+		Items: []Item{
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+		},
+	},
+}
+
+const (
+	defaultSelftestIterations = 1000
+	maxSelftestIterations     = 100000
+)
+
+// SelftestRequest sets how long the self-test runs and, optionally, the numbers it must reach to
+// pass. Zero thresholds aren't checked.
+type SelftestRequest struct {
+	Iterations     int      `json:"iterations"`
+	MinScoringRate float64  `json:"minScoringRate"`
+	MinStoreRate   float64  `json:"minStoreRate"`
+	MaxP99         duration `json:"maxP99"`
+}
+
+// BenchmarkResult is the throughput and latency of one benchmark of the self-test.
+type BenchmarkResult struct {
+	Operations   int      `json:"operations"`
+	Elapsed      duration `json:"elapsed"`
+	OpsPerSecond float64  `json:"opsPerSecond"`
+	P50          duration `json:"p50"`
+	P90          duration `json:"p90"`
+	P99          duration `json:"p99"`
+	Max          duration `json:"max"`
+}
+
+// benchmark times run over iterations operations, stopping at the first error.
+func benchmark(iterations int, run func(i int) error) (BenchmarkResult, error) {
+	latencies := make([]time.Duration, 0, iterations)
+	start := time.Now()
+	for i := range iterations {
+		opStart := time.Now()
+		if err := run(i); err != nil {
+			return BenchmarkResult{}, err
+		}
+		latencies = append(latencies, time.Since(opStart))
+	}
+	elapsed := time.Since(start)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) duration {
+		return duration(latencies[(len(latencies)*int(p*100)+99)/100-1])
+	}
+	return BenchmarkResult{
+		Operations:   iterations,
+		Elapsed:      duration(elapsed),
+		OpsPerSecond: float64(int(float64(iterations)/elapsed.Seconds()*10+0.5)) / 10,
+		P50:          percentile(0.50),
+		P90:          percentile(0.90),
+		P99:          percentile(0.99),
+		Max:          duration(latencies[len(latencies)-1]),
+	}, nil
+}
+
+// benchmarkScoring processes the self-test receipts under the live rules, campaigns and partner
+// programs, without storing them. A receipt scoring differently between runs fails the benchmark.
+func benchmarkScoring(iterations int, now time.Time) (BenchmarkResult, []int, error) {
+	points := make([]int, len(selftestReceipts))
+	for i, receipt := range selftestReceipts {
+		points[i] = processReceipt(context.Background(), receipt, "", now).Points
+	}
+	result, err := benchmark(iterations, func(i int) error {
+		n := i % len(selftestReceipts)
+		if got := processReceipt(context.Background(), selftestReceipts[n], "", now).Points; got != points[n] {
+			return fmt.Errorf("receipt %d scored %d points, then %d", n, points[n], got)
+		}
+		return nil
+	})
+	return result, points, err
+}
+
+// benchmarkStore saves, reads back and purges receipts in the receipt store, so each lives there
+// for only one operation. They carry a user ID, so identity sealing is measured too.
+func benchmarkStore(iterations int, now time.Time) (BenchmarkResult, error) {
+	return benchmark(iterations, func(i int) error {
+		receipt := selftestReceipts[i%len(selftestReceipts)]
+		receipt.UserID = "selftest"
+		processed := ProcessedReceipt{
+			ID:          "selftest-" + uuid.New().String(),
+			Receipt:     receipt,
+			ProcessedAt: now.UTC(),
+			Status:      statusScored,
+		}
+		if err := saveReceipt(context.Background(), processed); err != nil {
+			return fmt.Errorf("save: %w", err)
+		}
+		stored, exists := getReceipt(processed.ID)
+		if _, err := purgeReceipt(processed.ID, func(ProcessedReceipt) bool { return true }); err != nil {
+			return fmt.Errorf("purge: %w", err)
+		}
+		if !exists || stored.Receipt.UserID != receipt.UserID {
+			return errors.New("a saved receipt couldn't be read back")
+		}
+		return nil
+	})
+}
+
+// selftestHandler benchmarks scoring and the receipt store on this instance, so a deployment can
+// check an instance before routing traffic to it. It returns 503 Service Unavailable if a
+// benchmark fails or misses a threshold.
+func selftestHandler(w http.ResponseWriter, r *http.Request) {
+	var request SelftestRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "The self-test request is invalid.", http.StatusBadRequest)
+		return
+	}
+	if request.Iterations == 0 {
+		request.Iterations = defaultSelftestIterations
+	}
+	if request.Iterations < 0 || request.Iterations > maxSelftestIterations {
+		http.Error(w, fmt.Sprintf("iterations must be between 1 and %d.", maxSelftestIterations), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	failures := []string{}
+	response := map[string]any{}
+	scoring, points, err := benchmarkScoring(request.Iterations, now)
+	if err != nil {
+		failures = append(failures, "scoring: "+err.Error())
+	} else {
+		response["scoring"] = scoring
+		response["samplePoints"] = points
+		if request.MinScoringRate > 0 && scoring.OpsPerSecond < request.MinScoringRate {
+			failures = append(failures, fmt.Sprintf("scoring ran at %.1f/s, below %.1f/s", scoring.OpsPerSecond, request.MinScoringRate))
+		}
+		if request.MaxP99 > 0 && scoring.P99 > request.MaxP99 {
+			failures = append(failures, fmt.Sprintf("scoring p99 was %s, above %s", time.Duration(scoring.P99), time.Duration(request.MaxP99)))
+		}
+	}
+	store, err := benchmarkStore(request.Iterations, now)
+	if err != nil {
+		failures = append(failures, "store: "+err.Error())
+	} else {
+		response["store"] = store
+		if request.MinStoreRate > 0 && store.OpsPerSecond < request.MinStoreRate {
+			failures = append(failures, fmt.Sprintf("store ran at %.1f/s, below %.1f/s", store.OpsPerSecond, request.MinStoreRate))
+		}
+		if request.MaxP99 > 0 && store.P99 > request.MaxP99 {
+			failures = append(failures, fmt.Sprintf("store p99 was %s, above %s", time.Duration(store.P99), time.Duration(request.MaxP99)))
+		}
+	}
+	response["passed"] = len(failures) == 0
+	response["failures"] = failures
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
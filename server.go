@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serverOptions configure the HTTP server.
+type serverOptions struct {
+	port              string
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	// shutdownDelay is how long /readyz reports the instance as shutting down before it stops
+	// accepting connections, so load balancers take it out of rotation first.
+	shutdownDelay time.Duration
+	// shutdownTimeout is how long in-flight requests, and then queued work, are given to finish on
+	// shutdown.
+	shutdownTimeout time.Duration
+}
+
+// serverFlags defines the HTTP server flags on fs. Each defaults to its environment variable.
+func serverFlags(fs *flag.FlagSet) *serverOptions {
+	opts := &serverOptions{}
+	fs.StringVar(&opts.port, "port", orDefault(os.Getenv("PORT"), "8087"), "port the server listens on")
+	fs.DurationVar(&opts.readTimeout, "read-timeout", envDuration("READ_TIMEOUT", time.Minute), "longest time to read a request, body included (0 for no limit)")
+	fs.DurationVar(&opts.readHeaderTimeout, "read-header-timeout", envDuration("READ_HEADER_TIMEOUT", 10*time.Second), "longest time to read a request's headers")
+	fs.DurationVar(&opts.writeTimeout, "write-timeout", envDuration("WRITE_TIMEOUT", 2*time.Minute), "longest time from the end of reading a request's headers to the end of writing the response (0 for no limit)")
+	fs.DurationVar(&opts.idleTimeout, "idle-timeout", envDuration("IDLE_TIMEOUT", 2*time.Minute), "how long an idle keep-alive connection is kept open")
+	fs.IntVar(&opts.maxHeaderBytes, "max-header-bytes", envInt("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes), "largest request headers accepted, in bytes")
+	fs.DurationVar(&opts.shutdownDelay, "shutdown-delay", envDuration("SHUTDOWN_DELAY", 5*time.Second), "how long /readyz fails on SIGINT or SIGTERM before the server stops accepting connections")
+	fs.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", envDuration("SHUTDOWN_TIMEOUT", 30*time.Second), "how long in-flight requests are given to finish on SIGINT or SIGTERM")
+	return opts
+}
+
+// envDuration is the duration in the environment variable name, or fallback when it is unset. A
+// value that isn't a duration is fatal, as a flag's would be.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, value, err)
+	}
+	return parsed
+}
+
+// envInt is the integer in the environment variable name, or fallback when it is unset.
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, value, err)
+	}
+	return parsed
+}
+
+// shuttingDown is set once the server has started draining, so /readyz takes it out of rotation.
+var shuttingDown atomic.Bool
+
+// serve runs the server until SIGINT or SIGTERM. It then fails /readyz for the shutdown delay,
+// stops accepting connections and waits up to the shutdown timeout for in-flight requests to
+// finish, then for the scheduled tasks, job items and image jobs under way. Only then does it close
+// the receipt storage, so its last writes are on disk, and export the spans still queued. A second
+// signal during the drain exits at once.
+func serve(opts *serverOptions, handler http.Handler) error {
+	server := &http.Server{
+		Addr:              ":" + opts.port,
+		Handler:           handler,
+		ReadTimeout:       opts.readTimeout,
+		ReadHeaderTimeout: opts.readHeaderTimeout,
+		WriteTimeout:      opts.writeTimeout,
+		IdleTimeout:       opts.idleTimeout,
+		MaxHeaderBytes:    opts.maxHeaderBytes,
+	}
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	failed := make(chan error, 1)
+	go func() {
+		slog.Info("Server is running", "port", opts.port)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			failed <- err
+		}
+	}()
+
+	select {
+	case err := <-failed:
+		return err
+	case sig := <-stop:
+		log.Printf("Received %v; leaving rotation for %v, then draining in-flight requests and queued work for up to %v", sig, opts.shutdownDelay, opts.shutdownTimeout)
+	}
+	shuttingDown.Store(true)
+	go func() {
+		<-stop
+		log.Fatal("Received a second signal; exiting without draining")
+	}()
+
+	time.Sleep(opts.shutdownDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutting down: %v; closing the remaining connections", err)
+		server.Close()
+	}
+	if err := stopScheduledTasks(ctx); err != nil {
+		log.Printf("Stopping the scheduled tasks: %v", err)
+	}
+	if err := drainJobQueues(ctx); err != nil {
+		log.Printf("Draining the job queues: %v; their remaining items are lost", err)
+	}
+	if err := drainImageJobs(ctx); err != nil {
+		log.Printf("Draining the image jobs: %v; their remaining images are left unprocessed", err)
+	}
+	if err := closeStorage(); err != nil {
+		return err
+	}
+	stopTracing(ctx)
+	log.Println("Server stopped")
+	return nil
+}
+
+// closeStorage closes the receipt storage, if its backend holds a file or connections open.
+func closeStorage() error {
+	closer, ok := storageMigrator.(io.Closer)
+	if !ok {
+		return nil
+	}
+	if err := closer.Close(); err != nil {
+		return fmt.Errorf("closing receipt storage: %w", err)
+	}
+	return nil
+}
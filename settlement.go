@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const keyRingSettlementSigning = "settlement-signing"
+
+// Settlement summarizes a partner program's points liabilities for a calendar month, computed
+// from the ledger entries of its tenant alone, so the same file comes out every time it is
+// generated.
+type Settlement struct {
+	ProgramID string           `json:"programId"`
+	TenantID  string           `json:"tenantId"`
+	Period    string           `json:"period"`
+	From      time.Time        `json:"from"`
+	To        time.Time        `json:"to"`
+	Lines     []SettlementLine `json:"lines"`
+	// Totals maps settlement currencies to the amount owed for the period.
+	Totals  map[string]string `json:"totals"`
+	Entries int               `json:"entries"`
+}
+
+// SettlementLine totals the entries valued under one contract version. Earned, Reversed and
+// Redeemed are points; Amount is Net valued at the contract's PointValue, rounded to cents.
+type SettlementLine struct {
+	ContractVersion int    `json:"contractVersion"`
+	Currency        string `json:"currency"`
+	PointValue      string `json:"pointValue"`
+	Earned          int    `json:"earned"`
+	Reversed        int    `json:"reversed"`
+	Redeemed        int    `json:"redeemed"`
+	Net             int    `json:"net"`
+	Amount          string `json:"amount"`
+}
+
+var (
+	errUnknownProgram = errors.New("unknown partner program")
+	errInvalidPeriod  = errors.New("invalid period")
+	errPeriodOpen     = errors.New("period has not ended")
+)
+
+// initSettlementKey sets up the settlement signing key ring. A random key is used when no secret
+// is configured, so signatures made before a restart can't be checked against the keys listed
+// after it.
+func initSettlementKey(secret string) {
+	key := []byte(secret)
+	if secret == "" {
+		key = randomSecret()
+		log.Println("No settlement signing key configured; settlement signatures won't verify after a restart.")
+	}
+	newKeyRing(keyRingSettlementSigning, key, nil)
+}
+
+// settlementPrivateKey derives the Ed25519 key settlements are signed with from a ring secret.
+func settlementPrivateKey(secret []byte) ed25519.PrivateKey {
+	seed := sha256.Sum256(append([]byte("receipt-processor settlement signing\x00"), secret...))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// buildSettlement computes the settlement of program for the month starting at from. Earn and
+// reversal entries are valued under the contract their receipt was scored with, and other entries
+// under the contract in force on the day they were posted; entries with no contract are left out.
+func buildSettlement(program *PartnerProgram, period string, from time.Time) Settlement {
+	to := from.AddDate(0, 1, 0)
+	settlement := Settlement{
+		ProgramID: program.ID,
+		TenantID:  program.TenantID,
+		Period:    period,
+		From:      from,
+		To:        to,
+		Lines:     []SettlementLine{},
+		Totals:    map[string]string{},
+	}
+
+	lines := map[int]*SettlementLine{}
+	ledgerMu.Lock()
+	for _, entry := range ledger {
+		if entry.TenantID != program.TenantID || entry.CreatedAt.Before(from) || !entry.CreatedAt.Before(to) {
+			continue
+		}
+		var contract *PartnerContract
+		if entry.Contract != nil {
+			if entry.Contract.ProgramID != program.ID {
+				continue
+			}
+			contract, _ = program.contractVersion(entry.Contract.Version)
+		} else if found, ok := program.contractOn(entry.CreatedAt.Truncate(24 * time.Hour)); ok {
+			contract = found
+		}
+		if contract == nil {
+			continue
+		}
+
+		line, exists := lines[contract.Version]
+		if !exists {
+			line = &SettlementLine{ContractVersion: contract.Version, Currency: contract.SettlementCurrency, PointValue: contract.PointValue}
+			lines[contract.Version] = line
+		}
+		switch entry.Type {
+		case entryEarn:
+			line.Earned += entry.Points
+		case entryReversal:
+			line.Reversed -= entry.Points
+		default:
+			line.Redeemed -= entry.Points
+		}
+		line.Net += entry.Points
+		settlement.Entries++
+	}
+	ledgerMu.Unlock()
+
+	totals := map[string]*big.Rat{}
+	for _, line := range lines {
+		contract, _ := program.contractVersion(line.ContractVersion)
+		amount := new(big.Rat).Mul(contract.pointValue, new(big.Rat).SetInt64(int64(line.Net)))
+		line.Amount = amount.FloatString(2)
+		if totals[line.Currency] == nil {
+			totals[line.Currency] = new(big.Rat)
+		}
+		totals[line.Currency].Add(totals[line.Currency], amount)
+		settlement.Lines = append(settlement.Lines, *line)
+	}
+	sort.Slice(settlement.Lines, func(i, j int) bool {
+		return settlement.Lines[i].ContractVersion < settlement.Lines[j].ContractVersion
+	})
+	for currency, total := range totals {
+		settlement.Totals[currency] = total.FloatString(2)
+	}
+	return settlement
+}
+
+func (p *PartnerProgram) contractVersion(version int) (*PartnerContract, bool) {
+	for i := range p.Contracts {
+		if p.Contracts[i].Version == version {
+			return &p.Contracts[i], true
+		}
+	}
+	return nil, false
+}
+
+// settlementFile renders the settlement of a program for period ("2006-01") as the bytes that are
+// signed. Only ended periods can be settled, since later entries would change an open one.
+func settlementFile(programID, period string) ([]byte, error) {
+	var program *PartnerProgram
+	for _, candidate := range partnerPrograms {
+		if candidate.ID == programID {
+			program = candidate
+		}
+	}
+	if program == nil {
+		return nil, errUnknownProgram
+	}
+	from, err := time.Parse("2006-01", period)
+	if err != nil {
+		return nil, errInvalidPeriod
+	}
+	if time.Now().Before(from.AddDate(0, 1, 0)) {
+		return nil, errPeriodOpen
+	}
+	body, err := json.MarshalIndent(buildSettlement(program, period, from), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(body, '\n'), nil
+}
+
+// writeSettlementError answers a settlement request that settlementFile rejected.
+func writeSettlementError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnknownProgram):
+		http.Error(w, "No partner program found for that ID.", http.StatusNotFound)
+	case errors.Is(err, errInvalidPeriod):
+		http.Error(w, "The period must be a month, e.g. 2025-03.", http.StatusBadRequest)
+	case errors.Is(err, errPeriodOpen):
+		http.Error(w, "The period has not ended yet.", http.StatusConflict)
+	default:
+		log.Printf("Building settlement: %v", err)
+		http.Error(w, "The settlement could not be built.", http.StatusInternalServerError)
+	}
+}
+
+func getSettlementHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	body, err := settlementFile(vars["id"], vars["period"])
+	if err != nil {
+		writeSettlementError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="settlement-`+vars["id"]+"-"+vars["period"]+`.json"`)
+	w.Write(body)
+}
+
+// getSettlementSignatureHandler returns the detached Ed25519 signature of the settlement file,
+// made with the current settlement signing key.
+func getSettlementSignatureHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	body, err := settlementFile(vars["id"], vars["period"])
+	if err != nil {
+		writeSettlementError(w, err)
+		return
+	}
+	key, _ := keyRings[keyRingSettlementSigning].currentKey()
+	signature := ed25519.Sign(settlementPrivateKey(key.secret), body)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="settlement-`+vars["id"]+"-"+vars["period"]+`.json.sig"`)
+	json.NewEncoder(w).Encode(map[string]string{
+		"keyId":     key.ID,
+		"algorithm": "Ed25519",
+		"signature": base64.StdEncoding.EncodeToString(signature),
+	})
+}
+
+// listSettlementKeysHandler publishes the public keys settlement signatures can be verified with.
+func listSettlementKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := []map[string]any{}
+	now := time.Now()
+	for _, key := range keyRings[keyRingSettlementSigning].list() {
+		if key.RetiresAt != nil && !now.Before(*key.RetiresAt) {
+			continue
+		}
+		public := settlementPrivateKey(key.secret).Public().(ed25519.PublicKey)
+		keys = append(keys, map[string]any{
+			"id":        key.ID,
+			"createdAt": key.CreatedAt,
+			"retiresAt": key.RetiresAt,
+			"publicKey": base64.StdEncoding.EncodeToString(public),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
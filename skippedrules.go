@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Validation modes. Strict rejects receipts with a total, time or item price that isn't in the
+// API's format; lenient accepts them, scoring them with the rules that don't need those fields
+// and warning about the rules it had to skip.
+const (
+	validationStrict  = "strict"
+	validationLenient = "lenient"
+)
+
+var validationMode = validationStrict
+
+// lenientIssue reports whether an error of the issue only keeps some rules from applying, so it is
+// a warning in lenient mode.
+func lenientIssue(issue ValidationIssue) bool {
+	if issue.Code != "format" {
+		return false
+	}
+	return issue.Field == "total" || issue.Field == "purchaseTime" ||
+		strings.HasPrefix(issue.Field, "items[") && strings.HasSuffix(issue.Field, "].price")
+}
+
+// RuleWarning is a rule that couldn't be evaluated on a receipt, and why. Item is the index of the
+// item it was skipped for, for rules applied per item.
+type RuleWarning struct {
+	Rule   string `json:"rule"`
+	Item   *int   `json:"item,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// skippedRules lists the rules of cfg that couldn't be evaluated on the receipt because a field
+// they need is missing or doesn't parse, and so awarded nothing whatever the receipt.
+func skippedRules(cfg RulesConfig, receipt Receipt) []RuleWarning {
+	var warnings []RuleWarning
+	skip := func(rule string, item *int, reason string) {
+		warnings = append(warnings, RuleWarning{Rule: rule, Item: item, Reason: reason})
+	}
+
+	totalReason := ""
+	if _, ok := receiptTotal(receipt); !ok {
+		totalReason = unusableReason("total", receipt.Total, "an amount with two decimals")
+	}
+	var priceReasons []string
+	for _, item := range receipt.Items {
+		reason := ""
+		if _, err := parseMoney(item.Price); err != nil {
+			reason = unusableReason("item price", item.Price, "an amount with two decimals")
+		}
+		priceReasons = append(priceReasons, reason)
+	}
+	perItem := func(rule string) {
+		for i, reason := range priceReasons {
+			if reason != "" {
+				skip(rule, &i, reason)
+			}
+		}
+	}
+
+	for _, rule := range cfg.BaseRules {
+		if rule.Disabled {
+			continue
+		}
+		switch rule.Type {
+		case baseRoundTotal, baseTotalMultiple:
+			if totalReason != "" {
+				skip(rule.Name, nil, totalReason)
+			}
+		case baseItemDescription:
+			perItem(rule.Name)
+		}
+	}
+	for _, rules := range [][]ItemPriceRule{cfg.ItemPriceRules, cfg.BigTicketRules} {
+		for _, rule := range rules {
+			if !rule.Disabled {
+				perItem(rule.Name)
+			}
+		}
+	}
+	if _, err := time.Parse("15:04", receipt.PurchaseTime); err != nil {
+		reason := unusableReason("purchase time", receipt.PurchaseTime, "a 24-hour HH:MM time")
+		for _, window := range cfg.TimeWindows {
+			if !window.Disabled {
+				skip(window.Name, nil, reason)
+			}
+		}
+	}
+	return warnings
+}
+
+func unusableReason(field, value, format string) string {
+	if value == "" {
+		return "the " + field + " is missing"
+	}
+	return fmt.Sprintf("the %s %q isn't %s", field, value, format)
+}
+
+// receiptSkippedRules lists the rules skipped when processed was scored, by the rule set it was
+// scored with. Receipts that weren't scored skipped none.
+func receiptSkippedRules(processed ProcessedReceipt) []RuleWarning {
+	if processed.Status != statusScored {
+		return nil
+	}
+	cfg, ok := rulesAt(processed.RulesVersion)
+	if !ok {
+		return nil
+	}
+	return skippedRules(cfg, processed.Receipt)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// receiptStatsLine is what a receipt currently counts for in its tenant's stats: a scored receipt
+// that isn't deleted counts its points towards the tenant's totals, its retailer, the day it was
+// processed and its user.
+type receiptStatsLine struct {
+	tenantID string
+	userID   string
+	retailer string
+	day      string
+	points   int
+}
+
+// retailerStats totals the receipts of one retailer.
+type retailerStats struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+}
+
+// leaderboardEntry is a user's place on their tenant's leaderboard.
+type leaderboardEntry struct {
+	Rank     int    `json:"rank"`
+	UserID   string `json:"userId"`
+	Points   int    `json:"points"`
+	Receipts int    `json:"receipts"`
+}
+
+// tenantStats aggregates a tenant's counted receipts. ranking holds the users with receipts,
+// most points first and then by user ID, and is kept in order as receipts change, so the
+// leaderboard is read without sorting.
+type tenantStats struct {
+	receipts  int
+	points    int
+	retailers map[string]*retailerStats
+	days      map[string]int
+	users     map[string]*leaderboardEntry
+	ranking   []string
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = map[string]*tenantStats{}
+	// receiptStats is what each receipt is currently counted for.
+	receiptStats = map[string]receiptStatsLine{}
+)
+
+// statsLine returns what receipt counts for, if anything.
+func statsLine(receipt ProcessedReceipt) (receiptStatsLine, bool) {
+	if receipt.Status != statusScored || receipt.DeletedAt != nil {
+		return receiptStatsLine{}, false
+	}
+	return receiptStatsLine{
+		tenantID: receipt.TenantID,
+		userID:   receipt.Receipt.UserID,
+		retailer: strings.TrimSpace(receipt.Receipt.Retailer),
+		day:      receipt.ProcessedAt.UTC().Format("2006-01-02"),
+		points:   receipt.Points,
+	}, true
+}
+
+// trackReceiptStats brings the stats in line with what receipt counts for now, taking back what
+// it counted for before. Each change costs the receipt's own lines, not a pass over the receipts.
+func trackReceiptStats(receipt ProcessedReceipt) {
+	line, counted := statsLine(receipt)
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	previous, tracked := receiptStats[receipt.ID]
+	if tracked == counted && previous == line {
+		return
+	}
+	if tracked {
+		addStatsLocked(previous, -1)
+		delete(receiptStats, receipt.ID)
+	}
+	if counted {
+		addStatsLocked(line, 1)
+		receiptStats[receipt.ID] = line
+	}
+}
+
+// forgetReceiptStats takes a removed receipt out of the stats.
+func forgetReceiptStats(id string) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if previous, tracked := receiptStats[id]; tracked {
+		addStatsLocked(previous, -1)
+		delete(receiptStats, id)
+	}
+}
+
+// addStatsLocked adds a receipt's line to its tenant's stats, sign 1, or takes it back, sign -1.
+// statsMu must be held.
+func addStatsLocked(line receiptStatsLine, sign int) {
+	tenant := stats[line.tenantID]
+	if tenant == nil {
+		tenant = &tenantStats{
+			retailers: map[string]*retailerStats{},
+			days:      map[string]int{},
+			users:     map[string]*leaderboardEntry{},
+		}
+		stats[line.tenantID] = tenant
+	}
+	tenant.receipts += sign
+	tenant.points += sign * line.points
+
+	if line.retailer != "" {
+		key := strings.ToLower(line.retailer)
+		retailer := tenant.retailers[key]
+		if retailer == nil {
+			retailer = &retailerStats{Retailer: line.retailer}
+			tenant.retailers[key] = retailer
+		}
+		retailer.Receipts += sign
+		retailer.Points += sign * line.points
+		if retailer.Receipts == 0 {
+			delete(tenant.retailers, key)
+		}
+	}
+
+	if tenant.days[line.day] += sign; tenant.days[line.day] == 0 {
+		delete(tenant.days, line.day)
+	}
+
+	if line.userID != "" {
+		tenant.moveUser(line.userID, sign, sign*line.points)
+	}
+}
+
+// moveUser changes a user's receipts and points and moves them to their new place in the
+// ranking.
+func (t *tenantStats) moveUser(userID string, receipts, points int) {
+	user := t.users[userID]
+	if user == nil {
+		user = &leaderboardEntry{UserID: userID}
+		t.users[userID] = user
+	} else if i, found := t.rankOf(user); found {
+		t.ranking = slices.Delete(t.ranking, i, i+1)
+	}
+	user.Receipts += receipts
+	user.Points += points
+	if user.Receipts == 0 {
+		delete(t.users, userID)
+		return
+	}
+	i, _ := t.rankOf(user)
+	t.ranking = slices.Insert(t.ranking, i, userID)
+}
+
+// rankOf finds the index of user in the ranking, or where they belong in it.
+func (t *tenantStats) rankOf(user *leaderboardEntry) (int, bool) {
+	return slices.BinarySearchFunc(t.ranking, user, func(userID string, target *leaderboardEntry) int {
+		other := t.users[userID]
+		if c := cmp.Compare(target.Points, other.Points); c != 0 {
+			return c
+		}
+		return cmp.Compare(other.UserID, target.UserID)
+	})
+}
+
+// startStats keeps the stats in step with receipt lifecycle events.
+func startStats() {
+	subscribe(func(event Event) {
+		switch event.Type {
+		case eventReceiptProcessed, eventReceiptApproved, eventReceiptReprocessed,
+			eventReceiptRejected, eventReceiptDeleted, eventReceiptRestored:
+		default:
+			return
+		}
+		if receipt, exists := getReceipt(event.ReceiptID); exists {
+			trackReceiptStats(receipt)
+		} else {
+			forgetReceiptStats(event.ReceiptID)
+		}
+	})
+}
+
+// indexReceiptStats counts the stored receipts into the stats at startup, after which events keep
+// them up to date. Archived receipts keep only their outcome, so they count towards every total
+// but their retailer's.
+func indexReceiptStats() {
+	for _, store := range []ReceiptStore{receiptStore, sandboxStore} {
+		for _, receipt := range listStore(store) {
+			trackReceiptStats(openIdentifiers(receipt))
+		}
+	}
+}
+
+// statsHandler returns the tenant's aggregate stats: the receipts scored and their points, in
+// total, by retailer, most points first, and the receipts processed per day, oldest first.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	tenantID := tenantFromRequest(r)
+	retailers := []retailerStats{}
+	type dayStats struct {
+		Date     string `json:"date"`
+		Receipts int    `json:"receipts"`
+	}
+	days := []dayStats{}
+	var receipts, points int
+
+	statsMu.Lock()
+	if tenant := stats[tenantID]; tenant != nil {
+		receipts, points = tenant.receipts, tenant.points
+		for _, retailer := range tenant.retailers {
+			retailers = append(retailers, *retailer)
+		}
+		for day, n := range tenant.days {
+			days = append(days, dayStats{day, n})
+		}
+	}
+	statsMu.Unlock()
+
+	slices.SortFunc(retailers, func(a, b retailerStats) int {
+		return cmp.Or(cmp.Compare(b.Points, a.Points), cmp.Compare(a.Retailer, b.Retailer))
+	})
+	slices.SortFunc(days, func(a, b dayStats) int { return cmp.Compare(a.Date, b.Date) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"tenantId":   tenantID,
+		"receipts":   receipts,
+		"points":     points,
+		"byRetailer": retailers,
+		"byDay":      days,
+	})
+}
+
+// leaderboardHandler returns a page of the tenant's users ranked by the points of their scored
+// receipts. Users with the same points are ranked by user ID.
+func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	tenantID := tenantFromRequest(r)
+	query := r.URL.Query()
+	cursor, err := parseNonNegative(query.Get("cursor"), 0)
+	if err != nil {
+		http.Error(w, "The cursor is invalid.", http.StatusBadRequest)
+		return
+	}
+	limit, err := parseNonNegative(query.Get("limit"), defaultResultsLimit)
+	if err != nil || limit == 0 {
+		http.Error(w, "The limit is invalid.", http.StatusBadRequest)
+		return
+	}
+
+	leaders := []leaderboardEntry{}
+	statsMu.Lock()
+	if tenant := stats[tenantID]; tenant != nil && cursor < len(tenant.ranking) {
+		for i, userID := range tenant.ranking[cursor:min(cursor+limit, len(tenant.ranking))] {
+			entry := *tenant.users[userID]
+			entry.Rank = cursor + i + 1
+			leaders = append(leaders, entry)
+		}
+	}
+	statsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"tenantId":   tenantID,
+		"leaders":    leaders,
+		"nextCursor": strconv.Itoa(cursor + len(leaders)),
+	})
+}
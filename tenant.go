@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultTenant = "default"
+
+// TenantConfig holds per-tenant settings. IDPrefix namespaces the tenant's receipt IDs (e.g.
+// "acme_3f2c...") so they can be attributed across systems; receipts in a namespace can only be
+// looked up by their own tenant. Region is where the tenant trades, for campaign targeting, and
+// Locale the language its receipts are in when they don't say, for item dictionaries. Sandbox
+// tenants are for partner onboarding; see sandbox.go.
+type TenantConfig struct {
+	ID       string `json:"id"`
+	IDPrefix string `json:"idPrefix,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Locale   string `json:"locale,omitempty"`
+	Sandbox  bool   `json:"sandbox,omitempty"`
+	// DataTTL is how long a sandbox tenant's receipts are kept, defaultSandboxTTL when unset.
+	DataTTL duration `json:"dataTtl,omitempty"`
+	// MaxConcurrency limits the tenant's job items in progress per priority, overriding
+	// tenantJobConcurrency.
+	MaxConcurrency int `json:"maxConcurrency,omitempty"`
+	// ArchiveAfter overrides archiveAfter for the tenant's receipts.
+	ArchiveAfter duration `json:"archiveAfter,omitempty"`
+}
+
+var idPrefixPattern = regexp.MustCompile(`^[a-z][a-z0-9]{1,15}$`)
+
+// reservedIDPrefixes can't be used as namespaces since their vanity paths would shadow API routes.
+// They are the first segments of the router's paths; see reserveRouteSegments.
+var reservedIDPrefixes []string
+
+var (
+	tenantsMu sync.RWMutex
+	tenants   = map[string]TenantConfig{}
+)
+
+type tenantKey struct{}
+
+// tenantFromRequest identifies the tenant a request is made on behalf of, as resolveTenants
+// authenticated it. Requests without credentials belong to the default tenant.
+func tenantFromRequest(r *http.Request) string {
+	if tenant, ok := r.Context().Value(tenantKey{}).(string); ok {
+		return tenant
+	}
+	return defaultTenant
+}
+
+// credentialTenants returns the tenants the request's valid credentials are bound to: an API key's
+// tenantId, a submission token's or registered device's tenant, and a user token's tenant claim.
+// anyTenant reports a credential that may act for every tenant: the admin token or an API key
+// without a tenantId. Invalid credentials are left to the routes that check them.
+func credentialTenants(r *http.Request) (bound []string, anyTenant bool) {
+	if presented := r.Header.Get("X-API-Key"); presented != "" {
+		if key, ok := apiKeys[sha256.Sum256([]byte(presented))]; ok && !key.Disabled {
+			if key.TenantID == "" {
+				anyTenant = true
+			} else {
+				bound = append(bound, key.TenantID)
+			}
+		}
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		switch {
+		case strings.HasPrefix(token, submissionTokenPrefix):
+			if claims, err := parseSubmissionToken(strings.TrimPrefix(token, submissionTokenPrefix)); err == nil {
+				bound = append(bound, claims.TenantID)
+			}
+		case hasAdminToken(r):
+			anyTenant = true
+		case userTokens != nil:
+			if claims, err := userTokens.verify(token, time.Now()); err == nil && claims.Tenant != "" {
+				bound = append(bound, claims.Tenant)
+			}
+		}
+	}
+	if deviceID, tenantID, err := deviceFromRequest(r); err == nil && deviceID != "" {
+		bound = append(bound, tenantID)
+	}
+	slices.Sort(bound)
+	return slices.Compact(bound), anyTenant
+}
+
+// resolveTenants authenticates the tenant each request is made on behalf of. A credential bound to
+// a tenant decides it, and an X-Tenant-ID header or vanity path naming another one is 403.
+// Credentials for every tenant may pick one with the header; without credentials, requests can
+// only be made for the default tenant.
+func resolveTenants(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested := r.Header.Get("X-Tenant-ID")
+		bound, anyTenant := credentialTenants(r)
+		tenant := defaultTenant
+		switch {
+		case len(bound) > 1:
+			http.Error(w, "The credentials are for different tenants.", http.StatusForbidden)
+			return
+		case len(bound) == 1:
+			if requested != "" && requested != bound[0] {
+				http.Error(w, "The credentials are not valid for this tenant.", http.StatusForbidden)
+				return
+			}
+			tenant = bound[0]
+		case requested == "":
+		case anyTenant:
+			tenant = requested
+		case requested != defaultTenant:
+			http.Error(w, "Credentials for the tenant are required.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+	})
+}
+
+// reserveRouteSegments reserves the first segment of each of router's paths, so no tenant's
+// vanity path shadows a route, including routes added later.
+func reserveRouteSegments(router *mux.Router) error {
+	reserved := map[string]bool{}
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		segment, _, _ := strings.Cut(strings.TrimPrefix(template, "/"), "/")
+		if segment != "" && !strings.HasPrefix(segment, "{") {
+			reserved[segment] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	reservedIDPrefixes = slices.Sorted(maps.Keys(reserved))
+	return nil
+}
+
+func tenantIDPrefix(tenantID string) string {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	return tenants[tenantID].IDPrefix
+}
+
+func tenantRegion(tenantID string) string {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	return tenants[tenantID].Region
+}
+
+func tenantLocale(tenantID string) string {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	return tenants[tenantID].Locale
+}
+
+// newReceiptID returns a receipt ID in the tenant's namespace, if it has one.
+func newReceiptID(tenantID string, id string) string {
+	if prefix := tenantIDPrefix(tenantID); prefix != "" {
+		return prefix + "_" + id
+	}
+	return id
+}
+
+// tenantCanAccess reports whether the request's tenant may see receipt. Receipts created without
+// a namespace stay visible to everyone, as before namespaces existed.
+func tenantCanAccess(r *http.Request, receipt ProcessedReceipt) bool {
+	return !strings.Contains(receipt.ID, "_") || receipt.TenantID == tenantFromRequest(r)
+}
+
+// lookupTenantReceipt looks up a receipt on behalf of the request's tenant, as lookupReceipt.
+// Deleted receipts are not found.
+func lookupTenantReceipt(r *http.Request, id string) (ProcessedReceipt, error) {
+	_, span := startSpan(r.Context(), "storage.get")
+	span.set("receipt.id", id)
+	receipt, err := lookupReceipt(id)
+	if !errors.Is(err, errReceiptNotFound) {
+		span.fail(err)
+	}
+	span.End()
+	if err != nil {
+		return ProcessedReceipt{}, err
+	}
+	if receipt.DeletedAt != nil || !tenantCanAccess(r, receipt) || !userCanAccess(r, receipt) {
+		return ProcessedReceipt{}, errReceiptNotFound
+	}
+	return receipt, nil
+}
+
+// getTenantReceipt looks up a receipt on behalf of the request's tenant. Deleted receipts, and
+// archived ones until they are retrieved, are not found.
+func getTenantReceipt(r *http.Request, id string) (ProcessedReceipt, bool) {
+	receipt, err := lookupTenantReceipt(r, id)
+	return receipt, err == nil
+}
+
+// tenantVanityPaths serves /{idPrefix}/... as the same route without the prefix, for the tenant
+// owning that namespace as if it was named by X-Tenant-ID, so the request's credentials must be
+// valid for it.
+func tenantVanityPaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segment, rest, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if found {
+			tenantsMu.RLock()
+			var tenantID string
+			for _, tenant := range tenants {
+				if tenant.IDPrefix == segment {
+					tenantID = tenant.ID
+				}
+			}
+			tenantsMu.RUnlock()
+			if tenantID != "" {
+				r = r.Clone(r.Context())
+				r.URL.Path = "/" + rest
+				r.URL.RawPath = ""
+				r.Header.Set("X-Tenant-ID", tenantID)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func listTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	tenantsMu.RLock()
+	list := make([]TenantConfig, 0, len(tenants))
+	for _, tenant := range tenants {
+		list = append(list, tenant)
+	}
+	tenantsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"tenants": list})
+}
+
+// putTenantHandler creates or replaces a tenant's settings. Changing a tenant's IDPrefix only
+// affects receipts submitted afterwards.
+func putTenantHandler(w http.ResponseWriter, r *http.Request) {
+	var tenant TenantConfig
+	if err := json.NewDecoder(r.Body).Decode(&tenant); err != nil {
+		http.Error(w, "The tenant is invalid.", http.StatusBadRequest)
+		return
+	}
+	tenant.ID = mux.Vars(r)["id"]
+	if tenant.IDPrefix != "" && !idPrefixPattern.MatchString(tenant.IDPrefix) {
+		http.Error(w, "The ID prefix must be 2 to 16 lowercase letters and digits, starting with a letter.", http.StatusBadRequest)
+		return
+	}
+	if slices.Contains(reservedIDPrefixes, tenant.IDPrefix) {
+		http.Error(w, "That ID prefix is reserved.", http.StatusBadRequest)
+		return
+	}
+	if tenant.ArchiveAfter < 0 {
+		http.Error(w, "archiveAfter can't be negative.", http.StatusBadRequest)
+		return
+	}
+	if tenant.MaxConcurrency < 0 {
+		http.Error(w, "maxConcurrency can't be negative.", http.StatusBadRequest)
+		return
+	}
+	if tenant.DataTTL < 0 || tenant.DataTTL != 0 && !tenant.Sandbox {
+		http.Error(w, "dataTtl must be positive and is only for sandbox tenants.", http.StatusBadRequest)
+		return
+	}
+
+	tenantsMu.Lock()
+	for _, other := range tenants {
+		if tenant.IDPrefix != "" && other.ID != tenant.ID && other.IDPrefix == tenant.IDPrefix {
+			tenantsMu.Unlock()
+			http.Error(w, "That ID prefix belongs to another tenant.", http.StatusConflict)
+			return
+		}
+	}
+	tenants[tenant.ID] = tenant
+	tenantsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tenant)
+}
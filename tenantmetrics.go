@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// tenantMetricsDays is how many days of daily usage are kept per tenant.
+const tenantMetricsDays = 31
+
+// latencyBuckets are the upper bounds of the request latency histogram.
+var latencyBuckets = [...]time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+	2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// TenantUsage counts a tenant's API usage, for chargeback and per-tenant SLO reporting. Client
+// errors are 4xx responses and server errors 5xx ones. SkippedRules counts the rules skipped on
+// scored receipts for want of a field they could read.
+type TenantUsage struct {
+	Requests      int64            `json:"requests"`
+	ClientErrors  int64            `json:"clientErrors"`
+	ServerErrors  int64            `json:"serverErrors"`
+	Receipts      int64            `json:"receipts"`
+	Scored        int64            `json:"scored"`
+	Ineligible    int64            `json:"ineligible"`
+	PendingReview int64            `json:"pendingReview"`
+	Points        int64            `json:"points"`
+	SkippedRules  int64            `json:"skippedRules"`
+	Latency       latencyHistogram `json:"latency"`
+}
+
+// latencyHistogram counts requests by latency bucket; the last count is of requests slower than
+// every bucket.
+type latencyHistogram struct {
+	counts [len(latencyBuckets) + 1]int64
+	total  time.Duration
+}
+
+func (h *latencyHistogram) observe(latency time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return latency <= latencyBuckets[i] })
+	h.counts[i]++
+	h.total += latency
+}
+
+// quantile estimates the latency under which q of the requests completed, as the upper bound of
+// the bucket it falls in. Requests slower than every bucket count as the last bound.
+func (h *latencyHistogram) quantile(q float64, count int64) time.Duration {
+	rank := int64(q*float64(count-1)) + 1
+	var seen int64
+	for i, n := range h.counts[:len(latencyBuckets)] {
+		if seen += n; seen >= rank {
+			return latencyBuckets[i]
+		}
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+func (h latencyHistogram) MarshalJSON() ([]byte, error) {
+	var count int64
+	for _, n := range h.counts {
+		count += n
+	}
+	view := map[string]any{"count": count}
+	if count > 0 {
+		view["mean"] = (h.total / time.Duration(count)).String()
+		view["p50"] = h.quantile(0.5, count).String()
+		view["p90"] = h.quantile(0.9, count).String()
+		view["p99"] = h.quantile(0.99, count).String()
+		buckets := make(map[string]int64, len(h.counts))
+		for i, bound := range latencyBuckets {
+			buckets["le "+bound.String()] = h.counts[i]
+		}
+		buckets["gt "+latencyBuckets[len(latencyBuckets)-1].String()] = h.counts[len(latencyBuckets)]
+		view["buckets"] = buckets
+	}
+	return json.Marshal(view)
+}
+
+// tenantMetricsEntry is a tenant's usage since startup and per UTC day.
+type tenantMetricsEntry struct {
+	total TenantUsage
+	daily map[string]*TenantUsage
+}
+
+var (
+	tenantMetricsMu sync.Mutex
+	tenantMetrics   = map[string]*tenantMetricsEntry{}
+	metricsSince    = time.Now().UTC()
+)
+
+// updateTenantUsage applies fn to the tenant's usage since startup and on today's date.
+func updateTenantUsage(tenantID string, fn func(*TenantUsage)) {
+	day := time.Now().UTC().Format("2006-01-02")
+	tenantMetricsMu.Lock()
+	defer tenantMetricsMu.Unlock()
+	entry, exists := tenantMetrics[tenantID]
+	if !exists {
+		entry = &tenantMetricsEntry{daily: map[string]*TenantUsage{}}
+		tenantMetrics[tenantID] = entry
+	}
+	usage, exists := entry.daily[day]
+	if !exists {
+		usage = &TenantUsage{}
+		entry.daily[day] = usage
+		// Dates sort as strings; drop the oldest beyond the kept days.
+		if len(entry.daily) > tenantMetricsDays {
+			days := make([]string, 0, len(entry.daily))
+			for d := range entry.daily {
+				days = append(days, d)
+			}
+			sort.Strings(days)
+			for _, d := range days[:len(days)-tenantMetricsDays] {
+				delete(entry.daily, d)
+			}
+		}
+	}
+	fn(&entry.total)
+	fn(usage)
+}
+
+// recordTenantReceipt counts a newly stored receipt and the points it earned.
+func recordTenantReceipt(processed ProcessedReceipt) {
+	skipped := receiptSkippedRules(processed)
+	updateTenantUsage(processed.TenantID, func(u *TenantUsage) {
+		u.Receipts++
+		switch processed.Status {
+		case statusScored:
+			u.Scored++
+			u.Points += int64(processed.Points)
+			u.SkippedRules += int64(len(skipped))
+		case statusIneligible:
+			u.Ineligible++
+		case statusPendingReview:
+			u.PendingReview++
+		}
+	})
+}
+
+// statusRecorder captures the status code a handler responds with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+// Flush lets long-polling and streaming handlers flush through the recorder.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// countTenantRequests counts the API requests of each tenant, with their errors and latency.
+// Admin requests are the operators', not the tenant's, and aren't counted, nor are health
+// probes or metrics scrapes.
+func countTenantRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tenantID := tenantFromRequest(r)
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		latency := time.Since(start)
+		updateTenantUsage(tenantID, func(u *TenantUsage) {
+			u.Requests++
+			switch {
+			case recorder.status >= 500:
+				u.ServerErrors++
+			case recorder.status >= 400:
+				u.ClientErrors++
+			}
+			u.Latency.observe(latency)
+		})
+	})
+}
+
+// tenantMetricsHandler returns a tenant's usage since the instance started and for each of the
+// last days it was used on.
+func tenantMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	tenantID := mux.Vars(r)["id"]
+	tenantMetricsMu.Lock()
+	view := map[string]any{"tenantId": tenantID, "since": metricsSince, "total": TenantUsage{}, "daily": []any{}}
+	if entry, exists := tenantMetrics[tenantID]; exists {
+		days := make([]string, 0, len(entry.daily))
+		for day := range entry.daily {
+			days = append(days, day)
+		}
+		sort.Strings(days)
+		daily := make([]any, 0, len(days))
+		for _, day := range days {
+			daily = append(daily, map[string]any{"date": day, "usage": *entry.daily[day]})
+		}
+		view["total"], view["daily"] = entry.total, daily
+	}
+	tenantMetricsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
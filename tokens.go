@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	keyRingSubmissionTokens = "submission-tokens"
+
+	submissionTokenPrefix = "st_"
+	scopeSubmit           = "receipts:submit"
+	maxSubmissionTokenTTL = time.Hour
+)
+
+var errInvalidSubmissionToken = errors.New("invalid or expired submission token")
+
+// SubmissionClaims are carried by a submission token: short-lived, submit-only credentials for a
+// single tenant, so kiosks never hold long-lived secrets. Tokens are signed rather than stored;
+// rotating the submission-tokens key ring with no grace period revokes every outstanding token.
+type SubmissionClaims struct {
+	TenantID  string `json:"tenant"`
+	DeviceID  string `json:"device,omitempty"`
+	Scope     string `json:"scope"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func signSubmissionToken(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func issueSubmissionToken(claims SubmissionClaims) string {
+	data, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return submissionTokenPrefix + payload + "." + signSubmissionToken(keyRings[keyRingSubmissionTokens].current(), payload)
+}
+
+func parseSubmissionToken(token string) (SubmissionClaims, error) {
+	payload, signature, ok := strings.Cut(strings.TrimPrefix(token, submissionTokenPrefix), ".")
+	if !ok {
+		return SubmissionClaims{}, errInvalidSubmissionToken
+	}
+	valid := false
+	for _, key := range keyRings[keyRingSubmissionTokens].accepted() {
+		if hmac.Equal([]byte(signature), []byte(signSubmissionToken(key, payload))) {
+			valid = true
+		}
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	var claims SubmissionClaims
+	if !valid || err != nil || json.Unmarshal(data, &claims) != nil ||
+		claims.Scope != scopeSubmit || time.Now().Unix() > claims.ExpiresAt {
+		return SubmissionClaims{}, errInvalidSubmissionToken
+	}
+	return claims, nil
+}
+
+// submitterFromRequest identifies who is submitting a receipt: a kiosk with a submission token, a
+// device with its API key, or another client, on behalf of the tenant its credentials are for.
+func submitterFromRequest(r *http.Request) (deviceID, tenantID string, err error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "+submissionTokenPrefix); ok {
+		claims, err := parseSubmissionToken(token)
+		if err != nil {
+			return "", "", err
+		}
+		return claims.DeviceID, claims.TenantID, nil
+	}
+	deviceID, tenantID, err = deviceFromRequest(r)
+	if err != nil || deviceID != "" {
+		return deviceID, tenantID, err
+	}
+	return "", tenantFromRequest(r), nil
+}
+
+// createSubmissionTokenHandler exchanges the admin credential for a submission token.
+func createSubmissionTokenHandler(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		TenantID string   `json:"tenantId"`
+		DeviceID string   `json:"deviceId"`
+		TTL      duration `json:"ttl"`
+	}{TTL: duration(maxSubmissionTokenTTL)}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.TenantID == "" {
+		http.Error(w, "A submission token needs a tenantId.", http.StatusBadRequest)
+		return
+	}
+	if request.TTL <= 0 || time.Duration(request.TTL) > maxSubmissionTokenTTL {
+		http.Error(w, "The ttl must be positive and at most 1h.", http.StatusBadRequest)
+		return
+	}
+	if request.DeviceID != "" {
+		devicesMu.RLock()
+		device, exists := devices[request.DeviceID]
+		var tenant string
+		if exists {
+			tenant = device.TenantID
+		}
+		devicesMu.RUnlock()
+		if !exists {
+			http.Error(w, "No device found for that ID.", http.StatusNotFound)
+			return
+		}
+		if tenant != request.TenantID {
+			http.Error(w, "The device belongs to another tenant.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	expiresAt := time.Now().Add(time.Duration(request.TTL)).UTC()
+	claims := SubmissionClaims{TenantID: request.TenantID, DeviceID: request.DeviceID, Scope: scopeSubmit, ExpiresAt: expiresAt.Unix()}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"token":     issueSubmissionToken(claims),
+		"tenantId":  claims.TenantID,
+		"deviceId":  claims.DeviceID,
+		"scope":     claims.Scope,
+		"expiresAt": expiresAt,
+	})
+}
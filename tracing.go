@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	mathrand "math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+)
+
+// tracingOptions configure trace export.
+type tracingOptions struct {
+	// endpoint is the OTLP/HTTP collector spans are exported to, e.g. http://localhost:4318.
+	// Tracing is off when it is empty.
+	endpoint    string
+	headers     string
+	serviceName string
+	sampleRatio float64
+}
+
+// tracingFlags defines the tracing flags on fs, defaulting to the standard OpenTelemetry
+// environment variables.
+func tracingFlags(fs *flag.FlagSet) *tracingOptions {
+	opts := &tracingOptions{}
+	fs.StringVar(&opts.endpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector spans are exported to, e.g. http://localhost:4318 (tracing is off when empty)")
+	fs.StringVar(&opts.headers, "otlp-headers", os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), "headers sent with the exported spans, as key=value pairs separated by commas")
+	fs.StringVar(&opts.serviceName, "service-name", orDefault(os.Getenv("OTEL_SERVICE_NAME"), "receipt-processor"), "service name the spans are exported under")
+	fs.Float64Var(&opts.sampleRatio, "trace-sample-ratio", envFloat("TRACE_SAMPLE_RATIO", 1), "share of the traces started here that are exported, from 0 to 1; traces continued from a traceparent follow its sampled flag")
+	return opts
+}
+
+// envFloat is the number in the environment variable name, or fallback when it is unset.
+func envFloat(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, value, err)
+	}
+	return parsed
+}
+
+// spanContext identifies a span within its trace, as carried by a traceparent header.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent reads a W3C traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01. Headers of a later version are read as
+// version 00, as the spec asks.
+func parseTraceparent(header string) (spanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return spanContext{}, false
+	}
+	var sc spanContext
+	var flags [1]byte
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return spanContext{}, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return spanContext{}, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return spanContext{}, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return spanContext{}, false
+	}
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return spanContext{}, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// span is an operation of a trace. A nil span, as started while tracing is off, records nothing,
+// so callers don't need to check.
+type span struct {
+	spanContext
+	parentID   [8]byte
+	name       string
+	kind       int
+	start, end time.Time
+	attributes map[string]any
+	errMessage string
+}
+
+type spanContextKey struct{}
+
+// startSpan starts a span named name as a child of the span in ctx, or of no span, and returns a
+// context carrying it. The span is exported when it is ended, if its trace is sampled.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if spanExporter == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: spanKindInternal, start: time.Now(), attributes: map[string]any{}}
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = mathrand.Float64() < spanExporter.sampleRatio
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s.spanContext), s
+}
+
+// set records an attribute of the span: a string, bool, int or float64.
+func (s *span) set(key string, value any) {
+	if s != nil {
+		s.attributes[key] = value
+	}
+}
+
+// fail marks the span as failed with err, if err isn't nil.
+func (s *span) fail(err error) {
+	if s != nil && err != nil {
+		s.errMessage = err.Error()
+	}
+}
+
+// End ends the span and queues it for export.
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if s.sampled {
+		spanExporter.queue(s)
+	}
+}
+
+// traceRequests starts a server span for every request, continuing the trace of its traceparent
+// header if it has one. It is router middleware, so spans are named after the route template.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if spanExporter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		ctx := r.Context()
+		if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanContextKey{}, parent)
+		}
+		ctx, s := startSpan(ctx, r.Method+" "+route)
+		s.kind = spanKindServer
+		s.set("http.request.method", r.Method)
+		s.set("http.route", route)
+		s.set("url.path", r.URL.Path)
+		s.set("request.id", requestIDFrom(ctx))
+		if tenantID := tenantFromRequest(r); tenantID != "" {
+			s.set("tenant.id", tenantID)
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			s.set("http.response.status_code", recorder.status)
+			if recorder.status >= 500 {
+				s.errMessage = http.StatusText(recorder.status)
+			}
+			s.End()
+		}()
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+	})
+}
+
+// otlpExporter batches ended spans and posts them to an OTLP/HTTP collector, in the OTLP JSON
+// encoding. Spans ended while the queue is full are dropped rather than holding up requests.
+type otlpExporter struct {
+	url         string
+	headers     map[string]string
+	serviceName string
+	sampleRatio float64
+	client      *http.Client
+	spans       chan *span
+	flush       chan chan struct{}
+}
+
+// Export batching: spans are posted once a batch is full or when the interval has passed.
+const (
+	spanBatchSize     = 512
+	spanFlushInterval = 5 * time.Second
+)
+
+// spanExporter exports the spans, nil while tracing is off.
+var spanExporter *otlpExporter
+
+// startTracing starts exporting spans to the configured collector, if any.
+func startTracing(opts *tracingOptions) error {
+	if opts.endpoint == "" {
+		return nil
+	}
+	if opts.sampleRatio < 0 || opts.sampleRatio > 1 || math.IsNaN(opts.sampleRatio) {
+		return fmt.Errorf("-trace-sample-ratio %v must be from 0 to 1", opts.sampleRatio)
+	}
+	headers := map[string]string{}
+	for _, pair := range splitList(opts.headers) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("OTLP header %q is not key=value", pair)
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	spanExporter = &otlpExporter{
+		url:         strings.TrimSuffix(opts.endpoint, "/") + "/v1/traces",
+		headers:     headers,
+		serviceName: opts.serviceName,
+		sampleRatio: opts.sampleRatio,
+		client:      egressClient(egressOTLP, 10*time.Second),
+		spans:       make(chan *span, 4*spanBatchSize),
+		flush:       make(chan chan struct{}),
+	}
+	go spanExporter.run()
+	log.Printf("Exporting traces to %s", spanExporter.url)
+	return nil
+}
+
+// stopTracing exports the spans still queued, waiting for them up to ctx's deadline.
+func stopTracing(ctx context.Context) {
+	if spanExporter == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case spanExporter.flush <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Tracing: gave up exporting the last spans")
+	}
+}
+
+func (e *otlpExporter) queue(s *span) {
+	select {
+	case e.spans <- s:
+	default:
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-e.spans:
+			if batch = append(batch, s); len(batch) >= spanBatchSize {
+				e.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.export(batch)
+			batch = nil
+		case done := <-e.flush:
+			for drained := false; !drained; {
+				select {
+				case s := <-e.spans:
+					batch = append(batch, s)
+				default:
+					drained = true
+				}
+			}
+			e.export(batch)
+			batch = nil
+			close(done)
+		}
+	}
+}
+
+// export posts a batch of spans. A batch the collector doesn't take is logged and dropped.
+func (e *otlpExporter) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	spans := make([]map[string]any, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{"attributes": otlpAttributes(map[string]any{"service.name": e.serviceName})},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": "receipt-processor"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Printf("Tracing: encoding %d spans: %v", len(batch), err)
+		return
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Tracing: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Printf("Tracing: exporting %d spans: %v", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Tracing: exporting %d spans: collector answered %s", len(batch), resp.Status)
+	}
+}
+
+// otlp encodes the span as an OTLP JSON span.
+func (s *span) otlp() map[string]any {
+	encoded := map[string]any{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+	}
+	if s.parentID != [8]byte{} {
+		encoded["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.errMessage != "" {
+		encoded["status"] = map[string]any{"code": spanStatusError, "message": s.errMessage}
+	}
+	return encoded
+}
+
+// otlpAttributes encodes attributes as OTLP key-values. Integers are strings in OTLP JSON.
+func otlpAttributes(attributes map[string]any) []map[string]any {
+	encoded := make([]map[string]any, 0, len(attributes))
+	for key, value := range attributes {
+		var v map[string]any
+		switch value := value.(type) {
+		case bool:
+			v = map[string]any{"boolValue": value}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case float64:
+			v = map[string]any{"doubleValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		encoded = append(encoded, map[string]any{"key": key, "value": v})
+	}
+	return encoded
+}
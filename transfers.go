@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// transferFee returns the fee the sender pays on top of a transfer of points.
+func (t TransferRules) transferFee(points int) int {
+	fee := int(roundRatio(int64(points)*int64(t.FeeBasisPoints), 10000, currentRules().roundingFor("transfer-fee")))
+	return max(fee, t.MinFee)
+}
+
+// sentTodayLocked sums the points the user has transferred out in the last 24 hours. ledgerMu
+// must be held.
+func sentTodayLocked(userID string) int {
+	hashes := userIDHashes(userID)
+	since := time.Now().Add(-24 * time.Hour)
+	sent := 0
+	for _, entry := range ledger {
+		if entry.Type == entryTransferOut && entry.CreatedAt.After(since) && slices.Contains(hashes, entry.userIDHash) {
+			sent -= entry.Points
+		}
+	}
+	return sent
+}
+
+// transferHandler moves points from one user to another. The debit, the fee and the credit are
+// posted together under the ledger lock, so a transfer is never half applied. Only the sender or
+// an admin may transfer.
+func transferHandler(w http.ResponseWriter, r *http.Request) {
+	from := mux.Vars(r)["from"]
+	if !actsForUser(r, from) {
+		http.Error(w, "Transferring points needs the sender's token or the admin token.", http.StatusForbidden)
+		return
+	}
+	request := struct {
+		To        string `json:"to"`
+		Points    int    `json:"points"`
+		Reference string `json:"reference"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.To == "" || request.Points <= 0 {
+		http.Error(w, "A transfer needs a recipient and a positive number of points.", http.StatusBadRequest)
+		return
+	}
+	if request.To == from {
+		http.Error(w, "Points can't be transferred to the same user.", http.StatusBadRequest)
+		return
+	}
+	limits := currentRules().Transfers
+	if limits.Disabled {
+		http.Error(w, "Point transfers are disabled.", http.StatusForbidden)
+		return
+	}
+	if limits.MaxPoints > 0 && request.Points > limits.MaxPoints {
+		http.Error(w, "The transfer exceeds the per-transfer limit.", http.StatusUnprocessableEntity)
+		return
+	}
+	fee := limits.transferFee(request.Points)
+	tenantID := tenantFromRequest(r)
+
+	ledgerMu.Lock()
+	if limits.DailyLimit > 0 && sentTodayLocked(from)+request.Points > limits.DailyLimit {
+		ledgerMu.Unlock()
+		http.Error(w, "The transfer exceeds the daily transfer limit.", http.StatusUnprocessableEntity)
+		return
+	}
+	available := availableLocked(from)
+	if available < request.Points+fee {
+		ledgerMu.Unlock()
+		writeInsufficientPoints(w, available, request.Points+fee)
+		return
+	}
+	transferID := uuid.New().String()
+	postings := []ledgerPosting{{from, LedgerEntry{
+		Type:       entryTransferOut,
+		Points:     -request.Points,
+		TenantID:   tenantID,
+		Reference:  request.Reference,
+		TransferID: transferID,
+	}}}
+	if fee > 0 {
+		postings = append(postings, ledgerPosting{from, LedgerEntry{
+			Type:       entryTransferFee,
+			Points:     -fee,
+			TenantID:   tenantID,
+			Reference:  request.Reference,
+			TransferID: transferID,
+		}})
+	}
+	postings = append(postings, ledgerPosting{request.To, LedgerEntry{
+		Type:       entryTransferIn,
+		Points:     request.Points,
+		TenantID:   tenantID,
+		Reference:  request.Reference,
+		TransferID: transferID,
+	}})
+	entries, err := postEntriesLocked(postings...)
+	if err != nil {
+		ledgerMu.Unlock()
+		log.Printf("Posting transfer %s: %v", transferID, err)
+		http.Error(w, "The transfer could not be recorded.", http.StatusInternalServerError)
+		return
+	}
+	balance := balanceLocked(from)
+	ledgerMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":      transferID,
+		"from":    from,
+		"to":      request.To,
+		"points":  request.Points,
+		"fee":     fee,
+		"entries": entries,
+		"balance": balance,
+	})
+}
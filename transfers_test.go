@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func transfer(from, body, asUser string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	transferHandler(w, userRequest("POST", "/users/"+from+"/transfer", body, asUser, map[string]string{"from": from}))
+	return w
+}
+
+func TestTransferNeedsSender(t *testing.T) {
+	resetLedger(t)
+	earnPoints(t, "alice", 100)
+
+	for name, asUser := range map[string]string{"anonymous": "", "recipient": "bob"} {
+		if w := transfer("alice", `{"to": "bob", "points": 50}`, asUser); w.Code != http.StatusForbidden {
+			t.Errorf("%s transfer = %d, want 403", name, w.Code)
+		}
+	}
+	if alice, bob := userBalance("alice"), userBalance("bob"); alice != 100 || bob != 0 {
+		t.Errorf("balances after refused transfers = %d/%d, want 100/0", alice, bob)
+	}
+	if w := transfer("alice", `{"to": "bob", "points": 50}`, "alice"); w.Code != http.StatusCreated {
+		t.Errorf("sender's transfer = %d, want 201: %s", w.Code, w.Body)
+	}
+}
+
+// failingLedgerStore is a ledger store whose appends fail.
+type failingLedgerStore struct{ memoryLedgerStore }
+
+func (s *failingLedgerStore) Append(entries ...LedgerEntry) error {
+	return errors.New("store unavailable")
+}
+
+// withTransferRules puts the transfer rules in effect for the test.
+func withTransferRules(t *testing.T, transfers TransferRules) {
+	t.Helper()
+	previous := currentRules()
+	cfg := previous
+	cfg.Transfers = transfers
+	setRules(cfg, "", "test transfer rules")
+	t.Cleanup(func() { setRules(previous, "", "restore rules") })
+}
+
+func TestTransferPostsBothSides(t *testing.T) {
+	resetLedger(t)
+	withTransferRules(t, TransferRules{FeeBasisPoints: 100, MinFee: 2})
+	earnPoints(t, "alice", 100)
+
+	w := transfer("alice", `{"to": "bob", "points": 50, "reference": "household"}`, "alice")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("transfer = %d, want 201: %s", w.Code, w.Body)
+	}
+	var response struct {
+		ID      string        `json:"id"`
+		Fee     int           `json:"fee"`
+		Entries []LedgerEntry `json:"entries"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Fee != 2 {
+		t.Errorf("fee = %d, want the minimum fee 2", response.Fee)
+	}
+	if len(response.Entries) != 3 {
+		t.Fatalf("transfer posted %d entries, want out, fee and in", len(response.Entries))
+	}
+	for _, entry := range response.Entries {
+		if entry.TransferID != response.ID {
+			t.Errorf("%s entry has transfer %q, want %q", entry.Type, entry.TransferID, response.ID)
+		}
+	}
+	if alice, bob := userBalance("alice"), userBalance("bob"); alice != 48 || bob != 50 {
+		t.Errorf("balances = %d/%d, want 48/50", alice, bob)
+	}
+	ledgerMu.Lock()
+	problems := checkLedgerLocked()
+	ledgerMu.Unlock()
+	if len(problems) > 0 {
+		t.Errorf("ledger problems after a transfer: %v", problems)
+	}
+}
+
+func TestTransferIsAllOrNothing(t *testing.T) {
+	resetLedger(t)
+	withTransferRules(t, TransferRules{FeeBasisPoints: 100, MinFee: 2, MaxPoints: 80})
+	earnPoints(t, "alice", 100)
+
+	for _, test := range []struct {
+		name, body string
+		want       int
+	}{
+		{"over the per-transfer limit", `{"to": "bob", "points": 81}`, http.StatusUnprocessableEntity},
+		{"to the sender", `{"to": "alice", "points": 10}`, http.StatusBadRequest},
+	} {
+		if w := transfer("alice", test.body, "alice"); w.Code != test.want {
+			t.Errorf("%s = %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+	withTransferRules(t, TransferRules{FeeBasisPoints: 100, MinFee: 2})
+	if w := transfer("alice", `{"to": "bob", "points": 99}`, "alice"); w.Code != http.StatusConflict {
+		t.Errorf("points and fee over the balance = %d, want 409", w.Code)
+	}
+
+	ledgerMu.Lock()
+	ledgerStore = &failingLedgerStore{}
+	ledgerMu.Unlock()
+	if w := transfer("alice", `{"to": "bob", "points": 50}`, "alice"); w.Code != http.StatusInternalServerError {
+		t.Errorf("transfer the store fails = %d, want 500", w.Code)
+	}
+	if alice, bob := userBalance("alice"), userBalance("bob"); alice != 100 || bob != 0 {
+		t.Errorf("balances after refused and failed transfers = %d/%d, want 100/0", alice, bob)
+	}
+	ledgerMu.Lock()
+	entries := len(ledger)
+	ledgerMu.Unlock()
+	if entries != 1 {
+		t.Errorf("ledger has %d entries, want only the earn", entries)
+	}
+}
+
+func TestTransferDailyLimit(t *testing.T) {
+	resetLedger(t)
+	withTransferRules(t, TransferRules{DailyLimit: 60})
+	earnPoints(t, "alice", 100)
+
+	if w := transfer("alice", `{"to": "bob", "points": 40}`, "alice"); w.Code != http.StatusCreated {
+		t.Fatalf("first transfer = %d, want 201: %s", w.Code, w.Body)
+	}
+	if w := transfer("alice", `{"to": "bob", "points": 30}`, "alice"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("transfer over the daily limit = %d, want 422", w.Code)
+	}
+	if w := transfer("alice", `{"to": "bob", "points": 20}`, "alice"); w.Code != http.StatusCreated {
+		t.Errorf("transfer up to the daily limit = %d, want 201: %s", w.Code, w.Body)
+	}
+}
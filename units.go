@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PointsUnit expresses points in a partner's currency for cobranded programs. Its rates are
+// versioned: adding a rate never changes how points earned before its effective date convert.
+type PointsUnit struct {
+	Name string `json:"name"`
+	// Decimals is the number of decimal places amounts in the unit are rounded to, using Rounding.
+	Decimals int          `json:"decimals"`
+	Rounding string       `json:"rounding"`
+	Rates    []PointsRate `json:"rates"`
+}
+
+// PointsRate is the number of units one point is worth from EffectiveFrom on.
+type PointsRate struct {
+	Version       int       `json:"version"`
+	Rate          string    `json:"rate"`
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+	CreatedAt     time.Time `json:"createdAt"`
+	rate          *big.Rat
+}
+
+var (
+	unitsMu     sync.RWMutex
+	pointsUnits = map[string]*PointsUnit{}
+)
+
+var (
+	errUnknownUnit = errors.New("unknown unit")
+	errNoRate      = errors.New("no rate in effect")
+)
+
+// rateAt returns the rate in effect at t: the one with the latest effective date not after t,
+// and the latest version among those.
+func (u *PointsUnit) rateAt(t time.Time) (PointsRate, bool) {
+	var found *PointsRate
+	for i := range u.Rates {
+		rate := &u.Rates[i]
+		if rate.EffectiveFrom.After(t) {
+			continue
+		}
+		if found == nil || !rate.EffectiveFrom.Before(found.EffectiveFrom) {
+			found = rate
+		}
+	}
+	if found == nil {
+		return PointsRate{}, false
+	}
+	return *found, true
+}
+
+// convertPoints expresses points earned at earnedAt in unit.
+func convertPoints(points int, unitName string, earnedAt time.Time) (map[string]any, error) {
+	unitsMu.RLock()
+	defer unitsMu.RUnlock()
+	unit, exists := pointsUnits[unitName]
+	if !exists {
+		return nil, errUnknownUnit
+	}
+	rate, ok := unit.rateAt(earnedAt)
+	if !ok {
+		return nil, errNoRate
+	}
+
+	// Scale to the unit's smallest denomination and round there, exactly.
+	scaled := new(big.Rat).Mul(rate.rate, new(big.Rat).SetInt64(int64(points)))
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(unit.Decimals)), nil)
+	scaled.Mul(scaled, new(big.Rat).SetInt(scale))
+	minor := roundRatio(scaled.Num().Int64(), scaled.Denom().Int64(), unit.Rounding)
+	amount := new(big.Rat).SetFrac(big.NewInt(minor), scale)
+
+	return map[string]any{
+		"unit":        unit.Name,
+		"amount":      amount.FloatString(unit.Decimals),
+		"rate":        rate.Rate,
+		"rateVersion": rate.Version,
+	}, nil
+}
+
+// withUnit adds the conversion requested with ?unit= to a points response, writing an error and
+// returning false if it can't be done.
+func withUnit(w http.ResponseWriter, r *http.Request, response map[string]any, receipt ProcessedReceipt) bool {
+	unit := r.URL.Query().Get("unit")
+	if unit == "" {
+		return true
+	}
+	converted, err := convertPoints(receipt.Points, unit, receipt.ProcessedAt)
+	switch {
+	case errors.Is(err, errUnknownUnit):
+		http.Error(w, "No unit found with that name.", http.StatusNotFound)
+		return false
+	case errors.Is(err, errNoRate):
+		http.Error(w, "No rate was in effect for that unit when the points were earned.", http.StatusUnprocessableEntity)
+		return false
+	}
+	response["converted"] = converted
+	return true
+}
+
+func listUnitsHandler(w http.ResponseWriter, r *http.Request) {
+	unitsMu.RLock()
+	list := make([]PointsUnit, 0, len(pointsUnits))
+	for _, unit := range pointsUnits {
+		list = append(list, *unit)
+	}
+	unitsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"units": list})
+}
+
+// addUnitRateHandler adds a rate version to a unit, creating the unit on its first rate.
+func addUnitRateHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Rate          string     `json:"rate"`
+		EffectiveFrom *time.Time `json:"effectiveFrom"`
+		Decimals      *int       `json:"decimals"`
+		Rounding      string     `json:"rounding"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "The rate is invalid.", http.StatusBadRequest)
+		return
+	}
+	value, ok := new(big.Rat).SetString(strings.TrimSpace(request.Rate))
+	if !ok || value.Sign() < 0 {
+		http.Error(w, "The rate must be a non-negative decimal.", http.StatusBadRequest)
+		return
+	}
+	if request.Rounding != "" {
+		if err := validRoundingMode(request.Rounding); err != nil {
+			http.Error(w, fmt.Sprintf("The rounding is invalid: %v.", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if request.Decimals != nil && (*request.Decimals < 0 || *request.Decimals > 6) {
+		http.Error(w, "The decimals must be between 0 and 6.", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	name := mux.Vars(r)["unit"]
+	unitsMu.Lock()
+	unit, exists := pointsUnits[name]
+	if !exists {
+		unit = &PointsUnit{Name: name, Rounding: roundFloor}
+		pointsUnits[name] = unit
+	}
+	if request.Decimals != nil {
+		unit.Decimals = *request.Decimals
+	}
+	if request.Rounding != "" {
+		unit.Rounding = request.Rounding
+	}
+	rate := PointsRate{Version: len(unit.Rates) + 1, Rate: request.Rate, EffectiveFrom: now, CreatedAt: now, rate: value}
+	if request.EffectiveFrom != nil {
+		rate.EffectiveFrom = request.EffectiveFrom.UTC()
+	}
+	unit.Rates = append(unit.Rates, rate)
+	response := *unit
+	unitsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// userAuthOptions configure the bearer tokens users authenticate with: JWTs signed with an HMAC
+// secret (HS256) or the private key of an RSA (RS256) or P-256 (ES256) public key.
+type userAuthOptions struct {
+	secret    string
+	publicKey string
+	issuer    string
+	audience  string
+	required  bool
+}
+
+// userAuthFlags defines the user token flags on fs.
+func userAuthFlags(fs *flag.FlagSet) *userAuthOptions {
+	opts := &userAuthOptions{}
+	fs.StringVar(&opts.secret, "jwt-secret", os.Getenv("JWT_SECRET"), "HMAC secret user tokens are signed with (HS256); may be a secret: reference")
+	fs.StringVar(&opts.publicKey, "jwt-public-key", os.Getenv("JWT_PUBLIC_KEY"), "PEM file of the RSA or P-256 public key user tokens are signed for (RS256 or ES256)")
+	fs.StringVar(&opts.issuer, "jwt-issuer", os.Getenv("JWT_ISSUER"), "iss claim user tokens must have, if set")
+	fs.StringVar(&opts.audience, "jwt-audience", os.Getenv("JWT_AUDIENCE"), "aud claim user tokens must have, if set")
+	fs.BoolVar(&opts.required, "jwt-required", os.Getenv("JWT_REQUIRED") == "true", "require a user token on the /receipts, /users and /households routes")
+	return opts
+}
+
+// userTokenLeeway is the clock skew tolerated on the exp and nbf claims of user tokens.
+const userTokenLeeway = time.Minute
+
+// userTokenVerifier checks the user tokens. It is nil when user tokens aren't configured.
+type userTokenVerifier struct {
+	alg       string
+	secret    []byte
+	publicKey crypto.PublicKey
+	issuer    string
+	audience  string
+	required  bool
+}
+
+var userTokens *userTokenVerifier
+
+var errInvalidUserToken = errors.New("invalid user token")
+
+// configureUserAuth sets up the verification of user tokens. It must run once secrets can be
+// resolved.
+func configureUserAuth(opts *userAuthOptions) error {
+	verifier := &userTokenVerifier{issuer: opts.issuer, audience: opts.audience, required: opts.required}
+	switch {
+	case opts.secret != "" && opts.publicKey != "":
+		return fmt.Errorf("-jwt-secret and -jwt-public-key can't both be set")
+	case opts.secret != "":
+		if err := resolveSecrets(&opts.secret); err != nil {
+			return fmt.Errorf("jwt-secret: %w", err)
+		}
+		verifier.alg, verifier.secret = "HS256", []byte(opts.secret)
+	case opts.publicKey != "":
+		data, err := os.ReadFile(opts.publicKey)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("%s: no PEM block", opts.publicKey)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("%s: %w", opts.publicKey, err)
+		}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			verifier.alg = "RS256"
+		case *ecdsa.PublicKey:
+			if key.Curve.Params().Name != "P-256" {
+				return fmt.Errorf("%s: ECDSA keys must be on P-256", opts.publicKey)
+			}
+			verifier.alg = "ES256"
+		default:
+			return fmt.Errorf("%s: not an RSA or ECDSA public key", opts.publicKey)
+		}
+		verifier.publicKey = key
+	case opts.required:
+		return fmt.Errorf("-jwt-required needs -jwt-secret or -jwt-public-key")
+	default:
+		return nil
+	}
+	userTokens = verifier
+	return nil
+}
+
+// userTokenClaims are the claims of a user token that are checked. The subject is the user ID, and
+// the tenant claim, if the issuer sets it, the tenant the user belongs to.
+type userTokenClaims struct {
+	Subject   string          `json:"sub"`
+	Tenant    string          `json:"tenant"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+}
+
+// audiences returns the aud claim, which may be a string or a list of them.
+func (c userTokenClaims) audiences() []string {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return []string{one}
+	}
+	var many []string
+	json.Unmarshal(c.Audience, &many)
+	return many
+}
+
+// verify checks a token's signature and claims and returns them. Tokens must expire, and
+// only the configured algorithm is accepted, never "none".
+func (v *userTokenVerifier) verify(token string, now time.Time) (userTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return userTokenClaims{}, errInvalidUserToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil || header.Alg != v.alg {
+		return userTokenClaims{}, errInvalidUserToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !v.validSignature(parts[0]+"."+parts[1], signature) {
+		return userTokenClaims{}, errInvalidUserToken
+	}
+
+	var claims userTokenClaims
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(data, &claims) != nil {
+		return userTokenClaims{}, errInvalidUserToken
+	}
+	switch {
+	case claims.Subject == "":
+		return userTokenClaims{}, fmt.Errorf("%w: no subject", errInvalidUserToken)
+	case claims.ExpiresAt == nil || now.After(time.Unix(*claims.ExpiresAt, 0).Add(userTokenLeeway)):
+		return userTokenClaims{}, fmt.Errorf("%w: expired", errInvalidUserToken)
+	case claims.NotBefore != nil && now.Before(time.Unix(*claims.NotBefore, 0).Add(-userTokenLeeway)):
+		return userTokenClaims{}, fmt.Errorf("%w: not valid yet", errInvalidUserToken)
+	case v.issuer != "" && claims.Issuer != v.issuer:
+		return userTokenClaims{}, fmt.Errorf("%w: wrong issuer", errInvalidUserToken)
+	case v.audience != "" && !slices.Contains(claims.audiences(), v.audience):
+		return userTokenClaims{}, fmt.Errorf("%w: wrong audience", errInvalidUserToken)
+	}
+	return claims, nil
+}
+
+func (v *userTokenVerifier) validSignature(signed string, signature []byte) bool {
+	digest := sha256.Sum256([]byte(signed))
+	switch key := v.publicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	}
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(signed))
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+type authenticatedUserKey struct{}
+
+// authenticatedUser returns the user ID of the token the request ctx belongs to was made with, if
+// any.
+func authenticatedUser(ctx context.Context) string {
+	user, _ := ctx.Value(authenticatedUserKey{}).(string)
+	return user
+}
+
+// actsForUser reports whether the request may read, spend or move userID's points: it must carry
+// the user's token or the admin token, whether or not user tokens are required.
+func actsForUser(r *http.Request, userID string) bool {
+	return authenticatedUser(r.Context()) == userID || hasAdminToken(r)
+}
+
+// userInHousehold reports whether a household may be read on behalf of the request's user: any
+// without a user token, and only the user's own with one.
+func userInHousehold(r *http.Request, household Household) bool {
+	user := authenticatedUser(r.Context())
+	return user == "" || slices.Contains(household.Members, user)
+}
+
+// userCanAccess reports whether a receipt may be read on behalf of the request's user: any of the
+// tenant's receipts without a user token, and only the user's own with one. It works on receipts
+// as stored and as opened.
+func userCanAccess(r *http.Request, receipt ProcessedReceipt) bool {
+	user := authenticatedUser(r.Context())
+	switch {
+	case user == "":
+		return true
+	case receipt.Receipt.UserID != "":
+		return receipt.Receipt.UserID == user
+	}
+	return receipt.UserIDHash != "" && slices.Contains(userIDHashes(user), receipt.UserIDHash)
+}
+
+// userScopedRoute reports whether a route's data belongs to users, so that -jwt-required requires
+// a user token on it. Attachment downloads are authorized by their signed link instead.
+func userScopedRoute(route string) bool {
+	if route == "/receipts/{id}/attachments/{attachmentId}" {
+		return false
+	}
+	for _, prefix := range []string{"/receipts", "/users/", "/households/"} {
+		if strings.HasPrefix(route, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateUsers verifies the user token of requests with an Authorization: Bearer header and
+// serves them on behalf of its subject: receipts submitted are the user's, only the user's
+// receipts are found, and the /users/{id} routes of other users are 403. An invalid token is 401,
+// as is a request without one to those routes when -jwt-required is set. Submission tokens are
+// left to the submission handlers, and the admin token to the routes that accept it. It is router middleware.
+func authenticateUsers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userTokens == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if bearer && strings.HasPrefix(token, submissionTokenPrefix) {
+			switch route {
+			case "/receipts/process", "/receipts/process/batch", "/receipts/process/wallet-pass":
+				next.ServeHTTP(w, r)
+				return
+			}
+			bearer = false
+		}
+		if bearer && hasAdminToken(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !bearer {
+			if userTokens.required && userScopedRoute(route) {
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				http.Error(w, "A user token is required.", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := userTokens.verify(token, time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Invalid or expired user token.", http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(route, "/users/") {
+			vars := mux.Vars(r)
+			if id := orDefault(vars["id"], vars["from"]); id != claims.Subject {
+				http.Error(w, "The user token is not valid for this user.", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authenticatedUserKey{}, claims.Subject)))
+	})
+}
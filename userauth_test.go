@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// signUserToken signs an HS256 user token with claims.
+func signUserToken(secret string, claims map[string]any) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthenticateUsers(t *testing.T) {
+	resetLedger(t)
+	earnPoints(t, "alice", 100)
+	adminToken.Set("admin-secret")
+	t.Cleanup(func() { adminToken.Set(""); userTokens = nil })
+
+	router := mux.NewRouter()
+	router.Use(authenticateUsers)
+	router.HandleFunc("/users/{id}/balance", getBalanceHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/redeem", redeemHandler).Methods("POST")
+
+	expires := time.Now().Add(time.Hour).Unix()
+	alice := signUserToken("jwt-secret", map[string]any{"sub": "alice", "exp": expires})
+	tests := []struct {
+		name          string
+		required      bool
+		method, path  string
+		authorization string
+		want          int
+	}{
+		{"user's own token", false, "GET", "/users/alice/balance", "Bearer " + alice, http.StatusOK},
+		{"admin token", true, "GET", "/users/alice/balance", "Bearer admin-secret", http.StatusOK},
+		{"another user's token", false, "GET", "/users/bob/balance", "Bearer " + alice, http.StatusForbidden},
+		{"no token, required", true, "GET", "/users/alice/balance", "", http.StatusUnauthorized},
+		{"no token, not required", false, "GET", "/users/alice/balance", "", http.StatusForbidden},
+		{"no token, not required, redeem", false, "POST", "/users/alice/redeem", "", http.StatusForbidden},
+		{"expired token", false, "GET", "/users/alice/balance", "Bearer " + signUserToken("jwt-secret", map[string]any{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()}), http.StatusUnauthorized},
+		{"token without expiry", false, "GET", "/users/alice/balance", "Bearer " + signUserToken("jwt-secret", map[string]any{"sub": "alice"}), http.StatusUnauthorized},
+		{"token signed with another secret", false, "GET", "/users/alice/balance", "Bearer " + signUserToken("other", map[string]any{"sub": "alice", "exp": expires}), http.StatusUnauthorized},
+		{"unsigned token", false, "GET", "/users/alice/balance", "Bearer " + base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice","exp":9999999999}`)) + ".", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		userTokens = &userTokenVerifier{alg: "HS256", secret: []byte("jwt-secret"), required: test.required}
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(`{"points": 10}`))
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: %s %s = %d, want %d", test.name, test.method, test.path, w.Code, test.want)
+		}
+	}
+	if got := userBalance("alice"); got != 100 {
+		t.Errorf("balance = %d, want 100", got)
+	}
+}
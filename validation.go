@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Validation severities. Errors are receipts scoring can't make sense of; warnings are receipts
+// that are accepted but won't be scored the way an exporter might expect.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// ValidationIssue is one problem found in a receipt. Field is a JSON path into the receipt, such
+// as "items[2].price", or empty for the receipt as a whole.
+type ValidationIssue struct {
+	Field    string `json:"field,omitempty"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Severity string `json:"-"`
+}
+
+// A receiptValidator checks one aspect of a receipt.
+type receiptValidator func(receipt Receipt, now time.Time) []ValidationIssue
+
+// validationPipeline lists the checks run on a receipt, in order.
+var validationPipeline = []receiptValidator{
+	validateReceiptFields,
+	validateReceiptItems,
+	validateReceiptTotal,
+	validateReceiptSignature,
+	validateReceiptEligibility,
+}
+
+var (
+	amountPattern   = regexp.MustCompile(`^\d+\.\d{2}$`)
+	retailerPattern = regexp.MustCompile(`^[\p{L}\p{N}\s\-&'.]+$`)
+)
+
+func validationError(field, code, message string) ValidationIssue {
+	return ValidationIssue{Field: field, Code: code, Message: message, Severity: severityError}
+}
+
+func validationWarning(field, code, message string) ValidationIssue {
+	return ValidationIssue{Field: field, Code: code, Message: message, Severity: severityWarning}
+}
+
+func validateReceiptFields(receipt Receipt, now time.Time) []ValidationIssue {
+	var issues []ValidationIssue
+	switch {
+	case strings.TrimSpace(receipt.Retailer) == "":
+		issues = append(issues, validationError("retailer", "required", "The retailer is required."))
+	case !retailerPattern.MatchString(receipt.Retailer):
+		issues = append(issues, validationError("retailer", "characters", "The retailer has characters other than letters, digits, spaces and -&'."))
+	}
+	date, err := time.Parse("2006-01-02", receipt.PurchaseDate)
+	switch {
+	case err != nil:
+		issues = append(issues, validationError("purchaseDate", "format", "The purchase date must be given as YYYY-MM-DD."))
+	case date.After(now.UTC()):
+		issues = append(issues, validationWarning("purchaseDate", "future", "The purchase date is in the future."))
+	}
+	// A missing time or total, as OCR can leave them, only keeps the rules that need it from
+	// applying; the receipt is flagged instead.
+	if receipt.PurchaseTime == "" {
+		issues = append(issues, validationWarning("purchaseTime", "missing", "The purchase time is missing, so no time-window bonus applies."))
+	} else if _, err := time.Parse("15:04", receipt.PurchaseTime); err != nil {
+		issues = append(issues, validationError("purchaseTime", "format", "The purchase time must be given as 24-hour HH:MM."))
+	}
+	if receipt.Total == "" {
+		issues = append(issues, validationWarning("total", "missing", "The total is missing, so the rules of the total award nothing."))
+	} else if !amountPattern.MatchString(receipt.Total) {
+		issues = append(issues, validationError("total", "format", "The total must be an amount with two decimals, e.g. 35.35."))
+	}
+	if c := receipt.OCRConfidence; c != nil && (*c < 0 || *c > 1) {
+		issues = append(issues, validationError("ocrConfidence", "range", "The OCR confidence must be from 0 to 1."))
+	}
+	return issues
+}
+
+func validateReceiptItems(receipt Receipt, _ time.Time) []ValidationIssue {
+	if len(receipt.Items) == 0 {
+		return []ValidationIssue{validationError("items", "required", "At least one item is required.")}
+	}
+	var issues []ValidationIssue
+	for i, item := range receipt.Items {
+		if strings.TrimSpace(item.ShortDescription) == "" {
+			issues = append(issues, validationError(fmt.Sprintf("items[%d].shortDescription", i), "required", "The item description is required."))
+		} else if item.ShortDescription != strings.TrimSpace(item.ShortDescription) {
+			issues = append(issues, validationWarning(fmt.Sprintf("items[%d].shortDescription", i), "whitespace", "The item description has leading or trailing spaces, which are ignored when scoring."))
+		}
+		if !amountPattern.MatchString(item.Price) {
+			issues = append(issues, validationError(fmt.Sprintf("items[%d].price", i), "format", "The item price must be an amount with two decimals."))
+		}
+	}
+	return issues
+}
+
+// validateReceiptTotal warns when the items don't add up to the total. Receipts with tax or
+// discounts legitimately differ, so this is never an error.
+func validateReceiptTotal(receipt Receipt, _ time.Time) []ValidationIssue {
+	if !amountPattern.MatchString(receipt.Total) {
+		return nil
+	}
+	sum := new(big.Rat)
+	for _, item := range receipt.Items {
+		if !amountPattern.MatchString(item.Price) {
+			return nil
+		}
+		price, _ := new(big.Rat).SetString(item.Price)
+		sum.Add(sum, price)
+	}
+	if total, _ := new(big.Rat).SetString(receipt.Total); total.Cmp(sum) != 0 {
+		return []ValidationIssue{validationWarning("total", "items-sum", "The items add up to "+sum.FloatString(2)+", not the total.")}
+	}
+	return nil
+}
+
+func validateReceiptSignature(receipt Receipt, _ time.Time) []ValidationIssue {
+	if receipt.Signature == "" {
+		return nil
+	}
+	if _, err := verifyReceiptSignature(receipt); err != nil {
+		return []ValidationIssue{validationWarning("signature", "unverified", "The signature can't be verified ("+err.Error()+"), so the receipt would be held for review.")}
+	}
+	return nil
+}
+
+func validateReceiptEligibility(receipt Receipt, _ time.Time) []ValidationIssue {
+	trusted, _ := verifyReceiptSignature(receipt)
+	cfg := currentRules()
+	switch status, reason := cfg.Eligibility.check(receipt, trusted && cfg.TrustedDevices.BypassReview); status {
+	case statusIneligible:
+		return []ValidationIssue{validationWarning("total", "ineligible", "The receipt would earn no points: "+reason+".")}
+	case statusPendingReview:
+		return []ValidationIssue{validationWarning("total", "review", "The receipt would be held for review: "+reason+".")}
+	}
+	return nil
+}
+
+// validateReceipt runs the validation pipeline as of now and splits what it finds by severity.
+func validateReceipt(receipt Receipt, now time.Time) (errs, warnings []ValidationIssue) {
+	errs, warnings = []ValidationIssue{}, []ValidationIssue{}
+	for _, validate := range validationPipeline {
+		for _, issue := range validate(receipt, now) {
+			if validationMode == validationLenient && lenientIssue(issue) {
+				issue.Severity = severityWarning
+			}
+			if issue.Severity == severityError {
+				errs = append(errs, issue)
+			} else {
+				warnings = append(warnings, issue)
+			}
+		}
+	}
+	return errs, warnings
+}
+
+// describeValidationErrors sums up a receipt's validation errors in one line, for places that
+// only have room for a message.
+func describeValidationErrors(errs []ValidationIssue) string {
+	parts := make([]string, len(errs))
+	for i, issue := range errs {
+		parts[i] = issue.Field + ": " + issue.Message
+	}
+	return "The receipt is invalid: " + strings.Join(parts, " ")
+}
+
+// writeValidationErrors rejects a receipt with a 400 listing its validation errors.
+func writeValidationErrors(w http.ResponseWriter, errs []ValidationIssue) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":  "The receipt is invalid.",
+		"errors": errs,
+	})
+}
+
+// validateReceiptHandler checks a receipt against the validation pipeline without scoring or
+// storing it, for integrators certifying their exporters.
+func validateReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	var receipt Receipt
+	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
+		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+		return
+	}
+	now, ok := requestTime(w, r, tenantFromRequest(r))
+	if !ok {
+		return
+	}
+	errs, warnings := validateReceipt(receipt, now)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"valid":    len(errs) == 0,
+		"errors":   errs,
+		"warnings": warnings,
+	})
+}
+
+// scoreReceiptHandler scores a receipt as if it were submitted now, without storing it or giving it
+// an ID, for previews and load tests.
+func scoreReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	var receipt Receipt
+	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
+		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
+		return
+	}
+	tenantID := tenantFromRequest(r)
+	now, ok := requestTime(w, r, tenantID)
+	if !ok {
+		return
+	}
+	if errs, _ := validateReceipt(receipt, now); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	processed := processReceipt(r.Context(), receipt, tenantID, now)
+	response := map[string]any{
+		"status":    processed.Status,
+		"points":    processed.Points,
+		"breakdown": explainBreakdown(processed.Breakdown, processed.RulesVersion),
+	}
+	if processed.StatusReason != "" {
+		response["reason"] = processed.StatusReason
+	}
+	if processed.Language != "" {
+		response["language"] = processed.Language
+	}
+	if processed.DataQuality != nil {
+		response["dataQuality"] = processed.DataQuality
+	}
+	if warnings := receiptSkippedRules(processed); warnings != nil {
+		response["warnings"] = warnings
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.buildVersion=1.4.0 -X main.buildCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// The commit and date fall back to the VCS information Go records in the binary, when it has any.
+var (
+	buildVersion = "0.0.0-dev"
+	buildCommit  string
+	buildDate    string
+)
+
+var readBuildInfo = sync.OnceFunc(func() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && buildCommit == "":
+			buildCommit = setting.Value
+		case setting.Key == "vcs.time" && buildDate == "":
+			buildDate = setting.Value
+		}
+	}
+})
+
+// serviceVersion is the semantic version of the running build. It is on every log line and event.
+func serviceVersion() string {
+	return buildVersion
+}
+
+// enabledFeatures lists the optional features configured on this instance.
+func enabledFeatures() []string {
+	features := []string{}
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"admin-api", adminToken.Get() != ""},
+		{"api-keys", len(apiKeys) > 0},
+		{"user-tokens", userTokens != nil},
+		{"deprecations", len(deprecations) > 0},
+		{"gateway", gateway != nil},
+		{"tracing", spanExporter != nil},
+		{"notifications", len(notifierRoutes) > 0},
+		{"partners", len(partnerPrograms) > 0},
+		{"scoring-model", scoringModel != nil},
+		{"item-classifier", itemClassifier != nil},
+		{"virus-scanning", virusScanner != nil},
+		{"read-only", readOnly},
+	} {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+	return features
+}
+
+// versionHandler returns what is running: the build's version, commit and date, the Go version,
+// the features enabled and the version of the rule set in effect.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	readBuildInfo()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"version":      serviceVersion(),
+		"commit":       buildCommit,
+		"buildDate":    buildDate,
+		"goVersion":    runtime.Version(),
+		"features":     enabledFeatures(),
+		"rulesVersion": currentRules().Version,
+	})
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// pkpassMediaType is the media type of Apple Wallet passes.
+	pkpassMediaType = "application/vnd.apple.pkpass"
+
+	maxWalletPassSize = 10 << 20
+)
+
+// walletPass is what a wallet pass says about a purchase: the issuer, the pass's fields as lines
+// of text, in the order the pass shows them, and the date the pass is for, if it has one.
+type walletPass struct {
+	issuer string
+	lines  []string
+	date   time.Time
+}
+
+// addField adds a field of the pass as text: "Total 6.49" for a single value, and the label then
+// the value's lines for a value of several words, such as "Mountain Dew 12PK 6.49", so those
+// read like the lines of a printed receipt.
+func (p *walletPass) addField(label, value string) {
+	label, value = strings.TrimSpace(label), strings.TrimSpace(value)
+	if strings.ContainsAny(value, " \n") {
+		if label != "" {
+			p.lines = append(p.lines, label)
+		}
+		p.lines = append(p.lines, strings.Split(value, "\n")...)
+		return
+	}
+	if line := strings.TrimSpace(label + " " + value); line != "" {
+		p.lines = append(p.lines, line)
+	}
+}
+
+// text is the pass as the text of a receipt, with the issuer on the first line.
+func (p walletPass) text() string {
+	return strings.Join(append([]string{p.issuer}, p.lines...), "\n")
+}
+
+// parsePassDate parses the W3C dates of wallet passes, with or without seconds.
+func parsePassDate(value string) time.Time {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00"} {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date
+		}
+	}
+	return time.Time{}
+}
+
+// pkpassField is a field of an Apple Wallet pass. Its value is a string, a date string or a
+// number, which is an amount when it has a currency code.
+type pkpassField struct {
+	Label        string          `json:"label"`
+	Value        json.RawMessage `json:"value"`
+	CurrencyCode string          `json:"currencyCode"`
+}
+
+func (f pkpassField) text() string {
+	var value string
+	if json.Unmarshal(f.Value, &value) == nil {
+		return value
+	}
+	var number float64
+	if json.Unmarshal(f.Value, &number) != nil {
+		return ""
+	}
+	if f.CurrencyCode != "" {
+		return strconv.FormatFloat(number, 'f', 2, 64)
+	}
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
+
+// pkpassStyle holds the fields of an Apple Wallet pass, by where the pass shows them.
+type pkpassStyle struct {
+	HeaderFields    []pkpassField `json:"headerFields"`
+	PrimaryFields   []pkpassField `json:"primaryFields"`
+	SecondaryFields []pkpassField `json:"secondaryFields"`
+	AuxiliaryFields []pkpassField `json:"auxiliaryFields"`
+	BackFields      []pkpassField `json:"backFields"`
+}
+
+// pkpassJSON is the pass.json of an Apple Wallet pass. A pass has the fields of one style.
+type pkpassJSON struct {
+	OrganizationName string `json:"organizationName"`
+	RelevantDate     string `json:"relevantDate"`
+	RelevantDates    []struct {
+		Date string `json:"date"`
+	} `json:"relevantDates"`
+	BoardingPass *pkpassStyle `json:"boardingPass"`
+	Coupon       *pkpassStyle `json:"coupon"`
+	EventTicket  *pkpassStyle `json:"eventTicket"`
+	Generic      *pkpassStyle `json:"generic"`
+	StoreCard    *pkpassStyle `json:"storeCard"`
+}
+
+// readZipFile reads the file called name from archive, if it has one.
+func readZipFile(archive *zip.Reader, name string) ([]byte, bool, error) {
+	for _, file := range archive.File {
+		if file.Name != name {
+			continue
+		}
+		f, err := file.Open()
+		if err != nil {
+			return nil, true, err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(io.LimitReader(f, maxWalletPassSize+1))
+		if err == nil && len(data) > maxWalletPassSize {
+			err = fmt.Errorf("%s is too large", name)
+		}
+		return data, true, err
+	}
+	return nil, false, nil
+}
+
+// readPKPass reads an Apple Wallet pass, a zip archive with the pass in pass.json and the SHA-1
+// of each of its files in manifest.json. pass.json must match the manifest. The manifest's
+// signature isn't verified: submissions are authenticated like any other.
+func readPKPass(data []byte) (walletPass, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return walletPass{}, errors.New("not a zip archive")
+	}
+	passData, found, err := readZipFile(archive, "pass.json")
+	switch {
+	case err != nil:
+		return walletPass{}, err
+	case !found:
+		return walletPass{}, errors.New("no pass.json")
+	}
+	manifestData, found, err := readZipFile(archive, "manifest.json")
+	switch {
+	case err != nil:
+		return walletPass{}, err
+	case !found:
+		return walletPass{}, errors.New("no manifest.json")
+	}
+	var manifest map[string]string
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return walletPass{}, fmt.Errorf("manifest.json: %w", err)
+	}
+	digest := sha1.Sum(passData)
+	if !strings.EqualFold(manifest["pass.json"], hex.EncodeToString(digest[:])) {
+		return walletPass{}, errors.New("pass.json doesn't match the manifest")
+	}
+
+	var document pkpassJSON
+	if err := json.Unmarshal(passData, &document); err != nil {
+		return walletPass{}, fmt.Errorf("pass.json: %w", err)
+	}
+	pass := walletPass{issuer: document.OrganizationName, date: parsePassDate(document.RelevantDate)}
+	if pass.date.IsZero() && len(document.RelevantDates) > 0 {
+		pass.date = parsePassDate(document.RelevantDates[0].Date)
+	}
+	for _, style := range []*pkpassStyle{document.BoardingPass, document.Coupon, document.EventTicket, document.Generic, document.StoreCard} {
+		if style == nil {
+			continue
+		}
+		for _, fields := range [][]pkpassField{style.HeaderFields, style.PrimaryFields, style.SecondaryFields, style.AuxiliaryFields, style.BackFields} {
+			for _, field := range fields {
+				pass.addField(field.Label, field.text())
+			}
+		}
+	}
+	return pass, nil
+}
+
+// googleWalletString is a localized string of a Google Wallet object.
+type googleWalletString struct {
+	DefaultValue struct {
+		Value string `json:"value"`
+	} `json:"defaultValue"`
+}
+
+func (s *googleWalletString) text() string {
+	if s == nil {
+		return ""
+	}
+	return s.DefaultValue.Value
+}
+
+// googleWalletObject is a Google Wallet generic object. Its card title names the issuer; the
+// purchase is in its header, subheader and text modules.
+type googleWalletObject struct {
+	CardTitle       *googleWalletString `json:"cardTitle"`
+	Header          *googleWalletString `json:"header"`
+	Subheader       *googleWalletString `json:"subheader"`
+	TextModulesData []struct {
+		Header string `json:"header"`
+		Body   string `json:"body"`
+	} `json:"textModulesData"`
+	ValidTimeInterval *struct {
+		Start struct {
+			Date string `json:"date"`
+		} `json:"start"`
+	} `json:"validTimeInterval"`
+}
+
+// readGoogleWalletObject reads a Google Wallet generic object, given as is or as the payload of
+// a Save to Google Wallet JWT, whose first generic object is read.
+func readGoogleWalletObject(data []byte) (walletPass, error) {
+	var document struct {
+		googleWalletObject
+		Payload struct {
+			GenericObjects []googleWalletObject `json:"genericObjects"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return walletPass{}, errors.New("not a Google Wallet object")
+	}
+	object := document.googleWalletObject
+	if len(document.Payload.GenericObjects) > 0 {
+		object = document.Payload.GenericObjects[0]
+	}
+	pass := walletPass{issuer: object.CardTitle.text()}
+	if pass.issuer == "" {
+		return walletPass{}, errors.New("no cardTitle")
+	}
+	if object.ValidTimeInterval != nil {
+		pass.date = parsePassDate(object.ValidTimeInterval.Start.Date)
+	}
+	pass.addField("", object.Header.text())
+	pass.addField("", object.Subheader.text())
+	for _, module := range object.TextModulesData {
+		pass.addField(module.Header, module.Body)
+	}
+	return pass, nil
+}
+
+// processWalletPassHandler processes a receipt issued as a wallet pass: an Apple Wallet pass
+// (application/vnd.apple.pkpass) or a Google Wallet generic object (application/json). The pass
+// is read as the text of a receipt with the extraction templates, its issuer on the first line,
+// and the purchase date and time fall back to the date the pass is for. The receipt is then
+// processed as if it was submitted to /receipts/process, for the user in the userId query
+// parameter, and the response includes it.
+func processWalletPassHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, tenantID, ok := authenticateSubmitter(w, r)
+	if !ok {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != pkpassMediaType && mediaType != "application/json" {
+		http.Error(w, "Wallet passes must be application/vnd.apple.pkpass or application/json.", http.StatusUnsupportedMediaType)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWalletPassSize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "The wallet pass is too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "The wallet pass could not be read.", http.StatusBadRequest)
+		return
+	}
+	var pass walletPass
+	if mediaType == pkpassMediaType {
+		pass, err = readPKPass(data)
+	} else {
+		pass, err = readGoogleWalletObject(data)
+	}
+	if err != nil {
+		recordDeviceSubmission(deviceID, ProcessedReceipt{}, errors.New("invalid wallet pass"))
+		http.Error(w, "The wallet pass is invalid: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+
+	receipt, template, match := extractReceipt(pass.text())
+	if receipt.PurchaseDate == "" && !pass.date.IsZero() {
+		receipt.PurchaseDate = pass.date.Format("2006-01-02")
+	}
+	if receipt.PurchaseTime == "" && !pass.date.IsZero() {
+		receipt.PurchaseTime = pass.date.Format("15:04")
+	}
+	confidence := extractionConfidence(receipt, match)
+	receipt.OCRConfidence = &confidence
+	receipt.UserID = r.URL.Query().Get("userId")
+	if !admitReceipt(r.Context(), w, &receipt, deviceID) {
+		return
+	}
+	processAdmittedReceipt(w, r, receipt, tenantID, map[string]any{
+		"receipt":         receipt,
+		"template":        template.Retailer,
+		"templateVersion": template.Version,
+	})
+}
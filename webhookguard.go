@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errWebhookDestination is a webhook URL, or the address it resolves to, that deliveries may not go
+// to. Tenants choose webhook and callback URLs, so without the check they could make the server
+// call its own network.
+var errWebhookDestination = errors.New("webhook destination not allowed")
+
+// webhookGuardOptions restrict the destinations of webhooks, job callbacks and the other URLs
+// deliveries are POSTed to.
+type webhookGuardOptions struct {
+	schemes      string
+	ports        string
+	allowedHosts string
+	allowPrivate bool
+}
+
+// webhookGuardFlags defines the webhook destination flags on fs.
+func webhookGuardFlags(fs *flag.FlagSet) *webhookGuardOptions {
+	opts := &webhookGuardOptions{}
+	fs.StringVar(&opts.schemes, "webhook-schemes", orDefault(os.Getenv("WEBHOOK_SCHEMES"), "https,http"), "URL schemes webhooks and callbacks may use, separated by commas")
+	fs.StringVar(&opts.ports, "webhook-ports", orDefault(os.Getenv("WEBHOOK_PORTS"), "80,443,8080,8443"), "ports webhooks and callbacks may be delivered to, separated by commas")
+	fs.StringVar(&opts.allowedHosts, "webhook-allowed-hosts", os.Getenv("WEBHOOK_ALLOWED_HOSTS"), "the only hosts webhooks and callbacks may be delivered to, separated by commas; .example.com matches its subdomains (any host when empty)")
+	fs.BoolVar(&opts.allowPrivate, "webhook-allow-private", os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true", "allow webhooks and callbacks to private, loopback and link-local addresses")
+	return opts
+}
+
+// webhookPolicy is the configured restriction of webhook destinations.
+type webhookPolicy struct {
+	schemes      []string
+	ports        []string
+	allowedHosts []string
+	allowPrivate bool
+}
+
+var (
+	webhookDestinations = webhookPolicy{schemes: []string{"https", "http"}, ports: []string{"80", "443", "8080", "8443"}}
+	// webhookTransport carries webhook deliveries, checking the addresses they connect to.
+	webhookTransport http.RoundTripper
+)
+
+// blockedNetworks are the addresses, besides those of net.IP's private, loopback, link-local and
+// multicast checks, that deliveries may not reach: "this network", carrier-grade NAT, the IETF
+// protocol assignments, documentation ranges, benchmarking and NAT64.
+var blockedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// configureWebhookGuard sets the webhook destination policy and builds the transport that enforces
+// it, on top of the egress transport. It must run after configureEgress.
+func configureWebhookGuard(opts *webhookGuardOptions) error {
+	policy := webhookPolicy{
+		schemes:      splitList(strings.ToLower(opts.schemes)),
+		ports:        splitList(opts.ports),
+		allowedHosts: splitList(opts.allowedHosts),
+		allowPrivate: opts.allowPrivate,
+	}
+	for _, scheme := range policy.schemes {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("unknown webhook scheme %q: must be http or https", scheme)
+		}
+	}
+	for _, port := range policy.ports {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid webhook port %q", port)
+		}
+	}
+	webhookDestinations = policy
+
+	proxied := egressTransport.(*http.Transport)
+	direct := proxied.Clone()
+	direct.Proxy = nil
+	direct.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return checkWebhookAddress(host)
+		},
+	}).DialContext
+	webhookTransport = guardedTransport{direct: direct, proxied: proxied}
+	return nil
+}
+
+// webhookClient returns a client for webhook deliveries, which only reach allowed destinations.
+func webhookClient() *http.Client {
+	client := egressClient(egressWebhooks, 0)
+	client.Transport = webhookTransport
+	return client
+}
+
+// checkWebhookURL checks a webhook or callback URL when it is registered: its scheme, port and
+// host, and its address if the host is one. Hostnames are checked once resolved, at delivery.
+func checkWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%w: %q is not an absolute URL", errWebhookDestination, raw)
+	}
+	return webhookDestinations.check(u)
+}
+
+func (p webhookPolicy) check(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	if !slices.Contains(p.schemes, scheme) {
+		return fmt.Errorf("%w: scheme %q", errWebhookDestination, u.Scheme)
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[scheme]
+	}
+	if !slices.Contains(p.ports, port) {
+		return fmt.Errorf("%w: port %s", errWebhookDestination, port)
+	}
+	host := u.Hostname()
+	if len(p.allowedHosts) > 0 && !slices.ContainsFunc(p.allowedHosts, func(entry string) bool { return hostMatches(host, entry) }) {
+		return fmt.Errorf("%w: host %s is not allowlisted", errWebhookDestination, host)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return checkWebhookAddress(host)
+	}
+	return nil
+}
+
+// checkWebhookAddress checks an IP address a delivery would connect to.
+func checkWebhookAddress(host string) error {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: %q is not an IP address", errWebhookDestination, host)
+	}
+	if webhookDestinations.allowPrivate {
+		return nil
+	}
+	addr = addr.Unmap()
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() ||
+		slices.ContainsFunc(blockedNetworks, func(network netip.Prefix) bool { return network.Contains(addr) }) {
+		return fmt.Errorf("%w: %s is a private or reserved address", errWebhookDestination, addr)
+	}
+	return nil
+}
+
+// guardedTransport enforces the webhook policy on every request, redirects included. Direct
+// connections are checked as they are dialed, after DNS resolution, so a host can't resolve to an
+// allowed address when checked and a blocked one when connected to. The proxy resolves the host of
+// a proxied request itself, so its addresses are resolved and checked here before it is sent.
+type guardedTransport struct {
+	direct, proxied *http.Transport
+}
+
+func (t guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := webhookDestinations.check(req.URL); err != nil {
+		return nil, err
+	}
+	var proxyURL *url.URL
+	if t.proxied.Proxy != nil {
+		var err error
+		if proxyURL, err = t.proxied.Proxy(req); err != nil {
+			return nil, err
+		}
+	}
+	if proxyURL == nil {
+		return t.direct.RoundTrip(req)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(req.Context(), "ip", req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if err := checkWebhookAddress(addr.String()); err != nil {
+			return nil, err
+		}
+	}
+	return t.proxied.RoundTrip(req)
+}
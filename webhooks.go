@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// eventWebhookTest is the type of the sample events sent by test deliveries. It is never published.
+const eventWebhookTest = "webhook.test"
+
+// testResponseLimit is how much of a receiver's response a test delivery reports.
+const testResponseLimit = 4 << 10
+
+// DeliveryStats counts a notifier's deliveries since the instance started. Dropped counts the
+// notifications over its rate limit or its queue's capacity, and LastStatusCode is the status of
+// the last failed delivery the receiver answered. Test deliveries aren't counted.
+type DeliveryStats struct {
+	Delivered      int64            `json:"delivered"`
+	Failed         int64            `json:"failed"`
+	Dropped        int64            `json:"dropped"`
+	LastDeliveryAt *time.Time       `json:"lastDeliveryAt,omitempty"`
+	LastFailureAt  *time.Time       `json:"lastFailureAt,omitempty"`
+	LastError      string           `json:"lastError,omitempty"`
+	LastStatusCode int              `json:"lastStatusCode,omitempty"`
+	Latency        latencyHistogram `json:"latency"`
+}
+
+func (route *notifierRoute) recordDelivery(latency time.Duration, err error) {
+	now := time.Now().UTC()
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	route.stats.Latency.observe(latency)
+	if err == nil {
+		route.stats.Delivered++
+		route.stats.LastDeliveryAt = &now
+		return
+	}
+	route.stats.Failed++
+	route.stats.LastFailureAt = &now
+	route.stats.LastError = err.Error()
+	route.stats.LastStatusCode = 0
+	var status *statusError
+	if errors.As(err, &status) {
+		route.stats.LastStatusCode = status.code
+	}
+}
+
+func (route *notifierRoute) recordDrop() {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	route.stats.Dropped++
+}
+
+// isPaused reports whether the notifier is paused. The caller holds route.mu.
+func (route *notifierRoute) isPaused() bool {
+	select {
+	case <-route.resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+// skipsWhilePaused reports whether an event is left for the notifier to replay when it resumes:
+// the events published after it was paused. Those published before are queued and held.
+func (route *notifierRoute) skipsWhilePaused(event Event) bool {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	return route.isPaused() && event.Sequence > route.pausedAfter
+}
+
+// pause holds the notifier's deliveries, returning the sequence number of the last event published
+// before it was paused, and whether it was running.
+func (route *notifierRoute) pause() (pausedAfter int64, paused bool) {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	if route.isPaused() {
+		return route.pausedAfter, false
+	}
+	route.resumed = make(chan struct{})
+	route.pausedAfter = lastEventSequence()
+	return route.pausedAfter, true
+}
+
+// resume releases the notifier's held deliveries and replays the events it skipped while paused,
+// returning how many it replayed and the sequence number of the oldest event retained, and whether
+// it was paused.
+func (route *notifierRoute) resume() (replayed int, oldest int64, pausedAfter int64, resumed bool) {
+	route.mu.Lock()
+	if !route.isPaused() {
+		route.mu.Unlock()
+		return 0, 0, 0, false
+	}
+	close(route.resumed)
+	pausedAfter = route.pausedAfter
+	route.mu.Unlock()
+	replayed, oldest = route.replay(pausedAfter)
+	return replayed, oldest, pausedAfter, true
+}
+
+// view is how the notifier is listed: its configuration, whether it is paused and its deliveries.
+func (route *notifierRoute) view() map[string]any {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	view := map[string]any{
+		"name":       route.name,
+		"type":       route.kind,
+		"events":     route.events,
+		"paused":     route.isPaused(),
+		"queued":     len(route.queue),
+		"deliveries": route.stats,
+	}
+	if route.tenantID != "" {
+		view["tenantId"] = route.tenantID
+	}
+	if route.isPaused() {
+		view["pausedAfter"] = route.pausedAfter
+	}
+	return view
+}
+
+// notifierHandler is a handler of a resolved notifier.
+type notifierHandler func(w http.ResponseWriter, r *http.Request, route *notifierRoute)
+
+// tenantWebhook resolves the {id} webhook of the requesting tenant. Notifiers that aren't webhooks
+// or aren't the tenant's are not found, the operators' own included.
+func tenantWebhook(next notifierHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, exists := notifierRoutes[mux.Vars(r)["id"]]
+		if !exists || route.kind != "webhook" || route.tenantID != tenantFromRequest(r) {
+			http.Error(w, "No webhook with that ID.", http.StatusNotFound)
+			return
+		}
+		next(w, r, route)
+	}
+}
+
+// namedNotifier resolves the {name} notifier, of any tenant or none, for the admin API.
+func namedNotifier(next notifierHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, exists := notifierRoutes[mux.Vars(r)["name"]]
+		if !exists {
+			http.Error(w, "No notifier of that name.", http.StatusNotFound)
+			return
+		}
+		next(w, r, route)
+	}
+}
+
+// listWebhooksHandler lists the requesting tenant's webhooks.
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	tenantID := tenantFromRequest(r)
+	listNotifiers(w, func(route *notifierRoute) bool {
+		return route.kind == "webhook" && route.tenantID == tenantID
+	})
+}
+
+// listNotifiersHandler lists every notifier.
+func listNotifiersHandler(w http.ResponseWriter, r *http.Request) {
+	listNotifiers(w, func(*notifierRoute) bool { return true })
+}
+
+func listNotifiers(w http.ResponseWriter, include func(*notifierRoute) bool) {
+	names := make([]string, 0, len(notifierRoutes))
+	for name, route := range notifierRoutes {
+		if include(route) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	views := make([]map[string]any, 0, len(names))
+	for _, name := range names {
+		views = append(views, notifierRoutes[name].view())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func getNotifierHandler(w http.ResponseWriter, r *http.Request, route *notifierRoute) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(route.view())
+}
+
+// pauseNotifierHandler holds a notifier's deliveries until it is resumed, for a receiver that is
+// down or being fixed.
+func pauseNotifierHandler(w http.ResponseWriter, r *http.Request, route *notifierRoute) {
+	pausedAfter, paused := route.pause()
+	if !paused {
+		http.Error(w, "The notifier is already paused.", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"name": route.name, "paused": true, "pausedAfter": pausedAfter})
+}
+
+// resumeNotifierHandler resumes a paused notifier: the deliveries queued when it was paused are
+// sent, followed by the retained events published since, those it fires on.
+func resumeNotifierHandler(w http.ResponseWriter, r *http.Request, route *notifierRoute) {
+	replayed, oldest, pausedAfter, resumed := route.resume()
+	if !resumed {
+		http.Error(w, "The notifier isn't paused.", http.StatusConflict)
+		return
+	}
+	response := map[string]any{"name": route.name, "paused": false, "replayed": replayed, "oldestSequence": oldest}
+	if oldest > pausedAfter+1 {
+		response["missed"] = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// testNotifierHandler sends a webhook a sample event, rendered and signed as its deliveries are,
+// and reports how the receiver answered. It is sent at once, paused or not.
+func testNotifierHandler(w http.ResponseWriter, r *http.Request, route *notifierRoute) {
+	webhook, ok := route.notifier.(webhookNotifier)
+	if !ok {
+		http.Error(w, "Only webhooks can be sent test deliveries.", http.StatusConflict)
+		return
+	}
+	event := Event{
+		ID:             uuid.New().String(),
+		Type:           eventWebhookTest,
+		ReceiptID:      "00000000-0000-0000-0000-000000000000",
+		Time:           time.Now().UTC(),
+		ServiceVersion: serviceVersion(),
+		Data:           map[string]any{"points": 28, "tenantId": orDefault(route.tenantID, defaultTenant), "test": true},
+	}
+	notification, err := renderNotification(route.subject, route.text, event)
+	if err != nil {
+		http.Error(w, "Rendering the test notification: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(webhookPayload(notification))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	headers := signedHeaders(webhook.headers, body)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	result := map[string]any{"name": route.name, "event": event}
+	if signature := headers["X-Receipt-Signature"]; signature != "" {
+		result["signature"] = signature
+	}
+	resp, err := sendBody(ctx, webhook.url, headers, body)
+	if err != nil {
+		result["delivered"] = false
+		result["error"] = err.Error()
+	} else {
+		excerpt, err := io.ReadAll(io.LimitReader(resp.Body, testResponseLimit))
+		resp.Body.Close()
+		result["delivered"] = resp.StatusCode < 300
+		result["statusCode"] = resp.StatusCode
+		result["responseBody"] = string(excerpt)
+		if err != nil {
+			result["error"] = "reading the response: " + err.Error()
+		}
+	}
+	result["duration"] = time.Since(start).String()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// writeNotifierMetrics writes the deliveries of each notifier in the Prometheus text format.
+func writeNotifierMetrics(b *strings.Builder) {
+	b.WriteString("# HELP receipt_processor_notifier_deliveries_total Notifications by notifier and result.\n")
+	b.WriteString("# TYPE receipt_processor_notifier_deliveries_total counter\n")
+	names := make([]string, 0, len(notifierRoutes))
+	for name := range notifierRoutes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		route := notifierRoutes[name]
+		route.mu.Lock()
+		stats := route.stats
+		route.mu.Unlock()
+		for _, result := range []struct {
+			name  string
+			count int64
+		}{{"delivered", stats.Delivered}, {"failed", stats.Failed}, {"dropped", stats.Dropped}} {
+			fmt.Fprintf(b, "receipt_processor_notifier_deliveries_total{notifier=%q,result=%q} %d\n", name, result.name, result.count)
+		}
+	}
+}